@@ -0,0 +1,132 @@
+package tbeer
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// All API types that are published in the schema
+var apiSchemaTypes = []interface{}{
+	&APIAddress{},
+	&APIPeriod{},
+	&APIPlace{},
+	&APIParticipant{},
+	&APIMeeting{},
+	&APIAvailability{},
+	&APIEvent{},
+	&APISuggestion{},
+	&APISuggestions{},
+	&APIDynamicURL{},
+	&APIReview{},
+	&APIReputation{},
+	&APIUser{},
+	&APIFriendship{},
+	&APIMessage{},
+	&APINotification{},
+	&APICalendarFeed{},
+	&APIBeer{},
+	&APITap{},
+	&APICheckin{},
+	&APIDrink{},
+	&APICheckinStats{},
+	&APIGeoResult{},
+}
+
+// The schema name of an API type, e.g. "place" for APIPlace
+func apiSchemaName(t reflect.Type) string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return strings.ToLower(strings.TrimPrefix(t.Name(), "API"))
+}
+
+// Generate the JSON Schema of a Go type as seen by encoding/json.
+// Named struct types are referenced as refPrefix + schema name.
+func jsonSchemaOf(t reflect.Type, refPrefix string) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return jsonSchemaOf(t.Elem(), refPrefix)
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{
+			"type":  "array",
+			"items": jsonSchemaOf(t.Elem(), refPrefix)}
+	case reflect.Map:
+		return map[string]interface{}{
+			"type":                 "object",
+			"additionalProperties": jsonSchemaOf(t.Elem(), refPrefix)}
+	case reflect.Struct:
+		return map[string]interface{}{"$ref": refPrefix + apiSchemaName(t)}
+	default:
+		// interface{}: anything
+		return map[string]interface{}{}
+	}
+}
+
+// Generate the object schema of an API struct type
+func jsonObjectSchema(o interface{}, refPrefix string) map[string]interface{} {
+	t := reflect.TypeOf(o).Elem()
+	properties := make(map[string]interface{})
+	required := make([]string, 0)
+
+	if typed, ok := o.(APITyped); ok {
+		// emitted by the encoder, see encodeItem
+		properties["type"] = map[string]interface{}{"type": "string", "enum": []string{typed.APIType()}}
+		required = append(required, "type")
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := strings.Split(f.Tag.Get("json"), ",")
+		name := tag[0]
+		if name == "-" || f.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		properties[name] = jsonSchemaOf(f.Type, refPrefix)
+		omitempty := false
+		for _, opt := range tag[1:] {
+			omitempty = omitempty || opt == "omitempty"
+		}
+		if !omitempty {
+			required = append(required, name)
+		}
+	}
+	return map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+		"required":   required}
+}
+
+// Schemas of all published API types by schema name
+func apiSchemaDefinitions(refPrefix string) map[string]interface{} {
+	defs := make(map[string]interface{})
+	for _, o := range apiSchemaTypes {
+		defs[apiSchemaName(reflect.TypeOf(o))] = jsonObjectSchema(o, refPrefix)
+	}
+	return defs
+}
+
+// The JSON Schema document describing all API types
+func APISchema() map[string]interface{} {
+	return map[string]interface{}{
+		"$schema":     "http://json-schema.org/draft-07/schema#",
+		"title":       "beer-socialist API types",
+		"definitions": apiSchemaDefinitions("#/definitions/")}
+}
+
+func serveAPISchema(ctx *DispatchContext, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/schema+json")
+	writeJSON(w, APISchema())
+}
@@ -0,0 +1,369 @@
+package tbeer
+
+import (
+	"math"
+	"sort"
+)
+
+// The types in this file define the JSON representation of the
+// in memory model as seen by API clients. Handlers produce model
+// values; the json stream encoder converts them using APIValuer.
+
+// A model value that has a separate API representation
+type APIValuer interface {
+	APIValue() interface{}
+}
+
+// An API value that is one of several kinds of items in a list.
+// The encoder emits the type as a "type" member of the json object.
+type APITyped interface {
+	APIType() string
+}
+
+type APIAddress struct {
+	// 0 street, 1 postcode, 2 locality, 3 region, 4 country
+	Type  int    `json:"type"`
+	Value string `json:"value"`
+}
+
+type APIPeriod struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+	// recurrence rule the period is an occurrence of
+	RRule string `json:"rrule,omitempty"`
+	// starts of cancelled occurrences
+	ExDate []int `json:"exdate,omitempty"`
+}
+
+type APIPlace struct {
+	Id       int64         `json:"id"`
+	Name     string        `json:"name"`
+	Lat      float64       `json:"lat"`
+	Long     float64       `json:"long"`
+	Radius   int           `json:"radius"`
+	Capacity int           `json:"capacity,omitempty"`
+	Category string        `json:"category,omitempty"`
+	Address  []*APIAddress `json:"address,omitempty"`
+	// only for a single place
+	Amenities    []string  `json:"amenities,omitempty"`
+	Timezone     string    `json:"timezone,omitempty"`
+	OpeningHours string    `json:"opening_hours,omitempty"`
+	Taps         []*APITap `json:"taps,omitempty"`
+}
+
+type APIParticipant struct {
+	Id          int64  `json:"id"`
+	Alias       string `json:"alias"`
+	Description string `json:"description"`
+}
+
+type APIMeeting struct {
+	Id              int64      `json:"id"`
+	Owner           int64      `json:"owner"`
+	Name            string     `json:"name"`
+	Visibility      string     `json:"visibility"`
+	MaxParticipants int        `json:"max_participants,omitempty"`
+	Place           *APIPlace  `json:"place,omitempty"`
+	Period          *APIPeriod `json:"period,omitempty"`
+	// position of the user's participant on the waitlist, after attending a full meeting
+	WaitlistPosition int `json:"waitlist_position,omitempty"`
+	// overbooking of the place, in responses to creating or changing the meeting
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+type APIAvailability struct {
+	Id          int64           `json:"id"`
+	Description string          `json:"description"`
+	Visibility  string          `json:"visibility"`
+	Participant *APIParticipant `json:"participant,omitempty"`
+	Place       *APIPlace       `json:"place,omitempty"`
+	Period      *APIPeriod      `json:"period,omitempty"`
+}
+
+type APIBeer struct {
+	Id      int64   `json:"id"`
+	Name    string  `json:"name"`
+	Brewery string  `json:"brewery,omitempty"`
+	Style   string  `json:"style,omitempty"`
+	ABV     float64 `json:"abv,omitempty"`
+	IBU     int     `json:"ibu,omitempty"`
+}
+
+type APITap struct {
+	Beer *APIBeer `json:"beer"`
+	// only when searching for a beer
+	Place   *APIPlace `json:"place,omitempty"`
+	Price   float64   `json:"price"`
+	Updated int64     `json:"updated"`
+	// meters from the position searched from
+	Distance float64 `json:"distance,omitempty"`
+}
+
+type APISuggestion struct {
+	Value string `json:"value"`
+	Data  int64  `json:"data"`
+	// overbooking of the place within the requested period
+	Warning string `json:"warning,omitempty"`
+}
+
+type APISuggestions struct {
+	Suggestions []*APISuggestion `json:"suggestions"`
+}
+
+type APIDynamicURL struct {
+	Slug string `json:"slug"`
+	Type string `json:"type"`
+	Id   int64  `json:"id"`
+	// path of the vanity url
+	Path string `json:"path"`
+}
+
+type APIReview struct {
+	Id       int64 `json:"id"`
+	Reviewer int64 `json:"reviewer"`
+	Reviewee int64 `json:"reviewee"`
+	Meeting  int64 `json:"meeting"`
+	Score    int   `json:"score"`
+}
+
+type APIReputation struct {
+	User    int64 `json:"user"`
+	Reviews int   `json:"reviews"`
+	// average score, omitted when there are no reviews
+	Score *float64 `json:"score,omitempty"`
+}
+
+type APIUser struct {
+	Id    int64  `json:"id"`
+	Alias string `json:"alias"`
+	// only shown to the user itself
+	Email        string            `json:"email,omitempty"`
+	Participants []*APIParticipant `json:"participants"`
+	Reputation   *APIReputation    `json:"reputation,omitempty"`
+}
+
+type APIFriendship struct {
+	User  int64  `json:"user"`
+	Alias string `json:"alias"`
+	// requested, friends or blocked
+	State string `json:"state"`
+	// true for requests from the other user
+	Incoming bool `json:"incoming"`
+}
+
+type APIMessage struct {
+	Id          int64           `json:"id"`
+	Meeting     int64           `json:"meeting"`
+	Participant *APIParticipant `json:"participant,omitempty"`
+	Body        string          `json:"body"`
+	Created     int64           `json:"created"`
+	// zero unless edited
+	Edited int64 `json:"edited"`
+	// only set in streams, for deleted messages
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+type APICheckin struct {
+	Id          int64           `json:"id"`
+	Meeting     int64           `json:"meeting"`
+	Participant *APIParticipant `json:"participant"`
+	Place       *APIPlace       `json:"place"`
+	// start of the meeting occurrence checked in to
+	Occurrence int         `json:"occurrence"`
+	Created    int64       `json:"created"`
+	Drinks     []*APIDrink `json:"drinks"`
+}
+
+type APIDrink struct {
+	Id   int64    `json:"id"`
+	Beer *APIBeer `json:"beer"`
+	// 1 to 5, 0 if not rated
+	Rating  int    `json:"rating"`
+	Notes   string `json:"notes,omitempty"`
+	Created int64  `json:"created"`
+}
+
+type APICheckinStats struct {
+	Checkins int `json:"checkins"`
+	// distinct places checked in at
+	Places int `json:"places"`
+	Drinks int `json:"drinks"`
+	// distinct beers logged
+	Beers int `json:"beers"`
+	// of rated drinks, 0 if none are rated
+	AverageRating float64  `json:"average_rating"`
+	Styles        []string `json:"styles"`
+}
+
+type APIGeoResult struct {
+	Name    string        `json:"name"`
+	Lat     float64       `json:"lat"`
+	Long    float64       `json:"long"`
+	Address []*APIAddress `json:"address"`
+}
+
+type APICalendarFeed struct {
+	URL string `json:"url"`
+}
+
+type APINotification struct {
+	Id      int64  `json:"id"`
+	Kind    string `json:"kind"`
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+	// zero unless about a meeting
+	Meeting int64 `json:"meeting,omitempty"`
+	Created int64 `json:"created"`
+	Read    bool  `json:"read"`
+}
+
+type APIEvent struct {
+	Kind EventKind   `json:"kind"`
+	Type string      `json:"type"`
+	Id   int64       `json:"id"`
+	Item interface{} `json:"item,omitempty"`
+}
+
+func (*APIPlace) APIType() string        { return "place" }
+func (*APIMeeting) APIType() string      { return "meeting" }
+func (*APIAvailability) APIType() string { return "availability" }
+
+// Convert a value to its API representation, if it has one
+func apiValue(o interface{}) interface{} {
+	if v, ok := o.(APIValuer); ok {
+		return v.APIValue()
+	}
+	return o
+}
+
+func (a *Address) APIValue() interface{} {
+	return &APIAddress{a.Type, a.Value}
+}
+
+// nil for the zero period, which means the period was not loaded
+func (p *Period) apiPeriod() *APIPeriod {
+	if p.Start == 0 && p.End == 0 {
+		return nil
+	}
+	return p.APIValue().(*APIPeriod)
+}
+
+func (p *Period) APIValue() interface{} {
+	var exdate []int
+	for start := range p.exceptions() {
+		exdate = append(exdate, start)
+	}
+	sort.Ints(exdate)
+	return &APIPeriod{p.Start, p.End, p.RRule, exdate}
+}
+
+// nil for the zero place, which means the place was not loaded
+func (p *Place) apiPlace() *APIPlace {
+	if p.Id == 0 {
+		return nil
+	}
+	a := &APIPlace{
+		Id:           p.Id,
+		Name:         p.Name,
+		Lat:          p.Lat,
+		Long:         p.Long,
+		Radius:       p.Radius,
+		Capacity:     p.Capacity,
+		Category:     p.Category,
+		Amenities:    p.Amenities,
+		Timezone:     p.Timezone,
+		OpeningHours: p.OpeningHours.String()}
+	if p.Taps != nil {
+		a.Taps = apiTaps(p.Taps)
+	}
+	for _, addr := range p.Address {
+		a.Address = append(a.Address, addr.APIValue().(*APIAddress))
+	}
+	return a
+}
+
+func (p *Place) APIValue() interface{} {
+	return p.apiPlace()
+}
+
+// nil for the zero participant, which means the participant was not loaded
+func (p *Participant) apiParticipant() *APIParticipant {
+	if p.Id == 0 {
+		return nil
+	}
+	return &APIParticipant{p.Id, p.Alias, p.Description}
+}
+
+func (p *Participant) APIValue() interface{} {
+	return p.apiParticipant()
+}
+
+func (m *Meeting) APIValue() interface{} {
+	return &APIMeeting{
+		Id:              m.Id,
+		Owner:           m.Owner,
+		Name:            m.Name,
+		Visibility:      visibilityName(m.Visibility),
+		MaxParticipants: m.MaxParticipants,
+		Place:           m.Place.apiPlace(),
+		Period:          m.Period.apiPeriod()}
+}
+
+func (a *Availability) APIValue() interface{} {
+	return &APIAvailability{
+		a.Id,
+		a.Description,
+		visibilityName(a.Visibility),
+		a.Participant.apiParticipant(),
+		a.Place.apiPlace(),
+		a.Period.apiPeriod()}
+}
+
+func (b *Beer) APIValue() interface{} {
+	return &APIBeer{b.Id, b.Name, b.Brewery, b.Style, b.ABV, b.IBU}
+}
+
+func (t *Tap) APIValue() interface{} {
+	return &APITap{
+		Beer:     t.Beer.APIValue().(*APIBeer),
+		Place:    t.Place.apiPlace(),
+		Price:    t.Price,
+		Updated:  t.Updated,
+		Distance: math.Round(t.Distance)}
+}
+
+func (c *Checkin) APIValue() interface{} {
+	drinks := make([]*APIDrink, len(c.Drinks))
+	for i, d := range c.Drinks {
+		drinks[i] = d.APIValue().(*APIDrink)
+	}
+	return &APICheckin{
+		Id:          c.Id,
+		Meeting:     c.Meeting,
+		Participant: c.Participant.apiParticipant(),
+		Place:       c.Place.apiPlace(),
+		Occurrence:  c.Occurrence,
+		Created:     c.Created,
+		Drinks:      drinks}
+}
+
+func (d *Drink) APIValue() interface{} {
+	return &APIDrink{
+		Id:      d.Id,
+		Beer:    d.Beer.APIValue().(*APIBeer),
+		Rating:  d.Rating,
+		Notes:   d.Notes,
+		Created: d.Created}
+}
+
+func (r *GeoResult) APIValue() interface{} {
+	address := make([]*APIAddress, len(r.Address))
+	for i, a := range r.Address {
+		address[i] = a.APIValue().(*APIAddress)
+	}
+	return &APIGeoResult{r.Name, r.Lat, r.Long, address}
+}
+
+func (e *Event) APIValue() interface{} {
+	return &APIEvent{e.Kind, e.Type, e.Id, apiValue(e.Item)}
+}
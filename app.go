@@ -0,0 +1,76 @@
+package tbeer
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+)
+
+// An instance of the site: the database and configuration it serves,
+// the REST dispatcher tree with the prepared statements of its handlers,
+// and the services the handlers share. Handlers get it through their
+// DispatchContext. Apps are independent of each other, so a process,
+// e.g. a test binary, may have many.
+type App struct {
+	DB       *sql.DB
+	Env      *Env
+	Geocoder Geocoder
+	Events   *EventBus
+	Messages *MessageBus
+
+	tree *selectDP
+	// prepared for the handlers of tree, closed with the app
+	stmts []*sql.Stmt
+	// the first error from installing a handler in initRestTree
+	installErr error
+
+	// users checked by checkUser
+	users      map[int64]userCheck
+	usersMutex sync.Mutex
+}
+
+// Create an app serving db, with all REST handlers installed. Fails if
+// a query does not compile or a path pattern is ambiguous.
+func NewApp(env *Env, db *sql.DB) (*App, error) {
+	app := &App{
+		DB:       db,
+		Env:      env,
+		Geocoder: NewGeocoder(env),
+		Events:   NewEventBus(),
+		Messages: NewMessageBus(),
+		tree:     newSelectDP(),
+	}
+	if err := app.initRestTree(); err != nil {
+		app.Close()
+		return nil, err
+	}
+	return app, nil
+}
+
+// Close the prepared statements and the database
+func (app *App) Close() error {
+	for _, stmt := range app.stmts {
+		stmt.Close()
+	}
+	app.stmts = nil
+	return app.DB.Close()
+}
+
+func (app *App) compileStatements(q []string) ([]*sql.Stmt, error) {
+	var err error
+	stmts := make([]*sql.Stmt, len(q))
+	for i, _ := range stmts {
+		stmts[i], err = app.DB.Prepare(q[i])
+		if err != nil {
+			fmt.Println(err)
+			return nil, err
+		}
+		app.stmts = append(app.stmts, stmts[i])
+	}
+	return stmts, nil
+}
+
+// Run fn in a transaction, committing if it succeeds
+func (app *App) inTransaction(fn func(tx *sql.Tx) error) error {
+	return inTransactionOf(app.DB, fn)
+}
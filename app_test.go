@@ -0,0 +1,62 @@
+package tbeer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// An app serving a new database populated with seed
+func newTempApp(t *testing.T, seed int64) *App {
+	db, err := OpenMemoryDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := InitSchema(db); err != nil {
+		t.Fatal(err)
+	}
+	config := populateTestConfig()
+	config.Seed = seed
+	if err := Populate(db, config); err != nil {
+		t.Fatal(err)
+	}
+	app, err := NewApp(DefaultEnv(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { app.Close() })
+	return app
+}
+
+// Apps on databases of different seeds, serving at the same time
+func TestParallelApps(t *testing.T) {
+	for seed := int64(1); seed <= 3; seed++ {
+		seed := seed
+		t.Run("", func(t *testing.T) {
+			t.Parallel()
+			app := newTempApp(t, seed)
+			var alias string
+			if err := app.DB.QueryRow("SELECT alias FROM user WHERE id = 1").Scan(&alias); err != nil {
+				t.Fatal(err)
+			}
+			serv := httptest.NewServer(app)
+			defer serv.Close()
+			for i := 0; i < 10; i++ {
+				res, err := http.Get(serv.URL + "/api/me")
+				if err != nil {
+					t.Fatal(err)
+				}
+				var me APIUser
+				err = json.NewDecoder(res.Body).Decode(&me)
+				res.Body.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if me.Alias != alias {
+					t.Fatalf("app of seed %d served %q, expected %q", seed, me.Alias, alias)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,523 @@
+package tbeer
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// In memory representation: Beer
+type Beer struct {
+	Id      int64
+	Name    string
+	Brewery string
+	Style   string
+	// alcohol by volume in percent
+	ABV float64
+	// international bitterness units, 0 if unknown
+	IBU int
+}
+
+func (b *Beer) BasicFields() []interface{} {
+	return []interface{}{&b.Id, &b.Name, &b.Brewery, &b.Style, &b.ABV, &b.IBU}
+}
+
+// In memory representation: a beer on tap at a place
+type Tap struct {
+	Beer  Beer
+	Place Place
+	// in the local currency of the place
+	Price float64
+	// unix time the tap was last changed
+	Updated int64
+	// meters from the position searched from, only set when searching
+	Distance float64
+}
+
+func (t *Tap) BasicFields() []interface{} {
+	return []interface{}{&t.Price, &t.Updated}
+}
+
+const beerFields = "beer.id, beer.name, beer.brewery, beer.style, beer.abv, beer.ibu"
+
+const beerByIdQuery = "SELECT " + beerFields + " FROM beer WHERE id = ?"
+
+// The tap list of a place, without the place
+const placeTapsQuery = "SELECT tap.price, tap.updated, " + beerFields + " " +
+	"FROM tap, beer WHERE tap.placeid = ? AND tap.beerid = beer.id ORDER BY beer.name"
+
+const maintainerQuery = "SELECT count(*) FROM place_maintainer WHERE placeid = ? AND userid = ?"
+
+var errNotMaintainer = errors.New("not a maintainer of the place")
+
+// Check that the user maintains the place, using maintainerQuery
+func checkMaintainer(stmt *sql.Stmt, placeid, userid int64) error {
+	var n int
+	if err := stmt.QueryRow(placeid, userid).Scan(&n); err != nil {
+		return err
+	}
+	if n == 0 {
+		return errNotMaintainer
+	}
+	return nil
+}
+
+func apiTaps(taps []*Tap) []*APITap {
+	a := make([]*APITap, len(taps))
+	for i, t := range taps {
+		a[i] = t.APIValue().(*APITap)
+	}
+	return a
+}
+
+// Load the tap list of a place using placeTapsQuery
+func loadTaps(stmt *sql.Stmt, placeid int64) ([]*Tap, error) {
+	rows, err := stmt.Query(placeid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	taps := make([]*Tap, 0)
+	for rows.Next() {
+		t := &Tap{}
+		if err := rows.Scan(ConcatBasicFields(t, &t.Beer)...); err != nil {
+			return nil, err
+		}
+		taps = append(taps, t)
+	}
+	return taps, rows.Err()
+}
+
+const earthRadius = 6371000
+
+// Great circle distance in meters between two positions in degrees
+func distance(lat1, long1, lat2, long2 float64) float64 {
+	rad := math.Pi / 180
+	dlat := (lat2 - lat1) * rad
+	dlong := (long2 - long1) * rad
+	a := math.Sin(dlat/2)*math.Sin(dlat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dlong/2)*math.Sin(dlong/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
+
+var beerParams = []RouteParam{
+	{Name: "name", In: "query", Type: "string", Required: true},
+	{Name: "brewery", In: "query", Type: "string"},
+	{Name: "style", In: "query", Type: "string", Description: "e.g. IPA, stout, pilsner"},
+	{Name: "abv", In: "query", Type: "number", Description: "alcohol by volume in percent"},
+	{Name: "ibu", In: "query", Type: "integer", Description: "international bitterness units"},
+}
+
+// Read a beer from the form, with the fields of def where not given
+func getFormBeer(form url.Values, def *Beer) (*Beer, error) {
+	b := *def
+	if _, ok := form["name"]; ok {
+		if b.Name = strings.TrimSpace(form.Get("name")); b.Name == "" {
+			return nil, errors.New("a beer needs a name")
+		}
+	} else if b.Name == "" {
+		return nil, errors.New("missing key name")
+	}
+	if _, ok := form["brewery"]; ok {
+		b.Brewery = strings.TrimSpace(form.Get("brewery"))
+	}
+	if _, ok := form["style"]; ok {
+		b.Style = strings.TrimSpace(form.Get("style"))
+	}
+	if _, ok := form["abv"]; ok {
+		abv, err := getFormFloat(form, "abv")
+		if err != nil {
+			return nil, err
+		}
+		if abv < 0 || abv > 100 {
+			return nil, errors.New("abv must be a percentage")
+		}
+		b.ABV = abv
+	}
+	if _, ok := form["ibu"]; ok {
+		ibu, err := strconv.Atoi(form.Get("ibu"))
+		if err != nil || ibu < 0 || ibu > 1000 {
+			return nil, errors.New("ibu must be a number between 0 and 1000")
+		}
+		b.IBU = ibu
+	}
+	return &b, nil
+}
+
+func (app *App) initBeerHandlers() {
+	app.installStmtRestHandler("beers",
+		&RouteDoc{
+			Summary: "search the beer catalog by name, brewery or style",
+			Params: []RouteParam{
+				{Name: "query", In: "query", Type: "string", Required: true, Description: "part of the name, brewery or style"},
+				{Name: "limit", In: "query", Type: "integer", Description: fmt.Sprintf("at most %d, default %d", maxPageSize, pageSize)}},
+			Response: []*APIBeer{}},
+		[]string{
+			"SELECT " + beerFields + " FROM beer " +
+				"WHERE name LIKE ? OR brewery LIKE ? OR style LIKE ? ORDER BY name LIMIT ?"},
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			query, err := getFormString(ctx.request.Form, "query")
+			if err != nil {
+				return err
+			}
+			_, limit, err := getFormPage(ctx.request.Form)
+			if err != nil {
+				return err
+			}
+			items, err := Uniplex(queueBufferSize,
+				func(out chan<- interface{}) error {
+					like := "%" + query + "%"
+					rows, err := stmts[0].Query(like, like, like, limit)
+					if err != nil {
+						return err
+					}
+					defer rows.Close()
+					for rows.Next() {
+						b := &Beer{}
+						if err := rows.Scan(b.BasicFields()...); err != nil {
+							out <- err
+						} else {
+							out <- b
+						}
+					}
+					return nil
+				})
+
+			if err != nil {
+				return err
+			}
+
+			WriteChannelAsJSONList(w, items)
+			return nil
+		})
+
+	app.installStmtRestMethodHandler("POST", "beers",
+		&RouteDoc{
+			Summary:  "add a beer to the catalog",
+			Params:   beerParams,
+			Response: &APIBeer{}},
+		[]string{
+			"INSERT INTO beer (name, brewery, style, abv, ibu, ownerid) VALUES (?, ?, ?, ?, ?, ?)"},
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			b, err := getFormBeer(ctx.request.Form, &Beer{})
+			if err != nil {
+				return err
+			}
+			res, err := stmts[0].Exec(b.Name, b.Brewery, b.Style, b.ABV, b.IBU, ctx.userid)
+			if err != nil {
+				return err
+			}
+			if b.Id, err = res.LastInsertId(); err != nil {
+				return err
+			}
+			return writeJSON(w, b)
+		})
+
+	app.installStmtRestHandler("beer/:id",
+		&RouteDoc{
+			Summary:  "a beer in the catalog",
+			Response: &APIBeer{}},
+		[]string{beerByIdQuery},
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			b := &Beer{}
+			if err := stmts[0].QueryRow(ctx.IntParam("id")).Scan(b.BasicFields()...); err != nil {
+				return err
+			}
+			return writeJSON(w, b)
+		})
+
+	app.installStmtRestMethodHandler("PUT", "beer/:id",
+		&RouteDoc{
+			Summary:  "correct a beer added to the catalog by the user",
+			Params:   optionalParams(beerParams),
+			Response: &APIBeer{}},
+		[]string{
+			"SELECT " + beerFields + ", ownerid FROM beer WHERE id = ?",
+			"UPDATE beer SET name = ?, brewery = ?, style = ?, abv = ?, ibu = ? WHERE id = ?"},
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			before := &Beer{}
+			var owner int64
+			if err := stmts[0].QueryRow(ctx.IntParam("id")).Scan(append(before.BasicFields(), &owner)...); err != nil {
+				return err
+			}
+			if owner != ctx.userid {
+				return errNotOwner
+			}
+			b, err := getFormBeer(ctx.request.Form, before)
+			if err != nil {
+				return err
+			}
+			if _, err := stmts[1].Exec(b.Name, b.Brewery, b.Style, b.ABV, b.IBU, b.Id); err != nil {
+				return err
+			}
+			return writeJSON(w, b)
+		})
+
+	app.installStmtRestHandler("place/:id/taps",
+		&RouteDoc{
+			Summary:  "the beers on tap at a place",
+			Response: []*APITap{}},
+		[]string{placeTapsQuery},
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			taps, err := loadTaps(stmts[0], ctx.IntParam("id"))
+			if err != nil {
+				return err
+			}
+			return writeJSON(w, apiTaps(taps))
+		})
+
+	app.installStmtRestMethodHandler("PUT", "place/:id/taps/:beerid",
+		&RouteDoc{
+			Summary: "put a beer on tap at a place maintained by the user, or change its price",
+			Params: []RouteParam{
+				{Name: "price", In: "query", Type: "number", Required: true, Description: "in the local currency"}},
+			Response: []*APITap{}},
+		[]string{
+			maintainerQuery,
+			beerByIdQuery,
+			"INSERT OR REPLACE INTO tap (placeid, beerid, price, updated) VALUES (?, ?, ?, ?)",
+			placeTapsQuery},
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			placeid := ctx.IntParam("id")
+			if err := checkMaintainer(stmts[0], placeid, ctx.userid); err != nil {
+				return err
+			}
+			b := &Beer{}
+			if err := stmts[1].QueryRow(ctx.IntParam("beerid")).Scan(b.BasicFields()...); err != nil {
+				return err
+			}
+			price, err := getFormFloat(ctx.request.Form, "price")
+			if err != nil {
+				return err
+			}
+			if price < 0 {
+				return errors.New("price must not be negative")
+			}
+			if _, err := stmts[2].Exec(placeid, b.Id, price, time.Now().Unix()); err != nil {
+				return err
+			}
+			taps, err := loadTaps(stmts[3], placeid)
+			if err != nil {
+				return err
+			}
+			return writeJSON(w, apiTaps(taps))
+		})
+
+	app.installStmtRestMethodHandler("DELETE", "place/:id/taps/:beerid",
+		&RouteDoc{
+			Summary:  "take a beer off tap at a place maintained by the user",
+			Response: []*APITap{}},
+		[]string{
+			maintainerQuery,
+			"DELETE FROM tap WHERE placeid = ? AND beerid = ?",
+			placeTapsQuery},
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			placeid := ctx.IntParam("id")
+			if err := checkMaintainer(stmts[0], placeid, ctx.userid); err != nil {
+				return err
+			}
+			res, err := stmts[1].Exec(placeid, ctx.IntParam("beerid"))
+			if err != nil {
+				return err
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				return sql.ErrNoRows
+			}
+			taps, err := loadTaps(stmts[2], placeid)
+			if err != nil {
+				return err
+			}
+			return writeJSON(w, apiTaps(taps))
+		})
+
+	app.installStmtRestHandler("place/:id/maintainers",
+		&RouteDoc{
+			Summary:  "the users maintaining the tap list of a place",
+			Response: []*APIUser{}},
+		[]string{
+			"SELECT user.id, user.alias FROM place_maintainer, user " +
+				"WHERE place_maintainer.placeid = ? AND place_maintainer.userid = user.id ORDER BY user.id"},
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			items, err := Uniplex(queueBufferSize,
+				func(out chan<- interface{}) error {
+					rows, err := stmts[0].Query(ctx.IntParam("id"))
+					if err != nil {
+						return err
+					}
+					defer rows.Close()
+					for rows.Next() {
+						u := &APIUser{}
+						if err := rows.Scan(&u.Id, &u.Alias); err != nil {
+							out <- err
+						} else {
+							out <- u
+						}
+					}
+					return nil
+				})
+
+			if err != nil {
+				return err
+			}
+
+			WriteChannelAsJSONList(w, items)
+			return nil
+		})
+
+	app.installStmtRestMethodHandler("POST", "place/:id/maintainers",
+		&RouteDoc{
+			Summary: "make a user maintainer of a place. Maintainers may add others, " +
+				"and the first maintainer of a place may add themselves",
+			Params: []RouteParam{
+				{Name: "userid", In: "query", Type: "integer", Description: "default the user"}},
+			Response: int64(0)},
+		[]string{
+			"SELECT count(*) FROM place WHERE id = ?",
+			"SELECT count(*) FROM place_maintainer WHERE placeid = ?",
+			maintainerQuery,
+			"INSERT OR IGNORE INTO place_maintainer (placeid, userid) VALUES (?, ?)",
+			"SELECT count(*) FROM user WHERE id = ?"},
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			placeid := ctx.IntParam("id")
+			userid := ctx.userid
+			if _, ok := ctx.request.Form["userid"]; ok {
+				var err error
+				if userid, err = getFormInt(ctx.request.Form, "userid"); err != nil {
+					return err
+				}
+			}
+			var places, maintainers, users int
+			if err := stmts[0].QueryRow(placeid).Scan(&places); err != nil {
+				return err
+			}
+			if err := stmts[4].QueryRow(userid).Scan(&users); err != nil {
+				return err
+			}
+			if places == 0 || users == 0 {
+				return sql.ErrNoRows
+			}
+			if err := stmts[1].QueryRow(placeid).Scan(&maintainers); err != nil {
+				return err
+			}
+			if maintainers != 0 || userid != ctx.userid {
+				if err := checkMaintainer(stmts[2], placeid, ctx.userid); err != nil {
+					return err
+				}
+			}
+			if _, err := stmts[3].Exec(placeid, userid); err != nil {
+				return err
+			}
+			return writeJSON(w, userid)
+		})
+
+	app.installStmtRestMethodHandler("DELETE", "place/:id/maintainers/:userid",
+		&RouteDoc{
+			Summary:  "stop a user maintaining a place maintained by the user",
+			Response: int64(0)},
+		[]string{
+			maintainerQuery,
+			"DELETE FROM place_maintainer WHERE placeid = ? AND userid = ?"},
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			placeid := ctx.IntParam("id")
+			if err := checkMaintainer(stmts[0], placeid, ctx.userid); err != nil {
+				return err
+			}
+			res, err := stmts[1].Exec(placeid, ctx.IntParam("userid"))
+			if err != nil {
+				return err
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				return sql.ErrNoRows
+			}
+			return writeJSON(w, ctx.IntParam("userid"))
+		})
+
+	app.installStmtRestHandler("ontap",
+		&RouteDoc{
+			Summary: "where a beer is on tap, nearest first. The position defaults to the home of the user; " +
+				"without one the most recently updated taps come first",
+			Params: []RouteParam{
+				{Name: "beerid", In: "query", Type: "integer", Description: "the beer, or"},
+				{Name: "query", In: "query", Type: "string", Description: "part of the name of beers"},
+				{Name: "lat", In: "query", Type: "number"},
+				{Name: "long", In: "query", Type: "number"},
+				{Name: "limit", In: "query", Type: "integer", Description: fmt.Sprintf("at most %d, default %d", maxPageSize, pageSize)}},
+			Response: []*APITap{}},
+		[]string{
+			"SELECT tap.price, tap.updated, " + beerFields + ", " +
+				"place.id, place.name, place.lat, place.long, place.radius, place.capacity, place.category " +
+				"FROM tap, beer, place " +
+				"WHERE tap.beerid = beer.id AND tap.placeid = place.id AND " +
+				"(beer.id = ? OR beer.name LIKE ?) " +
+				"ORDER BY tap.updated DESC",
+			"SELECT value FROM user_preference WHERE ownerid = ? AND key = ?"},
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			form := ctx.request.Form
+			var beerid int64
+			like := ""
+			if _, ok := form["beerid"]; ok {
+				var err error
+				if beerid, err = getFormInt(form, "beerid"); err != nil {
+					return err
+				}
+			} else if query, err := getFormString(form, "query"); err != nil {
+				return errors.New("missing key beerid or query")
+			} else {
+				like = "%" + query + "%"
+			}
+			_, limit, err := getFormPage(form)
+			if err != nil {
+				return err
+			}
+
+			var lat, long float64
+			located := false
+			if _, ok := form["lat"]; ok {
+				if lat, err = getFormFloat(form, "lat"); err != nil {
+					return err
+				}
+				if long, err = getFormFloat(form, "long"); err != nil {
+					return err
+				}
+				located = true
+			} else {
+				errLat := stmts[1].QueryRow(ctx.userid, "homelat").Scan(&lat)
+				errLong := stmts[1].QueryRow(ctx.userid, "homelong").Scan(&long)
+				located = errLat == nil && errLong == nil
+			}
+
+			rows, err := stmts[0].Query(beerid, like)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			taps := make([]*Tap, 0)
+			for rows.Next() {
+				t := &Tap{}
+				if err := rows.Scan(ConcatBasicFields(t, &t.Beer, &t.Place)...); err != nil {
+					return err
+				}
+				if located {
+					t.Distance = distance(lat, long, t.Place.Lat, t.Place.Long)
+				}
+				taps = append(taps, t)
+			}
+			if err := rows.Err(); err != nil {
+				return err
+			}
+			if located {
+				sort.SliceStable(taps, func(i, j int) bool { return taps[i].Distance < taps[j].Distance })
+			}
+			if int64(len(taps)) > limit {
+				taps = taps[:limit]
+			}
+			return writeJSON(w, apiTaps(taps))
+		})
+}
@@ -0,0 +1,128 @@
+package tbeer
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestDistance(t *testing.T) {
+	// Oslo to Bergen is about 305 km
+	if d := distance(59.9139, 10.7522, 60.3913, 5.3221); math.Abs(d-305000) > 5000 {
+		t.Errorf("distance Oslo-Bergen %f", d)
+	}
+	if d := distance(10, 20, 10, 20); d != 0 {
+		t.Errorf("distance to itself %f", d)
+	}
+}
+
+func TestTapList(t *testing.T) {
+	app := OpenTestEnv()
+	defer CloseTestEnv(app)
+	serv := httptest.NewServer(app)
+	defer serv.Close()
+
+	do := func(method, path string, values url.Values, v interface{}) int {
+		req, _ := http.NewRequest(method, serv.URL+"/api/"+path+"?"+values.Encode(), nil)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode == 200 && v != nil {
+			if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return res.StatusCode
+	}
+
+	var places [3]int64
+	for i, pos := range [][2]float64{{59.92, 10.75}, {59.95, 10.75}, {60.39, 5.32}} {
+		res, err := app.DB.Exec("INSERT INTO place (name, lat, long, radius) VALUES (?, ?, ?, 0)",
+			fmt.Sprintf("Taproom %d", i), pos[0], pos[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		places[i], _ = res.LastInsertId()
+	}
+	defer func() {
+		for _, id := range places {
+			app.DB.Exec("DELETE FROM tap WHERE placeid = ?", id)
+			app.DB.Exec("DELETE FROM place_maintainer WHERE placeid = ?", id)
+			app.DB.Exec("DELETE FROM place WHERE id = ?", id)
+		}
+		app.DB.Exec("DELETE FROM beer WHERE name = 'Hazy Fjord'")
+	}()
+
+	beer := &APIBeer{}
+	if status := do("POST", "beers", url.Values{
+		"name": {"Hazy Fjord"}, "brewery": {"Nordic Ales"}, "style": {"NEIPA"}, "abv": {"6.5"}, "ibu": {"40"}}, beer); status != 200 {
+		t.Fatalf("add beer: status %d", status)
+	}
+	if beer.Id == 0 || beer.ABV != 6.5 || beer.IBU != 40 {
+		t.Errorf("unexpected beer %+v", beer)
+	}
+	if status := do("POST", "beers", url.Values{"name": {"Rocket Fuel"}, "abv": {"120"}}, nil); status == 200 {
+		t.Error("accepted an abv over 100%")
+	}
+	var found []APIBeer
+	if do("GET", "beers", url.Values{"query": {"neipa"}}, &found); len(found) != 1 || found[0].Id != beer.Id {
+		t.Errorf("search by style found %+v", found)
+	}
+
+	// the first user to claim a place maintains it
+	price := url.Values{"price": {"89"}}
+	tapPath := func(place int64) string { return fmt.Sprintf("place/%d/taps/%d", place, beer.Id) }
+	if status := do("PUT", tapPath(places[0]), price, nil); status == 200 {
+		t.Error("changed the taps of a place without maintaining it")
+	}
+	for _, place := range places {
+		if status := do("POST", fmt.Sprintf("place/%d/maintainers", place), nil, nil); status != 200 {
+			t.Fatalf("claim place: status %d", status)
+		}
+	}
+	var taps []APITap
+	if status := do("PUT", tapPath(places[0]), price, &taps); status != 200 || len(taps) != 1 || taps[0].Price != 89 {
+		t.Fatalf("put on tap: status %d, %+v", status, taps)
+	}
+	do("PUT", tapPath(places[1]), url.Values{"price": {"95"}}, nil)
+	do("PUT", tapPath(places[2]), url.Values{"price": {"99"}}, nil)
+
+	// someone else maintains this one
+	app.DB.Exec("DELETE FROM place_maintainer WHERE placeid = ?", places[2])
+	app.DB.Exec("INSERT INTO place_maintainer (placeid, userid) VALUES (?, 2)", places[2])
+	if status := do("DELETE", tapPath(places[2]), nil, nil); status == 200 {
+		t.Error("took a beer off tap at a place maintained by someone else")
+	}
+	if status := do("POST", fmt.Sprintf("place/%d/maintainers", places[2]), nil, nil); status == 200 {
+		t.Error("claimed a place that already has a maintainer")
+	}
+
+	// nearest to Bergen first
+	if do("GET", "ontap", url.Values{"query": {"hazy"}, "lat": {"60.39"}, "long": {"5.33"}}, &taps); len(taps) != 3 ||
+		taps[0].Place.Id != places[2] || taps[1].Place.Id != places[1] || taps[0].Distance > taps[1].Distance {
+		t.Errorf("unexpected taps near Bergen %+v", taps)
+	}
+	if do("GET", "ontap", url.Values{"beerid": {fmt.Sprint(beer.Id)}, "lat": {"59.91"}, "long": {"10.75"}, "limit": {"1"}}, &taps); len(taps) != 1 ||
+		taps[0].Place.Id != places[0] {
+		t.Errorf("unexpected nearest tap in Oslo %+v", taps)
+	}
+
+	if status := do("DELETE", tapPath(places[1]), nil, &taps); status != 200 || len(taps) != 0 {
+		t.Errorf("take off tap: status %d, %+v", status, taps)
+	}
+	place := &APIPlace{}
+	if do("GET", fmt.Sprintf("place/%d", places[0]), url.Values{"taps": {"1"}}, place); len(place.Taps) != 1 ||
+		place.Taps[0].Beer.Name != "Hazy Fjord" {
+		t.Errorf("unexpected place with taps %+v", place)
+	}
+	place = &APIPlace{}
+	if do("GET", fmt.Sprintf("place/%d", places[0]), nil, place); place.Taps != nil {
+		t.Errorf("taps included without asking %+v", place.Taps)
+	}
+}
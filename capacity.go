@@ -0,0 +1,249 @@
+package tbeer
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+var maxParticipantsParam = RouteParam{Name: "max_participants", In: "query", Type: "integer",
+	Description: "most participants attending, further participants are waitlisted. 0 for no limit"}
+
+// Extract the optional participant limit of a meeting, def if not given
+func getFormMaxParticipants(ctx *DispatchContext, def int) (int, error) {
+	if _, ok := ctx.request.Form["max_participants"]; !ok {
+		return def, nil
+	}
+	n, err := getFormInt(ctx.request.Form, "max_participants")
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, errors.New("max_participants must not be negative")
+	}
+	return int(n), nil
+}
+
+const meetingAttendanceCountQuery = "SELECT count(*) FROM meeting_participant WHERE meetingid = ?"
+
+// Whether a meeting with the given limit has no free seats
+func meetingFull(tx *sql.Tx, meetingid int64, max int) (bool, error) {
+	if max == 0 {
+		return false, nil
+	}
+	var count int
+	if err := tx.QueryRow(meetingAttendanceCountQuery, meetingid).Scan(&count); err != nil {
+		return false, err
+	}
+	return count >= max, nil
+}
+
+// Check that the attendees of a meeting fit within a new limit
+func checkAttendeesFit(tx *sql.Tx, meetingid int64, max int) error {
+	if max == 0 {
+		return nil
+	}
+	var count int
+	if err := tx.QueryRow(meetingAttendanceCountQuery, meetingid).Scan(&count); err != nil {
+		return err
+	}
+	if count > max {
+		return fmt.Errorf("max_participants is below the %d attending", count)
+	}
+	return nil
+}
+
+// Put a participant on the waitlist of a meeting, returning its position
+func joinWaitlist(tx *sql.Tx, meetingid, partid int64) (int, error) {
+	var attending int
+	err := tx.QueryRow("SELECT count(*) FROM meeting_participant WHERE meetingid = ? AND participantid = ?",
+		meetingid, partid).Scan(&attending)
+	if err != nil {
+		return 0, err
+	}
+	if attending != 0 {
+		return 0, errors.New("already attending")
+	}
+	res, err := tx.Exec("INSERT INTO meeting_waitlist (meetingid, participantid) VALUES (?, ?)", meetingid, partid)
+	if err != nil {
+		return 0, err
+	}
+	id, _ := res.LastInsertId()
+	var position int
+	err = tx.QueryRow("SELECT count(*) FROM meeting_waitlist WHERE meetingid = ? AND id <= ?",
+		meetingid, id).Scan(&position)
+	return position, err
+}
+
+// Move participants from the waitlist of a meeting into its free seats,
+// first come first served. Returns the promoted participants.
+func promoteWaitlist(tx *sql.Tx, meetingid int64, max int) ([]int64, error) {
+	// a negative limit is no limit in sqlite
+	seats := -1
+	if max != 0 {
+		var count int
+		if err := tx.QueryRow(meetingAttendanceCountQuery, meetingid).Scan(&count); err != nil {
+			return nil, err
+		}
+		if seats = max - count; seats <= 0 {
+			return nil, nil
+		}
+	}
+	rows, err := tx.Query("SELECT participantid FROM meeting_waitlist WHERE meetingid = ? ORDER BY id LIMIT ?",
+		meetingid, seats)
+	if err != nil {
+		return nil, err
+	}
+	promoted := make([]int64, 0)
+	for rows.Next() {
+		var partid int64
+		if err := rows.Scan(&partid); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		promoted = append(promoted, partid)
+	}
+	rows.Close()
+	for _, partid := range promoted {
+		if _, err := tx.Exec("INSERT INTO meeting_participant (meetingid, participantid) VALUES (?, ?)",
+			meetingid, partid); err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec("DELETE FROM meeting_waitlist WHERE meetingid = ? AND participantid = ?",
+			meetingid, partid); err != nil {
+			return nil, err
+		}
+	}
+	return promoted, nil
+}
+
+// Tell the owners of promoted participants that they got a seat
+func notifyPromoted(db *sql.DB, m *Meeting, promoted []int64) {
+	owners := make([]int64, 0, len(promoted))
+	for _, partid := range promoted {
+		owners = append(owners, queryUsers(db, "SELECT ownerid FROM participant WHERE id = ?", partid)...)
+	}
+	notifyUsers(db, owners, 0, NotifyPromoted, m.Id,
+		fmt.Sprintf("You got a seat at %s", m.Name), meetingSummary(db, m))
+}
+
+// A warning if more people are expected at the same time at a place
+// than it holds, counting the attendees of the meetings there
+// overlapping the window. Empty if the capacity of the place is unknown.
+func placeCapacityWarning(db *sql.DB, placeid int64, window Period) (string, error) {
+	var name string
+	var capacity int
+	err := db.QueryRow("SELECT name, capacity FROM place WHERE id = ?", placeid).Scan(&name, &capacity)
+	if err != nil || capacity == 0 {
+		return "", err
+	}
+	rows, err := db.Query("SELECT period.start, period.end, period.rrule, period.exdate, "+
+		"(SELECT count(*) FROM meeting_participant WHERE meetingid = meeting.id), ifnull(place.timezone, '') "+
+		"FROM meeting, period, place "+
+		"WHERE meeting.placeid = ? AND meeting.periodid = period.id AND meeting.placeid = place.id AND "+
+		"period.start < ? AND (period.end > ? OR period.rrule != '')",
+		placeid, window.End, window.Start)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	// attendees arriving and leaving over time
+	type change struct{ at, people int }
+	changes := make([]change, 0)
+	for rows.Next() {
+		var p Period
+		var attendees int
+		if err := rows.Scan(append(p.BasicFields(), &attendees, p.zoneField())...); err != nil {
+			return "", err
+		}
+		occurrences, err := p.Occurrences(window)
+		if err != nil {
+			return "", err
+		}
+		for _, o := range occurrences {
+			changes = append(changes, change{o.Start, attendees}, change{o.End, -attendees})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+	// people leave before others arrive at the same time
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].at == changes[j].at {
+			return changes[i].people < changes[j].people
+		}
+		return changes[i].at < changes[j].at
+	})
+	people, peak := 0, 0
+	for _, c := range changes {
+		if people += c.people; people > peak {
+			peak = people
+		}
+	}
+	if peak <= capacity {
+		return "", nil
+	}
+	return fmt.Sprintf("%d people are expected at %s at the same time, but it holds %d",
+		peak, name, capacity), nil
+}
+
+// The meeting as returned from writes, with a warning if its place
+// is overbooked during its first occurrence
+func meetingWithWarnings(db *sql.DB, m *Meeting) (*APIMeeting, error) {
+	v := m.APIValue().(*APIMeeting)
+	warning, err := placeCapacityWarning(db, m.Place.Id, Period{Start: m.Period.Start, End: m.Period.End})
+	if err != nil {
+		return nil, err
+	}
+	if warning != "" {
+		v.Warnings = append(v.Warnings, warning)
+	}
+	return v, nil
+}
+
+func (app *App) initCapacityHandlers() {
+	app.installStmtRestHandler("meeting/:id/waitlist",
+		&RouteDoc{
+			Summary:  "participants waiting for a seat in a meeting, first in line first",
+			Response: []*APIParticipant{}},
+		[]string{
+			meetingByIdQuery,
+			visibilityQuery,
+			"SELECT participant.id, participant.alias, participant.description " +
+				"FROM meeting_waitlist, participant " +
+				"WHERE meeting_waitlist.meetingid = ? AND meeting_waitlist.participantid = participant.id " +
+				"ORDER BY meeting_waitlist.id"},
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			m, _, err := loadVisibleMeeting(ctx, stmts[0], stmts[1], ctx.IntParam("id"))
+			if err != nil {
+				return err
+			}
+			items, err := Uniplex(queueBufferSize,
+				func(out chan<- interface{}) error {
+					rows, err := stmts[2].Query(m.Id)
+					if err != nil {
+						return err
+					}
+					defer rows.Close()
+					for rows.Next() {
+						p := &Participant{}
+						if err := rows.Scan(p.BasicFields()...); err != nil {
+							out <- err
+						} else {
+							out <- p
+						}
+					}
+					return nil
+				})
+
+			if err != nil {
+				return err
+			}
+
+			WriteChannelAsJSONList(w, items)
+			return nil
+		})
+}
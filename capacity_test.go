@@ -0,0 +1,223 @@
+package tbeer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// Create participants owned by the test user, removed by the returned func
+func testParticipants(t *testing.T, app *App, aliases ...string) ([]int64, func()) {
+	ids := make([]int64, len(aliases))
+	for i, alias := range aliases {
+		res, err := app.DB.Exec("INSERT INTO participant (ownerid, alias, description) VALUES (1, ?, '')", alias)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[i], _ = res.LastInsertId()
+	}
+	return ids, func() {
+		for _, id := range ids {
+			app.DB.Exec("DELETE FROM participant WHERE id = ?", id)
+		}
+	}
+}
+
+func decodeMeeting(t *testing.T, res *http.Response, err error) *APIMeeting {
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		var msg string
+		json.NewDecoder(res.Body).Decode(&msg)
+		t.Fatalf("status %d: %s", res.StatusCode, msg)
+	}
+	m := &APIMeeting{}
+	if err := json.NewDecoder(res.Body).Decode(m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestMeetingWaitlist(t *testing.T) {
+	app := OpenTestEnv()
+	defer CloseTestEnv(app)
+	serv := httptest.NewServer(app)
+	defer serv.Close()
+	decode := func(res *http.Response, err error) *APIMeeting { return decodeMeeting(t, res, err) }
+
+	parts, cleanup := testParticipants(t, app, "first", "second", "third", "fourth")
+	defer cleanup()
+	app.DB.Exec("DELETE FROM notification WHERE userid = 1")
+	defer app.DB.Exec("DELETE FROM notification WHERE userid = 1")
+
+	m := decode(http.PostForm(serv.URL+"/api/meetings", url.Values{
+		"partid":           {fmt.Sprint(parts[0])},
+		"placeid":          {"1"},
+		"name":             {"small table"},
+		"start":            {"1609520400"},
+		"end":              {"1609524000"},
+		"max_participants": {"2"}}))
+	if m.MaxParticipants != 2 {
+		t.Fatalf("unexpected meeting %+v", m)
+	}
+	defer func() {
+		req, _ := http.NewRequest("DELETE", fmt.Sprintf("%s/api/meeting/%d", serv.URL, m.Id), nil)
+		if res, err := http.DefaultClient.Do(req); err == nil {
+			res.Body.Close()
+		}
+	}()
+
+	attend := func(partid int64) *APIMeeting {
+		return decode(http.PostForm(fmt.Sprintf("%s/api/meeting/%d/participants", serv.URL, m.Id),
+			url.Values{"partid": {fmt.Sprint(partid)}}))
+	}
+	waitlist := func() []int64 {
+		res, err := http.Get(fmt.Sprintf("%s/api/meeting/%d/waitlist", serv.URL, m.Id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var items []APIParticipant
+		if err := json.NewDecoder(res.Body).Decode(&items); err != nil {
+			t.Fatal(err)
+		}
+		ids := make([]int64, len(items))
+		for i, p := range items {
+			ids[i] = p.Id
+		}
+		return ids
+	}
+
+	if a := attend(parts[1]); a.WaitlistPosition != 0 {
+		t.Errorf("waitlisted with a free seat: %+v", a)
+	}
+	if a := attend(parts[2]); a.WaitlistPosition != 1 {
+		t.Errorf("expected first on the waitlist: %+v", a)
+	}
+	if a := attend(parts[3]); a.WaitlistPosition != 2 {
+		t.Errorf("expected second on the waitlist: %+v", a)
+	}
+	if w := waitlist(); len(w) != 2 || w[0] != parts[2] || w[1] != parts[3] {
+		t.Fatalf("unexpected waitlist %v", w)
+	}
+
+	req, _ := http.NewRequest("DELETE", fmt.Sprintf("%s/api/meeting/%d/participants/%d", serv.URL, m.Id, parts[1]), nil)
+	decode(http.DefaultClient.Do(req))
+	if w := waitlist(); len(w) != 1 || w[0] != parts[3] {
+		t.Errorf("waitlist after a seat was freed %v", w)
+	}
+	var attending, promotions int
+	app.DB.QueryRow(attendanceQuery, m.Id, 1).Scan(&attending)
+	if attending != 2 {
+		t.Errorf("%d attending after promotion, expected 2", attending)
+	}
+	app.DB.QueryRow("SELECT count(*) FROM notification WHERE userid = 1 AND kind = ?", NotifyPromoted).Scan(&promotions)
+	if promotions != 1 {
+		t.Errorf("%d promotion notifications, expected 1", promotions)
+	}
+
+	req, _ = http.NewRequest("PUT", fmt.Sprintf("%s/api/meeting/%d?max_participants=1", serv.URL, m.Id), nil)
+	if res, err := http.DefaultClient.Do(req); err != nil || res.StatusCode != 400 {
+		t.Errorf("lowered the limit below the number attending")
+	}
+	var limit int
+	app.DB.QueryRow("SELECT max_participants FROM meeting WHERE id = ?", m.Id).Scan(&limit)
+	if limit != 2 {
+		t.Errorf("limit %d after a refused change", limit)
+	}
+
+	req, _ = http.NewRequest("PUT", fmt.Sprintf("%s/api/meeting/%d?max_participants=0", serv.URL, m.Id), nil)
+	if changed := decode(http.DefaultClient.Do(req)); changed.MaxParticipants != 0 {
+		t.Errorf("limit not removed: %+v", changed)
+	}
+	if w := waitlist(); len(w) != 0 {
+		t.Errorf("waitlist after removing the limit %v", w)
+	}
+
+	req, _ = http.NewRequest("PUT", fmt.Sprintf("%s/api/meeting/%d?max_participants=-1", serv.URL, m.Id), nil)
+	if res, err := http.DefaultClient.Do(req); err != nil || res.StatusCode != 400 {
+		t.Errorf("accepted a negative limit")
+	}
+}
+
+func TestPlaceCapacityWarning(t *testing.T) {
+	app := OpenTestEnv()
+	defer CloseTestEnv(app)
+	serv := httptest.NewServer(app)
+	defer serv.Close()
+	decode := func(res *http.Response, err error) *APIMeeting { return decodeMeeting(t, res, err) }
+
+	res, err := app.DB.Exec("INSERT INTO place (name, lat, long, radius, capacity) VALUES ('Tiny Tavern', 0, 0, 0, 3)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	placeid, _ := res.LastInsertId()
+	defer app.DB.Exec("DELETE FROM place WHERE id = ?", placeid)
+	parts, cleanup := testParticipants(t, app, "one", "two", "three", "four")
+	defer cleanup()
+
+	const start = 1609520400
+	create := func(partid int64, start int) *APIMeeting {
+		return decode(http.PostForm(serv.URL+"/api/meetings", url.Values{
+			"partid":  {fmt.Sprint(partid)},
+			"placeid": {fmt.Sprint(placeid)},
+			"name":    {"pint"},
+			"start":   {fmt.Sprint(start)},
+			"end":     {fmt.Sprint(start + 3600)}}))
+	}
+	cleanupMeeting := func(m *APIMeeting) {
+		req, _ := http.NewRequest("DELETE", fmt.Sprintf("%s/api/meeting/%d", serv.URL, m.Id), nil)
+		if res, err := http.DefaultClient.Do(req); err == nil {
+			res.Body.Close()
+		}
+	}
+
+	first := create(parts[0], start)
+	defer cleanupMeeting(first)
+	app.DB.Exec("INSERT INTO meeting_participant (meetingid, participantid) VALUES (?, ?)", first.Id, parts[1])
+	if len(first.Warnings) != 0 {
+		t.Errorf("unexpected warnings %v", first.Warnings)
+	}
+
+	// a meeting right after the first one fits
+	after := create(parts[2], start+3600)
+	defer cleanupMeeting(after)
+	if len(after.Warnings) != 0 {
+		t.Errorf("unexpected warnings for a following meeting %v", after.Warnings)
+	}
+
+	// 2 + 2 people in overlapping meetings
+	overlapping := create(parts[3], start+1800)
+	defer cleanupMeeting(overlapping)
+	app.DB.Exec("INSERT INTO meeting_participant (meetingid, participantid) VALUES (?, ?)", overlapping.Id, parts[2])
+	if len(overlapping.Warnings) != 0 {
+		t.Errorf("warned before the place was overbooked %v", overlapping.Warnings)
+	}
+	if warning, err := placeCapacityWarning(app.DB, placeid, Period{Start: start, End: start + 7200}); err != nil || warning == "" {
+		t.Errorf("no warning for 4 people at a place for 3: %q, %v", warning, err)
+	}
+
+	suggest := func(query string) []*APISuggestion {
+		res, err := http.Get(serv.URL + "/api/placesearch?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		s := &APISuggestions{}
+		if err := json.NewDecoder(res.Body).Decode(s); err != nil {
+			t.Fatal(err)
+		}
+		return s.Suggestions
+	}
+	if s := suggest(fmt.Sprintf("query=Tiny+Tavern&start=%d&end=%d", start, start+3600)); len(s) != 1 || s[0].Warning == "" {
+		t.Errorf("no warning in suggestions %+v", s)
+	}
+	if s := suggest("query=Tiny+Tavern"); len(s) != 1 || s[0].Warning != "" {
+		t.Errorf("unexpected suggestions without a window %+v", s)
+	}
+}
@@ -0,0 +1,406 @@
+package tbeer
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Slack in meters added to the radius of a place when checking in,
+// since phones rarely know exactly where they are
+const checkinAccuracy = 100
+
+// In memory representation: a participant present at the place of a
+// running meeting
+type Checkin struct {
+	Id          int64
+	Meeting     int64
+	Owner       int64
+	Participant Participant
+	Place       Place
+	// start of the meeting occurrence checked in to
+	Occurrence int
+	Created    int64
+	Drinks     []*Drink
+}
+
+func (c *Checkin) BasicFields() []interface{} {
+	return []interface{}{&c.Id, &c.Meeting, &c.Owner, &c.Occurrence, &c.Created}
+}
+
+// In memory representation: a beer logged at a check-in
+type Drink struct {
+	Id      int64
+	Checkin int64
+	Beer    Beer
+	// 1 to 5, 0 if not rated
+	Rating  int
+	Notes   string
+	Created int64
+}
+
+func (d *Drink) BasicFields() []interface{} {
+	return []interface{}{&d.Id, &d.Checkin, &d.Rating, &d.Notes, &d.Created}
+}
+
+const checkinFields = "checkin.id, checkin.meetingid, checkin.ownerid, checkin.occurrence, checkin.created, " +
+	"participant.id, participant.alias, participant.description, " +
+	"place.id, place.name, place.lat, place.long, place.radius, place.capacity, place.category "
+
+const checkinTables = "FROM checkin, participant, place " +
+	"WHERE checkin.participantid = participant.id AND checkin.placeid = place.id AND "
+
+const checkinByIdQuery = "SELECT " + checkinFields + checkinTables + "checkin.id = ?"
+
+const checkinDrinksQuery = "SELECT drink.id, drink.checkinid, drink.rating, drink.notes, drink.created, " +
+	beerFields + " FROM drink, beer WHERE drink.checkinid = ? AND drink.beerid = beer.id ORDER BY drink.id"
+
+// Check-ins of a user at meetings visible to a viewer, newest first.
+// Arguments are userid, viewer, visibilityArgs(viewer), before, limit.
+var userCheckinsQuery = "SELECT " + checkinFields + checkinTables +
+	"checkin.ownerid = ? AND checkin.meetingid IN (" +
+	"SELECT meeting.id FROM meeting WHERE meeting.ownerid = ? OR " + visibleTo("meeting") + ") AND " +
+	"checkin.id < ? ORDER BY checkin.id DESC LIMIT ?"
+
+// Scan the check-ins of rows, then load their drinks using checkinDrinksQuery
+func loadCheckins(rows *sql.Rows, drinksStmt *sql.Stmt) ([]*Checkin, error) {
+	checkins := make([]*Checkin, 0)
+	for rows.Next() {
+		c := &Checkin{}
+		if err := rows.Scan(ConcatBasicFields(c, &c.Participant, &c.Place)...); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		checkins = append(checkins, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, c := range checkins {
+		if err := loadDrinks(drinksStmt, c); err != nil {
+			return nil, err
+		}
+	}
+	return checkins, nil
+}
+
+func loadDrinks(stmt *sql.Stmt, c *Checkin) error {
+	rows, err := stmt.Query(c.Id)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	c.Drinks = make([]*Drink, 0)
+	for rows.Next() {
+		d := &Drink{}
+		if err := rows.Scan(ConcatBasicFields(d, &d.Beer)...); err != nil {
+			return err
+		}
+		c.Drinks = append(c.Drinks, d)
+	}
+	return rows.Err()
+}
+
+// Load a single check-in with its drinks
+func loadCheckin(stmt, drinksStmt *sql.Stmt, id int64) (*Checkin, error) {
+	c := &Checkin{}
+	if err := stmt.QueryRow(id).Scan(ConcatBasicFields(c, &c.Participant, &c.Place)...); err != nil {
+		return nil, err
+	}
+	return c, loadDrinks(drinksStmt, c)
+}
+
+func writeCheckins(w http.ResponseWriter, checkins []*Checkin) error {
+	items, err := Uniplex(queueBufferSize,
+		func(out chan<- interface{}) error {
+			for _, c := range checkins {
+				out <- c
+			}
+			return nil
+		})
+
+	if err != nil {
+		return err
+	}
+
+	WriteChannelAsJSONList(w, items)
+	return nil
+}
+
+// The occurrence of a meeting running at unix time now
+func runningOccurrence(m *Meeting, now int) (Period, error) {
+	occurrences, err := m.Period.Occurrences(Period{Start: now, End: now})
+	if err != nil {
+		return Period{}, err
+	}
+	if len(occurrences) == 0 {
+		return Period{}, errors.New("the meeting is not running")
+	}
+	return occurrences[0], nil
+}
+
+// Check that a position is at the place, within its radius in meters
+func checkAtPlace(p *Place, lat, long float64) error {
+	d := distance(lat, long, p.Lat, p.Long)
+	if d > float64(p.Radius)+checkinAccuracy {
+		return fmt.Errorf("%.0f meters from %s", d, p.Name)
+	}
+	return nil
+}
+
+// Read the optional rating of a drink
+func getFormRating(ctx *DispatchContext) (int, error) {
+	if _, ok := ctx.request.Form["rating"]; !ok {
+		return 0, nil
+	}
+	rating, err := strconv.Atoi(ctx.request.Form.Get("rating"))
+	if err != nil || rating < 1 || rating > 5 {
+		return 0, errors.New("rating must be 1 to 5")
+	}
+	return rating, nil
+}
+
+func (app *App) initCheckinHandlers() {
+	app.installStmtRestHandler("meeting/:id/checkins",
+		&RouteDoc{
+			Summary:  "check-ins at a meeting with the drinks logged, newest first",
+			Response: []*APICheckin{}},
+		[]string{
+			meetingByIdQuery,
+			visibilityQuery,
+			"SELECT " + checkinFields + checkinTables + "checkin.meetingid = ? ORDER BY checkin.id DESC",
+			checkinDrinksQuery},
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			m, _, err := loadMeeting(stmts[0], ctx.IntParam("id"))
+			if err != nil {
+				return err
+			}
+			if visible, err := canSee(stmts[1], ctx.userid, m.Owner, m.Visibility); err != nil {
+				return err
+			} else if !visible {
+				return sql.ErrNoRows
+			}
+			rows, err := stmts[2].Query(m.Id)
+			if err != nil {
+				return err
+			}
+			checkins, err := loadCheckins(rows, stmts[3])
+			if err != nil {
+				return err
+			}
+			return writeCheckins(w, checkins)
+		})
+
+	app.installStmtRestMethodHandler("POST", "meeting/:id/checkins",
+		&RouteDoc{
+			Summary: "check in to a running meeting the user attends, from where the user is",
+			Params: []RouteParam{
+				{Name: "partid", In: "query", Type: "integer", Description: "participant to check in, default any of the user's"},
+				{Name: "lat", In: "query", Type: "number", Required: true},
+				{Name: "long", In: "query", Type: "number", Required: true}},
+			Response: &APICheckin{}},
+		[]string{
+			userMeetingParticipantsQuery,
+			meetingByIdQuery,
+			"INSERT INTO checkin (meetingid, participantid, ownerid, placeid, occurrence, lat, long, created) " +
+				"VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+			"SELECT count(*) FROM checkin WHERE meetingid = ? AND participantid = ? AND occurrence = ?",
+			checkinByIdQuery,
+			checkinDrinksQuery},
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			meetingid := ctx.IntParam("id")
+			partid, err := messageAuthor(ctx, stmts[0], meetingid)
+			if err != nil {
+				return err
+			}
+			m, _, err := loadMeeting(stmts[1], meetingid)
+			if err != nil {
+				return err
+			}
+			now := time.Now().Unix()
+			occurrence, err := runningOccurrence(m, int(now))
+			if err != nil {
+				return err
+			}
+			lat, err := getFormFloat(ctx.request.Form, "lat")
+			if err != nil {
+				return err
+			}
+			long, err := getFormFloat(ctx.request.Form, "long")
+			if err != nil {
+				return err
+			}
+			if err := checkAtPlace(&m.Place, lat, long); err != nil {
+				return err
+			}
+
+			var id int64
+			err = ctx.app.inTransaction(func(tx *sql.Tx) error {
+				var n int
+				if err := tx.Stmt(stmts[3]).QueryRow(meetingid, partid, occurrence.Start).Scan(&n); err != nil {
+					return err
+				}
+				if n > 0 {
+					return errors.New("already checked in")
+				}
+				res, err := tx.Stmt(stmts[2]).Exec(meetingid, partid, ctx.userid, m.Place.Id,
+					occurrence.Start, lat, long, now)
+				if err != nil {
+					return err
+				}
+				id, err = res.LastInsertId()
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			c, err := loadCheckin(stmts[4], stmts[5], id)
+			if err != nil {
+				return err
+			}
+			return writeJSON(w, c)
+		})
+
+	app.installStmtRestMethodHandler("POST", "checkin/:id/drinks",
+		&RouteDoc{
+			Summary: "log a beer drunk at a check-in of the user",
+			Params: []RouteParam{
+				{Name: "beerid", In: "query", Type: "integer", Required: true},
+				{Name: "rating", In: "query", Type: "integer", Description: "1 to 5"},
+				{Name: "notes", In: "query", Type: "string"}},
+			Response: &APICheckin{}},
+		[]string{
+			checkinByIdQuery,
+			checkinDrinksQuery,
+			"SELECT count(*) FROM beer WHERE id = ?",
+			"INSERT INTO drink (checkinid, beerid, rating, notes, created) VALUES (?, ?, ?, ?, ?)"},
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			c, err := loadCheckin(stmts[0], stmts[1], ctx.IntParam("id"))
+			if err != nil {
+				return err
+			}
+			if c.Owner != ctx.userid {
+				return errNotOwner
+			}
+			beerid, err := getFormInt(ctx.request.Form, "beerid")
+			if err != nil {
+				return err
+			}
+			var n int
+			if err := stmts[2].QueryRow(beerid).Scan(&n); err != nil {
+				return err
+			}
+			if n == 0 {
+				return fmt.Errorf("unknown beer: %d", beerid)
+			}
+			rating, err := getFormRating(ctx)
+			if err != nil {
+				return err
+			}
+			notes := strings.TrimSpace(ctx.request.Form.Get("notes"))
+			if _, err := stmts[3].Exec(c.Id, beerid, rating, notes, time.Now().Unix()); err != nil {
+				return err
+			}
+			if err := loadDrinks(stmts[1], c); err != nil {
+				return err
+			}
+			return writeJSON(w, c)
+		})
+
+	app.installStmtRestMethodHandler("DELETE", "checkin/:id/drinks/:drinkid",
+		&RouteDoc{
+			Summary:  "remove a beer logged at a check-in of the user",
+			Response: &APICheckin{}},
+		[]string{
+			checkinByIdQuery,
+			checkinDrinksQuery,
+			"DELETE FROM drink WHERE id = ? AND checkinid = ?"},
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			c, err := loadCheckin(stmts[0], stmts[1], ctx.IntParam("id"))
+			if err != nil {
+				return err
+			}
+			if c.Owner != ctx.userid {
+				return errNotOwner
+			}
+			res, err := stmts[2].Exec(ctx.IntParam("drinkid"), c.Id)
+			if err != nil {
+				return err
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				return sql.ErrNoRows
+			}
+			if err := loadDrinks(stmts[1], c); err != nil {
+				return err
+			}
+			return writeJSON(w, c)
+		})
+
+	app.installStmtRestHandler("users/:id/checkins",
+		&RouteDoc{
+			Summary:  "check-in history of a user at meetings visible to the user, newest first",
+			Params:   pageParams,
+			Response: []*APICheckin{}},
+		[]string{userCheckinsQuery, checkinDrinksQuery},
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			before, limit, err := getFormPage(ctx.request.Form)
+			if err != nil {
+				return err
+			}
+			args := append([]interface{}{ctx.IntParam("id"), ctx.userid}, visibilityArgs(ctx.userid)...)
+			rows, err := stmts[0].Query(append(args, before, limit)...)
+			if err != nil {
+				return err
+			}
+			checkins, err := loadCheckins(rows, stmts[1])
+			if err != nil {
+				return err
+			}
+			return writeCheckins(w, checkins)
+		})
+
+	visibleCheckins := "checkin.ownerid = ? AND checkin.meetingid IN (" +
+		"SELECT meeting.id FROM meeting WHERE meeting.ownerid = ? OR " + visibleTo("meeting") + ")"
+	app.installStmtRestHandler("users/:id/stats",
+		&RouteDoc{
+			Summary:  "places visited and beers tried by a user, at meetings visible to the user",
+			Response: &APICheckinStats{}},
+		[]string{
+			"SELECT count(*), count(DISTINCT placeid) FROM checkin WHERE " + visibleCheckins,
+			"SELECT count(*), count(DISTINCT drink.beerid), ifnull(avg(nullif(drink.rating, 0)), 0) " +
+				"FROM drink, checkin WHERE drink.checkinid = checkin.id AND " + visibleCheckins,
+			"SELECT DISTINCT beer.style FROM drink, checkin, beer " +
+				"WHERE drink.checkinid = checkin.id AND drink.beerid = beer.id AND beer.style != '' AND " +
+				visibleCheckins + " ORDER BY beer.style"},
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			args := append([]interface{}{ctx.IntParam("id"), ctx.userid}, visibilityArgs(ctx.userid)...)
+			s := &APICheckinStats{Styles: make([]string, 0)}
+			if err := stmts[0].QueryRow(args...).Scan(&s.Checkins, &s.Places); err != nil {
+				return err
+			}
+			if err := stmts[1].QueryRow(args...).Scan(&s.Drinks, &s.Beers, &s.AverageRating); err != nil {
+				return err
+			}
+			rows, err := stmts[2].Query(args...)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var style string
+				if err := rows.Scan(&style); err != nil {
+					return err
+				}
+				s.Styles = append(s.Styles, style)
+			}
+			if err := rows.Err(); err != nil {
+				return err
+			}
+			return writeJSON(w, s)
+		})
+}
@@ -0,0 +1,130 @@
+package tbeer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestCheckinAtPlace(t *testing.T) {
+	p := &Place{Name: "Corner Pub", Lat: 59.9139, Long: 10.7522, Radius: 50}
+	if err := checkAtPlace(p, 59.9140, 10.7523); err != nil {
+		t.Error(err)
+	}
+	// about 1.1 km north
+	if err := checkAtPlace(p, 59.9239, 10.7522); err == nil {
+		t.Error("checked in a kilometer away")
+	}
+}
+
+func TestCheckins(t *testing.T) {
+	app := OpenTestEnv()
+	defer CloseTestEnv(app)
+	serv := httptest.NewServer(app)
+	defer serv.Close()
+
+	do := func(method, path string, values url.Values, v interface{}) int {
+		req, _ := http.NewRequest(method, serv.URL+"/api/"+path+"?"+values.Encode(), nil)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode == 200 && v != nil {
+			if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return res.StatusCode
+	}
+
+	res, err := app.DB.Exec("INSERT INTO place (name, lat, long, radius) VALUES ('Check Inn', 59.9139, 10.7522, 50)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	placeid, _ := res.LastInsertId()
+	res, err = app.DB.Exec("INSERT INTO beer (name, brewery, style, abv, ibu, ownerid) VALUES " +
+		"('Checkin Stout', 'Test Brewing', 'Stout', 7, 50, 1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	beerid, _ := res.LastInsertId()
+	parts, cleanup := testParticipants(t, app, "thirsty")
+	defer cleanup()
+
+	now := time.Now().Unix()
+	var meetings [2]*APIMeeting
+	for i, start := range []int64{now - 600, now + 86400} {
+		meetings[i] = &APIMeeting{}
+		if status := do("POST", "meetings", url.Values{
+			"partid":  {fmt.Sprint(parts[0])},
+			"placeid": {fmt.Sprint(placeid)},
+			"name":    {"checkin test"},
+			"start":   {fmt.Sprint(start)},
+			"end":     {fmt.Sprint(start + 3600)}}, meetings[i]); status != 200 {
+			t.Fatalf("create meeting: status %d", status)
+		}
+	}
+	defer func() {
+		for _, m := range meetings {
+			do("DELETE", fmt.Sprintf("meeting/%d", m.Id), nil, nil)
+		}
+		app.DB.Exec("DELETE FROM beer WHERE id = ?", beerid)
+		app.DB.Exec("DELETE FROM place WHERE id = ?", placeid)
+	}()
+
+	checkin := func(m *APIMeeting, lat float64, c *APICheckin) int {
+		return do("POST", fmt.Sprintf("meeting/%d/checkins", m.Id), url.Values{
+			"partid": {fmt.Sprint(parts[0])},
+			"lat":    {fmt.Sprint(lat)},
+			"long":   {"10.7522"}}, c)
+	}
+	if status := checkin(meetings[0], 59.93, nil); status == 200 {
+		t.Error("checked in far from the place")
+	}
+	if status := checkin(meetings[1], 59.9139, nil); status == 200 {
+		t.Error("checked in to a meeting that has not started")
+	}
+	c := &APICheckin{}
+	if status := checkin(meetings[0], 59.9141, c); status != 200 {
+		t.Fatalf("check in: status %d", status)
+	}
+	if c.Place.Id != placeid || c.Participant.Id != parts[0] || c.Occurrence != int(now-600) || len(c.Drinks) != 0 {
+		t.Errorf("unexpected check-in %+v", c)
+	}
+	if status := checkin(meetings[0], 59.9139, nil); status == 200 {
+		t.Error("checked in twice")
+	}
+
+	drinks := fmt.Sprintf("checkin/%d/drinks", c.Id)
+	if status := do("POST", drinks, url.Values{"beerid": {fmt.Sprint(beerid)}, "rating": {"6"}}, nil); status == 200 {
+		t.Error("accepted a rating of 6")
+	}
+	do("POST", drinks, url.Values{"beerid": {fmt.Sprint(beerid)}, "rating": {"4"}, "notes": {"roasty"}}, nil)
+	if status := do("POST", drinks, url.Values{"beerid": {fmt.Sprint(beerid)}}, c); status != 200 || len(c.Drinks) != 2 ||
+		c.Drinks[0].Notes != "roasty" || c.Drinks[0].Beer.Name != "Checkin Stout" || c.Drinks[1].Rating != 0 {
+		t.Fatalf("log drinks: status %d, %+v", status, c)
+	}
+	if status := do("DELETE", fmt.Sprintf("%s/%d", drinks, c.Drinks[1].Id), nil, c); status != 200 || len(c.Drinks) != 1 {
+		t.Errorf("remove drink: status %d, %+v", status, c)
+	}
+
+	var history []APICheckin
+	if do("GET", fmt.Sprintf("meeting/%d/checkins", meetings[0].Id), nil, &history); len(history) != 1 ||
+		history[0].Id != c.Id || len(history[0].Drinks) != 1 {
+		t.Errorf("unexpected meeting check-ins %+v", history)
+	}
+	if do("GET", "users/1/checkins", url.Values{"limit": {"1"}}, &history); len(history) != 1 || history[0].Id != c.Id {
+		t.Errorf("unexpected user check-ins %+v", history)
+	}
+
+	stats := &APICheckinStats{}
+	if status := do("GET", "users/1/stats", nil, stats); status != 200 || stats.Checkins < 1 || stats.Places < 1 ||
+		stats.Drinks < 1 || !contains(stats.Styles, "Stout") {
+		t.Errorf("unexpected stats: status %d, %+v", status, stats)
+	}
+}
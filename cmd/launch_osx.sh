@@ -1,2 +1,2 @@
 #!/bin/sh
-go run -ldflags -linkmode=external cmd/main.go
+go run -ldflags -linkmode=external cmd/main.go serve -dev "$@"
@@ -1,19 +1,448 @@
 package main
 
 import (
-	"github.com/audunhalland/beer-socialist"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
 	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/audunhalland/beer-socialist"
 )
 
+// Exit codes
+const (
+	exitOK      = 0
+	exitFailure = 1
+	exitUsage   = 2
+)
+
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands map[string]*command
+
+func init() {
+	commands = map[string]*command{
+		"serve":      {"serve the site and the api", serve},
+		"migrate":    {"create the tables of the database and add missing columns", migrate},
+		"seed":       {"fill the database with generated data", seed},
+		"import-osm": {"import pubs and bars from OpenStreetMap extracts", importOSM},
+		"user":       {"create, disable or enable users", user},
+		"export":     {"write the tables of the database as json", export},
+		"routes":     {"print the routes of the api", routes},
+	}
+}
+
+// Wrong use of a command, exiting with exitUsage
+type usageError struct {
+	msg string
+}
+
+func (e *usageError) Error() string {
+	return e.msg
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintf(w, "usage: %s <command> [flags]\n\ncommands:\n", os.Args[0])
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-11s %s\n", name, commands[name].usage)
+	}
+	fmt.Fprintf(w, "\nrun '%s <command> -h' for the flags of a command\n", os.Args[0])
+}
+
 func main() {
-	tbeer.LoadEnv()
-	tbeer.InitDB()
+	if len(os.Args) < 2 {
+		usage(os.Stderr)
+		os.Exit(exitUsage)
+	}
+	name := os.Args[1]
+	if name == "help" || name == "-h" || name == "-help" || name == "--help" {
+		usage(os.Stdout)
+		os.Exit(exitOK)
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n\n", name)
+		usage(os.Stderr)
+		os.Exit(exitUsage)
+	}
+
+	err := cmd.run(os.Args[2:])
+	var uerr *usageError
+	switch {
+	case err == nil:
+	case err == flag.ErrHelp:
+	case errors.As(err, &uerr):
+		fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+		os.Exit(exitUsage)
+	default:
+		fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+		os.Exit(exitFailure)
+	}
+}
+
+// Flags shared by all commands, selecting the configuration
+type envFlags struct {
+	config   string
+	database string
+}
+
+func newFlagSet(name, args string) (*flag.FlagSet, *envFlags) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s %s [flags] %s\n", os.Args[0], name, args)
+		fs.PrintDefaults()
+	}
+	e := &envFlags{}
+	fs.StringVar(&e.config, "config", "", "configuration file, default env.json if it exists")
+	fs.StringVar(&e.database, "db", "", "sqlite database file, overriding the configuration")
+	return fs, e
+}
+
+// Parse flags, turning parse errors into usage errors
+func parse(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return err
+		}
+		return &usageError{err.Error()}
+	}
+	return nil
+}
+
+// Load the configuration, with the TBEER_ variables of the process
+// and then the flags of the command overriding the file. set applies
+// the flags of the command, if any. Validating it is left to the
+// command.
+func (e *envFlags) load(set func(env *tbeer.Env)) (*tbeer.Env, error) {
+	env, err := tbeer.LoadEnv(e.config, os.LookupEnv)
+	if err != nil {
+		return nil, err
+	}
+	if e.database != "" {
+		env.Database = e.database
+	}
+	if set != nil {
+		set(env)
+	}
+	return env, nil
+}
+
+// Load the configuration, then open and migrate the database
+func (e *envFlags) open(set func(env *tbeer.Env)) (*tbeer.Env, *sql.DB, error) {
+	env, err := e.load(set)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := env.ValidateDatabase(); err != nil {
+		return nil, nil, err
+	}
+	db, err := openDatabase(env)
+	if err != nil {
+		return nil, nil, err
+	}
+	return env, db, nil
+}
+
+// Open and migrate the database of a validated configuration
+func openDatabase(env *tbeer.Env) (*sql.DB, error) {
+	db, err := tbeer.OpenDB(env.Database)
+	if err != nil {
+		return nil, err
+	}
+	if err := tbeer.InitSchema(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func serve(args []string) error {
+	fs, e := newFlagSet("serve", "")
+	port := fs.Int("port", 0, "port to listen on, overriding the configuration")
+	secure := fs.Bool("secure", false, "serve https, overriding the configuration")
+	cert := fs.String("cert", "", "tls certificate file, overriding the configuration")
+	key := fs.String("key", "", "tls key file, overriding the configuration")
+	acme := fs.Bool("acme", false, "get the certificate from an ACME CA, overriding the configuration")
+	acmeHosts := fs.String("acme-hosts", "", "comma separated hosts to get certificates for, overriding the configuration")
+	host := fs.String("host", "", "host name of the server, which http is redirected to, overriding the configuration")
+	redirectPort := fs.Int("redirect-port", 0, "port redirecting http to https, such as 80, 0 for none, overriding the configuration")
+	googleKey := fs.String("google-api-key", "", "google api key, overriding the configuration")
+	gazetteer := fs.String("gazetteer", "", "gazetteer file, overriding the configuration")
+	smtp := fs.String("smtp", "", "smtp server for notification email, overriding the configuration")
+	dev := fs.Bool("dev", false, "development mode: fill an empty database with generated data")
+	if err := parse(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return &usageError{"unexpected arguments: " + strings.Join(fs.Args(), " ")}
+	}
+	set := func(env *tbeer.Env) {
+		fs.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "port":
+				env.ServerPort = *port
+			case "secure":
+				env.ServerSecure = *secure
+			case "cert":
+				env.ServerCertFile = *cert
+			case "key":
+				env.ServerKeyFile = *key
+			case "acme":
+				env.ServerACME = *acme
+			case "acme-hosts":
+				env.ACMEHosts = *acmeHosts
+			case "host":
+				env.ServerHost = *host
+			case "redirect-port":
+				env.RedirectPort = *redirectPort
+			case "google-api-key":
+				env.GoogleAPIKey = *googleKey
+			case "gazetteer":
+				env.GazetteerFile = *gazetteer
+			case "smtp":
+				env.SMTPAddr = *smtp
+			}
+		})
+	}
+	env, err := e.load(set)
+	if err != nil {
+		return err
+	}
+	if err := env.ValidateServer(); err != nil {
+		return err
+	}
+	db, err := openDatabase(env)
+	if err != nil {
+		return err
+	}
 
-	if tbeer.IsDBEmpty() {
-		tbeer.PopulateRandom()
+	if *dev && tbeer.IsDBEmpty(db) {
+		if err := tbeer.Populate(db, tbeer.DefaultPopulateConfig()); err != nil {
+			db.Close()
+			return err
+		}
 	}
 
-	runtime.GOMAXPROCS(runtime.NumCPU() - 2)
+	if n := runtime.NumCPU() - 2; n > 0 {
+		runtime.GOMAXPROCS(n)
+	}
 
-	tbeer.StartHttp()
+	app, err := tbeer.NewApp(env, db)
+	if err != nil {
+		db.Close()
+		return err
+	}
+	srv, err := tbeer.NewServer(app)
+	if err != nil {
+		app.Close()
+		return err
+	}
+	return srv.Run()
+}
+
+func migrate(args []string) error {
+	fs, e := newFlagSet("migrate", "")
+	if err := parse(fs, args); err != nil {
+		return err
+	}
+	_, db, err := e.open(nil)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	fmt.Println("database is up to date")
+	return nil
+}
+
+func seed(args []string) error {
+	fs, e := newFlagSet("seed", "")
+	c := tbeer.DefaultPopulateConfig()
+	start := fs.String("start", c.Start.Format(time.RFC3339), "earliest start of periods")
+	fs.Int64Var(&c.Seed, "seed", c.Seed, "random seed; the same seed and counts give the same data")
+	fs.IntVar(&c.Users, "users", c.Users, "number of users")
+	fs.IntVar(&c.Participants, "participants", c.Participants, "number of participants")
+	fs.IntVar(&c.Places, "places", c.Places, "number of places")
+	fs.IntVar(&c.Addresses, "addresses", c.Addresses, "number of addresses")
+	fs.IntVar(&c.PlaceAddresses, "place-addresses", c.PlaceAddresses, "number of addresses given to places")
+	fs.IntVar(&c.Periods, "periods", c.Periods, "number of periods")
+	fs.IntVar(&c.Meetings, "meetings", c.Meetings, "number of meetings")
+	fs.IntVar(&c.MeetingParticipants, "meeting-participants", c.MeetingParticipants, "number of participants attending meetings")
+	fs.IntVar(&c.Availabilities, "availabilities", c.Availabilities, "number of availabilities")
+	fs.Float64Var(&c.CenterLat, "lat", c.CenterLat, "latitude of the center of places")
+	fs.Float64Var(&c.CenterLong, "long", c.CenterLong, "longitude of the center of places")
+	fs.Float64Var(&c.SpreadLat, "spread-lat", c.SpreadLat, "degrees of latitude places are spread over")
+	fs.Float64Var(&c.SpreadLong, "spread-long", c.SpreadLong, "degrees of longitude places are spread over")
+	fs.DurationVar(&c.Span, "span", c.Span, "time after start in which periods start")
+	fs.DurationVar(&c.MaxLength, "max-length", c.MaxLength, "longest period")
+	fs.IntVar(&c.BatchSize, "batch", c.BatchSize, "rows per transaction")
+	force := fs.Bool("force", false, "add to a database that already has data")
+	if err := parse(fs, args); err != nil {
+		return err
+	}
+	var err error
+	if c.Start, err = time.Parse(time.RFC3339, *start); err != nil {
+		return &usageError{err.Error()}
+	}
+	_, db, err := e.open(nil)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if !tbeer.IsDBEmpty(db) && !*force {
+		return errors.New("the database already has data; use -force to add more")
+	}
+	began := time.Now()
+	if err := tbeer.Populate(db, c); err != nil {
+		return err
+	}
+	fmt.Printf("populated in %v\n", time.Since(began).Round(time.Millisecond))
+	return nil
+}
+
+func importOSM(args []string) error {
+	fs, e := newFlagSet("import-osm", "extract.osm|extract.osm.pbf|overpass.json ...")
+	if err := parse(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return &usageError{"no extracts given"}
+	}
+	_, db, err := e.open(nil)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	for _, path := range fs.Args() {
+		stats, err := tbeer.ImportOSMFile(db, path)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		fmt.Printf("%s: %d inserted, %d updated, %d skipped\n", path, stats.Inserted, stats.Updated, stats.Skipped)
+	}
+	return nil
+}
+
+func user(args []string) error {
+	if len(args) == 0 {
+		return &usageError{"expected create, disable or enable"}
+	}
+	switch args[0] {
+	case "create":
+		fs, e := newFlagSet("user create", "")
+		alias := fs.String("alias", "", "name shown to other users")
+		login := fs.String("login", "", "login, unique among users")
+		email := fs.String("email", "", "email address")
+		if err := parse(fs, args[1:]); err != nil {
+			return err
+		}
+		if *alias == "" || *login == "" {
+			fs.Usage()
+			return &usageError{"-alias and -login are required"}
+		}
+		_, db, err := e.open(nil)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		id, err := tbeer.CreateUser(db, *alias, *login, *email)
+		if err != nil {
+			return err
+		}
+		fmt.Println(id)
+		return nil
+	case "disable", "enable":
+		fs, e := newFlagSet("user "+args[0], "")
+		id := fs.Int64("id", 0, "id of the user")
+		login := fs.String("login", "", "login of the user, instead of id")
+		if err := parse(fs, args[1:]); err != nil {
+			return err
+		}
+		if (*id == 0) == (*login == "") {
+			fs.Usage()
+			return &usageError{"either -id or -login is required"}
+		}
+		_, db, err := e.open(nil)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		if *login != "" {
+			if *id, err = tbeer.UserByLogin(db, *login); err != nil {
+				return fmt.Errorf("no user with login %s", *login)
+			}
+		}
+		if err := tbeer.SetUserDisabled(db, *id, args[0] == "disable"); err != nil {
+			return fmt.Errorf("user %d: %v", *id, err)
+		}
+		fmt.Printf("user %d %sd\n", *id, args[0])
+		return nil
+	}
+	return &usageError{"unknown user command: " + args[0]}
+}
+
+func export(args []string) error {
+	fs, e := newFlagSet("export", "[table ...]")
+	out := fs.String("o", "", "output file, default standard output")
+	if err := parse(fs, args); err != nil {
+		return err
+	}
+	_, db, err := e.open(nil)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	w := io.Writer(os.Stdout)
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	return tbeer.ExportJSON(db, w, fs.Args())
+}
+
+func routes(args []string) error {
+	fs, e := newFlagSet("routes", "")
+	if err := parse(fs, args); err != nil {
+		return err
+	}
+	env, err := e.load(nil)
+	if err != nil {
+		return err
+	}
+	// the routes are the same for any database, so they are listed from
+	// an empty one in memory instead of migrating the configured one
+	db, err := tbeer.OpenMemoryDB()
+	if err != nil {
+		return err
+	}
+	if err := tbeer.InitSchema(db); err != nil {
+		db.Close()
+		return err
+	}
+	app, err := tbeer.NewApp(env, db)
+	if err != nil {
+		db.Close()
+		return err
+	}
+	defer app.Close()
+	app.PrintRestRoutes(os.Stdout)
+	return nil
 }
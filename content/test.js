@@ -3,6 +3,7 @@ var map
 var plotlayers = {}
 var place_assoc = {}
 var avails = {}
+var live
 
 var selmarker = L.icon({
     iconUrl : '/script/leaflet/images/marker-icon-sel.png'
@@ -11,27 +12,27 @@ var selmarker = L.icon({
 function add_place(place) {
     // only new listings are added here, so
     // we could display an effect
-    m = new L.Marker(new L.LatLng(place.Lat, place.Long))
+    m = new L.Marker(new L.LatLng(place.lat, place.long))
     map.addLayer(m)
-    m.bindPopup(place.Name)
-    plotlayers[place.Id] = m
+    m.bindPopup(place.name)
+    plotlayers[place.id] = m
 }
 
 function add_avail(avail) {
-    var place = avail.Place
+    var place = avail.place
 
-    if (place.Id in place_assoc) {
-        place_assoc[place.Id].push(avail)
+    if (place.id in place_assoc) {
+        place_assoc[place.id].push(avail)
     } else {
-        place_assoc[place.Id] = [avail]
+        place_assoc[place.id] = [avail]
     }
 
-    avails[avail.Id] = avail
+    avails[avail.id] = avail
 
     var d = document.createElement("div")
     d.setAttribute("class", "avail")
-    d.setAttribute("avail_id", avail.Id)
-    d.appendChild(document.createTextNode(avail.Participant.Alias + "@" + avail.Place.Name))
+    d.setAttribute("avail_id", avail.id)
+    d.appendChild(document.createTextNode(avail.participant.alias + "@" + avail.place.name))
     $("#places").append(d)
 }
 
@@ -44,15 +45,29 @@ function map_highlight(placeid, enabled) {
     }
 }
 
-function fetch_locations() {
+function bounds_query() {
     var b = map.getBounds()
-    
+    return {"minlat"  : b.getSouthWest().lat,
+            "minlong" : b.getSouthWest().lng,
+            "maxlat"  : b.getNorthEast().lat,
+            "maxlong" : b.getNorthEast().lng}
+}
+
+// (re)subscribe to changes in the visible area, refetching on any change
+function subscribe_live() {
+    if (live) {
+        live.close()
+    }
+    live = new EventSource('/api/live?' + $.param(bounds_query()))
+    var changed = function(e) { fetch_locations() }
+    live.addEventListener('created', changed)
+    live.addEventListener('changed', changed)
+    live.addEventListener('deleted', changed)
+}
+
+function fetch_locations() {
     $.getJSON('/api/stuff_at',
-              {"minlat"  : b.getSouthWest().lat,
-               "minlong" : b.getSouthWest().lng,
-               "maxlat"  : b.getNorthEast().lat,
-               "maxlong" : b.getNorthEast().lng
-              },
+              bounds_query(),
               function(json) {
                   oldlayers = plotlayers
                   plotlayers = {}
@@ -62,10 +77,10 @@ function fetch_locations() {
 
                   for (var i = 0; i < json.length; i++) {
                       var item = json[i]
-                      if (item['Type'] == 'place') {
-                          if (item.Id in oldlayers) {
-                              plotlayers[item.Id] = oldlayers[item.Id]
-                              delete oldlayers[item.Id]
+                      if (item['type'] == 'place') {
+                          if (item.id in oldlayers) {
+                              plotlayers[item.id] = oldlayers[item.id]
+                              delete oldlayers[item.id]
                           } else {
                               add_place(item)
                           }
@@ -89,7 +104,10 @@ function initmap() {
 
     var osm = new L.TileLayer(osmUrl, {minZoom : 8, maxZoom : 20, attribution : osmAttrib});
     map.addLayer(osm)
-    map.on('moveend', function(e) { fetch_locations() })
+    map.on('moveend', function(e) {
+        fetch_locations()
+        subscribe_live()
+    })
 }
 
 function formatdate(unix) {
@@ -100,21 +118,35 @@ function formatdate(unix) {
 window.onload = function() {
     initmap()
 
-    $.getJSON('/api/userpref?q=homelat&q=homelong', '',
-              function(json) {
-                  map.setView(new L.LatLng(json["homelat"], json["homelong"]), 11)
-              })
+    // vanity urls redirect here with the resolved entity
+    var placeid = /[?&]place=(\d+)/.exec(location.search)
+    var meetingid = /[?&]meeting=(\d+)/.exec(location.search)
+    var show_place = function(place) {
+        map.setView(new L.LatLng(place.lat, place.long), 15)
+    }
+
+    if (placeid) {
+        $.getJSON('/api/place/' + placeid[1], '', show_place)
+    } else if (meetingid) {
+        $.getJSON('/api/meeting/' + meetingid[1], '',
+                  function(json) { show_place(json.place) })
+    } else {
+        $.getJSON('/api/userpref?q=homelat&q=homelong', '',
+                  function(json) {
+                      map.setView(new L.LatLng(json["homelat"], json["homelong"]), 11)
+                  })
+    }
 
     $.getJSON('/api/availability', '',
               function(json) {
                   av = $("#availability")
                   for (var i = 0; i < json.length; i++) {
-                      p = json[i].Period;
+                      p = json[i].period;
                       li = document.createElement("li")
                       li.appendChild(document.createTextNode(
-                          json[i].Description + " " +
-                              formatdate(p.Start) + " - " +
-                              formatdate(p.End)))
+                          json[i].description + " " +
+                              formatdate(p.start) + " - " +
+                              formatdate(p.end)))
                       av.append(li)
                   }
               })
@@ -122,11 +154,11 @@ window.onload = function() {
 
     $("#places").on("mouseover", ".avail", function(e) {
         avail = avails[$(this).context.getAttribute("avail_id")]
-        map_highlight(avail.Place.Id, true)
+        map_highlight(avail.place.id, true)
     })
     $("#places").on("mouseout", ".avail", function(e) {
         avail = avails[$(this).context.getAttribute("avail_id")]
-        map_highlight(avail.Place.Id, false)
+        map_highlight(avail.place.id, false)
     })
 
     fetch_locations()
@@ -4,6 +4,8 @@ import (
 	_ "code.google.com/p/go-sqlite/go1/sqlite3"
 	"database/sql"
 	"fmt"
+	"sync/atomic"
+	"time"
 )
 
 // A BasicFieldContainer is something that contains
@@ -25,17 +27,26 @@ func ConcatBasicFields(lst ...BasicFieldContainer) []interface{} {
 
 // In memory representation: Place
 type Place struct {
-	Type    string /* BUG: for json */
-	Id      int64
-	Name    string
-	Lat     float64
-	Long    float64
-	Radius  int
-	Address []*Address
+	Id     int64
+	Name   string
+	Lat    float64
+	Long   float64
+	Radius int
+	// number of people the place holds, 0 if unknown
+	Capacity int
+	// one of placeCategories, empty if unknown
+	Category string
+	Address  []*Address
+	// only loaded for a single place
+	Timezone     string
+	Amenities    []string
+	OpeningHours OpeningHours
+	// nil unless requested
+	Taps []*Tap
 }
 
 func (s *Place) BasicFields() []interface{} {
-	return []interface{}{&s.Id, &s.Name, &s.Lat, &s.Long, &s.Radius}
+	return []interface{}{&s.Id, &s.Name, &s.Lat, &s.Long, &s.Radius, &s.Capacity, &s.Category}
 }
 
 type MeetingParticipant struct {
@@ -43,31 +54,35 @@ type MeetingParticipant struct {
 
 // In memory representation: Meeting
 type Meeting struct {
-	Type         string /* BUG: for json */
-	Id           int64
-	Owner        int64
-	Name         string
-	Place        Place
-	Period       Period
-	Participants []MeetingParticipant
+	Id         int64
+	Owner      int64
+	Name       string
+	Visibility int
+	// 0 for no limit
+	MaxParticipants int
+	Place           Place
+	Period          Period
+	Participants    []MeetingParticipant
 }
 
 func (m *Meeting) BasicFields() []interface{} {
-	return []interface{}{&m.Id, &m.Owner, &m.Name}
+	return []interface{}{&m.Id, &m.Owner, &m.Name, &m.Visibility, &m.MaxParticipants}
 }
 
 // In memory representation: Availability
 type Availability struct {
-	Type        string /* BUG: for json */
 	Id          int64
 	Description string
+	Visibility  int
+	// the owning user, only loaded where needed
+	Owner       int64
 	Participant Participant
 	Place       Place
 	Period      Period
 }
 
 func (a *Availability) BasicFields() []interface{} {
-	return []interface{}{&a.Id, &a.Description}
+	return []interface{}{&a.Id, &a.Description, &a.Visibility}
 }
 
 // In memory representation: Participant
@@ -85,10 +100,17 @@ func (p *Participant) BasicFields() []interface{} {
 type Period struct {
 	Start int
 	End   int
+	// recurrence rule, empty if the period occurs once
+	RRule string
+	// comma separated starts of cancelled occurrences
+	ExDate string
+	// time zone of the place, in which recurrences are expanded.
+	// UTC if nil.
+	loc *time.Location
 }
 
 func (p *Period) BasicFields() []interface{} {
-	return []interface{}{&p.Start, &p.End}
+	return []interface{}{&p.Start, &p.End, &p.RRule, &p.ExDate}
 }
 
 type Address struct {
@@ -153,6 +175,97 @@ var init_queries = [...]string{
 		"PRIMARY KEY(meetingid, participantid)" +
 		//") WITHOUT ROWID", requires sqlite version 3.8.2
 		")",
+	// amenities of places, from placeAmenities
+	"CREATE TABLE IF NOT EXISTS place_tag (" +
+		"placeid INTEGER NOT NULL, " +
+		"tag TEXT NOT NULL, " +
+		"FOREIGN KEY(placeid) REFERENCES place(id), " +
+		"PRIMARY KEY(placeid, tag)" +
+		")",
+	// opening hours of places, see OpeningSpan
+	"CREATE TABLE IF NOT EXISTS place_hours (" +
+		"placeid INTEGER NOT NULL, " +
+		"day TEXT NOT NULL, " +
+		"open INTEGER NOT NULL, " +
+		"close INTEGER NOT NULL, " +
+		"FOREIGN KEY(placeid) REFERENCES place(id)" +
+		")",
+	"CREATE INDEX IF NOT EXISTS place_hours_place ON place_hours (placeid)",
+	"CREATE TABLE IF NOT EXISTS beer (" +
+		"id INTEGER PRIMARY KEY, " +
+		"name TEXT NOT NULL, " +
+		"brewery TEXT NOT NULL DEFAULT '', " +
+		"style TEXT NOT NULL DEFAULT '', " +
+		"abv REAL NOT NULL DEFAULT 0, " +
+		"ibu INTEGER NOT NULL DEFAULT 0, " +
+		// the user who added the beer to the catalog
+		"ownerid INTEGER NOT NULL, " +
+		"FOREIGN KEY(ownerid) REFERENCES user(id)" +
+		")",
+	// beers on tap at places
+	"CREATE TABLE IF NOT EXISTS tap (" +
+		"placeid INTEGER NOT NULL, " +
+		"beerid INTEGER NOT NULL, " +
+		"price REAL NOT NULL, " +
+		"updated INTEGER NOT NULL, " +
+		"FOREIGN KEY(placeid) REFERENCES place(id), " +
+		"FOREIGN KEY(beerid) REFERENCES beer(id), " +
+		"PRIMARY KEY(placeid, beerid)" +
+		")",
+	"CREATE INDEX IF NOT EXISTS tap_beer ON tap (beerid)",
+	// places imported from OpenStreetMap, by OSM id such as node/1234
+	"CREATE TABLE IF NOT EXISTS place_osm (" +
+		"osmid TEXT PRIMARY KEY NOT NULL, " +
+		"placeid INTEGER NOT NULL, " +
+		"FOREIGN KEY(placeid) REFERENCES place(id)" +
+		")",
+	// users who keep the tap list of a place up to date
+	"CREATE TABLE IF NOT EXISTS place_maintainer (" +
+		"placeid INTEGER NOT NULL, " +
+		"userid INTEGER NOT NULL, " +
+		"FOREIGN KEY(placeid) REFERENCES place(id), " +
+		"FOREIGN KEY(userid) REFERENCES user(id), " +
+		"PRIMARY KEY(placeid, userid)" +
+		")",
+	// participants present at the place of a meeting occurrence
+	"CREATE TABLE IF NOT EXISTS checkin (" +
+		"id INTEGER PRIMARY KEY, " +
+		"meetingid INTEGER NOT NULL, " +
+		"participantid INTEGER NOT NULL, " +
+		"ownerid INTEGER NOT NULL, " +
+		"placeid INTEGER NOT NULL, " +
+		"occurrence INTEGER NOT NULL, " +
+		"lat REAL NOT NULL, " +
+		"long REAL NOT NULL, " +
+		"created INTEGER NOT NULL, " +
+		"FOREIGN KEY(meetingid) REFERENCES meeting(id), " +
+		"FOREIGN KEY(participantid) REFERENCES participant(id), " +
+		"FOREIGN KEY(ownerid) REFERENCES user(id), " +
+		"FOREIGN KEY(placeid) REFERENCES place(id), " +
+		"UNIQUE(meetingid, participantid, occurrence)" +
+		")",
+	"CREATE INDEX IF NOT EXISTS checkin_owner ON checkin (ownerid, id)",
+	// beers logged at check-ins. rating is 1 to 5, 0 if not rated
+	"CREATE TABLE IF NOT EXISTS drink (" +
+		"id INTEGER PRIMARY KEY, " +
+		"checkinid INTEGER NOT NULL, " +
+		"beerid INTEGER NOT NULL, " +
+		"rating INTEGER NOT NULL DEFAULT 0, " +
+		"notes TEXT NOT NULL DEFAULT '', " +
+		"created INTEGER NOT NULL, " +
+		"FOREIGN KEY(checkinid) REFERENCES checkin(id), " +
+		"FOREIGN KEY(beerid) REFERENCES beer(id)" +
+		")",
+	"CREATE INDEX IF NOT EXISTS drink_checkin ON drink (checkinid)",
+	// participants waiting for a seat in a full meeting, in order of id
+	"CREATE TABLE IF NOT EXISTS meeting_waitlist (" +
+		"id INTEGER PRIMARY KEY, " +
+		"meetingid INTEGER NOT NULL, " +
+		"participantid INTEGER NOT NULL, " +
+		"FOREIGN KEY(meetingid) REFERENCES meeting(id), " +
+		"FOREIGN KEY(participantid) REFERENCES participant(id), " +
+		"UNIQUE(meetingid, participantid)" +
+		")",
 	// availability - a period in which a meeting participant is available
 	"CREATE TABLE IF NOT EXISTS availability (" +
 		"id INTEGER PRIMARY KEY, " +
@@ -188,39 +301,146 @@ var init_queries = [...]string{
 		"FOREIGN KEY(reviewer_id) REFERENCES user(id), " +
 		"FOREIGN KEY(reviewee_id) REFERENCES user(id) " +
 		")",
+	// one review per pair of users per meeting
+	"CREATE UNIQUE INDEX IF NOT EXISTS user_review_once " +
+		"ON user_review (reviewer_id, reviewee_id, meeting_id)",
 	"CREATE TABLE IF NOT EXISTS dynamic_url (" +
 		"value TEXT PRIMARY KEY NOT NULL, " +
 		"type INTEGER NOT NULL, " +
 		"foreignid INTEGER NOT NULL " +
 		")",
+	// one row per direction: userid's view of the relation to otherid.
+	// state is 'requested', 'friends' or 'blocked'
+	"CREATE TABLE IF NOT EXISTS friendship (" +
+		"userid INTEGER NOT NULL, " +
+		"otherid INTEGER NOT NULL, " +
+		"state TEXT NOT NULL, " +
+		"FOREIGN KEY(userid) REFERENCES user(id), " +
+		"FOREIGN KEY(otherid) REFERENCES user(id), " +
+		"PRIMARY KEY(userid, otherid)" +
+		")",
+	"CREATE TABLE IF NOT EXISTS meeting_message (" +
+		"id INTEGER PRIMARY KEY, " +
+		"meetingid INTEGER NOT NULL, " +
+		"partid INTEGER NOT NULL, " +
+		"ownerid INTEGER NOT NULL, " +
+		"body TEXT NOT NULL, " +
+		"created INTEGER NOT NULL, " +
+		"edited INTEGER NOT NULL DEFAULT 0, " +
+		"FOREIGN KEY(meetingid) REFERENCES meeting(id), " +
+		"FOREIGN KEY(partid) REFERENCES participant(id), " +
+		"FOREIGN KEY(ownerid) REFERENCES user(id)" +
+		")",
+	"CREATE INDEX IF NOT EXISTS meeting_message_thread " +
+		"ON meeting_message (meetingid, id)",
+	// delivery is 'pending', 'sent', 'failed' or 'inapp'
+	"CREATE TABLE IF NOT EXISTS notification (" +
+		"id INTEGER PRIMARY KEY, " +
+		"userid INTEGER NOT NULL, " +
+		"kind TEXT NOT NULL, " +
+		"subject TEXT NOT NULL, " +
+		"body TEXT NOT NULL, " +
+		"meetingid INTEGER NOT NULL DEFAULT 0, " +
+		"created INTEGER NOT NULL, " +
+		"read INTEGER NOT NULL DEFAULT 0, " +
+		"delivery TEXT NOT NULL, " +
+		"attempts INTEGER NOT NULL DEFAULT 0, " +
+		"FOREIGN KEY(userid) REFERENCES user(id)" +
+		")",
+	"CREATE INDEX IF NOT EXISTS notification_user " +
+		"ON notification (userid, id)",
+	"CREATE INDEX IF NOT EXISTS notification_delivery " +
+		"ON notification (delivery)",
 }
 
-var GlobalDB *sql.DB
+// A column added to a table after it was first created
+type columnMigration struct {
+	table      string
+	column     string
+	definition string
+}
+
+// Columns missing in databases created by earlier versions
+var column_migrations = [...]columnMigration{
+	{"dynamic_url", "ownerid", "INTEGER NOT NULL DEFAULT 0"},
+	{"availability", "visibility", "INTEGER NOT NULL DEFAULT 0"},
+	{"meeting", "visibility", "INTEGER NOT NULL DEFAULT 0"},
+	{"period", "rrule", "TEXT NOT NULL DEFAULT ''"},
+	{"period", "exdate", "TEXT NOT NULL DEFAULT ''"},
+	{"meeting", "max_participants", "INTEGER NOT NULL DEFAULT 0"},
+	{"place", "capacity", "INTEGER NOT NULL DEFAULT 0"},
+	{"place", "category", "TEXT NOT NULL DEFAULT ''"},
+	{"user", "disabled", "INTEGER NOT NULL DEFAULT 0"},
+}
 
-func init_table(db *sql.DB, q string) {
+func init_table(db *sql.DB, q string) error {
 	res, err := db.Exec(q)
 	if err != nil {
 		fmt.Println(q, res, err)
 	}
+	return err
 }
 
-func OpenDB() (*sql.DB, error) {
-	return sql.Open("sqlite3", "./tbeer.sqlite3")
+// Add the column unless the table already has it
+func migrate_column(db *sql.DB, m columnMigration) error {
+	rows, err := db.Query("PRAGMA table_info(" + m.table + ")")
+	if err != nil {
+		fmt.Println(m, err)
+		return err
+	}
+	for rows.Next() {
+		var cid, notnull, pk int
+		var name, ctype string
+		var dflt interface{}
+		if err := rows.Scan(&cid, &name, &ctype, &notnull, &dflt, &pk); err == nil && name == m.column {
+			rows.Close()
+			return nil
+		}
+	}
+	rows.Close()
+	return init_table(db, "ALTER TABLE "+m.table+" ADD COLUMN "+m.column+" "+m.definition)
 }
 
-func InitDB() {
-	db, err := OpenDB()
-	if err != nil {
-		fmt.Println(err)
+const defaultDatabase = "./tbeer.sqlite3"
+
+// Open a database file, or the default one if path is empty
+func OpenDB(path string) (*sql.DB, error) {
+	if path == "" {
+		path = defaultDatabase
 	}
+	return sql.Open("sqlite3", path)
+}
+
+// the number of databases opened by OpenMemoryDB
+var memoryDBs int64
+
+// Open a new, empty database in memory. Unlike :memory:, which is a
+// database of its own for every connection, the database is shared by
+// the connections of the pool, and lives until the last one is closed.
+func OpenMemoryDB() (*sql.DB, error) {
+	n := atomic.AddInt64(&memoryDBs, 1)
+	return OpenDB(fmt.Sprintf("file:memory%d?mode=memory&cache=shared", n))
+}
+
+// Create the tables of a database, and add columns missing in it.
+// Returns the first error, after trying everything.
+func InitSchema(db *sql.DB) error {
+	var first error
 	for i := range init_queries {
-		init_table(db, init_queries[i])
+		if err := init_table(db, init_queries[i]); err != nil && first == nil {
+			first = err
+		}
+	}
+	for i := range column_migrations {
+		if err := migrate_column(db, column_migrations[i]); err != nil && first == nil {
+			first = err
+		}
 	}
-	GlobalDB = db
+	return first
 }
 
-func IsDBEmpty() bool {
-	rows, _ := GlobalDB.Query("SELECT count(*) FROM user")
+func IsDBEmpty(db *sql.DB) bool {
+	rows, _ := db.Query("SELECT count(*) FROM user")
 	var count int
 	rows.Next()
 	rows.Scan(&count)
@@ -0,0 +1,263 @@
+package tbeer
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Types of things a dynamic url can point to, stored in dynamic_url.type
+const (
+	DynamicURLMeeting = 1
+	DynamicURLPlace   = 2
+	DynamicURLUser    = 3
+)
+
+// dynamic url types by name, as used in the API
+var dynamicURLTypes = map[string]int{
+	"meeting": DynamicURLMeeting,
+	"place":   DynamicURLPlace,
+	"user":    DynamicURLUser,
+}
+
+// Path prefix of each dynamic url type, e.g. /m/friday-beers
+var dynamicURLPrefixes = map[int]string{
+	DynamicURLMeeting: "/m/",
+	DynamicURLPlace:   "/p/",
+	DynamicURLUser:    "/u/",
+}
+
+// Slugs that can not be claimed because they look like something else
+var reservedSlugs = map[string]bool{
+	"admin": true, "api": true, "edit": true, "help": true, "login": true,
+	"logout": true, "m": true, "me": true, "new": true, "p": true,
+	"script": true, "settings": true, "style": true, "u": true,
+}
+
+var errSlugTaken = errors.New("slug already taken")
+
+func dynamicURLTypeName(typ int) string {
+	for name, t := range dynamicURLTypes {
+		if t == typ {
+			return name
+		}
+	}
+	return ""
+}
+
+func newAPIDynamicURL(slug string, typ int, id int64) *APIDynamicURL {
+	return &APIDynamicURL{slug, dynamicURLTypeName(typ), id, dynamicURLPrefixes[typ] + slug}
+}
+
+// Normalize and validate a slug that is to be claimed
+func checkSlug(slug string) (string, error) {
+	slug = strings.ToLower(slug)
+	if !IsSlug(slug) {
+		return "", fmt.Errorf("invalid slug: %s", slug)
+	}
+	if reservedSlugs[slug] {
+		return "", fmt.Errorf("reserved slug: %s", slug)
+	}
+	return slug, nil
+}
+
+func (app *App) initDynamicURLHandlers() {
+	app.installStmtRestHandler("slug/:slug",
+		&RouteDoc{
+			Summary:  "resolve a slug. Slugs of meetings the user can't see are not found",
+			Response: &APIDynamicURL{}},
+		[]string{
+			"SELECT type, foreignid FROM dynamic_url WHERE value = ?",
+			"SELECT ownerid, visibility FROM meeting WHERE id = ?",
+			visibilityQuery},
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			slug := ctx.StringParam("slug")
+			var typ int
+			var id int64
+			if err := stmts[0].QueryRow(slug).Scan(&typ, &id); err != nil {
+				return err
+			}
+			if typ == DynamicURLMeeting {
+				var owner int64
+				var visibility int
+				if err := stmts[1].QueryRow(id).Scan(&owner, &visibility); err != nil {
+					return err
+				}
+				if ok, err := canSee(stmts[2], ctx.userid, owner, visibility); err != nil {
+					return err
+				} else if !ok {
+					return errNotFound
+				}
+			}
+			return writeJSON(w, newAPIDynamicURL(slug, typ, id))
+		})
+
+	app.installStmtRestMethodHandler("POST", "slugs",
+		&RouteDoc{
+			Summary: "claim a slug for a meeting owned by the user, a place without a slug, or the user",
+			Params: []RouteParam{
+				{Name: "slug", In: "query", Type: "string", Required: true},
+				{Name: "type", In: "query", Type: "string", Required: true, Description: "meeting, place or user"},
+				{Name: "id", In: "query", Type: "integer", Description: "id of the meeting or place"}},
+			Response: &APIDynamicURL{}},
+		[]string{
+			"SELECT ownerid FROM meeting WHERE id = ?",
+			"SELECT count(*) FROM place WHERE id = ?",
+			"SELECT count(*) FROM dynamic_url WHERE type = ? AND foreignid = ?",
+			"SELECT type, foreignid FROM dynamic_url WHERE value = ?",
+			"INSERT INTO dynamic_url (value, type, foreignid, ownerid) VALUES (?, ?, ?, ?)"},
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			form := ctx.request.Form
+			slug, err := checkSlug(form.Get("slug"))
+			if err != nil {
+				return err
+			}
+			typ, ok := dynamicURLTypes[form.Get("type")]
+			if !ok {
+				return fmt.Errorf("unknown type: %s", form.Get("type"))
+			}
+
+			var id int64
+			switch typ {
+			case DynamicURLUser:
+				id = ctx.userid
+			case DynamicURLMeeting:
+				if id, err = getFormInt(form, "id"); err != nil {
+					return err
+				}
+				var owner int64
+				if err := stmts[0].QueryRow(id).Scan(&owner); err != nil {
+					return err
+				}
+				if owner != ctx.userid {
+					return errNotOwner
+				}
+			case DynamicURLPlace:
+				// places have no owner, so the first slug of a place
+				// can be claimed by anyone
+				if id, err = getFormInt(form, "id"); err != nil {
+					return err
+				}
+				var count int
+				if err := stmts[1].QueryRow(id).Scan(&count); err != nil || count == 0 {
+					return fmt.Errorf("no such place: %d", id)
+				}
+			}
+
+			err = ctx.app.inTransaction(func(tx *sql.Tx) error {
+				var oldType int
+				var oldId int64
+				err := tx.Stmt(stmts[3]).QueryRow(slug).Scan(&oldType, &oldId)
+				switch {
+				case err == sql.ErrNoRows:
+				case err != nil:
+					return err
+				case oldType == typ && oldId == id:
+					// already claimed by the same thing
+					return nil
+				default:
+					return errSlugTaken
+				}
+				if typ == DynamicURLPlace {
+					var count int
+					if err := tx.Stmt(stmts[2]).QueryRow(typ, id).Scan(&count); err != nil {
+						return err
+					}
+					if count > 0 {
+						return errors.New("place already has a slug")
+					}
+				}
+				_, err = tx.Stmt(stmts[4]).Exec(slug, typ, id, ctx.userid)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			return writeJSON(w, newAPIDynamicURL(slug, typ, id))
+		})
+
+	app.installStmtRestMethodHandler("DELETE", "slug/:slug",
+		&RouteDoc{
+			Summary:  "release a slug claimed by the user, of a meeting owned by the user, or of the user",
+			Response: ""},
+		[]string{
+			"SELECT type, foreignid, ownerid FROM dynamic_url WHERE value = ?",
+			"SELECT ownerid FROM meeting WHERE id = ?",
+			"DELETE FROM dynamic_url WHERE value = ?"},
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			slug := ctx.StringParam("slug")
+			var typ int
+			var id, claimer int64
+			if err := stmts[0].QueryRow(slug).Scan(&typ, &id, &claimer); err != nil {
+				return err
+			}
+			switch {
+			case claimer == ctx.userid:
+			case typ == DynamicURLUser:
+				if id != ctx.userid {
+					return errNotOwner
+				}
+			case typ == DynamicURLMeeting:
+				var owner int64
+				if err := stmts[1].QueryRow(id).Scan(&owner); err != nil {
+					return err
+				}
+				if owner != ctx.userid {
+					return errNotOwner
+				}
+			default:
+				return errNotOwner
+			}
+			if _, err := stmts[2].Exec(slug); err != nil {
+				return err
+			}
+			return writeJSON(w, slug)
+		})
+}
+
+// Whether the user can see the meeting with the id
+func meetingVisibleTo(db *sql.DB, viewer int64, id int64) (bool, error) {
+	var owner int64
+	var visibility int
+	if err := db.QueryRow("SELECT ownerid, visibility FROM meeting WHERE id = ?", id).Scan(&owner, &visibility); err != nil {
+		return false, err
+	}
+	stmt, err := db.Prepare(visibilityQuery)
+	if err != nil {
+		return false, err
+	}
+	defer stmt.Close()
+	return canSee(stmt, viewer, owner, visibility)
+}
+
+// Handle a vanity path by redirecting to the map page showing the
+// entity it resolves to. Meetings the user can't see are not found.
+func vanityHandler(db *sql.DB, typ int) http.HandlerFunc {
+	prefix := dynamicURLPrefixes[typ]
+	name := dynamicURLTypeName(typ)
+	return func(w http.ResponseWriter, r *http.Request) {
+		slug := strings.ToLower(strings.TrimSuffix(r.URL.Path[len(prefix):], "/"))
+		var id int64
+		err := db.QueryRow("SELECT foreignid FROM dynamic_url WHERE value = ? AND type = ?",
+			slug, typ).Scan(&id)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		if typ == DynamicURLMeeting {
+			if visible, err := meetingVisibleTo(db, requestUser(r), id); err != nil || !visible {
+				http.NotFound(w, r)
+				return
+			}
+		}
+		http.Redirect(w, r, fmt.Sprintf("/?%s=%d", name, id), http.StatusFound)
+	}
+}
+
+func installVanityHandlers(mux *http.ServeMux, db *sql.DB) {
+	for typ, prefix := range dynamicURLPrefixes {
+		mux.HandleFunc(prefix, vanityHandler(db, typ))
+	}
+}
@@ -2,32 +2,216 @@ package tbeer
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
 )
 
+// The configuration of the server. Every field can be overridden by an
+// environment variable, TBEER_ followed by the name in the env tag.
 type Env struct {
-	ServerPort     int
-	ServerSecure   bool
-	ServerCertFile string
-	ServerKeyFile  string
-	GoogleAPIKey   string
-	FacebookAppid  string
-	FacebookSecret string
+	// sqlite database file, default ./tbeer.sqlite3
+	Database   string `env:"DATABASE"`
+	ServerPort int    `env:"SERVER_PORT"`
+	// host name of the server, which plain http requests are
+	// redirected to. Defaults to the first of ACMEHosts.
+	ServerHost     string `env:"SERVER_HOST"`
+	ServerSecure   bool   `env:"SERVER_SECURE"`
+	ServerCertFile string `env:"SERVER_CERT_FILE"`
+	ServerKeyFile  string `env:"SERVER_KEY_FILE"`
+	// get the certificate of the secure server from an ACME CA, such
+	// as Let's Encrypt, instead of ServerCertFile and ServerKeyFile
+	ServerACME bool `env:"SERVER_ACME"`
+	// comma separated host names to get certificates for
+	ACMEHosts string `env:"ACME_HOSTS"`
+	// directory url of the CA, default Let's Encrypt
+	ACMEDirectory string `env:"ACME_DIRECTORY"`
+	// root certificates of the CA, if not trusted by the system
+	ACMECAFile string `env:"ACME_CA_FILE"`
+	ACMEEmail  string `env:"ACME_EMAIL"`
+	// certificates and the account key, default ./acme-cache
+	ACMECacheDir string `env:"ACME_CACHE_DIR"`
+	// plain http port of a secure server, redirecting to https on
+	// ServerPort and answering ACME http challenges. 0, the default,
+	// disables it, as binding 80 usually takes root; ACME certificates
+	// are then only got over tls, which needs ServerPort 443. Must
+	// differ from ServerPort.
+	RedirectPort int `env:"REDIRECT_PORT"`
+	// seconds browsers should only use https, default a year. 0
+	// sends no Strict-Transport-Security header.
+	HSTSMaxAge   int    `env:"HSTS_MAX_AGE"`
+	GoogleAPIKey string `env:"GOOGLE_API_KEY"`
+	// towns for offline geocoding, default ./data/gazetteer.tsv
+	GazetteerFile  string `env:"GAZETTEER_FILE"`
+	FacebookAppid  string `env:"FACEBOOK_APPID"`
+	FacebookSecret string `env:"FACEBOOK_SECRET"`
+	// SMTP server for notification email, disabled if empty
+	SMTPAddr     string `env:"SMTP_ADDR"`
+	SMTPFrom     string `env:"SMTP_FROM"`
+	SMTPUser     string `env:"SMTP_USER"`
+	SMTPPassword string `env:"SMTP_PASSWORD"`
 }
 
-var GlobalEnv *Env
+const (
+	envPrefix           = "TBEER_"
+	defaultEnvFile      = "env.json"
+	defaultPort         = 8080
+	defaultHSTSMaxAge   = 365 * 24 * 60 * 60
+	defaultACMECacheDir = "./acme-cache"
+)
 
-func LoadEnv() {
-	data, err := ioutil.ReadFile("env.json")
-	if err != nil {
-		fmt.Println(err)
+// The configuration used when nothing else is given
+func DefaultEnv() *Env {
+	return &Env{
+		Database:      defaultDatabase,
+		ServerPort:    defaultPort,
+		ACMECacheDir:  defaultACMECacheDir,
+		HSTSMaxAge:    defaultHSTSMaxAge,
+		GazetteerFile: defaultGazetteerFile,
+	}
+}
+
+// Load the configuration: the defaults, then the file at path, then
+// TBEER_ variables from lookup, usually os.LookupEnv. An empty path
+// reads env.json if it exists. The result is not validated, as the
+// caller may change it further; check it with ValidateDatabase or
+// ValidateServer for what it is used for.
+func LoadEnv(path string, lookup func(string) (string, bool)) (*Env, error) {
+	env := DefaultEnv()
+	allowMissing := path == ""
+	if allowMissing {
+		path = defaultEnvFile
+	}
+	if err := env.ReadFile(path, allowMissing); err != nil {
+		return nil, err
+	}
+	if err := env.Override(lookup); err != nil {
+		return nil, err
+	}
+	return env, nil
+}
+
+// Read a JSON configuration file over the values of env. A missing
+// file leaves env as it is if allowMissing is set.
+func (env *Env) ReadFile(path string, allowMissing bool) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && allowMissing {
+		return nil
 	}
-	var env Env
-	err = json.Unmarshal(data, &env)
 	if err != nil {
-		fmt.Println("Json unmarshal error in env.json:")
-		fmt.Println(err)
+		return err
+	}
+	if err := json.Unmarshal(data, env); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+// Set fields from the TBEER_ variables found by lookup
+func (env *Env) Override(lookup func(string) (string, bool)) error {
+	v := reflect.ValueOf(env).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := envPrefix + t.Field(i).Tag.Get("env")
+		s, ok := lookup(name)
+		if !ok {
+			continue
+		}
+		f := v.Field(i)
+		switch f.Kind() {
+		case reflect.String:
+			f.SetString(s)
+		case reflect.Int:
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				return fmt.Errorf("%s: not a number: %q", name, s)
+			}
+			f.SetInt(int64(n))
+		case reflect.Bool:
+			b, err := strconv.ParseBool(s)
+			if err != nil {
+				return fmt.Errorf("%s: not a boolean: %q", name, s)
+			}
+			f.SetBool(b)
+		}
+	}
+	return nil
+}
+
+// Check that the configuration has a database, for the commands
+// only using that
+func (env *Env) ValidateDatabase() error {
+	return invalidEnv(env.databaseProblems())
+}
+
+// Check that the configuration can be served, reporting every problem
+func (env *Env) ValidateServer() error {
+	return invalidEnv(append(env.databaseProblems(), env.serverProblems()...))
+}
+
+func invalidEnv(problems []string) error {
+	if len(problems) > 0 {
+		return errors.New("invalid configuration: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func (env *Env) databaseProblems() []string {
+	problems := make([]string, 0)
+	if env.Database == "" {
+		problems = append(problems, "no database")
+	}
+	return problems
+}
+
+func (env *Env) serverProblems() []string {
+	problems := make([]string, 0)
+	if env.ServerPort <= 0 || env.ServerPort > 65535 {
+		problems = append(problems, fmt.Sprintf("server port %d out of range", env.ServerPort))
+	}
+	if env.ServerSecure && !env.ServerACME {
+		for _, f := range []struct{ what, path string }{
+			{"certificate", env.ServerCertFile},
+			{"key", env.ServerKeyFile}} {
+			if f.path == "" {
+				problems = append(problems, "secure server without a "+f.what+" file")
+			} else if _, err := os.Stat(f.path); err != nil {
+				problems = append(problems, fmt.Sprintf("secure server %s: %v", f.what, err))
+			}
+		}
+	}
+	if env.ServerACME {
+		if !env.ServerSecure {
+			problems = append(problems, "acme without a secure server")
+		}
+		if len(acmeHosts(env.ACMEHosts)) == 0 {
+			problems = append(problems, "acme without hosts")
+		}
+		if env.RedirectPort == 0 && env.ServerPort != 443 {
+			problems = append(problems, "acme challenges need a redirect port or server port 443")
+		}
+		if env.ACMECAFile != "" {
+			if _, err := os.Stat(env.ACMECAFile); err != nil {
+				problems = append(problems, fmt.Sprintf("acme ca: %v", err))
+			}
+		}
+	}
+	if env.RedirectPort < 0 || env.RedirectPort > 65535 {
+		problems = append(problems, fmt.Sprintf("redirect port %d out of range", env.RedirectPort))
+	} else if env.ServerSecure && env.RedirectPort == env.ServerPort {
+		problems = append(problems, "redirect port is the server port")
+	} else if env.ServerSecure && env.RedirectPort > 0 && len(env.serverHosts()) == 0 {
+		problems = append(problems, "redirect port without a server host to redirect to")
+	}
+	if env.HSTSMaxAge < 0 {
+		problems = append(problems, "negative hsts max age")
+	}
+	if env.SMTPAddr != "" && env.SMTPFrom == "" {
+		problems = append(problems, "smtp server without a from address")
 	}
-	GlobalEnv = &env
+	return problems
 }
@@ -0,0 +1,114 @@
+package tbeer
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func lookupIn(vars map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		v, ok := vars[name]
+		return v, ok
+	}
+}
+
+func TestEnvOverride(t *testing.T) {
+	env := DefaultEnv()
+	if err := env.ValidateServer(); err != nil {
+		t.Errorf("defaults are invalid: %v", err)
+	}
+	// the redirect is opt in, as binding port 80 would need root
+	if env.RedirectPort != 0 {
+		t.Errorf("redirect port %d by default", env.RedirectPort)
+	}
+	err := env.Override(lookupIn(map[string]string{
+		"TBEER_SERVER_PORT":    "9090",
+		"TBEER_GOOGLE_API_KEY": "key",
+		"TBEER_SERVER_SECURE":  "false",
+		"SERVER_PORT":          "1",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.ServerPort != 9090 || env.GoogleAPIKey != "key" || env.Database != defaultDatabase {
+		t.Errorf("unexpected env %+v", env)
+	}
+
+	for _, bad := range []map[string]string{
+		{"TBEER_SERVER_PORT": "eighty"},
+		{"TBEER_SERVER_SECURE": "sometimes"},
+	} {
+		if err := DefaultEnv().Override(lookupIn(bad)); err == nil {
+			t.Errorf("accepted %v", bad)
+		}
+	}
+}
+
+func TestEnvValidate(t *testing.T) {
+	tests := []struct {
+		env     Env
+		problem string
+	}{
+		{Env{Database: "db", ServerPort: 0}, "port"},
+		{Env{Database: "", ServerPort: 80}, "database"},
+		{Env{Database: "db", ServerPort: 443, ServerSecure: true}, "certificate file"},
+		{Env{Database: "db", ServerPort: 443, ServerSecure: true,
+			ServerCertFile: "/no/such/cert.pem", ServerKeyFile: "/no/such/key.pem"}, "cert.pem"},
+		{Env{Database: "db", ServerPort: 80, SMTPAddr: "localhost:25"}, "from address"},
+		{Env{Database: "db", ServerPort: 443, ServerACME: true, ACMEHosts: "beer.example.com"}, "without a secure server"},
+		{Env{Database: "db", ServerPort: 443, ServerSecure: true, ServerACME: true, ACMEHosts: " , "}, "without hosts"},
+		{Env{Database: "db", ServerPort: 443, ServerSecure: true, RedirectPort: 443,
+			ServerCertFile: "env_test.go", ServerKeyFile: "env_test.go"}, "redirect port"},
+		{Env{Database: "db", ServerPort: 80, HSTSMaxAge: -1}, "hsts"},
+		{Env{Database: "db", ServerPort: 8443, ServerSecure: true, ServerACME: true, ACMEHosts: "beer.example.com"},
+			"redirect port or server port 443"},
+		{Env{Database: "db", ServerPort: 443, ServerSecure: true, RedirectPort: 80,
+			ServerCertFile: "env_test.go", ServerKeyFile: "env_test.go"}, "server host"},
+	}
+	for _, test := range tests {
+		err := test.env.ValidateServer()
+		if err == nil || !strings.Contains(err.Error(), test.problem) {
+			t.Errorf("%+v: expected %q, got %v", test.env, test.problem, err)
+		}
+	}
+
+	// commands not serving need no more than a database
+	if err := (&Env{Database: "db", ServerSecure: true}).ValidateDatabase(); err != nil {
+		t.Error(err)
+	}
+	if err := (&Env{ServerPort: 80}).ValidateDatabase(); err == nil || !strings.Contains(err.Error(), "database") {
+		t.Errorf("expected no database, got %v", err)
+	}
+}
+
+func TestLoadEnv(t *testing.T) {
+	f, err := ioutil.TempFile("", "env*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`{"ServerPort": 8000, "GoogleAPIKey": "file"}`)
+	f.Close()
+
+	env, err := LoadEnv(f.Name(), lookupIn(map[string]string{"TBEER_GOOGLE_API_KEY": "var"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.ServerPort != 8000 || env.GoogleAPIKey != "var" || env.GazetteerFile != defaultGazetteerFile {
+		t.Errorf("unexpected env %+v", env)
+	}
+
+	if _, err := LoadEnv(f.Name()+".missing", lookupIn(nil)); err == nil {
+		t.Error("loaded a missing file")
+	}
+	// validation is left to the caller
+	env, err = LoadEnv(f.Name(), lookupIn(map[string]string{"TBEER_SERVER_PORT": "0"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := env.ValidateServer(); err == nil {
+		t.Error("served an invalid configuration")
+	}
+}
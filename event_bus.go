@@ -0,0 +1,116 @@
+package tbeer
+
+import (
+	"sync"
+)
+
+// The kind of change an Event describes
+type EventKind string
+
+const (
+	EventCreated EventKind = "created"
+	EventChanged EventKind = "changed"
+	EventDeleted EventKind = "deleted"
+)
+
+// A point in space and time that an event touches
+type eventSpot struct {
+	lat    float64
+	long   float64
+	period Period
+}
+
+// An Event describes a change to an item that has a place and a period,
+// i.e. an availability or a meeting.
+type Event struct {
+	Kind EventKind
+	Type string
+	Id   int64
+	// The item after the change. nil for deleted items.
+	Item interface{}
+	// where and when the item was before and after the change
+	spots []eventSpot
+	// who may see the event
+	owner      int64
+	visibility int
+}
+
+// Record that the event touches the given place and period
+func (e *Event) touch(p *Place, period Period) {
+	e.spots = append(e.spots, eventSpot{p.Lat, p.Long, period})
+}
+
+// A Subscription receives events within a rectangle and a time window.
+// An End of zero in the window means that it is open ended.
+type Subscription struct {
+	Rect   Rectangle
+	Window Period
+	// Events are delivered on C. C is closed when the subscriber
+	// falls too far behind, or when unsubscribed.
+	C chan *Event
+}
+
+func (s *Subscription) matches(e *Event) bool {
+	for _, spot := range e.spots {
+		if spot.lat < s.Rect.MinLat || spot.lat > s.Rect.MaxLat ||
+			spot.long < s.Rect.MinLong || spot.long > s.Rect.MaxLong {
+			continue
+		}
+		if s.Window.End != 0 && spot.period.Start > s.Window.End {
+			continue
+		}
+		if spot.period.End < s.Window.Start {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// In-process publish/subscribe of item changes
+type EventBus struct {
+	mutex sync.Mutex
+	subs  map[*Subscription]bool
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{subs: make(map[*Subscription]bool)}
+}
+
+// Subscribe to events. bufsize is the number of events that may be
+// queued before the subscription is dropped.
+func (b *EventBus) Subscribe(rect Rectangle, window Period, bufsize int) *Subscription {
+	s := &Subscription{rect, window, make(chan *Event, bufsize)}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.subs[s] = true
+	return s
+}
+
+func (b *EventBus) Unsubscribe(s *Subscription) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.subs[s] {
+		delete(b.subs, s)
+		close(s.C)
+	}
+}
+
+// Deliver the event to all matching subscribers. Never blocks.
+func (b *EventBus) Publish(e *Event) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for s := range b.subs {
+		if !s.matches(e) {
+			continue
+		}
+		select {
+		case s.C <- e:
+		default:
+			// subscriber is not keeping up. Drop it, so that it
+			// can reload instead of silently missing events
+			delete(b.subs, s)
+			close(s.C)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package tbeer
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Names of the tables of a database
+func tableNames(db *sql.DB) ([]string, error) {
+	rows, err := db.Query("SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%' ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	names := make([]string, 0)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// Write tables as a JSON object of table names and lists of rows,
+// each row an object of column names and values. All tables are
+// written if none are given.
+func ExportJSON(db *sql.DB, w io.Writer, tables []string) error {
+	known, err := tableNames(db)
+	if err != nil {
+		return err
+	}
+	if len(tables) == 0 {
+		tables = known
+	}
+	for _, t := range tables {
+		if !contains(known, t) {
+			return fmt.Errorf("unknown table: %s", t)
+		}
+	}
+
+	io.WriteString(w, "{")
+	for i, t := range tables {
+		if i > 0 {
+			io.WriteString(w, ",")
+		}
+		name, _ := json.Marshal(t)
+		fmt.Fprintf(w, "\n%s: [", name)
+		if err := exportTable(db, w, t); err != nil {
+			return fmt.Errorf("%s: %v", t, err)
+		}
+		io.WriteString(w, "]")
+	}
+	_, err = io.WriteString(w, "\n}\n")
+	return err
+}
+
+func exportTable(db *sql.DB, w io.Writer, table string) error {
+	rows, err := db.Query("SELECT * FROM " + table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	values := make([]interface{}, len(columns))
+	for i := range values {
+		values[i] = new(interface{})
+	}
+	for n := 0; rows.Next(); n++ {
+		if err := rows.Scan(values...); err != nil {
+			return err
+		}
+		row := make(map[string]interface{}, len(columns))
+		for i, c := range columns {
+			v := *values[i].(*interface{})
+			if b, ok := v.([]byte); ok {
+				v = string(b)
+			}
+			row[c] = v
+		}
+		data, err := json.Marshal(row)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			io.WriteString(w, ",")
+		}
+		io.WriteString(w, "\n  ")
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,423 @@
+package tbeer
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Largest accepted iCalendar upload
+const maxICSSize = 1 << 20
+
+// Most availabilities created by one import
+const maxImportedWindows = 200
+
+// A content line of an iCalendar document
+type icsProperty struct {
+	name   string
+	params map[string]string
+	value  string
+}
+
+// Split an iCalendar document into unfolded content lines
+func parseICSLines(data string) ([]*icsProperty, error) {
+	data = strings.Replace(data, "\r\n", "\n", -1)
+	// unfold continuation lines
+	data = strings.Replace(data, "\n ", "", -1)
+	data = strings.Replace(data, "\n\t", "", -1)
+
+	var props []*icsProperty
+	for n, line := range strings.Split(data, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		p := &icsProperty{params: make(map[string]string)}
+		// the value starts at the first colon not inside a quoted parameter
+		quoted := false
+		colon := -1
+		for i, c := range line {
+			if c == '"' {
+				quoted = !quoted
+			} else if c == ':' && !quoted {
+				colon = i
+				break
+			}
+		}
+		if colon < 0 {
+			return nil, fmt.Errorf("line %d: not a content line", n+1)
+		}
+		p.value = line[colon+1:]
+		parts := strings.Split(line[:colon], ";")
+		p.name = strings.ToUpper(parts[0])
+		for _, param := range parts[1:] {
+			kv := strings.SplitN(param, "=", 2)
+			if len(kv) == 2 {
+				p.params[strings.ToUpper(kv[0])] = strings.Trim(kv[1], `"`)
+			}
+		}
+		props = append(props, p)
+	}
+	return props, nil
+}
+
+// Parse a DATE or DATE-TIME value, in the time zone of its TZID
+// parameter, or UTC for floating times
+func parseICSTime(value string, params map[string]string) (time.Time, error) {
+	loc := time.UTC
+	if tzid, ok := params["TZID"]; ok {
+		if l, err := time.LoadLocation(tzid); err == nil {
+			loc = l
+		}
+	}
+	switch {
+	case strings.HasSuffix(value, "Z"):
+		return time.Parse("20060102T150405Z", value)
+	case len(value) == len("20060102"):
+		return time.ParseInLocation("20060102", value, loc)
+	}
+	return time.ParseInLocation("20060102T150405", value, loc)
+}
+
+var icsDurationPattern = regexp.MustCompile(`^([+-])?P(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?)?$`)
+
+// Parse a DURATION value such as PT1H30M
+func parseICSDuration(value string) (time.Duration, error) {
+	m := icsDurationPattern.FindStringSubmatch(value)
+	if m == nil || value == "P" || value == "PT" {
+		return 0, fmt.Errorf("bad duration: %s", value)
+	}
+	units := []time.Duration{7 * 24 * time.Hour, 24 * time.Hour, time.Hour, time.Minute, time.Second}
+	var d time.Duration
+	for i, unit := range units {
+		if m[i+2] != "" {
+			n, _ := strconv.Atoi(m[i+2])
+			d += time.Duration(n) * unit
+		}
+	}
+	if m[1] == "-" {
+		d = -d
+	}
+	return d, nil
+}
+
+// Parse a FREEBUSY period: start/end or start/duration
+func parseICSPeriod(value string) (Period, error) {
+	parts := strings.SplitN(value, "/", 2)
+	if len(parts) != 2 {
+		return Period{}, fmt.Errorf("bad period: %s", value)
+	}
+	start, err := parseICSTime(parts[0], nil)
+	if err != nil {
+		return Period{}, err
+	}
+	end, err := parseICSTime(parts[1], nil)
+	if err != nil {
+		d, derr := parseICSDuration(parts[1])
+		if derr != nil {
+			return Period{}, fmt.Errorf("bad period: %s", value)
+		}
+		end = start.Add(d)
+	}
+	return Period{Start: int(start.Unix()), End: int(end.Unix())}, nil
+}
+
+// The busy time of an event within the window, expanding recurring events
+func eventBusy(props []*icsProperty, window Period) ([]Period, error) {
+	var start, end time.Time
+	var duration time.Duration
+	var rrule string
+	var exdates []string
+	hasEnd := false
+	for _, p := range props {
+		var err error
+		switch p.name {
+		case "DTSTART":
+			start, err = parseICSTime(p.value, p.params)
+		case "DTEND":
+			end, err = parseICSTime(p.value, p.params)
+			hasEnd = true
+		case "DURATION":
+			duration, err = parseICSDuration(p.value)
+		case "RRULE":
+			var r *RRule
+			if r, err = ParseRRule(p.value); err == nil {
+				rrule = r.String()
+			}
+		case "EXDATE":
+			for _, v := range strings.Split(p.value, ",") {
+				t, err := parseICSTime(v, p.params)
+				if err != nil {
+					return nil, err
+				}
+				exdates = append(exdates, strconv.FormatInt(t.Unix(), 10))
+			}
+		case "TRANSP":
+			if strings.ToUpper(p.value) == "TRANSPARENT" {
+				return nil, nil
+			}
+		case "STATUS":
+			if strings.ToUpper(p.value) == "CANCELLED" {
+				return nil, nil
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", p.name, err)
+		}
+	}
+	if start.IsZero() {
+		return nil, errors.New("event without DTSTART")
+	}
+	if !hasEnd {
+		end = start.Add(duration)
+	}
+	period := &Period{
+		Start:  int(start.Unix()),
+		End:    int(end.Unix()),
+		RRule:  rrule,
+		ExDate: strings.Join(exdates, ",")}
+	return period.occurrencesIn(window, start.Location())
+}
+
+// Busy periods within the window from the events and free/busy
+// components of an iCalendar document. Components nested in events,
+// such as VALARM, are skipped.
+func parseBusy(data string, window Period) ([]Period, error) {
+	props, err := parseICSLines(data)
+	if err != nil {
+		return nil, err
+	}
+	var busy []Period
+	// the components the current line is in, innermost last
+	var components []string
+	var event []*icsProperty
+	for _, p := range props {
+		component := ""
+		if len(components) > 0 {
+			component = components[len(components)-1]
+		}
+		switch {
+		case p.name == "BEGIN":
+			components = append(components, strings.ToUpper(p.value))
+			if strings.ToUpper(p.value) == "VEVENT" {
+				event = nil
+			}
+		case p.name == "END":
+			if component != strings.ToUpper(p.value) {
+				return nil, fmt.Errorf("END:%s inside %s", p.value, component)
+			}
+			components = components[:len(components)-1]
+			if component == "VEVENT" {
+				b, err := eventBusy(event, window)
+				if err != nil {
+					return nil, err
+				}
+				busy = append(busy, b...)
+			}
+		case component == "VEVENT":
+			event = append(event, p)
+		case component == "VFREEBUSY" && p.name == "FREEBUSY":
+			if fbtype := strings.ToUpper(p.params["FBTYPE"]); fbtype == "FREE" {
+				continue
+			}
+			for _, v := range strings.Split(p.value, ",") {
+				period, err := parseICSPeriod(v)
+				if err != nil {
+					return nil, err
+				}
+				busy = append(busy, period)
+			}
+		}
+	}
+	return busy, nil
+}
+
+// The parts of the window not covered by busy periods,
+// that are at least minLength seconds long
+func freeWindows(window Period, busy []Period, minLength int) []Period {
+	sort.Slice(busy, func(i, j int) bool { return busy[i].Start < busy[j].Start })
+	free := make([]Period, 0)
+	at := window.Start
+	add := func(end int) {
+		if end-at >= minLength && end > at {
+			free = append(free, Period{Start: at, End: end})
+		}
+	}
+	for _, b := range busy {
+		if b.End <= at {
+			continue
+		}
+		if b.Start >= window.End {
+			break
+		}
+		add(b.Start)
+		at = b.End
+	}
+	add(window.End)
+	return free
+}
+
+var errICSTooLarge = &statusError{http.StatusRequestEntityTooLarge,
+	fmt.Sprintf("iCalendar data larger than %d bytes", maxICSSize)}
+
+// Read all of an upload, failing with errICSTooLarge rather than
+// cutting it at maxICSSize
+func readICSData(r io.Reader) (string, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxICSSize+1))
+	if err != nil {
+		return "", uploadError(err)
+	}
+	if len(data) > maxICSSize {
+		return "", errICSTooLarge
+	}
+	return string(data), nil
+}
+
+// The error of reading a request body limited by http.MaxBytesReader
+func uploadError(err error) error {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return errICSTooLarge
+	}
+	return err
+}
+
+// Read the iCalendar document from the ics form value, the file of a
+// multipart upload, or the request body
+func readICSUpload(r *http.Request) (string, error) {
+	if v, ok := r.Form["ics"]; ok {
+		if len(v[0]) > maxICSSize {
+			return "", errICSTooLarge
+		}
+		return v[0], nil
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+		f, _, err := r.FormFile("file")
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		return readICSData(f)
+	}
+	data, err := readICSData(r.Body)
+	if err != nil {
+		return "", err
+	}
+	if len(data) == 0 {
+		return "", errors.New("no iCalendar data")
+	}
+	return data, nil
+}
+
+func (app *App) initFreeBusyHandlers() {
+	app.installStmtRestMethodHandler("POST", "freebusy",
+		&RouteDoc{
+			Summary: "create availabilities in the free windows of iCalendar events or free/busy data within a period. " +
+				"The document is the ics value, a multipart file upload, or the request body",
+			Params: append([]RouteParam{
+				partidParam, placeidParam, descriptionParam, visibilityParam,
+				{Name: "ics", In: "query", Type: "string", Description: "iCalendar document"},
+				{Name: "minlength", In: "query", Type: "integer", Description: "shortest free window in seconds, default 3600"},
+				{Name: "dryrun", In: "query", Type: "boolean", Description: "only return the availabilities that would be created"}},
+				periodParams...),
+			Response: []*APIAvailability{}},
+		append([]string{
+			"SELECT ownerid FROM participant WHERE id = ?",
+			"SELECT id, name, lat, long, radius, capacity, category FROM place WHERE id = ?",
+			"SELECT id, alias, description FROM participant WHERE id = ?"},
+			createAvailabilityQueries...),
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			if strings.HasPrefix(ctx.request.Header.Get("Content-Type"), "multipart/") {
+				// room for the other form values of the upload
+				ctx.request.Body = http.MaxBytesReader(w, ctx.request.Body, 2*maxICSSize)
+				if err := ctx.request.ParseMultipartForm(maxICSSize); err != nil {
+					return uploadError(err)
+				}
+			}
+			form := ctx.request.Form
+			partid, err := formParticipant(ctx, stmts[0], "partid")
+			if err != nil {
+				return err
+			}
+			placeid, err := getFormInt(form, "placeid")
+			if err != nil {
+				return err
+			}
+			window, err := GetPeriod(ctx)
+			if err != nil {
+				return err
+			}
+			minLength := 3600
+			if _, ok := form["minlength"]; ok {
+				n, err := getFormInt(form, "minlength")
+				if err != nil {
+					return err
+				}
+				minLength = int(n)
+			}
+			description := form.Get("description")
+			visibility, err := getFormVisibility(ctx, VisibilityPublic)
+			if err != nil {
+				return err
+			}
+			dryRun := form.Get("dryrun") == "1" || form.Get("dryrun") == "true"
+
+			data, err := readICSUpload(ctx.request)
+			if err != nil {
+				return err
+			}
+			busy, err := parseBusy(data, *window)
+			if err != nil {
+				return err
+			}
+			free := freeWindows(*window, busy, minLength)
+			if len(free) > maxImportedWindows {
+				return fmt.Errorf("too many free windows: %d", len(free))
+			}
+
+			if dryRun {
+				a := Availability{Description: description, Visibility: visibility, Owner: ctx.userid}
+				if err := stmts[1].QueryRow(placeid).Scan(a.Place.BasicFields()...); err != nil {
+					return err
+				}
+				if err := stmts[2].QueryRow(partid).Scan(a.Participant.BasicFields()...); err != nil {
+					return err
+				}
+				items := make([]*Availability, len(free))
+				for i, p := range free {
+					items[i] = a.occurrence(p).(*Availability)
+				}
+				return writeAvailabilities(w, items)
+			}
+
+			items, err := createAvailabilities(ctx, stmts[3:], partid, placeid, description, visibility, free)
+			if err != nil {
+				return err
+			}
+			return writeAvailabilities(w, items)
+		})
+}
+
+func writeAvailabilities(w http.ResponseWriter, availabilities []*Availability) error {
+	items, err := Uniplex(queueBufferSize,
+		func(out chan<- interface{}) error {
+			for _, a := range availabilities {
+				out <- a
+			}
+			return nil
+		})
+
+	if err != nil {
+		return err
+	}
+
+	WriteChannelAsJSONList(w, items)
+	return nil
+}
@@ -0,0 +1,220 @@
+package tbeer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// Monday 2021-01-04 00:00 UTC
+const freeBusyDay = 1609718400
+
+const freeBusyCalendar = "BEGIN:VCALENDAR\r\n" +
+	"VERSION:2.0\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:standup\r\n" +
+	"DTSTART;TZID=Europe/Oslo:20210104T100000\r\n" +
+	"DURATION:PT30M\r\n" +
+	"RRULE:FREQ=DAILY;COUNT=3\r\n" +
+	"EXDATE;TZID=Europe/Oslo:20210105T100000\r\n" +
+	"END:VEVENT\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:lunch\r\n" +
+	"DTSTART:20210104T110000Z\r\n" +
+	"DTEND:20210104T120000Z\r\n" +
+	"TRANSP:TRANSPARENT\r\n" +
+	"END:VEVENT\r\n" +
+	"BEGIN:VFREEBUSY\r\n" +
+	"FREEBUSY:20210104T130000Z/PT2H,\r\n" +
+	" 20210104T140000Z/20210104T160000Z\r\n" +
+	"FREEBUSY;FBTYPE=FREE:20210104T170000Z/PT1H\r\n" +
+	"END:VFREEBUSY\r\n" +
+	"END:VCALENDAR\r\n"
+
+func TestParseBusy(t *testing.T) {
+	const h = 3600
+	window := Period{Start: freeBusyDay, End: freeBusyDay + 3*24*h}
+	busy, err := parseBusy(freeBusyCalendar, window)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// standup at 09:00 UTC on the 4th and 6th, and the free/busy periods
+	expected := []Period{
+		{Start: freeBusyDay + 9*h, End: freeBusyDay + 9*h + 1800},
+		{Start: freeBusyDay + 2*24*h + 9*h, End: freeBusyDay + 2*24*h + 9*h + 1800},
+		{Start: freeBusyDay + 13*h, End: freeBusyDay + 15*h},
+		{Start: freeBusyDay + 14*h, End: freeBusyDay + 16*h}}
+	if len(busy) != len(expected) {
+		t.Fatalf("busy %+v, expected %+v", busy, expected)
+	}
+	for i, p := range expected {
+		if busy[i].Start != p.Start || busy[i].End != p.End {
+			t.Errorf("busy %d is %+v, expected %+v", i, busy[i], p)
+		}
+	}
+
+	if _, err := parseBusy("BEGIN:VEVENT\nDTSTART:tomorrow\nEND:VEVENT\n", window); err == nil {
+		t.Error("accepted a bad DTSTART")
+	}
+	if _, err := parseBusy("no colon here", window); err == nil {
+		t.Error("accepted a line without a value")
+	}
+
+	// as exported by Outlook and Google, with a reminder in the event
+	alarm := "BEGIN:VCALENDAR\r\n" +
+		"BEGIN:VEVENT\r\n" +
+		"DTSTART:20210104T090000Z\r\n" +
+		"BEGIN:VALARM\r\n" +
+		"ACTION:DISPLAY\r\n" +
+		"TRIGGER:-PT15M\r\n" +
+		"DURATION:PT5M\r\n" +
+		"END:VALARM\r\n" +
+		"DTEND:20210104T100000Z\r\n" +
+		"END:VEVENT\r\n" +
+		"END:VCALENDAR\r\n"
+	busy, err = parseBusy(alarm, window)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(busy) != 1 || busy[0].Start != freeBusyDay+9*h || busy[0].End != freeBusyDay+10*h {
+		t.Errorf("unexpected busy time of an event with an alarm %+v", busy)
+	}
+	if _, err := parseBusy("BEGIN:VEVENT\nBEGIN:VALARM\nEND:VEVENT\n", window); err == nil {
+		t.Error("accepted an unterminated component")
+	}
+}
+
+func TestFreeWindows(t *testing.T) {
+	window := Period{Start: 0, End: 100}
+	busy := []Period{{Start: 50, End: 60}, {Start: -10, End: 10}, {Start: 55, End: 70}, {Start: 95, End: 200}}
+	free := freeWindows(window, busy, 10)
+	expected := []Period{{Start: 10, End: 50}, {Start: 70, End: 95}}
+	if len(free) != len(expected) {
+		t.Fatalf("free %+v, expected %+v", free, expected)
+	}
+	for i, p := range expected {
+		if free[i] != p {
+			t.Errorf("free %d is %+v, expected %+v", i, free[i], p)
+		}
+	}
+	if free := freeWindows(window, busy, 30); len(free) != 1 || free[0].End != 50 {
+		t.Errorf("minimum length not applied: %+v", free)
+	}
+}
+
+func TestFreeBusyImport(t *testing.T) {
+	app := OpenTestEnv()
+	defer CloseTestEnv(app)
+	serv := httptest.NewServer(app)
+	defer serv.Close()
+
+	res, err := app.DB.Exec("INSERT INTO participant (ownerid, alias, description) VALUES (1, 'importer', '')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	partid, _ := res.LastInsertId()
+	defer app.DB.Exec("DELETE FROM participant WHERE id = ?", partid)
+
+	// the working day of the 4th: busy 09:00-09:30 and 13:00-16:00
+	query := url.Values{
+		"partid":      {fmt.Sprint(partid)},
+		"placeid":     {"1"},
+		"description": {"free for a beer"},
+		"start":       {fmt.Sprint(freeBusyDay + 8*3600)},
+		"end":         {fmt.Sprint(freeBusyDay + 18*3600)}}
+
+	postCalendar := func(query url.Values, calendar string) (int, []APIAvailability) {
+		res, err := http.Post(serv.URL+"/api/freebusy?"+query.Encode(), "text/calendar",
+			strings.NewReader(calendar))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var items []APIAvailability
+		if res.StatusCode == 200 {
+			if err := json.NewDecoder(res.Body).Decode(&items); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return res.StatusCode, items
+	}
+	post := func(query url.Values) (int, []APIAvailability) {
+		return postCalendar(query, freeBusyCalendar)
+	}
+
+	count := func() (n int) {
+		app.DB.QueryRow("SELECT count(*) FROM availability WHERE partid = ?", partid).Scan(&n)
+		return
+	}
+
+	query.Set("dryrun", "1")
+	status, items := post(query)
+	if status != 200 || len(items) != 3 {
+		t.Fatalf("dry run: status %d, %+v", status, items)
+	}
+	if items[0].Id != 0 || items[0].Period.Start != freeBusyDay+8*3600 || items[0].Period.End != freeBusyDay+9*3600 {
+		t.Errorf("unexpected first window %+v", items[0])
+	}
+	if n := count(); n != 0 {
+		t.Errorf("dry run created %d availabilities", n)
+	}
+
+	query.Del("dryrun")
+	query.Set("minlength", "7200")
+	status, items = post(query)
+	if status != 200 || len(items) != 2 {
+		t.Fatalf("import: status %d, %+v", status, items)
+	}
+	for _, a := range items {
+		defer app.DB.Exec("DELETE FROM availability WHERE id = ?", a.Id)
+		if a.Id == 0 || a.Description != "free for a beer" {
+			t.Errorf("unexpected imported availability %+v", a)
+		}
+	}
+	if n := count(); n != 2 {
+		t.Errorf("import created %d availabilities, expected 2", n)
+	}
+
+	// large calendars are refused rather than cut
+	large := freeBusyCalendar + strings.Repeat("X-PADDING:"+strings.Repeat("x", 60)+"\r\n", maxICSSize/70+1)
+	if status, _ := postCalendar(query, large); status != http.StatusRequestEntityTooLarge {
+		t.Errorf("large calendar: status %d", status)
+	}
+
+	for _, size := range []int{maxICSSize + 1, 3 * maxICSSize} {
+		body := &bytes.Buffer{}
+		mw := multipart.NewWriter(body)
+		fw, _ := mw.CreateFormFile("file", "calendar.ics")
+		fw.Write([]byte(freeBusyCalendar))
+		fw.Write(bytes.Repeat([]byte(" "), size))
+		mw.Close()
+		res, err := http.Post(serv.URL+"/api/freebusy?"+query.Encode(), mw.FormDataContentType(), body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusRequestEntityTooLarge {
+			t.Errorf("upload of %d bytes: status %d", size, res.StatusCode)
+		}
+	}
+
+	query.Set("placeid", "999999")
+	if status, _ := post(query); status == 200 {
+		t.Error("imported at a place that does not exist")
+	}
+	if n := count(); n != 2 {
+		t.Errorf("%d availabilities after failed imports, expected 2", n)
+	}
+
+	query.Set("placeid", "1")
+	query.Set("partid", "2")
+	if status, _ := post(query); status == 200 {
+		t.Error("imported into a participant owned by another user")
+	}
+}
@@ -0,0 +1,246 @@
+package tbeer
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Visibility levels of availabilities and meetings,
+// stored in the visibility column
+const (
+	VisibilityPublic           = 0
+	VisibilityFriends          = 1
+	VisibilityFriendsOfFriends = 2
+	VisibilityPrivate          = 3
+)
+
+var visibilityNames = []string{"public", "friends", "friends-of-friends", "private"}
+
+var visibilityParam = RouteParam{
+	Name: "visibility", In: "query", Type: "string",
+	Description: strings.Join(visibilityNames, ", ") + ". public if omitted"}
+
+func visibilityName(v int) string {
+	if v < 0 || v >= len(visibilityNames) {
+		return ""
+	}
+	return visibilityNames[v]
+}
+
+// Read the visibility form value, or def if not present
+func getFormVisibility(ctx *DispatchContext, def int) (int, error) {
+	if _, ok := ctx.request.Form["visibility"]; !ok {
+		return def, nil
+	}
+	name := ctx.request.Form.Get("visibility")
+	for v, n := range visibilityNames {
+		if n == name {
+			return v, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown visibility: %s", name)
+}
+
+// SQL condition that is true when the row of the given table alias, which
+// has ownerid and visibility columns, is visible to a viewer.
+// Must be followed by visibilityArgs(viewer) in the query arguments.
+func visibleTo(alias string) string {
+	friendsOf := "SELECT otherid FROM friendship WHERE userid = ? AND state = 'friends'"
+	return "((" +
+		alias + ".ownerid = ? OR " +
+		alias + ".visibility = " + fmt.Sprint(VisibilityPublic) + " OR " +
+		"(" + alias + ".visibility IN (" + fmt.Sprint(VisibilityFriends, ", ", VisibilityFriendsOfFriends) + ") AND " +
+		alias + ".ownerid IN (" + friendsOf + ")) OR " +
+		"(" + alias + ".visibility = " + fmt.Sprint(VisibilityFriendsOfFriends) + " AND " +
+		alias + ".ownerid IN (SELECT f.otherid FROM friendship AS f WHERE f.state = 'friends' AND f.userid IN (" + friendsOf + ")))" +
+		") AND " +
+		alias + ".ownerid NOT IN (SELECT userid FROM friendship WHERE otherid = ? AND state = 'blocked'))"
+}
+
+// Arguments of the condition returned by visibleTo
+func visibilityArgs(viewer int64) []interface{} {
+	return []interface{}{viewer, viewer, viewer, viewer}
+}
+
+// Query whether an item with an owner and visibility is visible to a
+// viewer. Arguments are owner, visibility, visibilityArgs(viewer)...
+var visibilityQuery = "SELECT count(*) FROM (SELECT ? AS ownerid, ? AS visibility) AS item WHERE " +
+	visibleTo("item")
+
+func canSee(stmt *sql.Stmt, viewer int64, owner int64, visibility int) (bool, error) {
+	var count int
+	args := append([]interface{}{owner, visibility}, visibilityArgs(viewer)...)
+	if err := stmt.QueryRow(args...).Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func (app *App) initFriendHandlers() {
+	app.installStmtRestHandler("friends",
+		&RouteDoc{
+			Summary:  "friends, blocked users and pending requests of the user",
+			Response: []*APIFriendship{}},
+		[]string{
+			"SELECT friendship.otherid, user.alias, friendship.state, 0 " +
+				"FROM friendship, user " +
+				"WHERE friendship.userid = ? AND friendship.otherid = user.id " +
+				"UNION ALL " +
+				"SELECT friendship.userid, user.alias, friendship.state, 1 " +
+				"FROM friendship, user " +
+				"WHERE friendship.otherid = ? AND friendship.state = 'requested' AND friendship.userid = user.id"},
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			items, err := Uniplex(queueBufferSize,
+				func(out chan<- interface{}) error {
+					rows, err := stmts[0].Query(ctx.userid, ctx.userid)
+					if err != nil {
+						return err
+					}
+					for rows.Next() {
+						f := &APIFriendship{}
+						if err := rows.Scan(&f.User, &f.Alias, &f.State, &f.Incoming); err != nil {
+							out <- err
+						} else {
+							out <- f
+						}
+					}
+					return nil
+				})
+			if err != nil {
+				return err
+			}
+			WriteChannelAsJSONList(w, items)
+			return nil
+		})
+
+	// statements shared by the handlers changing a friendship
+	friendshipQueries := []string{
+		"SELECT state FROM friendship WHERE userid = ? AND otherid = ?",
+		"INSERT OR REPLACE INTO friendship (userid, otherid, state) VALUES (?, ?, ?)",
+		"DELETE FROM friendship WHERE userid = ? AND otherid = ?",
+		"SELECT count(*) FROM user WHERE id = ?"}
+
+	// state of the relation from one user to another, "" if none
+	friendshipState := func(tx *sql.Tx, stmts []*sql.Stmt, from int64, to int64) (string, error) {
+		var state string
+		err := tx.Stmt(stmts[0]).QueryRow(from, to).Scan(&state)
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+		return state, err
+	}
+
+	// get the other user from the path and check that it exists
+	otherUser := func(ctx *DispatchContext, stmts []*sql.Stmt) (int64, error) {
+		other := ctx.IntParam("id")
+		if other == ctx.userid {
+			return 0, errors.New("that's you")
+		}
+		var count int
+		if err := stmts[3].QueryRow(other).Scan(&count); err != nil || count == 0 {
+			return 0, fmt.Errorf("no such user: %d", other)
+		}
+		return other, nil
+	}
+
+	app.installStmtRestMethodHandler("POST", "friends/:id",
+		&RouteDoc{
+			Summary:  "send a friend request, or accept one from the other user",
+			Response: &APIFriendship{}},
+		friendshipQueries,
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			other, err := otherUser(ctx, stmts)
+			if err != nil {
+				return err
+			}
+			f := &APIFriendship{User: other}
+			err = ctx.app.inTransaction(func(tx *sql.Tx) error {
+				mine, err := friendshipState(tx, stmts, ctx.userid, other)
+				if err != nil {
+					return err
+				}
+				theirs, err := friendshipState(tx, stmts, other, ctx.userid)
+				if err != nil {
+					return err
+				}
+				switch {
+				case theirs == "blocked" || mine == "blocked":
+					return errors.New("can't befriend a blocked user")
+				case theirs == "requested" || theirs == "friends":
+					f.State = "friends"
+					if _, err := tx.Stmt(stmts[1]).Exec(other, ctx.userid, f.State); err != nil {
+						return err
+					}
+				default:
+					f.State = "requested"
+				}
+				_, err = tx.Stmt(stmts[1]).Exec(ctx.userid, other, f.State)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			return writeJSON(w, f)
+		})
+
+	app.installStmtRestMethodHandler("DELETE", "friends/:id",
+		&RouteDoc{
+			Summary:  "unfriend, unblock, or cancel or decline a friend request",
+			Response: int64(0)},
+		friendshipQueries,
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			other, err := otherUser(ctx, stmts)
+			if err != nil {
+				return err
+			}
+			err = ctx.app.inTransaction(func(tx *sql.Tx) error {
+				theirs, err := friendshipState(tx, stmts, other, ctx.userid)
+				if err != nil {
+					return err
+				}
+				if theirs != "blocked" {
+					if _, err := tx.Stmt(stmts[2]).Exec(other, ctx.userid); err != nil {
+						return err
+					}
+				}
+				_, err = tx.Stmt(stmts[2]).Exec(ctx.userid, other)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			return writeJSON(w, other)
+		})
+
+	app.installStmtRestMethodHandler("POST", "friends/:id/block",
+		&RouteDoc{
+			Summary:  "block a user, ending any friendship",
+			Response: &APIFriendship{}},
+		friendshipQueries,
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			other, err := otherUser(ctx, stmts)
+			if err != nil {
+				return err
+			}
+			err = ctx.app.inTransaction(func(tx *sql.Tx) error {
+				theirs, err := friendshipState(tx, stmts, other, ctx.userid)
+				if err != nil {
+					return err
+				}
+				if theirs != "blocked" {
+					if _, err := tx.Stmt(stmts[2]).Exec(other, ctx.userid); err != nil {
+						return err
+					}
+				}
+				_, err = tx.Stmt(stmts[1]).Exec(ctx.userid, other, "blocked")
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			return writeJSON(w, &APIFriendship{User: other, State: "blocked"})
+		})
+}
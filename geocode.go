@@ -0,0 +1,521 @@
+package tbeer
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Types of place addresses
+const (
+	// street name and number
+	AddressStreet = iota
+	AddressPostcode
+	// city, town or village
+	AddressLocality
+	// state, county or the like
+	AddressRegion
+	AddressCountry
+)
+
+// Most results returned for a lookup
+const maxGeoResults = 5
+
+// Radius in meters of places added without one
+const defaultPlaceRadius = 25
+
+// A position found by a geocoder, with what is known of its address
+type GeoResult struct {
+	Name    string
+	Lat     float64
+	Long    float64
+	Address []*Address
+}
+
+// Looks up positions of addresses, and addresses of positions
+type Geocoder interface {
+	Geocode(query string) ([]*GeoResult, error)
+	Reverse(lat, long float64) ([]*GeoResult, error)
+}
+
+// Google Geocoding API, with the bundled gazetteer as fallback,
+// or only the gazetteer when there is no api key
+func NewGeocoder(env *Env) Geocoder {
+	file := env.GazetteerFile
+	if file == "" {
+		file = defaultGazetteerFile
+	}
+	gazetteer := NewGazetteerFile(file)
+	if env.GoogleAPIKey == "" {
+		return gazetteer
+	}
+	return FallbackGeocoder{NewGoogleGeocoder(env.GoogleAPIKey), gazetteer}
+}
+
+// Geocoder asking each geocoder in turn until one does not fail
+type FallbackGeocoder []Geocoder
+
+func (f FallbackGeocoder) Geocode(query string) ([]*GeoResult, error) {
+	return f.first(func(g Geocoder) ([]*GeoResult, error) { return g.Geocode(query) })
+}
+
+func (f FallbackGeocoder) Reverse(lat, long float64) ([]*GeoResult, error) {
+	return f.first(func(g Geocoder) ([]*GeoResult, error) { return g.Reverse(lat, long) })
+}
+
+func (f FallbackGeocoder) first(lookup func(Geocoder) ([]*GeoResult, error)) ([]*GeoResult, error) {
+	err := errors.New("no geocoder")
+	for _, g := range f {
+		var results []*GeoResult
+		if results, err = lookup(g); err == nil {
+			return results, nil
+		}
+		log.Printf("geocoder failed: %v", err)
+	}
+	return nil, err
+}
+
+const googleGeocodeURL = "https://maps.googleapis.com/maps/api/geocode/json"
+
+// Google Geocoding API client
+type GoogleGeocoder struct {
+	Key string
+	// the geocoding endpoint, replaced in tests
+	URL    string
+	Client *http.Client
+}
+
+func NewGoogleGeocoder(key string) *GoogleGeocoder {
+	return &GoogleGeocoder{Key: key, URL: googleGeocodeURL, Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+type googleGeocodeResponse struct {
+	Status       string `json:"status"`
+	ErrorMessage string `json:"error_message"`
+	Results      []struct {
+		FormattedAddress string `json:"formatted_address"`
+		Geometry         struct {
+			Location struct {
+				Lat float64 `json:"lat"`
+				Lng float64 `json:"lng"`
+			} `json:"location"`
+		} `json:"geometry"`
+		AddressComponents []struct {
+			LongName string   `json:"long_name"`
+			Types    []string `json:"types"`
+		} `json:"address_components"`
+	} `json:"results"`
+}
+
+// Address types of the Google address component types
+var googleAddressTypes = map[string]int{
+	"postal_code":                 AddressPostcode,
+	"postal_town":                 AddressLocality,
+	"locality":                    AddressLocality,
+	"administrative_area_level_1": AddressRegion,
+	"country":                     AddressCountry,
+}
+
+func (g *GoogleGeocoder) Geocode(query string) ([]*GeoResult, error) {
+	return g.lookup(url.Values{"address": {query}})
+}
+
+func (g *GoogleGeocoder) Reverse(lat, long float64) ([]*GeoResult, error) {
+	return g.lookup(url.Values{"latlng": {strconv.FormatFloat(lat, 'f', -1, 64) + "," +
+		strconv.FormatFloat(long, 'f', -1, 64)}})
+}
+
+func (g *GoogleGeocoder) lookup(params url.Values) ([]*GeoResult, error) {
+	params.Set("key", g.Key)
+	res, err := g.Client.Get(g.URL + "?" + params.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("google geocoding: %s", res.Status)
+	}
+	var body googleGeocodeResponse
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	switch body.Status {
+	case "OK":
+	case "ZERO_RESULTS":
+		return []*GeoResult{}, nil
+	default:
+		return nil, fmt.Errorf("google geocoding: %s %s", body.Status, body.ErrorMessage)
+	}
+
+	results := make([]*GeoResult, 0, len(body.Results))
+	for _, r := range body.Results {
+		result := &GeoResult{
+			Name: r.FormattedAddress,
+			Lat:  r.Geometry.Location.Lat,
+			Long: r.Geometry.Location.Lng,
+		}
+		var route, number string
+		for _, c := range r.AddressComponents {
+			for _, t := range c.Types {
+				switch t {
+				case "route":
+					route = c.LongName
+				case "street_number":
+					number = c.LongName
+				}
+				if typ, ok := googleAddressTypes[t]; ok && !result.hasAddress(typ) {
+					result.Address = append(result.Address, &Address{typ, c.LongName})
+				}
+			}
+		}
+		if route != "" {
+			street := &Address{AddressStreet, strings.TrimSpace(route + " " + number)}
+			result.Address = append([]*Address{street}, result.Address...)
+		}
+		results = append(results, result)
+		if len(results) == maxGeoResults {
+			break
+		}
+	}
+	return results, nil
+}
+
+func (r *GeoResult) hasAddress(typ int) bool {
+	for _, a := range r.Address {
+		if a.Type == typ {
+			return true
+		}
+	}
+	return false
+}
+
+const defaultGazetteerFile = "./data/gazetteer.tsv"
+
+// Farthest a position may be from a gazetteer entry to be reverse
+// geocoded to it, in meters
+const gazetteerReach = 30000
+
+type gazetteerEntry struct {
+	name    string
+	lat     float64
+	long    float64
+	region  string
+	country string
+}
+
+func (e *gazetteerEntry) result() *GeoResult {
+	r := &GeoResult{Name: e.name, Lat: e.lat, Long: e.long,
+		Address: []*Address{{AddressLocality, e.name}}}
+	if e.region != "" {
+		r.Address = append(r.Address, &Address{AddressRegion, e.region})
+	}
+	if e.country != "" {
+		r.Name += ", " + e.country
+		r.Address = append(r.Address, &Address{AddressCountry, e.country})
+	}
+	return r
+}
+
+// Offline geocoder knowing the positions of towns, read from a tab
+// separated file of name, latitude, longitude, region and country
+type Gazetteer struct {
+	file    string
+	once    sync.Once
+	entries []*gazetteerEntry
+	err     error
+}
+
+// Gazetteer read from file when first used
+func NewGazetteerFile(file string) *Gazetteer {
+	return &Gazetteer{file: file}
+}
+
+func ReadGazetteer(r io.Reader) (*Gazetteer, error) {
+	g := &Gazetteer{}
+	g.once.Do(func() { g.entries, g.err = readGazetteerEntries(r) })
+	return g, g.err
+}
+
+func readGazetteerEntries(r io.Reader) ([]*gazetteerEntry, error) {
+	entries := make([]*gazetteerEntry, 0)
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("gazetteer line %d: expected name, lat and long", n)
+		}
+		e := &gazetteerEntry{name: fields[0]}
+		var err error
+		if e.lat, err = strconv.ParseFloat(fields[1], 64); err != nil {
+			return nil, fmt.Errorf("gazetteer line %d: %v", n, err)
+		}
+		if e.long, err = strconv.ParseFloat(fields[2], 64); err != nil {
+			return nil, fmt.Errorf("gazetteer line %d: %v", n, err)
+		}
+		if len(fields) > 3 {
+			e.region = fields[3]
+		}
+		if len(fields) > 4 {
+			e.country = fields[4]
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+func (g *Gazetteer) load() ([]*gazetteerEntry, error) {
+	g.once.Do(func() {
+		f, err := os.Open(g.file)
+		if err != nil {
+			g.err = err
+			return
+		}
+		defer f.Close()
+		g.entries, g.err = readGazetteerEntries(f)
+	})
+	return g.entries, g.err
+}
+
+// Towns named in the query, or whose name starts with it
+func (g *Gazetteer) Geocode(query string) ([]*GeoResult, error) {
+	entries, err := g.load()
+	if err != nil {
+		return nil, err
+	}
+	q := strings.ToLower(strings.TrimSpace(query))
+	words := strings.FieldsFunc(q, func(r rune) bool { return r == ',' || r == ' ' })
+	type match struct {
+		e     *gazetteerEntry
+		score int
+	}
+	matches := make([]match, 0)
+	for _, e := range entries {
+		name := strings.ToLower(e.name)
+		switch {
+		case q == "":
+		case name == q:
+			matches = append(matches, match{e, 0})
+		case contains(words, name) || strings.Contains(q, name+","):
+			matches = append(matches, match{e, 1})
+		case strings.HasPrefix(name, q):
+			matches = append(matches, match{e, 2})
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].score < matches[j].score })
+	results := make([]*GeoResult, 0)
+	for i := 0; i < len(matches) && i < maxGeoResults; i++ {
+		results = append(results, matches[i].e.result())
+	}
+	return results, nil
+}
+
+// The nearest town within gazetteerReach
+func (g *Gazetteer) Reverse(lat, long float64) ([]*GeoResult, error) {
+	entries, err := g.load()
+	if err != nil {
+		return nil, err
+	}
+	var nearest *gazetteerEntry
+	best := math.Inf(1)
+	for _, e := range entries {
+		if d := distance(lat, long, e.lat, e.long); d < best {
+			nearest, best = e, d
+		}
+	}
+	if nearest == nil || best > gazetteerReach {
+		return []*GeoResult{}, nil
+	}
+	return []*GeoResult{nearest.result()}, nil
+}
+
+func writeGeoResults(w http.ResponseWriter, results []*GeoResult) error {
+	items, err := Uniplex(queueBufferSize,
+		func(out chan<- interface{}) error {
+			for _, r := range results {
+				out <- r
+			}
+			return nil
+		})
+
+	if err != nil {
+		return err
+	}
+
+	WriteChannelAsJSONList(w, items)
+	return nil
+}
+
+// The address at a position, for a new place. Lookup failures only
+// mean the place gets no address.
+func reverseGeocodeAddress(g Geocoder, lat, long float64) []*Address {
+	results, err := g.Reverse(lat, long)
+	if err != nil {
+		log.Printf("geocoding place: %v", err)
+		return nil
+	}
+	if len(results) == 0 {
+		return nil
+	}
+	return results[0].Address
+}
+
+func (app *App) initGeocodeHandlers() {
+	app.installStmtRestHandler("geocode",
+		&RouteDoc{
+			Summary: "positions of an address or place name",
+			Params: []RouteParam{
+				{Name: "q", In: "query", Type: "string", Required: true}},
+			Response: []*APIGeoResult{}},
+		[]string{},
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			q, err := getFormString(ctx.request.Form, "q")
+			if err != nil {
+				return err
+			}
+			results, err := ctx.app.Geocoder.Geocode(q)
+			if err != nil {
+				return err
+			}
+			return writeGeoResults(w, results)
+		})
+
+	app.installStmtRestHandler("reverse",
+		&RouteDoc{
+			Summary: "addresses at a position",
+			Params: []RouteParam{
+				{Name: "lat", In: "query", Type: "number", Required: true},
+				{Name: "long", In: "query", Type: "number", Required: true}},
+			Response: []*APIGeoResult{}},
+		[]string{},
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			lat, err := getFormFloat(ctx.request.Form, "lat")
+			if err != nil {
+				return err
+			}
+			long, err := getFormFloat(ctx.request.Form, "long")
+			if err != nil {
+				return err
+			}
+			if err := checkPosition(lat, long); err != nil {
+				return err
+			}
+			results, err := ctx.app.Geocoder.Reverse(lat, long)
+			if err != nil {
+				return err
+			}
+			return writeGeoResults(w, results)
+		})
+
+	app.installStmtRestMethodHandler("POST", "places",
+		&RouteDoc{
+			Summary: "add a place, at a position or at a geocoded address. " +
+				"Its address is filled in by geocoding",
+			Params: []RouteParam{
+				{Name: "name", In: "query", Type: "string", Required: true},
+				{Name: "q", In: "query", Type: "string", Description: "address to place it at, instead of lat and long"},
+				{Name: "lat", In: "query", Type: "number"},
+				{Name: "long", In: "query", Type: "number"},
+				{Name: "radius", In: "query", Type: "integer", Description: "in meters, 25 by default"},
+				{Name: "category", In: "query", Type: "string", Description: "one of " + strings.Join(placeCategories, ", ")}},
+			Response: &APIPlace{}},
+		append([]string{
+			"INSERT INTO place (name, lat, long, radius, category) VALUES (?, ?, ?, ?, ?)",
+			"INSERT INTO address (type, value) VALUES (?, ?)",
+			"INSERT INTO place_address (placeid, addressid) VALUES (?, ?)"},
+			placeDetailQueries...),
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			form := ctx.request.Form
+			name, err := getFormString(form, "name")
+			if err != nil {
+				return err
+			}
+			if name = strings.TrimSpace(name); name == "" {
+				return errors.New("a place needs a name")
+			}
+			category := form.Get("category")
+			if category != "" && !contains(placeCategories, category) {
+				return fmt.Errorf("unknown category: %s", category)
+			}
+			radius := defaultPlaceRadius
+			if _, ok := form["radius"]; ok {
+				if radius, err = strconv.Atoi(form.Get("radius")); err != nil || radius <= 0 {
+					return errors.New("radius must be a positive number of meters")
+				}
+			}
+
+			var lat, long float64
+			var address []*Address
+			if q := strings.TrimSpace(form.Get("q")); q != "" {
+				results, err := ctx.app.Geocoder.Geocode(q)
+				if err != nil {
+					return err
+				}
+				if len(results) == 0 {
+					return fmt.Errorf("address not found: %s", q)
+				}
+				lat, long, address = results[0].Lat, results[0].Long, results[0].Address
+			} else {
+				if lat, err = getFormFloat(form, "lat"); err != nil {
+					return err
+				}
+				if long, err = getFormFloat(form, "long"); err != nil {
+					return err
+				}
+				if err = checkPosition(lat, long); err != nil {
+					return err
+				}
+				address = reverseGeocodeAddress(ctx.app.Geocoder, lat, long)
+			}
+
+			var id int64
+			err = ctx.app.inTransaction(func(tx *sql.Tx) error {
+				res, err := tx.Stmt(stmts[0]).Exec(name, lat, long, radius, category)
+				if err != nil {
+					return err
+				}
+				if id, err = res.LastInsertId(); err != nil {
+					return err
+				}
+				for _, a := range address {
+					res, err := tx.Stmt(stmts[1]).Exec(a.Type, a.Value)
+					if err != nil {
+						return err
+					}
+					addrid, err := res.LastInsertId()
+					if err != nil {
+						return err
+					}
+					if _, err := tx.Stmt(stmts[2]).Exec(id, addrid); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			place, err := loadPlace(stmts[3:], id)
+			if err != nil {
+				return err
+			}
+			return writeJSON(w, place)
+		})
+}
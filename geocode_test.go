@@ -0,0 +1,219 @@
+package tbeer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+const fakeGoogleResult = `{
+	"status": "OK",
+	"results": [{
+		"formatted_address": "Thorvald Meyers gate 30, 0555 Oslo, Norway",
+		"geometry": {"location": {"lat": 59.9225, "lng": 10.7590}},
+		"address_components": [
+			{"long_name": "30", "types": ["street_number"]},
+			{"long_name": "Thorvald Meyers gate", "types": ["route"]},
+			{"long_name": "Grünerløkka", "types": ["sublocality", "political"]},
+			{"long_name": "Oslo", "types": ["locality", "political"]},
+			{"long_name": "Oslo", "types": ["administrative_area_level_1", "political"]},
+			{"long_name": "Norway", "types": ["country", "political"]},
+			{"long_name": "0555", "types": ["postal_code"]}
+		]
+	}]
+}`
+
+// Fake of the Google Geocoding API knowing a single address
+func fakeGoogleGeocoder(t *testing.T) (*GoogleGeocoder, *httptest.Server) {
+	serv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		switch {
+		case q.Get("key") != "test-key":
+			fmt.Fprint(w, `{"status": "REQUEST_DENIED", "error_message": "The provided API key is invalid."}`)
+		case strings.Contains(q.Get("address"), "Thorvald Meyers") || q.Get("latlng") == "59.9225,10.759":
+			fmt.Fprint(w, fakeGoogleResult)
+		default:
+			fmt.Fprint(w, `{"status": "ZERO_RESULTS", "results": []}`)
+		}
+	}))
+	g := NewGoogleGeocoder("test-key")
+	g.URL = serv.URL
+	return g, serv
+}
+
+func TestGoogleGeocoder(t *testing.T) {
+	g, serv := fakeGoogleGeocoder(t)
+	defer serv.Close()
+
+	results, err := g.Geocode("Thorvald Meyers gate 30, Oslo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Lat != 59.9225 || results[0].Long != 10.759 {
+		t.Fatalf("unexpected results %+v", results)
+	}
+	expected := []Address{
+		{AddressStreet, "Thorvald Meyers gate 30"},
+		{AddressLocality, "Oslo"},
+		{AddressRegion, "Oslo"},
+		{AddressCountry, "Norway"},
+		{AddressPostcode, "0555"},
+	}
+	if len(results[0].Address) != len(expected) {
+		t.Fatalf("unexpected address %+v", results[0].Address)
+	}
+	for i, a := range results[0].Address {
+		if *a != expected[i] {
+			t.Errorf("address %d is %+v, expected %+v", i, *a, expected[i])
+		}
+	}
+
+	if results, err := g.Reverse(59.9225, 10.759); err != nil || len(results) != 1 {
+		t.Errorf("reverse: %v, %+v", err, results)
+	}
+	if results, err := g.Geocode("nowhere at all"); err != nil || len(results) != 0 {
+		t.Errorf("unknown address: %v, %+v", err, results)
+	}
+
+	g.Key = "wrong"
+	if _, err := g.Geocode("Thorvald Meyers gate 30"); err == nil || !strings.Contains(err.Error(), "REQUEST_DENIED") {
+		t.Errorf("expected denied request, got %v", err)
+	}
+	gazetteer, err := ReadGazetteer(strings.NewReader("Oslo\t59.9139\t10.7522\tOslo\tNorway\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results, err := (FallbackGeocoder{g, gazetteer}).Reverse(59.9225, 10.759); err != nil ||
+		len(results) != 1 || results[0].Name != "Oslo, Norway" {
+		t.Errorf("fallback: %v, %+v", err, results)
+	}
+}
+
+func TestGazetteer(t *testing.T) {
+	g, err := ReadGazetteer(strings.NewReader(
+		"# name, lat, long, region, country\n" +
+			"Bergen\t60.3913\t5.3221\tVestland\tNorway\n" +
+			"Berlin\t52.5200\t13.4050\tBerlin\tGermany\n" +
+			"Oslo\t59.9139\t10.7522\tOslo\tNorway\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := func(results []*GeoResult, err error) string {
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := make([]string, len(results))
+		for i, r := range results {
+			n[i] = r.Name
+		}
+		return strings.Join(n, "; ")
+	}
+	tests := []struct{ query, expected string }{
+		{"oslo", "Oslo, Norway"},
+		{"Thorvald Meyers gate 30, Oslo", "Oslo, Norway"},
+		{"ber", "Bergen, Norway; Berlin, Germany"},
+		{"Springfield", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if found := names(g.Geocode(test.query)); found != test.expected {
+			t.Errorf("%q found %q, expected %q", test.query, found, test.expected)
+		}
+	}
+	if found := names(g.Reverse(59.95, 10.75)); found != "Oslo, Norway" {
+		t.Errorf("reverse geocoded to %q", found)
+	}
+	if found := names(g.Reverse(0, 0)); found != "" {
+		t.Errorf("reverse geocoded the middle of the ocean to %q", found)
+	}
+
+	if _, err := ReadGazetteer(strings.NewReader("Oslo\tnorth\teast\n")); err == nil {
+		t.Error("accepted a gazetteer without positions")
+	}
+	if found := names(NewGazetteerFile(defaultGazetteerFile).Geocode("Bergen")); found != "Bergen, Norway" {
+		t.Errorf("bundled gazetteer found %q", found)
+	}
+}
+
+func TestGeocodeRoutes(t *testing.T) {
+	app := OpenTestEnv()
+	defer CloseTestEnv(app)
+	serv := httptest.NewServer(app)
+	defer serv.Close()
+	google, googleServ := fakeGoogleGeocoder(t)
+	defer googleServ.Close()
+	app.Geocoder = google
+
+	var results []APIGeoResult
+	res, err := http.Get(serv.URL + "/api/geocode?q=" + url.QueryEscape("Thorvald Meyers gate 30"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	json.NewDecoder(res.Body).Decode(&results)
+	res.Body.Close()
+	if len(results) != 1 || results[0].Address[0].Value != "Thorvald Meyers gate 30" {
+		t.Errorf("unexpected geocode results %+v", results)
+	}
+
+	var places []int64
+	defer func() {
+		for _, id := range places {
+			app.DB.Exec("DELETE FROM address WHERE id IN (SELECT addressid FROM place_address WHERE placeid = ?)", id)
+			app.DB.Exec("DELETE FROM place_address WHERE placeid = ?", id)
+			app.DB.Exec("DELETE FROM place WHERE id = ?", id)
+		}
+	}()
+	create := func(values url.Values) *APIPlace {
+		res, err := http.PostForm(serv.URL+"/api/places", values)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != 200 {
+			t.Fatalf("create place %v: status %d", values, res.StatusCode)
+		}
+		p := &APIPlace{}
+		if err := json.NewDecoder(res.Body).Decode(p); err != nil {
+			t.Fatal(err)
+		}
+		places = append(places, p.Id)
+		return p
+	}
+
+	p := create(url.Values{"name": {"Løkka Ølbar"}, "lat": {"59.9225"}, "long": {"10.759"}, "category": {"bar"}})
+	if len(p.Address) != 5 || p.Category != "bar" {
+		t.Errorf("place not given the reverse geocoded address %+v", p)
+	}
+	p = create(url.Values{"name": {"Meyers Pub"}, "q": {"Thorvald Meyers gate 30"}})
+	if p.Lat != 59.9225 || p.Long != 10.759 || len(p.Address) != 5 {
+		t.Errorf("place not put at the geocoded address %+v", p)
+	}
+	// an unknown position only means no address
+	p = create(url.Values{"name": {"Offshore"}, "lat": {"0"}, "long": {"0"}})
+	if len(p.Address) != 0 {
+		t.Errorf("unexpected address of %+v", p)
+	}
+	if p.Radius != defaultPlaceRadius {
+		t.Errorf("place without a radius given %d", p.Radius)
+	}
+	for _, values := range []url.Values{
+		{"name": {"Lost"}, "q": {"nowhere at all"}},
+		{"name": {"North"}, "lat": {"90.5"}, "long": {"0"}},
+		{"name": {"East"}, "lat": {"0"}, "long": {"180.5"}},
+		{"name": {"Nowhere"}, "lat": {"NaN"}, "long": {"0"}},
+		{"name": {"Point"}, "lat": {"0"}, "long": {"0"}, "radius": {"0"}},
+		{"name": {"Hole"}, "lat": {"0"}, "long": {"0"}, "radius": {"-10"}}} {
+		res, err = http.PostForm(serv.URL+"/api/places", values)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != 400 {
+			t.Errorf("create place %v: status %d", values, res.StatusCode)
+		}
+	}
+}
@@ -1,12 +1,20 @@
 package tbeer
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	htmltmpl "html/template"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
+	"sync"
+	"syscall"
 	texttmpl "text/template"
+	"time"
 )
 
 type Page struct {
@@ -36,8 +44,8 @@ func defaultHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func installTemplateHandler(prefix string, content_type string) {
-	http.HandleFunc(prefix,
+func installTemplateHandler(mux *http.ServeMux, env *Env, prefix string, content_type string) {
+	mux.HandleFunc(prefix,
 		func(w http.ResponseWriter, r *http.Request) {
 			filename := "./content/" + r.URL.Path[len(prefix):]
 			t, err := texttmpl.ParseFiles(filename)
@@ -46,37 +54,229 @@ func installTemplateHandler(prefix string, content_type string) {
 				http.NotFound(w, r)
 			} else {
 				w.Header().Set("Content-Type", content_type)
-				t.Execute(w, GlobalEnv)
+				t.Execute(w, env)
 			}
 		})
 }
 
-// Start http server and block
-func StartHttp() {
-	installTemplateHandler("/script/", "application/javascript")
-	installTemplateHandler("/style/", "text/css")
+// Timeouts of a new Server. Live event streams lift the write timeout
+// of their own response.
+const (
+	serverReadHeaderTimeout = 10 * time.Second
+	serverReadTimeout       = 30 * time.Second
+	serverWriteTimeout      = 60 * time.Second
+	serverIdleTimeout       = 2 * time.Minute
+	serverShutdownTimeout   = 30 * time.Second
+)
 
-	InitRestTree()
-	http.HandleFunc("/api/", HandleRestRequest)
+// An app served over http, with its own mux and the notification
+// worker. The app and its database are closed on shutdown.
+type Server struct {
+	App  *App
+	HTTP *http.Server
+	// the plain http listener of a secure server, redirecting to https
+	// and answering ACME challenges; nil if there is none
+	Redirect *http.Server
+	// how long Shutdown waits for requests in flight
+	ShutdownTimeout time.Duration
 
-	http.HandleFunc("/", defaultHandler)
+	// the certificate of a secure server, unless it comes from ACME
+	certs *certReloader
 
-	addr := ":" + strconv.FormatInt(int64(GlobalEnv.ServerPort), 10)
-	var err error
+	// closed on shutdown, ending live streams and the notification worker
+	stop     chan struct{}
+	stopOnce sync.Once
+	workers  sync.WaitGroup
+}
+
+type serverStopKey struct{}
+
+// Closed when the server handling a request is shutting down, nil
+// outside a Server
+func serverStopping(ctx context.Context) <-chan struct{} {
+	stop, _ := ctx.Value(serverStopKey{}).(chan struct{})
+	return stop
+}
+
+// Create a server for an app. Fields of HTTP and Redirect may be
+// changed before serving. Fails if the certificate of a secure server
+// can't be loaded.
+func NewServer(app *App) (*Server, error) {
+	env := app.Env
+	mux := http.NewServeMux()
+	installTemplateHandler(mux, env, "/script/", "application/javascript")
+	installTemplateHandler(mux, env, "/style/", "text/css")
+	mux.Handle("/api/", app)
+	installVanityHandlers(mux, app.DB)
+	mux.HandleFunc("/", defaultHandler)
+
+	s := &Server{
+		App:             app,
+		ShutdownTimeout: serverShutdownTimeout,
+		stop:            make(chan struct{}),
+	}
+	s.HTTP = newHTTPServer(env.ServerPort, mux)
+	s.HTTP.BaseContext = func(net.Listener) context.Context {
+		return context.WithValue(context.Background(), serverStopKey{}, s.stop)
+	}
+	s.HTTP.RegisterOnShutdown(s.stopWorkers)
+
+	if env.ServerSecure {
+		if env.HSTSMaxAge > 0 {
+			s.HTTP.Handler = withHSTS(mux, env.HSTSMaxAge)
+		}
+		redirect := httpsRedirect(env.serverHosts(), env.ServerPort)
+		if env.ServerACME {
+			m, err := newACMEManager(env)
+			if err != nil {
+				return nil, err
+			}
+			s.HTTP.TLSConfig = m.TLSConfig()
+			redirect = m.HTTPHandler(redirect)
+		} else {
+			var err error
+			if s.certs, err = newCertReloader(env.ServerCertFile, env.ServerKeyFile); err != nil {
+				return nil, err
+			}
+			s.HTTP.TLSConfig = &tls.Config{GetCertificate: s.certs.getCertificate}
+		}
+		if env.RedirectPort > 0 {
+			s.Redirect = newHTTPServer(env.RedirectPort, redirect)
+		}
+	}
+
+	s.workers.Add(1)
+	go func() {
+		defer s.workers.Done()
+		NewNotificationWorker(env, app.DB).Run(s.stop)
+	}()
+	return s, nil
+}
+
+func newHTTPServer(port int, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              ":" + strconv.Itoa(port),
+		Handler:           handler,
+		ReadHeaderTimeout: serverReadHeaderTimeout,
+		ReadTimeout:       serverReadTimeout,
+		WriteTimeout:      serverWriteTimeout,
+		IdleTimeout:       serverIdleTimeout,
+	}
+}
+
+func (s *Server) stopWorkers() {
+	s.stopOnce.Do(func() { close(s.stop) })
+}
 
-	if GlobalEnv.ServerSecure {
-		log.Printf("starting secure server on %s", addr)
-		err = http.ListenAndServeTLS(
-			addr,
-			GlobalEnv.ServerCertFile,
-			GlobalEnv.ServerKeyFile,
-			nil)
+// Serve on l until Shutdown, over tls if the environment says so
+func (s *Server) Serve(l net.Listener) error {
+	var err error
+	env := s.App.Env
+	if env.ServerSecure {
+		log.Printf("starting secure server on %s", l.Addr())
+		err = s.HTTP.ServeTLS(l, "", "")
 	} else {
-		log.Printf("starting non-secure server on %s", addr)
-		err = http.ListenAndServe(addr, nil)
+		log.Printf("starting non-secure server on %s", l.Addr())
+		err = s.HTTP.Serve(l)
+	}
+	if err == http.ErrServerClosed {
+		return nil
 	}
+	return err
+}
+
+// Serve the redirects of a secure server on l until Shutdown
+func (s *Server) ServeRedirect(l net.Listener) error {
+	log.Printf("redirecting to https on %s", l.Addr())
+	if err := s.Redirect.Serve(l); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
 
+// Serve on the addresses of HTTP and Redirect until Shutdown
+func (s *Server) ListenAndServe() error {
+	l, err := net.Listen("tcp", s.HTTP.Addr)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	if s.Redirect != nil {
+		rl, err := net.Listen("tcp", s.Redirect.Addr)
+		if err != nil {
+			l.Close()
+			return err
+		}
+		go func() {
+			if err := s.ServeRedirect(rl); err != nil {
+				log.Println(err)
+			}
+		}()
+	}
+	return s.Serve(l)
+}
+
+// Read the certificate files of a secure server again, keeping the old
+// certificate if they can't be loaded. ACME certificates are renewed
+// without this.
+func (s *Server) ReloadCertificate() error {
+	if s.certs == nil {
+		return nil
+	}
+	return s.certs.reload()
+}
+
+// Stop accepting connections, end live streams, wait for the requests
+// in flight and close the app. Requests still running when ctx
+// is done are cut off.
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s.Redirect != nil {
+		if err := s.Redirect.Shutdown(ctx); err != nil {
+			s.Redirect.Close()
+		}
+	}
+	err := s.HTTP.Shutdown(ctx)
+	if err != nil {
+		s.HTTP.Close()
+	}
+	s.stopWorkers()
+	s.workers.Wait()
+	if cerr := s.App.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Serve until SIGINT or SIGTERM, then shut down gracefully. SIGHUP
+// reloads the certificate files.
+func (s *Server) Run() error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	served := make(chan error, 1)
+	go func() { served <- s.ListenAndServe() }()
+
+	for stopping := false; !stopping; {
+		select {
+		case err := <-served:
+			s.Shutdown(context.Background())
+			return err
+		case sig := <-signals:
+			if sig != syscall.SIGHUP {
+				log.Printf("%v: shutting down", sig)
+				stopping = true
+			} else if err := s.ReloadCertificate(); err != nil {
+				log.Printf("reloading certificate: %v", err)
+			} else {
+				log.Print("reloaded certificate")
+			}
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.ShutdownTimeout)
+	defer cancel()
+	err := s.Shutdown(ctx)
+	if serr := <-served; err == nil {
+		err = serr
 	}
+	return err
 }
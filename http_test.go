@@ -0,0 +1,133 @@
+package tbeer
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestServerShutdown(t *testing.T) {
+	// two servers in one process, each with its own app and mux
+	srv, err := NewServer(OpenTestEnv())
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewServer(OpenTestEnv())
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(l) }()
+	url := "http://" + l.Addr().String()
+	// a connection per request, so that no spare connection of the
+	// client keeps the server from shutting down
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+
+	res, err := client.Get(url + "/api/me")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", res.StatusCode)
+	}
+
+	// a live stream in flight ends on shutdown
+	live, err := client.Get(url + "/api/live?minlat=-90&minlong=-180&maxlat=90&maxlong=180")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer live.Body.Close()
+	streamed := make(chan error, 1)
+	go func() {
+		_, err := ioutil.ReadAll(live.Body)
+		streamed <- err
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	began := time.Now()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	if d := time.Since(began); d > 2*time.Second {
+		t.Errorf("shutdown took %v", d)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("serve: %v", err)
+	}
+	select {
+	case err := <-streamed:
+		if err != nil {
+			t.Errorf("live stream: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("live stream still open")
+	}
+	if err := srv.App.DB.Ping(); err == nil {
+		t.Error("database still open")
+	}
+	if _, err := client.Get(url + "/api/me"); err == nil {
+		t.Error("served after shutdown")
+	}
+	other.Shutdown(ctx)
+}
+
+// Streams outlive the write timeout of the server, kept open by
+// keepalive writes
+func TestStreamWriteTimeout(t *testing.T) {
+	app := OpenTestEnv()
+	defer CloseTestEnv(app)
+	serv := httptest.NewUnstartedServer(app)
+	serv.Config.WriteTimeout = 100 * time.Millisecond
+	serv.Start()
+	defer serv.Close()
+	defer func(d time.Duration) { liveKeepalive = d }(liveKeepalive)
+	liveKeepalive = 20 * time.Millisecond
+
+	exec := func(q string, args ...interface{}) int64 {
+		res, err := app.DB.Exec(q, args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, _ := res.LastInsertId()
+		return id
+	}
+	periodid := exec("INSERT INTO period (start, end) VALUES (1000, 2000)")
+	meetingid := exec("INSERT INTO meeting (ownerid, periodid, placeid, name) VALUES (1, ?, 1, 'late')", periodid)
+	partid := exec("INSERT INTO participant (ownerid, alias, description) VALUES (1, 'patient', '')")
+	exec("INSERT INTO meeting_participant (meetingid, participantid) VALUES (?, ?)", meetingid, partid)
+	defer func() {
+		exec("DELETE FROM meeting_participant WHERE meetingid = ?", meetingid)
+		exec("DELETE FROM participant WHERE id = ?", partid)
+		exec("DELETE FROM meeting WHERE id = ?", meetingid)
+		exec("DELETE FROM period WHERE id = ?", periodid)
+	}()
+
+	for _, path := range []string{
+		"/api/live?minlat=-90&minlong=-180&maxlat=90&maxlong=180",
+		fmt.Sprintf("/api/meeting/%d/stream", meetingid)} {
+		res, err := http.Get(serv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		began := time.Now()
+		buf := make([]byte, 64)
+		for time.Since(began) < 3*serv.Config.WriteTimeout {
+			if _, err := res.Body.Read(buf); err != nil {
+				t.Errorf("%s: closed after %v: %v", path, time.Since(began), err)
+				break
+			}
+		}
+		res.Body.Close()
+	}
+}
@@ -0,0 +1,148 @@
+package tbeer
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// A certificate read from files, which may be read again without
+// restarting the server, e.g. after the files were renewed
+type certReloader struct {
+	certFile string
+	keyFile  string
+	mutex    sync.RWMutex
+	cert     *tls.Certificate
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	return r, r.reload()
+}
+
+// Read the files again. The old certificate is kept if they can't be
+// loaded.
+func (r *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	r.cert = &cert
+	r.mutex.Unlock()
+	return nil
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.cert, nil
+}
+
+// The host names of a comma separated list
+func acmeHosts(list string) []string {
+	hosts := make([]string, 0)
+	for _, h := range strings.Split(list, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			hosts = append(hosts, h)
+		}
+	}
+	return hosts
+}
+
+// A manager getting and renewing the certificates of env from its CA,
+// keeping them in the cache directory
+func newACMEManager(env *Env) (*autocert.Manager, error) {
+	dir := env.ACMECacheDir
+	if dir == "" {
+		dir = defaultACMECacheDir
+	}
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(dir),
+		HostPolicy: autocert.HostWhitelist(acmeHosts(env.ACMEHosts)...),
+		Email:      env.ACMEEmail,
+	}
+	if env.ACMEDirectory == "" && env.ACMECAFile == "" {
+		return m, nil
+	}
+	client := &acme.Client{DirectoryURL: env.ACMEDirectory}
+	if env.ACMECAFile != "" {
+		pem, err := ioutil.ReadFile(env.ACMECAFile)
+		if err != nil {
+			return nil, err
+		}
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates", env.ACMECAFile)
+		}
+		client.HTTPClient = &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	}
+	m.Client = client
+	return m, nil
+}
+
+// Host names of the server, the one to redirect to first
+func (env *Env) serverHosts() []string {
+	hosts := acmeHosts(env.ACMEHosts)
+	if env.ServerHost != "" {
+		hosts = append([]string{env.ServerHost}, hosts...)
+	}
+	return hosts
+}
+
+// Redirect plain http requests to the same url over https on port, at
+// the requested host if it is one of hosts and otherwise the first one.
+// Without hosts nothing is redirected.
+func httpsRedirect(hosts []string, port int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(hosts) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		requested := r.Host
+		if h, _, err := net.SplitHostPort(requested); err == nil {
+			requested = h
+		}
+		host := hosts[0]
+		for _, h := range hosts {
+			if strings.EqualFold(h, requested) {
+				host = h
+			}
+		}
+		if port != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(port))
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		code := http.StatusMovedPermanently
+		if r.Method != "GET" && r.Method != "HEAD" {
+			// keeps the method and body
+			code = http.StatusPermanentRedirect
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), code)
+	})
+}
+
+// Tell browsers to only use https for the next maxAge seconds
+func withHSTS(h http.Handler, maxAge int) http.Handler {
+	value := "max-age=" + strconv.Itoa(maxAge)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Strict-Transport-Security", value)
+		h.ServeHTTP(w, r)
+	})
+}
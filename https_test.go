@@ -0,0 +1,282 @@
+package tbeer
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPSRedirect(t *testing.T) {
+	tests := []struct {
+		method   string
+		url      string
+		port     int
+		code     int
+		location string
+	}{
+		{"GET", "http://example.com/api/me?x=1", 443, 301, "https://example.com/api/me?x=1"},
+		{"GET", "http://example.com:80/m/friday", 8443, 301, "https://example.com:8443/m/friday"},
+		{"POST", "http://example.com/api/availability", 443, 308, "https://example.com/api/availability"},
+		{"GET", "http://WWW.example.com/", 443, 301, "https://www.example.com/"},
+		{"GET", "http://[::1]:80/", 443, 301, "https://[::1]/"},
+		// hosts not ours are not trusted
+		{"GET", "http://evil.example.net/api/me", 443, 301, "https://example.com/api/me"},
+	}
+	hosts := []string{"example.com", "www.example.com", "::1"}
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		httpsRedirect(hosts, test.port).ServeHTTP(rec, httptest.NewRequest(test.method, test.url, nil))
+		if rec.Code != test.code || rec.Header().Get("Location") != test.location {
+			t.Errorf("%s %s: %d %q", test.method, test.url, rec.Code, rec.Header().Get("Location"))
+		}
+	}
+}
+
+// Write a self-signed certificate for 127.0.0.1 and its key to dir
+func writeTestCert(t *testing.T, dir string, name string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return
+}
+
+func listen(t *testing.T, addr string) (net.Listener, int) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l, l.Addr().(*net.TCPAddr).Port
+}
+
+func TestSecureServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	app := OpenTestEnv()
+	defer CloseTestEnv(app)
+	env := DefaultEnv()
+	env.ServerSecure = true
+	env.ServerCertFile, env.ServerKeyFile = writeTestCert(t, dir, "first")
+	l, port := listen(t, "127.0.0.1:0")
+	rl, redirectPort := listen(t, "127.0.0.1:0")
+	env.ServerPort = port
+	env.RedirectPort = redirectPort
+	env.ServerHost = "127.0.0.1"
+	app.Env = env
+	srv, err := NewServer(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	go srv.ServeRedirect(rl)
+	defer srv.Shutdown(context.Background())
+
+	// the name of the certificate served to a new connection
+	served := func() string {
+		conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+	if name := served(); name != "first" {
+		t.Errorf("served %q", name)
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			DisableKeepAlives: true},
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	res, err := client.Get("https://" + l.Addr().String() + "/api/me")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 || res.Header.Get("Strict-Transport-Security") != "max-age="+strconv.Itoa(defaultHSTSMaxAge) {
+		t.Errorf("unexpected response %d %v", res.StatusCode, res.Header)
+	}
+
+	res, err = client.Get("http://" + rl.Addr().String() + "/api/me")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if loc := res.Header.Get("Location"); res.StatusCode != 301 || loc != "https://127.0.0.1:"+strconv.Itoa(port)+"/api/me" {
+		t.Errorf("unexpected redirect %d %q", res.StatusCode, loc)
+	}
+
+	// renewed files are served after a reload, broken ones are not
+	writeTestCert(t, dir, "second")
+	if name := served(); name != "first" {
+		t.Errorf("served %q before reloading", name)
+	}
+	if err := srv.ReloadCertificate(); err != nil {
+		t.Fatal(err)
+	}
+	if name := served(); name != "second" {
+		t.Errorf("served %q after reloading", name)
+	}
+	ioutil.WriteFile(env.ServerKeyFile, []byte("broken"), 0600)
+	if err := srv.ReloadCertificate(); err == nil {
+		t.Error("reloaded a broken key")
+	}
+	if name := served(); name != "second" {
+		t.Errorf("served %q after a failed reload", name)
+	}
+}
+
+func TestACMEServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile, keyFile := writeTestCert(t, dir, "ca")
+
+	app := OpenTestEnv()
+	defer CloseTestEnv(app)
+	env := DefaultEnv()
+	env.ServerSecure = true
+	env.ServerACME = true
+	env.ACMEHosts = "beer.example.com, www.beer.example.com"
+	env.ACMEDirectory = "https://127.0.0.1:14000/dir"
+	env.ACMECAFile = keyFile
+	env.ACMECacheDir = dir
+	env.RedirectPort = 80
+	app.Env = env
+	if _, err := NewServer(app); err == nil {
+		t.Error("trusted a ca file without certificates")
+	}
+	env.ACMECAFile = caFile
+	srv, err := NewServer(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Shutdown(context.Background())
+
+	// challenges are answered, not redirected
+	rec := httptest.NewRecorder()
+	srv.Redirect.Handler.ServeHTTP(rec, httptest.NewRequest("GET", "http://beer.example.com/.well-known/acme-challenge/token", nil))
+	if rec.Code != 404 {
+		t.Errorf("unknown challenge: %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	srv.Redirect.Handler.ServeHTTP(rec, httptest.NewRequest("GET", "http://beer.example.com/api/me", nil))
+	if rec.Code != 301 {
+		t.Errorf("not redirected: %d", rec.Code)
+	}
+	if protos := srv.HTTP.TLSConfig.NextProtos; !contains(protos, "acme-tls/1") {
+		t.Errorf("no tls-alpn-01 challenges in %v", protos)
+	}
+}
+
+// Get a certificate from a pebble ACME test server, which is run with
+//
+//	PEBBLE_VA_ALWAYS_VALID=1 pebble -config test/config/pebble-config.json
+//
+// and given to the test with PEBBLE_DIRECTORY, e.g.
+// https://localhost:14000/dir, and PEBBLE_CA_FILE, the file
+// test/certs/pebble.minica.pem of pebble. Without PEBBLE_VA_ALWAYS_VALID
+// pebble validates the challenges at PEBBLE_HOST, default localhost,
+// on ports 5001 and 5002, where the test serves.
+func TestACMEPebble(t *testing.T) {
+	directory := os.Getenv("PEBBLE_DIRECTORY")
+	if directory == "" {
+		t.Skip("PEBBLE_DIRECTORY not set")
+	}
+	host := os.Getenv("PEBBLE_HOST")
+	if host == "" {
+		host = "localhost"
+	}
+	cache, err := ioutil.TempDir("", "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cache)
+
+	app := OpenTestEnv()
+	defer CloseTestEnv(app)
+	env := DefaultEnv()
+	env.ServerSecure = true
+	env.ServerACME = true
+	env.ACMEHosts = host
+	env.ACMEDirectory = directory
+	env.ACMECAFile = os.Getenv("PEBBLE_CA_FILE")
+	env.ACMECacheDir = cache
+	env.ServerPort = 5001
+	env.RedirectPort = 5002
+	if err := env.ValidateServer(); err != nil {
+		t.Fatal(err)
+	}
+	app.Env = env
+	srv, err := NewServer(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, _ := listen(t, ":5001")
+	rl, _ := listen(t, ":5002")
+	go srv.Serve(l)
+	go srv.ServeRedirect(rl)
+	defer srv.Shutdown(context.Background())
+
+	// the certificate is requested on the first handshake
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: time.Minute}, "tcp", "127.0.0.1:5001",
+		&tls.Config{ServerName: host, InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	cert := conn.ConnectionState().PeerCertificates[0]
+	if err := cert.VerifyHostname(host); err != nil {
+		t.Error(err)
+	}
+	if !strings.Contains(cert.Issuer.CommonName, "Pebble") {
+		t.Errorf("issued by %q", cert.Issuer.CommonName)
+	}
+	if files, _ := ioutil.ReadDir(cache); len(files) == 0 {
+		t.Error("certificate not cached")
+	}
+}
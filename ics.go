@@ -0,0 +1,428 @@
+package tbeer
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// user_preference key of the secret token in the calendar feed URL
+const calendarTokenPrefKey = "calendar_token"
+
+// Writes iCalendar (RFC 5545) content lines, folding them at 75 octets
+type icsWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (iw *icsWriter) line(name string, value string) {
+	if iw.err != nil {
+		return
+	}
+	l := name + ":" + value
+	limit := 75
+	for len(l) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(l[cut]) {
+			cut--
+		}
+		if _, iw.err = io.WriteString(iw.w, l[:cut]+"\r\n "); iw.err != nil {
+			return
+		}
+		l = l[cut:]
+		// continuation lines start with a space
+		limit = 74
+	}
+	_, iw.err = io.WriteString(iw.w, l+"\r\n")
+}
+
+// Escape a TEXT value
+func icsText(s string) string {
+	return strings.NewReplacer(
+		`\`, `\\`,
+		";", `\;`,
+		",", `\,`,
+		"\r\n", `\n`,
+		"\n", `\n`).Replace(s)
+}
+
+// Quote a parameter value if needed
+func icsParam(s string) string {
+	s = strings.Replace(s, `"`, "'", -1)
+	if strings.ContainsAny(s, ";:,") {
+		return `"` + s + `"`
+	}
+	return s
+}
+
+func icsUTCTime(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+func icsLocalTime(t time.Time) string {
+	return t.Format("20060102T150405")
+}
+
+// Format a UTC offset in seconds as +HHMM
+func icsOffset(seconds int) string {
+	sign := "+"
+	if seconds < 0 {
+		sign = "-"
+		seconds = -seconds
+	}
+	return fmt.Sprintf("%s%02d%02d", sign, seconds/3600, seconds/60%60)
+}
+
+// Calendar address of a user: the email address if known
+func icsAddress(userid int64, email string) string {
+	if email != "" {
+		return "mailto:" + email
+	}
+	return "urn:x-tbeer:user:" + strconv.FormatInt(userid, 10)
+}
+
+// A change of UTC offset in a time zone
+type tzTransition struct {
+	at   time.Time
+	from int
+	to   int
+	name string
+	dst  bool
+}
+
+// Offset changes of loc in the years from first to last
+func tzTransitions(loc *time.Location, first int, last int) []tzTransition {
+	t := time.Date(first, 1, 1, 0, 0, 0, 0, loc)
+	end := time.Date(last+1, 1, 1, 0, 0, 0, 0, loc)
+	_, offset := t.Zone()
+	var transitions []tzTransition
+	for t.Before(end) {
+		next := t.Add(24 * time.Hour)
+		if _, o := next.Zone(); o != offset {
+			// find the second of the change
+			lo, hi := t, next
+			for hi.Sub(lo) > time.Second {
+				mid := lo.Add(hi.Sub(lo) / 2)
+				if _, o := mid.Zone(); o == offset {
+					lo = mid
+				} else {
+					hi = mid
+				}
+			}
+			name, o := hi.Zone()
+			transitions = append(transitions, tzTransition{hi, offset, o, name, hi.IsDST()})
+			offset = o
+		}
+		t = next
+	}
+	return transitions
+}
+
+// Write a VTIMEZONE describing loc in the years from first to last
+func writeVTimezone(iw *icsWriter, loc *time.Location, first int, last int) {
+	start := time.Date(first, 1, 1, 0, 0, 0, 0, loc)
+	name, offset := start.Zone()
+	// the offset in effect at the start of the range, then the changes
+	transitions := append([]tzTransition{{start, offset, offset, name, start.IsDST()}},
+		tzTransitions(loc, first, last)...)
+
+	iw.line("BEGIN", "VTIMEZONE")
+	iw.line("TZID", loc.String())
+	for _, tr := range transitions {
+		component := "STANDARD"
+		if tr.dst {
+			component = "DAYLIGHT"
+		}
+		iw.line("BEGIN", component)
+		// onset in the local time before the change
+		iw.line("DTSTART", icsLocalTime(tr.at.In(time.FixedZone("", tr.from))))
+		iw.line("TZOFFSETFROM", icsOffset(tr.from))
+		iw.line("TZOFFSETTO", icsOffset(tr.to))
+		iw.line("TZNAME", icsText(tr.name))
+		iw.line("END", component)
+	}
+	iw.line("END", "VTIMEZONE")
+}
+
+// An attendee of a calendar event
+type icsAttendee struct {
+	name  string
+	user  int64
+	email string
+	// RFC 5545 PARTSTAT
+	status string
+}
+
+// A meeting as a calendar event
+type icsEvent struct {
+	meeting   *Meeting
+	loc       *time.Location
+	organizer *User
+	attendees []icsAttendee
+}
+
+// Write the events as an iCalendar document
+func writeCalendar(w io.Writer, events []*icsEvent, now time.Time) error {
+	iw := &icsWriter{w: w}
+	iw.line("BEGIN", "VCALENDAR")
+	iw.line("VERSION", "2.0")
+	iw.line("PRODID", "-//beer-socialist//tbeer//EN")
+	iw.line("CALSCALE", "GREGORIAN")
+	iw.line("METHOD", "PUBLISH")
+	iw.line("X-WR-CALNAME", "Beer meetings")
+
+	// time zones used by the events, with the years they span
+	type yearRange struct{ first, last int }
+	zones := make(map[string]*yearRange)
+	zoneLocs := make(map[string]*time.Location)
+	for _, e := range events {
+		if e.loc == time.UTC {
+			continue
+		}
+		span := e.meeting.Period.Span()
+		first := time.Unix(int64(span.Start), 0).In(e.loc).Year()
+		last := time.Unix(int64(span.End), 0).In(e.loc).Year()
+		if span.End == foreverTime {
+			// unbounded recurrences: enough for the near future
+			last = now.Year() + 1
+		}
+		if last < first {
+			last = first
+		}
+		if r, ok := zones[e.loc.String()]; ok {
+			if first < r.first {
+				r.first = first
+			}
+			if last > r.last {
+				r.last = last
+			}
+		} else {
+			zones[e.loc.String()] = &yearRange{first, last}
+			zoneLocs[e.loc.String()] = e.loc
+		}
+	}
+	names := make([]string, 0, len(zones))
+	for name := range zones {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		writeVTimezone(iw, zoneLocs[name], zones[name].first, zones[name].last)
+	}
+
+	for _, e := range events {
+		m := e.meeting
+		// times in the place time zone, or UTC
+		timeProp := func(name string, unix int) {
+			t := time.Unix(int64(unix), 0).In(e.loc)
+			if e.loc == time.UTC {
+				iw.line(name, icsUTCTime(t))
+			} else {
+				iw.line(name+";TZID="+icsParam(e.loc.String()), icsLocalTime(t))
+			}
+		}
+
+		iw.line("BEGIN", "VEVENT")
+		iw.line("UID", fmt.Sprintf("meeting-%d@beer-socialist", m.Id))
+		iw.line("DTSTAMP", icsUTCTime(now))
+		timeProp("DTSTART", m.Period.Start)
+		timeProp("DTEND", m.Period.End)
+		if m.Period.RRule != "" {
+			iw.line("RRULE", m.Period.RRule)
+			exdates := make([]int, 0)
+			for start := range m.Period.exceptions() {
+				exdates = append(exdates, start)
+			}
+			sort.Ints(exdates)
+			for _, start := range exdates {
+				timeProp("EXDATE", start)
+			}
+		}
+		iw.line("SUMMARY", icsText(m.Name))
+		iw.line("LOCATION", icsText(m.Place.Name))
+		iw.line("GEO", fmt.Sprintf("%f;%f", m.Place.Lat, m.Place.Long))
+		if m.Visibility != VisibilityPublic {
+			iw.line("CLASS", "PRIVATE")
+		}
+		if o := e.organizer; o != nil {
+			iw.line("ORGANIZER;CN="+icsParam(o.Alias), icsAddress(o.Id, o.Email))
+		}
+		for _, a := range e.attendees {
+			iw.line("ATTENDEE;CN="+icsParam(a.name)+";ROLE=REQ-PARTICIPANT;PARTSTAT="+a.status,
+				icsAddress(a.user, a.email))
+		}
+		iw.line("END", "VEVENT")
+	}
+	iw.line("END", "VCALENDAR")
+	return iw.err
+}
+
+// Statements for loading a user's calendar
+var calendarQueries = []string{
+	userMeetingsQuery,
+	userByIdQuery,
+	// attendees
+	"SELECT participant.alias, user.id, user.email " +
+		"FROM meeting_participant, participant, user " +
+		"WHERE meeting_participant.meetingid = ? AND " +
+		"meeting_participant.participantid = participant.id AND " +
+		"participant.ownerid = user.id " +
+		"ORDER BY participant.id",
+	// invited users not attending
+	"SELECT DISTINCT user.alias, user.id, user.email " +
+		"FROM notification, user " +
+		"WHERE notification.kind = '" + NotifyInvitation + "' AND notification.meetingid = ? AND " +
+		"notification.userid = user.id AND user.id NOT IN (" +
+		"SELECT participant.ownerid FROM meeting_participant, participant " +
+		"WHERE meeting_participant.meetingid = ? AND meeting_participant.participantid = participant.id) " +
+		"ORDER BY user.id",
+}
+
+// Load the meetings of a user as calendar events. stmts are calendarQueries.
+func loadCalendar(stmts []*sql.Stmt, userid int64) ([]*icsEvent, error) {
+	rows, err := stmts[0].Query(userid)
+	if err != nil {
+		return nil, err
+	}
+	events := make([]*icsEvent, 0)
+	seen := make(map[int64]bool)
+	for rows.Next() {
+		m := &Meeting{}
+		var partid int
+		if err := rows.Scan(append(ConcatBasicFields(m, &m.Place, &m.Period), &partid, m.Period.zoneField())...); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		// attending with several participants lists a meeting once for each.
+		// Times are in the zone the server expands recurrences in.
+		if !seen[m.Id] {
+			seen[m.Id] = true
+			events = append(events, &icsEvent{meeting: m, loc: m.Period.location()})
+		}
+	}
+	rows.Close()
+
+	// then the details of each meeting
+	for _, e := range events {
+		m := e.meeting
+		if o, err := loadUser(stmts[1], m.Owner); err == nil {
+			e.organizer = o
+		}
+
+		attendees := func(status string, stmt *sql.Stmt, args ...interface{}) error {
+			rows, err := stmt.Query(args...)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			for rows.Next() {
+				a := icsAttendee{status: status}
+				var email sql.NullString
+				if err := rows.Scan(&a.name, &a.user, &email); err != nil {
+					return err
+				}
+				a.email = email.String
+				e.attendees = append(e.attendees, a)
+			}
+			return nil
+		}
+		if err := attendees("ACCEPTED", stmts[2], m.Id); err != nil {
+			return nil, err
+		}
+		if err := attendees("NEEDS-ACTION", stmts[3], m.Id, m.Id); err != nil {
+			return nil, err
+		}
+	}
+	return events, nil
+}
+
+func serveCalendar(stmts []*sql.Stmt, userid int64, w http.ResponseWriter) error {
+	events, err := loadCalendar(stmts, userid)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	return writeCalendar(w, events, time.Now())
+}
+
+// The secret calendar feed URL of a request's user
+func calendarFeedURL(ctx *DispatchContext, token string) string {
+	scheme := "http"
+	if ctx.request.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + ctx.request.Host + "/api/calendar/" + token + "/meetings.ics"
+}
+
+func (app *App) initCalendarHandlers() {
+	app.installStmtRestHandler("meetings.ics",
+		&RouteDoc{
+			Summary:     "iCalendar of the meetings the user participates in",
+			Response:    "",
+			ContentType: "text/calendar"},
+		calendarQueries,
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			return serveCalendar(stmts, ctx.userid, w)
+		})
+
+	app.installStmtRestHandler("calendar/:token:uuid/meetings.ics",
+		&RouteDoc{
+			Summary:     "iCalendar of the meetings of the user owning the secret token, for calendar subscriptions",
+			Response:    "",
+			ContentType: "text/calendar"},
+		append([]string{
+			"SELECT ownerid FROM user_preference WHERE key = '" + calendarTokenPrefKey + "' AND value = ?"},
+			calendarQueries...),
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			var userid int64
+			if err := stmts[0].QueryRow(ctx.StringParam("token")).Scan(&userid); err != nil {
+				return err
+			}
+			return serveCalendar(stmts[1:], userid, w)
+		})
+
+	app.installStmtRestHandler("calendar",
+		&RouteDoc{
+			Summary:  "secret URL of the calendar feed of the user, created when first requested",
+			Response: &APICalendarFeed{}},
+		[]string{
+			"SELECT value FROM user_preference WHERE ownerid = ? AND key = '" + calendarTokenPrefKey + "'",
+			"INSERT INTO user_preference (ownerid, key, value) VALUES (?, '" + calendarTokenPrefKey + "', ?)"},
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			var token string
+			err := stmts[0].QueryRow(ctx.userid).Scan(&token)
+			if err == sql.ErrNoRows {
+				if token, err = newUUID(); err != nil {
+					return err
+				}
+				_, err = stmts[1].Exec(ctx.userid, token)
+			}
+			if err != nil {
+				return err
+			}
+			return writeJSON(w, &APICalendarFeed{calendarFeedURL(ctx, token)})
+		})
+
+	app.installStmtRestMethodHandler("DELETE", "calendar",
+		&RouteDoc{
+			Summary:  "revoke the calendar feed URL of the user. A new one is created when next requested",
+			Response: int64(0)},
+		[]string{"DELETE FROM user_preference WHERE ownerid = ? AND key = '" + calendarTokenPrefKey + "'"},
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			res, err := stmts[0].Exec(ctx.userid)
+			if err != nil {
+				return err
+			}
+			count, err := res.RowsAffected()
+			if err != nil {
+				return err
+			}
+			return writeJSON(w, count)
+		})
+}
@@ -0,0 +1,115 @@
+package tbeer
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestICSLineFolding(t *testing.T) {
+	buf := &bytes.Buffer{}
+	iw := &icsWriter{w: buf}
+	long := strings.Repeat("øl, ", 40)
+	iw.line("SUMMARY", icsText(long))
+	for _, l := range strings.Split(strings.TrimSuffix(buf.String(), "\r\n"), "\r\n") {
+		if len(l) > 75 {
+			t.Errorf("line longer than 75 octets: %q", l)
+		}
+	}
+	unfolded := strings.Replace(buf.String(), "\r\n ", "", -1)
+	if unfolded != "SUMMARY:"+strings.Replace(long, ",", `\,`, -1)+"\r\n" {
+		t.Errorf("unexpected unfolded line %q", unfolded)
+	}
+}
+
+func TestWriteCalendar(t *testing.T) {
+	oslo, err := time.LoadLocation("Europe/Oslo")
+	if err != nil {
+		t.Skip("no time zone database")
+	}
+	start := int(time.Date(2021, 3, 5, 17, 0, 0, 0, oslo).Unix())
+	m := &Meeting{
+		Id:     7,
+		Owner:  1,
+		Name:   "after work; fridays",
+		Place:  Place{Name: "Schouskjelleren", Lat: 59.92, Long: 10.76},
+		Period: Period{Start: start, End: start + 7200, RRule: "FREQ=WEEKLY;COUNT=4", ExDate: "1615564800"}}
+	events := []*icsEvent{{
+		meeting:   m,
+		loc:       oslo,
+		organizer: &User{Id: 1, Alias: "ola", Email: "ola@example.com"},
+		attendees: []icsAttendee{
+			{"ola", 1, "ola@example.com", "ACCEPTED"},
+			{"kari", 2, "", "NEEDS-ACTION"}}}}
+
+	buf := &bytes.Buffer{}
+	if err := writeCalendar(buf, events, time.Unix(int64(start), 0)); err != nil {
+		t.Fatal(err)
+	}
+	ics := strings.Replace(buf.String(), "\r\n ", "", -1)
+	for _, want := range []string{
+		"BEGIN:VCALENDAR\r\n",
+		"TZID:Europe/Oslo\r\n",
+		// summer time starts on the last sunday of march
+		"BEGIN:DAYLIGHT\r\nDTSTART:20210328T020000\r\nTZOFFSETFROM:+0100\r\nTZOFFSETTO:+0200\r\n",
+		"DTSTART;TZID=Europe/Oslo:20210305T170000\r\n",
+		"RRULE:FREQ=WEEKLY;COUNT=4\r\n",
+		"EXDATE;TZID=Europe/Oslo:20210312T170000\r\n",
+		`SUMMARY:after work\; fridays` + "\r\n",
+		"GEO:59.920000;10.760000\r\n",
+		"ORGANIZER;CN=ola:mailto:ola@example.com\r\n",
+		"ATTENDEE;CN=kari;ROLE=REQ-PARTICIPANT;PARTSTAT=NEEDS-ACTION:urn:x-tbeer:user:2\r\n",
+		"END:VCALENDAR\r\n",
+	} {
+		if !strings.Contains(ics, want) {
+			t.Errorf("calendar lacks %q:\n%s", want, ics)
+		}
+	}
+}
+
+func TestCalendarFeed(t *testing.T) {
+	app := OpenTestEnv()
+	defer CloseTestEnv(app)
+	serv := httptest.NewServer(app)
+	defer serv.Close()
+
+	res, err := http.Get(serv.URL + "/api/calendar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	feed := &APICalendarFeed{}
+	json.NewDecoder(res.Body).Decode(feed)
+	res.Body.Close()
+	if !strings.HasSuffix(feed.URL, "/meetings.ics") {
+		t.Fatalf("unexpected feed %+v", feed)
+	}
+
+	res, err = http.Get(feed.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != 200 || res.Header.Get("Content-Type") != "text/calendar; charset=utf-8" ||
+		!strings.HasPrefix(string(body), "BEGIN:VCALENDAR\r\n") {
+		t.Errorf("unexpected feed response %d %q", res.StatusCode, body)
+	}
+
+	req, _ := http.NewRequest("DELETE", serv.URL+"/api/calendar", nil)
+	if res, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res, err = http.Get(feed.URL); err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode == 200 {
+		t.Errorf("revoked feed URL still works")
+	}
+}
@@ -1,6 +1,7 @@
 package tbeer
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -23,15 +24,37 @@ type EmptyDictionary struct{}
 // is an empty list by default
 type EmptyList struct{}
 
-// Encode any value as json
+// A value of this instance keeps a slowly streamed list open. It is
+// written as whitespace, which is not an item of the list.
+type Keepalive struct{}
+
+// Encode any value as json, using its API representation if it has one.
+// The type of APITyped values is emitted as the "type" member.
 func encodeItem(w io.Writer, o interface{}) error {
-	bytes, err := json.Marshal(o)
+	o = apiValue(o)
+	data, err := json.Marshal(o)
 	if err != nil {
 		return err
-	} else {
-		w.Write(bytes)
-		return nil
 	}
+	if typed, ok := o.(APITyped); ok && bytes.HasPrefix(data, []byte("{")) {
+		w.Write([]byte(`{"type":`))
+		encodeItem(w, typed.APIType())
+		if !bytes.Equal(data, []byte("{}")) {
+			w.Write([]byte(","))
+		}
+		data = data[1:]
+	}
+	w.Write(data)
+	return nil
+}
+
+// Write a single value as a json document
+func writeJSON(w io.Writer, o interface{}) error {
+	if err := encodeItem(w, o); err != nil {
+		return err
+	}
+	w.Write([]byte("\n"))
+	return nil
 }
 
 // Encode one dictionary item (KeyedItem)
@@ -55,19 +78,48 @@ func encodeDictionaryItem(w io.Writer, o interface{}) error {
 	}
 }
 
-func WriteChannelAsJSONList(w io.Writer, items <-chan interface{}) {
-	w.Write([]byte("["))
-	if item, ok := <-items; ok {
-		encodeItem(w, item)
-		for item := range items {
-			w.Write([]byte(","))
-			if err := encodeItem(w, item); err != nil {
-				w.Write([]byte("null"))
-				break
-			}
+// Writer keeping the first error of the writer it wraps, after which
+// nothing more is written
+type stickyWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (s *stickyWriter) Write(p []byte) (int, error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+	n, err := s.w.Write(p)
+	s.err = err
+	return n, err
+}
+
+// Write the items of the channel as a json list. An item that can't be
+// encoded ends the list with null. Returns the first error; when writing
+// failed the list is left as it is and the channel is not drained.
+func WriteChannelAsJSONList(w io.Writer, items <-chan interface{}) error {
+	sw := &stickyWriter{w: w}
+	sw.Write([]byte("["))
+	first := true
+	for item := range items {
+		if sw.err != nil {
+			return sw.err
+		}
+		if _, ok := item.(Keepalive); ok {
+			sw.Write([]byte("\n"))
+			continue
+		}
+		if !first {
+			sw.Write([]byte(","))
+		}
+		first = false
+		if err := encodeItem(sw, item); err != nil {
+			sw.Write([]byte("null]"))
+			return err
 		}
 	}
-	w.Write([]byte("]"))
+	sw.Write([]byte("]"))
+	return sw.err
 }
 
 func WriteChannelAsJSONDictionary(w io.Writer, items <-chan interface{}) {
@@ -0,0 +1,365 @@
+package tbeer
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// In memory representation: Message in a meeting thread
+type Message struct {
+	Id          int64
+	Meeting     int64
+	Owner       int64
+	Participant Participant
+	Body        string
+	Created     int64
+	Edited      int64
+	// set on messages sent to streams when deleted
+	Deleted bool
+}
+
+func (m *Message) BasicFields() []interface{} {
+	return []interface{}{&m.Id, &m.Meeting, &m.Owner, &m.Body, &m.Created, &m.Edited}
+}
+
+func (m *Message) APIValue() interface{} {
+	return &APIMessage{
+		m.Id,
+		m.Meeting,
+		m.Participant.apiParticipant(),
+		m.Body,
+		m.Created,
+		m.Edited,
+		m.Deleted}
+}
+
+const messageFields = "meeting_message.id, meeting_message.meetingid, meeting_message.ownerid, " +
+	"meeting_message.body, meeting_message.created, meeting_message.edited, " +
+	"participant.id, participant.alias, participant.description "
+
+const messageByIdQuery = "SELECT " + messageFields +
+	"FROM meeting_message, participant " +
+	"WHERE meeting_message.id = ? AND meeting_message.meetingid = ? AND " +
+	"meeting_message.partid = participant.id"
+
+func loadMessage(stmt *sql.Stmt, meetingid int64, id int64) (*Message, error) {
+	m := &Message{}
+	if err := stmt.QueryRow(id, meetingid).Scan(ConcatBasicFields(m, &m.Participant)...); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Distributes new, changed and deleted messages to streams of a meeting
+type MessageBus struct {
+	mutex sync.Mutex
+	subs  map[int64]map[chan *Message]bool
+}
+
+func NewMessageBus() *MessageBus {
+	return &MessageBus{subs: make(map[int64]map[chan *Message]bool)}
+}
+
+func (b *MessageBus) Subscribe(meetingid int64, bufsize int) chan *Message {
+	c := make(chan *Message, bufsize)
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.subs[meetingid] == nil {
+		b.subs[meetingid] = make(map[chan *Message]bool)
+	}
+	b.subs[meetingid][c] = true
+	return c
+}
+
+func (b *MessageBus) Unsubscribe(meetingid int64, c chan *Message) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.subs[meetingid][c] {
+		delete(b.subs[meetingid], c)
+		close(c)
+		if len(b.subs[meetingid]) == 0 {
+			delete(b.subs, meetingid)
+		}
+	}
+}
+
+// Deliver the message to the streams of its meeting. Never blocks;
+// streams that are not keeping up are closed.
+func (b *MessageBus) Publish(m *Message) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for c := range b.subs[m.Meeting] {
+		select {
+		case c <- m:
+		default:
+			delete(b.subs[m.Meeting], c)
+			close(c)
+		}
+	}
+}
+
+// Writer that flushes after every write, for streaming responses
+type flushWriter struct {
+	w http.ResponseWriter
+	f http.Flusher
+}
+
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	fw.f.Flush()
+	return n, err
+}
+
+// Check that the user attends the meeting and return the participant
+// to write as: the one in the form if given, otherwise any of the user's
+// participants in the meeting. stmt is userMeetingParticipantsQuery.
+func messageAuthor(ctx *DispatchContext, stmt *sql.Stmt, meetingid int64) (int64, error) {
+	rows, err := stmt.Query(meetingid, ctx.userid)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	want, wantErr := getFormInt(ctx.request.Form, "partid")
+	var first int64
+	for rows.Next() {
+		var partid int64
+		if err := rows.Scan(&partid); err != nil {
+			return 0, err
+		}
+		if wantErr == nil && partid == want {
+			return partid, nil
+		}
+		if first == 0 {
+			first = partid
+		}
+	}
+	if first == 0 {
+		return 0, errNotParticipant
+	}
+	if wantErr == nil {
+		return 0, errNotOwner
+	}
+	return first, nil
+}
+
+var errNotParticipant = errors.New("not a participant of the meeting")
+
+// Participants of a meeting owned by a user
+const userMeetingParticipantsQuery = "SELECT meeting_participant.participantid " +
+	"FROM meeting_participant, participant " +
+	"WHERE " +
+	"meeting_participant.meetingid = ? AND " +
+	"meeting_participant.participantid = participant.id AND " +
+	"participant.ownerid = ? " +
+	"ORDER BY meeting_participant.participantid"
+
+// Check that the user attends the meeting. stmt is attendanceQuery.
+func checkAttendance(ctx *DispatchContext, stmt *sql.Stmt, meetingid int64) error {
+	var count int
+	if err := stmt.QueryRow(meetingid, ctx.userid).Scan(&count); err != nil {
+		return err
+	}
+	if count == 0 {
+		return errNotParticipant
+	}
+	return nil
+}
+
+func (app *App) initMessageHandlers() {
+	app.installStmtRestHandler("meeting/:id/messages",
+		&RouteDoc{
+			Summary:  "message history of a meeting, newest first",
+			Params:   pageParams,
+			Response: []*APIMessage{}},
+		[]string{
+			attendanceQuery,
+			"SELECT " + messageFields +
+				"FROM meeting_message, participant " +
+				"WHERE meeting_message.meetingid = ? AND meeting_message.id < ? AND " +
+				"meeting_message.partid = participant.id " +
+				"ORDER BY meeting_message.id DESC LIMIT ?"},
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			meetingid := ctx.IntParam("id")
+			if err := checkAttendance(ctx, stmts[0], meetingid); err != nil {
+				return err
+			}
+			before, limit, err := getFormPage(ctx.request.Form)
+			if err != nil {
+				return err
+			}
+
+			items, err := Uniplex(queueBufferSize,
+				func(out chan<- interface{}) error {
+					rows, err := stmts[1].Query(meetingid, before, limit)
+					if err != nil {
+						return err
+					}
+					for rows.Next() {
+						m := &Message{}
+						if err := rows.Scan(ConcatBasicFields(m, &m.Participant)...); err != nil {
+							out <- err
+						} else {
+							out <- m
+						}
+					}
+					return nil
+				})
+			if err != nil {
+				return err
+			}
+			WriteChannelAsJSONList(w, items)
+			return nil
+		})
+
+	app.installStmtRestHandler("meeting/:id/stream",
+		&RouteDoc{
+			Summary:  "json list of new, edited and deleted messages of a meeting, streamed as they happen",
+			Response: []*APIMessage{}},
+		[]string{attendanceQuery},
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			meetingid := ctx.IntParam("id")
+			if err := checkAttendance(ctx, stmts[0], meetingid); err != nil {
+				return err
+			}
+			flusher, keepalive, err := startStream(w, "application/json")
+			if err != nil {
+				return err
+			}
+			defer keepalive.Stop()
+
+			sub := ctx.app.Messages.Subscribe(meetingid, liveBufferSize)
+			items := make(chan interface{}, queueBufferSize)
+			// closed when the list is no longer written
+			done := make(chan struct{})
+			defer close(done)
+			go func() {
+				defer close(items)
+				defer ctx.app.Messages.Unsubscribe(meetingid, sub)
+				for {
+					var item interface{}
+					select {
+					case m, ok := <-sub:
+						if !ok {
+							return
+						}
+						// a participant who left gets no more messages
+						if err := checkAttendance(ctx, stmts[0], meetingid); err != nil {
+							return
+						}
+						item = m
+					case <-keepalive.C:
+						item = Keepalive{}
+					case <-done:
+						return
+					case <-ctx.request.Context().Done():
+						return
+					case <-serverStopping(ctx.request.Context()):
+						return
+					}
+					select {
+					case items <- item:
+					case <-done:
+						return
+					}
+				}
+			}()
+
+			if err := WriteChannelAsJSONList(&flushWriter{w, flusher}, items); err != nil {
+				log.Printf("meeting %d stream: %v", meetingid, err)
+			}
+			return nil
+		})
+
+	app.installStmtRestMethodHandler("POST", "meeting/:id/messages",
+		&RouteDoc{
+			Summary: "write a message to a meeting the user attends",
+			Params: []RouteParam{
+				{Name: "body", In: "query", Type: "string", Required: true},
+				{Name: "partid", In: "query", Type: "integer", Description: "participant to write as"}},
+			Response: &APIMessage{}},
+		[]string{
+			userMeetingParticipantsQuery,
+			"INSERT INTO meeting_message (meetingid, partid, ownerid, body, created, edited) " +
+				"VALUES (?, ?, ?, ?, ?, 0)",
+			messageByIdQuery},
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			meetingid := ctx.IntParam("id")
+			partid, err := messageAuthor(ctx, stmts[0], meetingid)
+			if err != nil {
+				return err
+			}
+			body, err := getFormString(ctx.request.Form, "body")
+			if err != nil {
+				return err
+			}
+			res, err := stmts[1].Exec(meetingid, partid, ctx.userid, body, time.Now().Unix())
+			if err != nil {
+				return err
+			}
+			id, err := res.LastInsertId()
+			if err != nil {
+				return err
+			}
+			m, err := loadMessage(stmts[2], meetingid, id)
+			if err != nil {
+				return err
+			}
+			ctx.app.Messages.Publish(m)
+			return writeJSON(w, m)
+		})
+
+	app.installStmtRestMethodHandler("PUT", "meeting/:id/messages/:msgid",
+		&RouteDoc{
+			Summary:  "edit a message written by the user",
+			Params:   []RouteParam{{Name: "body", In: "query", Type: "string", Required: true}},
+			Response: &APIMessage{}},
+		[]string{
+			messageByIdQuery,
+			"UPDATE meeting_message SET body = ?, edited = ? WHERE id = ?"},
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			m, err := loadMessage(stmts[0], ctx.IntParam("id"), ctx.IntParam("msgid"))
+			if err != nil {
+				return err
+			}
+			if m.Owner != ctx.userid {
+				return errNotOwner
+			}
+			if m.Body, err = getFormString(ctx.request.Form, "body"); err != nil {
+				return err
+			}
+			m.Edited = time.Now().Unix()
+			if _, err := stmts[1].Exec(m.Body, m.Edited, m.Id); err != nil {
+				return err
+			}
+			ctx.app.Messages.Publish(m)
+			return writeJSON(w, m)
+		})
+
+	app.installStmtRestMethodHandler("DELETE", "meeting/:id/messages/:msgid",
+		&RouteDoc{
+			Summary:  "delete a message written by the user",
+			Response: int64(0)},
+		[]string{
+			messageByIdQuery,
+			"DELETE FROM meeting_message WHERE id = ?"},
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			m, err := loadMessage(stmts[0], ctx.IntParam("id"), ctx.IntParam("msgid"))
+			if err != nil {
+				return err
+			}
+			if m.Owner != ctx.userid {
+				return errNotOwner
+			}
+			if _, err := stmts[1].Exec(m.Id); err != nil {
+				return err
+			}
+			m.Body = ""
+			m.Deleted = true
+			ctx.app.Messages.Publish(m)
+			return writeJSON(w, m.Id)
+		})
+}
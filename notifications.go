@@ -0,0 +1,528 @@
+package tbeer
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Kinds of notifications
+const (
+	NotifyInvitation        = "invitation"
+	NotifyAttending         = "attending"
+	NotifyLeft              = "left"
+	NotifyPromoted          = "promoted"
+	NotifyMeetingChanged    = "meeting_changed"
+	NotifyMeetingCancelled  = "meeting_cancelled"
+	NotifyAvailabilityMatch = "availability_match"
+)
+
+// user_preference keys selecting how notifications reach the user.
+// notify is one of deliveryMethods; in-app if not set.
+const (
+	notifyPrefKey  = "notify"
+	webhookPrefKey = "notify_webhook"
+)
+
+var deliveryMethods = []string{"inapp", "email", "webhook"}
+
+// Delivery states of a notification
+const (
+	deliveryPending = "pending"
+	deliverySent    = "sent"
+	deliveryFailed  = "failed"
+	// delivered only in the app
+	deliveryInApp = "inapp"
+)
+
+// Give up delivering a notification after this many failures
+const maxDeliveryAttempts = 5
+
+// In memory representation: Notification
+type Notification struct {
+	Id      int64
+	User    int64
+	Kind    string
+	Subject string
+	Body    string
+	Meeting int64
+	Created int64
+	Read    bool
+}
+
+func (n *Notification) BasicFields() []interface{} {
+	return []interface{}{&n.Id, &n.User, &n.Kind, &n.Subject, &n.Body, &n.Meeting, &n.Created, &n.Read}
+}
+
+func (n *Notification) APIValue() interface{} {
+	return &APINotification{n.Id, n.Kind, n.Subject, n.Body, n.Meeting, n.Created, n.Read}
+}
+
+const notificationFields = "id, userid, kind, subject, body, meetingid, created, read "
+
+// Notify users, except the one causing the notification. Notifications
+// are a side effect of the request, so failures are only logged.
+func notifyUsers(db *sql.DB, users []int64, except int64, kind string, meetingid int64, subject string, body string) {
+	now := time.Now().Unix()
+	for _, u := range users {
+		if u == except {
+			continue
+		}
+		_, err := db.Exec("INSERT INTO notification "+
+			"(userid, kind, subject, body, meetingid, created, read, delivery, attempts) "+
+			"VALUES (?, ?, ?, ?, ?, ?, 0, ?, 0)",
+			u, kind, subject, body, meetingid, now, deliveryPending)
+		if err != nil {
+			log.Printf("notify %d: %s", u, err)
+		}
+	}
+}
+
+// Text describing a meeting in notifications about it
+func meetingSummary(db *sql.DB, m *Meeting) string {
+	var tz string
+	db.QueryRow(placeTimezoneQuery, m.Place.Id).Scan(&tz)
+	return fmt.Sprintf("%s at %s, %s", m.Name, m.Place.Name,
+		time.Unix(int64(m.Period.Start), 0).In(placeLocation(tz)).Format("Mon Jan 2 15:04 MST"))
+}
+
+// Query a list of user ids, logging failures
+func queryUsers(db *sql.DB, q string, args ...interface{}) []int64 {
+	rows, err := db.Query(q, args...)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	defer rows.Close()
+	users := make([]int64, 0)
+	for rows.Next() {
+		var u int64
+		if err := rows.Scan(&u); err == nil {
+			users = append(users, u)
+		}
+	}
+	return users
+}
+
+// Users attending a meeting with one of their participants
+func meetingAttendees(db *sql.DB, meetingid int64) []int64 {
+	return queryUsers(db, "SELECT DISTINCT participant.ownerid "+
+		"FROM meeting_participant, participant "+
+		"WHERE meeting_participant.meetingid = ? AND "+
+		"meeting_participant.participantid = participant.id", meetingid)
+}
+
+// Notify the owners of other availabilities at the same place and
+// overlapping in time, that can see the new availability
+func notifyAvailabilityMatches(db *sql.DB, a *Availability) {
+	users := queryUsers(db, "SELECT DISTINCT availability.ownerid "+
+		"FROM availability, period "+
+		"WHERE availability.placeid = ? AND availability.id != ? AND "+
+		"availability.periodid = period.id AND "+
+		"period.start < ? AND period.end > ?",
+		a.Place.Id, a.Id, a.Period.End, a.Period.Start)
+	stmt, err := db.Prepare(visibilityQuery)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer stmt.Close()
+	visible := make([]int64, 0, len(users))
+	for _, u := range users {
+		if ok, err := canSee(stmt, u, a.Owner, a.Visibility); err == nil && ok {
+			visible = append(visible, u)
+		}
+	}
+	notifyUsers(db, visible, a.Owner, NotifyAvailabilityMatch, 0,
+		fmt.Sprintf("%s is available at %s", a.Participant.Alias, a.Place.Name),
+		a.Description)
+}
+
+// A Delivery sends notifications outside of the app
+type Delivery interface {
+	// Deliver a notification to an address, whose meaning
+	// depends on the delivery method
+	Deliver(n *Notification, to string) error
+}
+
+// Delivery by email through an SMTP server
+type EmailDelivery struct {
+	Addr string
+	From string
+	// nil for servers not requiring authentication
+	Auth smtp.Auth
+}
+
+func (d *EmailDelivery) Deliver(n *Notification, to string) error {
+	if to == "" {
+		return fmt.Errorf("user %d has no email address", n.User)
+	}
+	msg := &bytes.Buffer{}
+	fmt.Fprintf(msg, "From: %s\r\n", d.From)
+	fmt.Fprintf(msg, "To: %s\r\n", to)
+	subject := strings.NewReplacer("\r", " ", "\n", " ").Replace(n.Subject)
+	fmt.Fprintf(msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(msg, "%s\r\n", n.Body)
+	return smtp.SendMail(d.Addr, d.Auth, d.From, []string{to}, msg.Bytes())
+}
+
+// Delivery by posting the notification as json to a URL
+type WebhookDelivery struct {
+	Client *http.Client
+}
+
+// A client for webhooks, which are given by users, that only connects
+// to public addresses and does not follow redirects. It connects
+// directly, a proxy would make the address checks useless.
+func newWebhookClient() *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second, Control: publicAddressOnly}
+	return &http.Client{
+		Transport:     &http.Transport{DialContext: dialer.DialContext},
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		Timeout:       10 * time.Second,
+	}
+}
+
+// Shared address space of carrier-grade NAT, RFC 6598
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// Refuse to connect to loopback, link-local, private, shared and other
+// non-public addresses. Runs after name resolution, so host names
+// resolving to such addresses are refused too.
+func publicAddressOnly(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() || sharedAddressSpace.Contains(ip) {
+		return fmt.Errorf("refusing to connect to %s", host)
+	}
+	return nil
+}
+
+func (d *WebhookDelivery) Deliver(n *Notification, to string) error {
+	if to == "" {
+		return fmt.Errorf("user %d has no webhook", n.User)
+	}
+	data, err := json.Marshal(n.APIValue())
+	if err != nil {
+		return err
+	}
+	res, err := d.Client.Post(to, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	// redirects are not followed, so they fail here
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook %s: status %d", to, res.StatusCode)
+	}
+	return nil
+}
+
+// Background worker delivering pending notifications
+type NotificationWorker struct {
+	DB *sql.DB
+	// delivery method name to Delivery
+	Methods  map[string]Delivery
+	Interval time.Duration
+}
+
+// Create a worker with the delivery methods configured in env
+func NewNotificationWorker(env *Env, db *sql.DB) *NotificationWorker {
+	methods := map[string]Delivery{
+		"webhook": &WebhookDelivery{newWebhookClient()}}
+	if env.SMTPAddr != "" {
+		var auth smtp.Auth
+		if env.SMTPUser != "" {
+			host := strings.Split(env.SMTPAddr, ":")[0]
+			auth = smtp.PlainAuth("", env.SMTPUser, env.SMTPPassword, host)
+		}
+		methods["email"] = &EmailDelivery{env.SMTPAddr, env.SMTPFrom, auth}
+	}
+	return &NotificationWorker{db, methods, 10 * time.Second}
+}
+
+// Deliver pending notifications every Interval until stop is closed
+func (nw *NotificationWorker) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(nw.Interval)
+	defer ticker.Stop()
+	for {
+		if _, err := nw.DeliverPending(); err != nil {
+			log.Println(err)
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// A pending notification and where to deliver it
+type pendingNotification struct {
+	Notification
+	method   sql.NullString
+	email    sql.NullString
+	webhook  sql.NullString
+	attempts int
+}
+
+// Deliver all pending notifications once, returning the number sent
+func (nw *NotificationWorker) DeliverPending() (int, error) {
+	rows, err := nw.DB.Query("SELECT notification.id, notification.userid, notification.kind, " +
+		"notification.subject, notification.body, notification.meetingid, " +
+		"notification.created, notification.read, " +
+		"(SELECT value FROM user_preference WHERE ownerid = notification.userid AND key = '" + notifyPrefKey + "'), " +
+		"user.email, " +
+		"(SELECT value FROM user_preference WHERE ownerid = notification.userid AND key = '" + webhookPrefKey + "'), " +
+		"notification.attempts " +
+		"FROM notification, user " +
+		"WHERE notification.delivery = '" + deliveryPending + "' AND notification.userid = user.id " +
+		"ORDER BY notification.id")
+	if err != nil {
+		return 0, err
+	}
+	pending := make([]*pendingNotification, 0)
+	for rows.Next() {
+		p := &pendingNotification{}
+		if err := rows.Scan(append(p.BasicFields(), &p.method, &p.email, &p.webhook, &p.attempts)...); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		pending = append(pending, p)
+	}
+	rows.Close()
+
+	sent := 0
+	for _, p := range pending {
+		state := nw.deliver(p)
+		if state == deliverySent {
+			sent++
+		}
+		if _, err := nw.DB.Exec("UPDATE notification SET delivery = ?, attempts = ? WHERE id = ?",
+			state, p.attempts, p.Id); err != nil {
+			return sent, err
+		}
+	}
+	return sent, nil
+}
+
+// Deliver a notification by the method preferred by its user,
+// returning its new delivery state
+func (nw *NotificationWorker) deliver(p *pendingNotification) string {
+	if !p.method.Valid || p.method.String == "inapp" {
+		return deliveryInApp
+	}
+	d, ok := nw.Methods[p.method.String]
+	if !ok {
+		log.Printf("notification %d: no delivery method %s", p.Id, p.method.String)
+		return deliveryFailed
+	}
+	to := p.email.String
+	if p.method.String == "webhook" {
+		to = p.webhook.String
+	}
+	if err := d.Deliver(&p.Notification, to); err != nil {
+		log.Printf("notification %d: %s", p.Id, err)
+		p.attempts++
+		if p.attempts >= maxDeliveryAttempts {
+			return deliveryFailed
+		}
+		return deliveryPending
+	}
+	return deliverySent
+}
+
+func (app *App) initNotificationHandlers() {
+	app.installStmtRestHandler("notifications",
+		&RouteDoc{
+			Summary: "notifications of the user, newest first",
+			Params: append([]RouteParam{
+				{Name: "unread", In: "query", Type: "boolean", Description: "only unread notifications"}},
+				pageParams...),
+			Response: []*APINotification{}},
+		[]string{
+			"SELECT " + notificationFields + "FROM notification " +
+				"WHERE userid = ? AND id < ? AND read <= ? " +
+				"ORDER BY id DESC LIMIT ?"},
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			before, limit, err := getFormPage(ctx.request.Form)
+			if err != nil {
+				return err
+			}
+			maxRead := 1
+			if v := ctx.request.Form.Get("unread"); v == "1" || v == "true" {
+				maxRead = 0
+			}
+
+			items, err := Uniplex(queueBufferSize,
+				func(out chan<- interface{}) error {
+					rows, err := stmts[0].Query(ctx.userid, before, maxRead, limit)
+					if err != nil {
+						return err
+					}
+					for rows.Next() {
+						n := &Notification{}
+						if err := rows.Scan(n.BasicFields()...); err != nil {
+							out <- err
+						} else {
+							out <- n
+						}
+					}
+					return nil
+				})
+			if err != nil {
+				return err
+			}
+			WriteChannelAsJSONList(w, items)
+			return nil
+		})
+
+	readParam := RouteParam{Name: "read", In: "query", Type: "boolean", Description: "true if omitted"}
+
+	// read state from the form
+	formRead := func(ctx *DispatchContext) bool {
+		v := ctx.request.Form.Get("read")
+		return v == "" || v == "1" || v == "true"
+	}
+
+	app.installStmtRestMethodHandler("PUT", "notifications",
+		&RouteDoc{
+			Summary:  "mark all notifications of the user as read or unread",
+			Params:   []RouteParam{readParam},
+			Response: int64(0)},
+		[]string{"UPDATE notification SET read = ? WHERE userid = ?"},
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			res, err := stmts[0].Exec(formRead(ctx), ctx.userid)
+			if err != nil {
+				return err
+			}
+			count, err := res.RowsAffected()
+			if err != nil {
+				return err
+			}
+			return writeJSON(w, count)
+		})
+
+	app.installStmtRestMethodHandler("PUT", "notifications/:id",
+		&RouteDoc{
+			Summary:  "mark a notification as read or unread",
+			Params:   []RouteParam{readParam},
+			Response: &APINotification{}},
+		[]string{
+			"SELECT " + notificationFields + "FROM notification WHERE id = ?",
+			"UPDATE notification SET read = ? WHERE id = ?"},
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			n := &Notification{}
+			if err := stmts[0].QueryRow(ctx.IntParam("id")).Scan(n.BasicFields()...); err != nil {
+				return err
+			}
+			if n.User != ctx.userid {
+				return errNotOwner
+			}
+			n.Read = formRead(ctx)
+			if _, err := stmts[1].Exec(n.Read, n.Id); err != nil {
+				return err
+			}
+			return writeJSON(w, n)
+		})
+
+	app.installStmtRestMethodHandler("PUT", "userpref",
+		&RouteDoc{
+			Summary: "set preferences of the user",
+			Params: []RouteParam{
+				{Name: notifyPrefKey, In: "query", Type: "string",
+					Description: "notification delivery: " + strings.Join(deliveryMethods, ", ")},
+				{Name: webhookPrefKey, In: "query", Type: "string", Format: "uri"},
+				{Name: "homelat", In: "query", Type: "number"},
+				{Name: "homelong", In: "query", Type: "number"}},
+			Response: map[string]interface{}{}},
+		[]string{"INSERT OR REPLACE INTO user_preference (ownerid, key, value) VALUES (?, ?, ?)"},
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			form := ctx.request.Form
+			prefs := make(map[string]interface{})
+			if _, ok := form[notifyPrefKey]; ok {
+				method := form.Get(notifyPrefKey)
+				known := false
+				for _, m := range deliveryMethods {
+					known = known || m == method
+				}
+				if !known {
+					return fmt.Errorf("unknown delivery method: %s", method)
+				}
+				prefs[notifyPrefKey] = method
+			}
+			if _, ok := form[webhookPrefKey]; ok {
+				hook := form.Get(webhookPrefKey)
+				if !strings.HasPrefix(hook, "http://") && !strings.HasPrefix(hook, "https://") {
+					return fmt.Errorf("webhook is not an http url: %s", hook)
+				}
+				prefs[webhookPrefKey] = hook
+			}
+			for _, key := range []string{"homelat", "homelong"} {
+				if _, ok := form[key]; ok {
+					f, err := getFormFloat(form, key)
+					if err != nil {
+						return err
+					}
+					prefs[key] = f
+				}
+			}
+			err := ctx.app.inTransaction(func(tx *sql.Tx) error {
+				for key, val := range prefs {
+					if _, err := tx.Stmt(stmts[0]).Exec(ctx.userid, key, val); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			return writeJSON(w, prefs)
+		})
+
+	app.installStmtRestMethodHandler("POST", "meeting/:id/invitations",
+		&RouteDoc{
+			Summary:  "invite a user to a meeting the user attends",
+			Params:   []RouteParam{{Name: "userid", In: "query", Type: "integer", Required: true}},
+			Response: int64(0)},
+		[]string{attendanceQuery, meetingByIdQuery, "SELECT alias FROM user WHERE id = ?", visibilityQuery},
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			m, _, err := loadVisibleMeeting(ctx, stmts[1], stmts[3], ctx.IntParam("id"))
+			if err != nil {
+				return err
+			}
+			if err := checkAttendance(ctx, stmts[0], m.Id); err != nil {
+				return err
+			}
+			invitee, err := getFormInt(ctx.request.Form, "userid")
+			if err != nil {
+				return err
+			}
+			var inviter string
+			if err := stmts[2].QueryRow(ctx.userid).Scan(&inviter); err != nil {
+				return err
+			}
+			var alias string
+			if err := stmts[2].QueryRow(invitee).Scan(&alias); err != nil {
+				return fmt.Errorf("no such user: %d", invitee)
+			}
+			notifyUsers(ctx.app.DB, []int64{invitee}, ctx.userid, NotifyInvitation, m.Id,
+				fmt.Sprintf("%s invites you to %s", inviter, m.Name), meetingSummary(ctx.app.DB, m))
+			return writeJSON(w, invitee)
+		})
+}
@@ -0,0 +1,246 @@
+package tbeer
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// Minimal SMTP server accepting one message per connection
+// and sending its data on the returned channel
+func fakeSMTPServer(t *testing.T) (string, <-chan string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				fmt.Fprintf(conn, "220 fake ESMTP\r\n")
+				var data []string
+				inData := false
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					line = strings.TrimRight(line, "\r\n")
+					if inData {
+						if line == "." {
+							inData = false
+							messages <- strings.Join(data, "\n")
+							fmt.Fprintf(conn, "250 queued\r\n")
+						} else {
+							data = append(data, line)
+						}
+						continue
+					}
+					switch cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); cmd {
+					case "EHLO", "HELO":
+						fmt.Fprintf(conn, "250 fake\r\n")
+					case "DATA":
+						inData = true
+						fmt.Fprintf(conn, "354 go ahead\r\n")
+					case "QUIT":
+						fmt.Fprintf(conn, "221 bye\r\n")
+						return
+					default:
+						fmt.Fprintf(conn, "250 ok\r\n")
+					}
+				}
+			}(conn)
+		}
+	}()
+	return l.Addr().String(), messages, func() { l.Close() }
+}
+
+func TestNotificationDelivery(t *testing.T) {
+	app := OpenTestEnv()
+	defer CloseTestEnv(app)
+
+	addr, mails, stop := fakeSMTPServer(t)
+	defer stop()
+
+	hooks := make(chan *APINotification, 10)
+	hookServ := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := &APINotification{}
+		if err := json.NewDecoder(r.Body).Decode(n); err != nil {
+			t.Error(err)
+		}
+		hooks <- n
+	}))
+	defer hookServ.Close()
+
+	exec := func(q string, args ...interface{}) {
+		if _, err := app.DB.Exec(q, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exec("DELETE FROM notification")
+	exec("UPDATE user SET email = 'one@example.com' WHERE id = 1")
+	exec("INSERT OR REPLACE INTO user_preference (ownerid, key, value) VALUES (1, ?, 'email')", notifyPrefKey)
+	exec("INSERT OR REPLACE INTO user_preference (ownerid, key, value) VALUES (2, ?, 'webhook')", notifyPrefKey)
+	exec("INSERT OR REPLACE INTO user_preference (ownerid, key, value) VALUES (2, ?, ?)", webhookPrefKey, hookServ.URL)
+	defer func() {
+		exec("DELETE FROM notification")
+		exec("DELETE FROM user_preference WHERE key IN (?, ?)", notifyPrefKey, webhookPrefKey)
+	}()
+
+	notifyUsers(app.DB, []int64{1, 2, 3}, 0, NotifyInvitation, 0, "come along", "beer at noon")
+
+	worker := NewNotificationWorker(&Env{SMTPAddr: addr, SMTPFrom: "tbeer@example.com"}, app.DB)
+	// the test server is on the loopback address refused to webhooks
+	worker.Methods["webhook"] = &WebhookDelivery{hookServ.Client()}
+	sent, err := worker.DeliverPending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent != 2 {
+		t.Errorf("sent %d notifications, expected 2", sent)
+	}
+
+	mail := <-mails
+	if !strings.Contains(mail, "Subject: come along") || !strings.Contains(mail, "beer at noon") {
+		t.Errorf("unexpected mail %q", mail)
+	}
+	if n := <-hooks; n.Subject != "come along" || n.Kind != NotifyInvitation {
+		t.Errorf("unexpected webhook notification %+v", n)
+	}
+
+	var pending int
+	app.DB.QueryRow("SELECT count(*) FROM notification WHERE delivery = ?", deliveryPending).Scan(&pending)
+	if pending != 0 {
+		t.Errorf("%d notifications still pending", pending)
+	}
+}
+
+func TestWebhookAddresses(t *testing.T) {
+	redirect := httptest.NewServer(http.RedirectHandler("http://169.254.169.254/", http.StatusFound))
+	defer redirect.Close()
+	n := &Notification{User: 1, Kind: NotifyInvitation, Subject: "come along"}
+
+	// the loopback test server itself is refused, and redirects are not
+	// followed by the webhook client
+	if err := (&WebhookDelivery{newWebhookClient()}).Deliver(n, redirect.URL); err == nil {
+		t.Error("posted to a loopback address")
+	}
+	if err := (&WebhookDelivery{newWebhookClient()}).Deliver(n, "http://[::1]:1/"); err == nil {
+		t.Error("posted to a loopback address")
+	}
+	client := newWebhookClient()
+	client.Transport = redirect.Client().Transport
+	if err := (&WebhookDelivery{client}).Deliver(n, redirect.URL); err == nil || !strings.Contains(err.Error(), "302") {
+		t.Errorf("followed a redirect: %v", err)
+	}
+
+	for _, addr := range []string{"127.0.0.1:80", "10.0.0.1:80", "192.168.1.1:443", "169.254.169.254:80", "[fe80::1]:80", "0.0.0.0:80", "100.64.0.1:80", "100.127.255.254:443"} {
+		if err := publicAddressOnly("tcp", addr, nil); err == nil {
+			t.Errorf("allowed %s", addr)
+		}
+	}
+	for _, addr := range []string{"93.184.216.34:443", "100.128.0.1:443"} {
+		if err := publicAddressOnly("tcp", addr, nil); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestMailSubject(t *testing.T) {
+	addr, mails, stop := fakeSMTPServer(t)
+	defer stop()
+	d := &EmailDelivery{Addr: addr, From: "tbeer@example.com"}
+	n := &Notification{User: 1, Subject: "hi\rBcc: victim@example.com\nX: y", Body: "beer"}
+	if err := d.Deliver(n, "one@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	mail := <-mails
+	for _, line := range strings.Split(mail, "\n") {
+		if strings.HasPrefix(line, "Bcc:") || strings.HasPrefix(line, "X:") || strings.Contains(line, "\r") {
+			t.Errorf("injected header in %q", mail)
+		}
+	}
+}
+
+func TestMeetingSummaryTimezone(t *testing.T) {
+	app := OpenTestEnv()
+	defer CloseTestEnv(app)
+	var tz sql.NullString
+	app.DB.QueryRow("SELECT timezone FROM place WHERE id = 1").Scan(&tz)
+	app.DB.Exec("UPDATE place SET timezone = 'Europe/Oslo' WHERE id = 1")
+	defer app.DB.Exec("UPDATE place SET timezone = ? WHERE id = 1", tz)
+
+	// 2021-07-01 17:00 UTC
+	m := &Meeting{Name: "summer", Place: Place{Id: 1, Name: "bar"}, Period: Period{Start: 1625158800}}
+	if s := meetingSummary(app.DB, m); s != "summer at bar, Thu Jul 1 19:00 CEST" {
+		t.Errorf("unexpected summary %q", s)
+	}
+}
+
+func TestNotificationsFeed(t *testing.T) {
+	app := OpenTestEnv()
+	defer CloseTestEnv(app)
+	serv := httptest.NewServer(app)
+	defer serv.Close()
+
+	app.DB.Exec("DELETE FROM notification WHERE userid = 1")
+	defer app.DB.Exec("DELETE FROM notification WHERE userid = 1")
+	notifyUsers(app.DB, []int64{1}, 0, NotifyMeetingChanged, 1, "first", "")
+	notifyUsers(app.DB, []int64{1}, 0, NotifyMeetingChanged, 1, "second", "")
+
+	list := func(query string) []APINotification {
+		res, err := http.Get(serv.URL + "/api/notifications" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var items []APINotification
+		if err := json.NewDecoder(res.Body).Decode(&items); err != nil {
+			t.Fatal(err)
+		}
+		return items
+	}
+
+	items := list("?unread=1")
+	if len(items) != 2 || items[0].Subject != "second" {
+		t.Fatalf("unexpected unread notifications %+v", items)
+	}
+
+	req, _ := http.NewRequest("PUT", fmt.Sprintf("%s/api/notifications/%d?read=1", serv.URL, items[0].Id), nil)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Fatalf("mark read: status %d", res.StatusCode)
+	}
+	if items := list("?unread=1"); len(items) != 1 || items[0].Subject != "first" {
+		t.Errorf("unexpected unread notifications after marking one read %+v", items)
+	}
+	if items := list("?limit=1"); len(items) != 1 || !items[0].Read {
+		t.Errorf("unexpected first page %+v", items)
+	}
+
+	res, err = http.PostForm(serv.URL+"/api/meeting/1/invitations", url.Values{"userid": {"1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if items := list("?unread=1"); len(items) != 1 {
+		t.Errorf("self invitation created a notification")
+	}
+}
@@ -0,0 +1,268 @@
+package tbeer
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Weekdays as used in opening hours, starting on Sunday like time.Weekday
+var openingWeekdays = []string{"su", "mo", "tu", "we", "th", "fr", "sa"}
+
+// The order days are listed in, Monday first
+var openingDayOrder = []time.Weekday{
+	time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday, time.Saturday, time.Sunday}
+
+const openingDateLayout = "2006-01-02"
+
+// A span of local time a place is open on a day. Day is a weekday
+// in openingWeekdays, or a date overriding the weekly hours on that date.
+// Open and Close are minutes after midnight; a close before the open
+// time is after midnight. Open equal to Close is closed all day.
+type OpeningSpan struct {
+	Day   string
+	Open  int
+	Close int
+}
+
+func (s *OpeningSpan) BasicFields() []interface{} {
+	return []interface{}{&s.Day, &s.Open, &s.Close}
+}
+
+// The opening hours of a place, in the time zone of the place.
+// Without any spans the opening hours are unknown.
+type OpeningHours []*OpeningSpan
+
+var openingTimePattern = regexp.MustCompile(`^(\d\d):(\d\d)-(\d\d):(\d\d)$`)
+
+func weekdayIndex(s string) int {
+	for i, d := range openingWeekdays {
+		if d == s {
+			return i
+		}
+	}
+	return -1
+}
+
+// Expand a day selector: a weekday, a range of weekdays, or a date
+func parseOpeningDays(sel string) ([]string, error) {
+	if _, err := time.Parse(openingDateLayout, sel); err == nil {
+		return []string{sel}, nil
+	}
+	bounds := strings.SplitN(sel, "-", 2)
+	from := weekdayIndex(bounds[0])
+	to := from
+	if len(bounds) == 2 {
+		to = weekdayIndex(bounds[1])
+	}
+	if from < 0 || to < 0 {
+		return nil, fmt.Errorf("bad day: %s", sel)
+	}
+	days := make([]string, 0, 7)
+	// in the order of the week, so that fr-mo includes the weekend
+	from = (from + 6) % 7
+	to = (to + 6) % 7
+	for i := from; ; i = (i + 1) % 7 {
+		days = append(days, openingWeekdays[openingDayOrder[i]])
+		if i == to {
+			break
+		}
+	}
+	return days, nil
+}
+
+// Parse opening hours in a subset of the OpenStreetMap opening_hours
+// syntax: rules separated by semicolons, each a comma separated list
+// of weekdays, weekday ranges or dates followed by comma separated
+// time spans or "off". Rules without days apply to every day, and
+// "24/7" is always open, for example:
+//
+//	Mo-Th 16:00-23:00; Fr,Sa 14:00-02:00; 2021-12-24 off
+func ParseOpeningHours(s string) (OpeningHours, error) {
+	h := make(OpeningHours, 0)
+	for _, rule := range strings.Split(strings.ToLower(s), ";") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		if rule == "24/7" {
+			rule = "00:00-24:00"
+		}
+		fields := strings.Fields(rule)
+		days := openingWeekdays
+		if len(fields) == 2 {
+			days = nil
+			for _, sel := range strings.Split(fields[0], ",") {
+				d, err := parseOpeningDays(sel)
+				if err != nil {
+					return nil, err
+				}
+				days = append(days, d...)
+			}
+		} else if len(fields) != 1 {
+			return nil, fmt.Errorf("bad rule: %s", rule)
+		}
+		times := fields[len(fields)-1]
+
+		for _, day := range days {
+			// a later rule for a day replaces earlier ones
+			kept := h[:0]
+			for _, span := range h {
+				if span.Day != day {
+					kept = append(kept, span)
+				}
+			}
+			h = kept
+
+			if times == "off" || times == "closed" {
+				h = append(h, &OpeningSpan{Day: day})
+				continue
+			}
+			for _, t := range strings.Split(times, ",") {
+				m := openingTimePattern.FindStringSubmatch(t)
+				if m == nil {
+					return nil, fmt.Errorf("bad time span: %s", t)
+				}
+				var hm [4]int
+				for i := range hm {
+					fmt.Sscan(m[i+1], &hm[i])
+				}
+				open, close := hm[0]*60+hm[1], hm[2]*60+hm[3]
+				if hm[0] > 23 || hm[1] > 59 || hm[2] > 24 || hm[3] > 59 || close > 24*60 {
+					return nil, fmt.Errorf("bad time span: %s", t)
+				}
+				if open == close {
+					return nil, fmt.Errorf("empty time span: %s", t)
+				}
+				h = append(h, &OpeningSpan{Day: day, Open: open, Close: close})
+			}
+		}
+	}
+	return h, nil
+}
+
+func formatOpeningTime(minutes int) string {
+	return fmt.Sprintf("%02d:%02d", minutes/60, minutes%60)
+}
+
+// The opening hours in the syntax of ParseOpeningHours, with
+// consecutive weekdays of the same hours joined into ranges
+func (h OpeningHours) String() string {
+	times := make(map[string][]string)
+	dates := make([]string, 0)
+	for _, span := range h {
+		if _, ok := times[span.Day]; !ok && weekdayIndex(span.Day) < 0 {
+			dates = append(dates, span.Day)
+		}
+		if span.Open == span.Close {
+			times[span.Day] = []string{"off"}
+		} else {
+			times[span.Day] = append(times[span.Day], formatOpeningTime(span.Open)+"-"+formatOpeningTime(span.Close))
+		}
+	}
+
+	rules := make([]string, 0)
+	title := func(day string) string {
+		if weekdayIndex(day) < 0 {
+			return day
+		}
+		return strings.ToUpper(day[:1]) + day[1:]
+	}
+	for i := 0; i < len(openingDayOrder); {
+		day := openingWeekdays[openingDayOrder[i]]
+		t, ok := times[day]
+		if !ok {
+			i++
+			continue
+		}
+		j := i + 1
+		for ; j < len(openingDayOrder); j++ {
+			next := times[openingWeekdays[openingDayOrder[j]]]
+			if strings.Join(next, ",") != strings.Join(t, ",") {
+				break
+			}
+		}
+		days := title(day)
+		if j-i > 1 {
+			days += "-" + title(openingWeekdays[openingDayOrder[j-1]])
+		}
+		rules = append(rules, days+" "+strings.Join(t, ","))
+		i = j
+	}
+	sort.Strings(dates)
+	for _, date := range dates {
+		rules = append(rules, date+" "+strings.Join(times[date], ","))
+	}
+	return strings.Join(rules, "; ")
+}
+
+// The spans of the given local date as absolute time intervals
+func (h OpeningHours) intervalsOn(year int, month time.Month, day int, loc *time.Location) []Period {
+	date := time.Date(year, month, day, 0, 0, 0, 0, loc)
+	key := date.Format(openingDateLayout)
+	spans := make([]*OpeningSpan, 0)
+	for _, span := range h {
+		if span.Day == key {
+			spans = append(spans, span)
+		}
+	}
+	if len(spans) == 0 {
+		weekday := openingWeekdays[date.Weekday()]
+		for _, span := range h {
+			if span.Day == weekday {
+				spans = append(spans, span)
+			}
+		}
+	}
+	intervals := make([]Period, 0, len(spans))
+	for _, span := range spans {
+		if span.Open == span.Close {
+			continue
+		}
+		closeDay := day
+		if span.Close < span.Open {
+			closeDay++
+		}
+		open := time.Date(year, month, day, span.Open/60, span.Open%60, 0, 0, loc)
+		close := time.Date(year, month, closeDay, span.Close/60, span.Close%60, 0, 0, loc)
+		intervals = append(intervals, Period{Start: int(open.Unix()), End: int(close.Unix())})
+	}
+	return intervals
+}
+
+// Whether the place is open during all of the period. Unknown
+// opening hours are always open.
+func (h OpeningHours) Covers(p Period, loc *time.Location) bool {
+	if len(h) == 0 {
+		return true
+	}
+	// spans of the day before may last past midnight
+	start := time.Unix(int64(p.Start), 0).In(loc)
+	first := time.Date(start.Year(), start.Month(), start.Day()-1, 0, 0, 0, 0, loc)
+	last := time.Unix(int64(p.End), 0).In(loc)
+	intervals := make([]Period, 0)
+	for d := first; !d.After(last); d = d.AddDate(0, 0, 1) {
+		intervals = append(intervals, h.intervalsOn(d.Year(), d.Month(), d.Day(), loc)...)
+	}
+	sort.Slice(intervals, func(i, j int) bool { return intervals[i].Start < intervals[j].Start })
+	at := p.Start
+	for _, i := range intervals {
+		if i.Start > at {
+			break
+		}
+		if i.End > at {
+			at = i.End
+		}
+		if at >= p.End {
+			return true
+		}
+	}
+	return at >= p.End
+}
+
+// Whether the place is open at the time
+func (h OpeningHours) IsOpen(t int, loc *time.Location) bool {
+	return h.Covers(Period{Start: t, End: t + 1}, loc)
+}
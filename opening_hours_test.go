@@ -0,0 +1,83 @@
+package tbeer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseOpeningHours(t *testing.T) {
+	tests := []struct{ in, out string }{
+		{"Mo-Th 16:00-23:00; Fr,Sa 14:00-02:00", "Mo-Th 16:00-23:00; Fr-Sa 14:00-02:00"},
+		{"mo-su 12:00-15:00,18:00-23:00; Tu off", "Mo 12:00-15:00,18:00-23:00; Tu off; We-Su 12:00-15:00,18:00-23:00"},
+		{"24/7; 2021-12-24 off", "Mo-Su 00:00-24:00; 2021-12-24 off"},
+		{"Fr-Mo 20:00-04:00", "Mo 20:00-04:00; Fr-Su 20:00-04:00"},
+		{"10:00-20:00; Su 12:00-18:00", "Mo-Sa 10:00-20:00; Su 12:00-18:00"},
+		{"", ""},
+	}
+	for _, test := range tests {
+		h, err := ParseOpeningHours(test.in)
+		if err != nil {
+			t.Errorf("%q: %v", test.in, err)
+			continue
+		}
+		if s := h.String(); s != test.out {
+			t.Errorf("%q formatted as %q, expected %q", test.in, s, test.out)
+		}
+		if again, err := ParseOpeningHours(h.String()); err != nil || again.String() != test.out {
+			t.Errorf("%q does not survive formatting: %q, %v", test.in, again, err)
+		}
+	}
+
+	for _, bad := range []string{"Xy 10:00-12:00", "Mo 10-12", "Mo 25:00-26:00", "Mo 10:00-10:00", "Mo Tu 10:00-12:00"} {
+		if _, err := ParseOpeningHours(bad); err == nil {
+			t.Errorf("accepted %q", bad)
+		}
+	}
+}
+
+func TestOpeningHoursCovers(t *testing.T) {
+	oslo, err := time.LoadLocation("Europe/Oslo")
+	if err != nil {
+		t.Skip(err)
+	}
+	h, err := ParseOpeningHours("Mo-Th 16:00-23:00; Fr 16:00-02:00; Sa 12:00-24:00; Su 00:00-01:00; 2021-01-07 off")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(day, hour, min int) int {
+		return int(time.Date(2021, 1, day, hour, min, 0, 0, oslo).Unix())
+	}
+
+	tests := []struct {
+		name     string
+		start    int
+		end      int
+		expected bool
+	}{
+		{"monday evening", at(4, 18, 0), at(4, 20, 0), true},
+		{"monday after closing", at(4, 22, 0), at(4, 23, 30), false},
+		{"monday morning", at(4, 10, 0), at(4, 11, 0), false},
+		{"thursday exception", at(7, 18, 0), at(7, 20, 0), false},
+		{"friday past midnight", at(8, 23, 0), at(9, 1, 30), true},
+		{"friday until closing", at(8, 16, 0), at(9, 2, 0), true},
+		{"friday too late", at(9, 1, 0), at(9, 3, 0), false},
+		{"saturday into sunday", at(9, 22, 0), at(10, 0, 30), true},
+		{"sunday after one", at(10, 0, 30), at(10, 1, 30), false},
+	}
+	for _, test := range tests {
+		if covered := h.Covers(Period{Start: test.start, End: test.end}, oslo); covered != test.expected {
+			t.Errorf("%s: covered %v, expected %v", test.name, covered, test.expected)
+		}
+	}
+
+	// 15:30 UTC is 16:30 in Oslo in winter
+	if !h.IsOpen(int(time.Date(2021, 1, 4, 15, 30, 0, 0, time.UTC).Unix()), oslo) {
+		t.Error("closed at 16:30 local time")
+	}
+	if h.IsOpen(int(time.Date(2021, 1, 4, 15, 30, 0, 0, time.UTC).Unix()), time.UTC) {
+		t.Error("open at 15:30 UTC")
+	}
+	if !(OpeningHours{}).IsOpen(at(4, 4, 0), oslo) {
+		t.Error("unknown opening hours are not always open")
+	}
+}
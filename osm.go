@@ -0,0 +1,489 @@
+package tbeer
+
+import (
+	"compress/bzip2"
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Radius in meters of places imported from nodes, which are points
+const osmNodeRadius = 25
+
+// A node or way of an OpenStreetMap extract
+type osmElement struct {
+	kind string
+	id   int64
+	// the position of nodes, or the center of ways if the extract has it
+	lat    float64
+	long   float64
+	hasPos bool
+	tags   map[string]string
+	// the nodes of ways
+	refs []int64
+}
+
+// Reads the elements of an extract in some format, calling fn for each
+type osmScanner func(r io.Reader, fn func(e *osmElement) error) error
+
+// A place found in an extract
+type osmPlace struct {
+	osmid     string
+	name      string
+	lat       float64
+	long      float64
+	radius    int
+	category  string
+	amenities []string
+	// nil if the extract does not have them
+	hours   OpeningHours
+	address []*Address
+}
+
+// Counts of an import. Skipped places lack a name or a position.
+type OSMImportStats struct {
+	Inserted int
+	Updated  int
+	Skipped  int
+}
+
+// The place category of the tags of an element, or "" if it is not
+// a place to drink beer. Breweries are usually tagged craft=brewery.
+func osmCategory(tags map[string]string) string {
+	switch tags["amenity"] {
+	case "pub":
+		if tags["microbrewery"] == "yes" {
+			return "brewpub"
+		}
+		return "pub"
+	case "bar":
+		return "bar"
+	case "biergarten":
+		return "beer_garden"
+	case "brewery":
+		return "brewery"
+	}
+	if tags["craft"] == "brewery" {
+		return "brewery"
+	}
+	return ""
+}
+
+func osmAmenities(tags map[string]string) []string {
+	amenities := make([]string, 0)
+	if tags["outdoor_seating"] == "yes" {
+		amenities = append(amenities, "outdoor_seating")
+	}
+	if tags["food"] == "yes" || tags["cuisine"] != "" {
+		amenities = append(amenities, "food")
+	}
+	if contains([]string{"yes", "wlan", "wifi"}, tags["internet_access"]) {
+		amenities = append(amenities, "wifi")
+	}
+	if tags["wheelchair"] == "yes" {
+		amenities = append(amenities, "wheelchair")
+	}
+	if tags["live_music"] == "yes" {
+		amenities = append(amenities, "live_music")
+	}
+	if tags["dog"] == "yes" {
+		amenities = append(amenities, "dogs")
+	}
+	return amenities
+}
+
+func osmAddress(tags map[string]string) []*Address {
+	address := make([]*Address, 0)
+	if street := tags["addr:street"]; street != "" {
+		address = append(address, &Address{AddressStreet, strings.TrimSpace(street + " " + tags["addr:housenumber"])})
+	}
+	for _, a := range []struct {
+		key string
+		typ int
+	}{
+		{"addr:postcode", AddressPostcode},
+		{"addr:city", AddressLocality},
+		{"addr:state", AddressRegion},
+		{"addr:country", AddressCountry}} {
+		if v := tags[a.key]; v != "" {
+			address = append(address, &Address{a.typ, v})
+		}
+	}
+	return address
+}
+
+// The place of an element, without position
+func newOSMPlace(e *osmElement, category string) *osmPlace {
+	p := &osmPlace{
+		osmid:     e.kind + "/" + strconv.FormatInt(e.id, 10),
+		name:      strings.TrimSpace(e.tags["name"]),
+		lat:       e.lat,
+		long:      e.long,
+		radius:    osmNodeRadius,
+		category:  category,
+		amenities: osmAmenities(e.tags),
+		address:   osmAddress(e.tags),
+	}
+	if h, err := ParseOpeningHours(e.tags["opening_hours"]); err == nil && len(h) > 0 {
+		p.hours = h
+	}
+	return p
+}
+
+// Find the places of an extract. open is called once more if the
+// positions of ways have to be found from their nodes.
+func readOSMPlaces(open func() (io.ReadCloser, error), scan osmScanner) ([]*osmPlace, int, error) {
+	places := make([]*osmPlace, 0)
+	skipped := 0
+	type way struct {
+		place *osmPlace
+		refs  []int64
+	}
+	pending := make([]way, 0)
+	needed := make(map[int64]bool)
+
+	scanFile := func(fn func(e *osmElement) error) error {
+		r, err := open()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		return scan(r, fn)
+	}
+
+	err := scanFile(func(e *osmElement) error {
+		category := osmCategory(e.tags)
+		if category == "" {
+			return nil
+		}
+		p := newOSMPlace(e, category)
+		switch {
+		case p.name == "":
+			skipped++
+		case e.hasPos:
+			places = append(places, p)
+		case e.kind == "way" && len(e.refs) > 0:
+			pending = append(pending, way{p, e.refs})
+			for _, ref := range e.refs {
+				needed[ref] = true
+			}
+		default:
+			skipped++
+		}
+		return nil
+	})
+	if err != nil || len(pending) == 0 {
+		return places, skipped, err
+	}
+
+	positions := make(map[int64][2]float64)
+	err = scanFile(func(e *osmElement) error {
+		if e.kind == "node" && needed[e.id] {
+			positions[e.id] = [2]float64{e.lat, e.long}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, w := range pending {
+		if placeWay(w.place, w.refs, positions) {
+			places = append(places, w.place)
+		} else {
+			skipped++
+		}
+	}
+	return places, skipped, nil
+}
+
+// Put the place of a way at the center of its nodes, with a radius
+// reaching all of them. False if none of the nodes are known.
+func placeWay(p *osmPlace, refs []int64, positions map[int64][2]float64) bool {
+	// closed ways repeat the first node last
+	if len(refs) > 1 && refs[0] == refs[len(refs)-1] {
+		refs = refs[:len(refs)-1]
+	}
+	var lat, long float64
+	n := 0
+	for _, ref := range refs {
+		if pos, ok := positions[ref]; ok {
+			lat += pos[0]
+			long += pos[1]
+			n++
+		}
+	}
+	if n == 0 {
+		return false
+	}
+	p.lat, p.long = lat/float64(n), long/float64(n)
+	radius := 0.0
+	for _, ref := range refs {
+		if pos, ok := positions[ref]; ok {
+			radius = math.Max(radius, distance(p.lat, p.long, pos[0], pos[1]))
+		}
+	}
+	p.radius = int(math.Ceil(radius))
+	return true
+}
+
+// Insert the places not imported before, and update the others
+func upsertOSMPlaces(db *sql.DB, places []*osmPlace, stats *OSMImportStats) error {
+	queries := []string{
+		"SELECT placeid FROM place_osm WHERE osmid = ?",
+		"INSERT INTO place (name, lat, long, radius, category) VALUES (?, ?, ?, ?, ?)",
+		"INSERT INTO place_osm (osmid, placeid) VALUES (?, ?)",
+		"UPDATE place SET name = ?, lat = ?, long = ?, radius = ?, category = ? WHERE id = ?",
+		"DELETE FROM address WHERE id IN (SELECT addressid FROM place_address WHERE placeid = ?)",
+		"DELETE FROM place_address WHERE placeid = ?",
+		"INSERT INTO address (type, value) VALUES (?, ?)",
+		"INSERT INTO place_address (placeid, addressid) VALUES (?, ?)",
+		"DELETE FROM place_tag WHERE placeid = ?",
+		"INSERT INTO place_tag (placeid, tag) VALUES (?, ?)",
+		"DELETE FROM place_hours WHERE placeid = ?",
+		"INSERT INTO place_hours (placeid, day, open, close) VALUES (?, ?, ?, ?)"}
+
+	return inTransactionOf(db, func(tx *sql.Tx) error {
+		stmts := make([]*sql.Stmt, len(queries))
+		for i, q := range queries {
+			var err error
+			if stmts[i], err = tx.Prepare(q); err != nil {
+				return err
+			}
+			defer stmts[i].Close()
+		}
+
+		for _, p := range places {
+			var id int64
+			err := stmts[0].QueryRow(p.osmid).Scan(&id)
+			switch err {
+			case nil:
+				if _, err := stmts[3].Exec(p.name, p.lat, p.long, p.radius, p.category, id); err != nil {
+					return err
+				}
+				stats.Updated++
+			case sql.ErrNoRows:
+				res, err := stmts[1].Exec(p.name, p.lat, p.long, p.radius, p.category)
+				if err != nil {
+					return err
+				}
+				if id, err = res.LastInsertId(); err != nil {
+					return err
+				}
+				if _, err := stmts[2].Exec(p.osmid, id); err != nil {
+					return err
+				}
+				stats.Inserted++
+			default:
+				return err
+			}
+
+			// what the extract does not know is left as it was
+			if len(p.address) > 0 {
+				if _, err := stmts[4].Exec(id); err != nil {
+					return err
+				}
+				if _, err := stmts[5].Exec(id); err != nil {
+					return err
+				}
+				for _, a := range p.address {
+					res, err := stmts[6].Exec(a.Type, a.Value)
+					if err != nil {
+						return err
+					}
+					addrid, err := res.LastInsertId()
+					if err != nil {
+						return err
+					}
+					if _, err := stmts[7].Exec(id, addrid); err != nil {
+						return err
+					}
+				}
+			}
+			if len(p.amenities) > 0 {
+				if _, err := stmts[8].Exec(id); err != nil {
+					return err
+				}
+				for _, a := range p.amenities {
+					if _, err := stmts[9].Exec(id, a); err != nil {
+						return err
+					}
+				}
+			}
+			if p.hours != nil {
+				if _, err := stmts[10].Exec(id); err != nil {
+					return err
+				}
+				for _, span := range p.hours {
+					if _, err := stmts[11].Exec(id, span.Day, span.Open, span.Close); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// Import the pubs, bars, beer gardens and breweries of an extract
+// into the place table. Places are keyed by OSM id, so importing a
+// newer extract updates the places imported before.
+func ImportOSM(db *sql.DB, open func() (io.ReadCloser, error), scan osmScanner) (*OSMImportStats, error) {
+	places, skipped, err := readOSMPlaces(open, scan)
+	if err != nil {
+		return nil, err
+	}
+	stats := &OSMImportStats{Skipped: skipped}
+	if err := upsertOSMPlaces(db, places, stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// Import an extract file: OSM XML (.osm), PBF (.pbf) or Overpass
+// JSON (.json), optionally bzip2 compressed (.bz2)
+func ImportOSMFile(db *sql.DB, path string) (*OSMImportStats, error) {
+	name := strings.TrimSuffix(path, ".bz2")
+	var scan osmScanner
+	switch {
+	case strings.HasSuffix(name, ".pbf"):
+		scan = scanOSMPBF
+	case strings.HasSuffix(name, ".json"):
+		scan = scanOverpassJSON
+	case strings.HasSuffix(name, ".osm") || strings.HasSuffix(name, ".xml"):
+		scan = scanOSMXML
+	default:
+		return nil, fmt.Errorf("unknown extract format: %s", path)
+	}
+	return ImportOSM(db, func() (io.ReadCloser, error) {
+		f, err := os.Open(path)
+		if err != nil || name == path {
+			return f, err
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{bzip2.NewReader(f), f}, nil
+	}, scan)
+}
+
+// Read OSM XML, as exported from openstreetmap.org or by Overpass
+func scanOSMXML(r io.Reader, fn func(e *osmElement) error) error {
+	d := xml.NewDecoder(r)
+	var e *osmElement
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			attr := func(name string) string {
+				for _, a := range t.Attr {
+					if a.Name.Local == name {
+						return a.Value
+					}
+				}
+				return ""
+			}
+			switch t.Name.Local {
+			case "node", "way", "relation":
+				e = &osmElement{kind: t.Name.Local, tags: make(map[string]string)}
+				if e.id, err = strconv.ParseInt(attr("id"), 10, 64); err != nil {
+					return fmt.Errorf("%s id: %v", e.kind, err)
+				}
+				if e.kind == "node" {
+					if err := e.setPos(attr("lat"), attr("lon")); err != nil {
+						return err
+					}
+				}
+			case "center":
+				if e != nil {
+					if err := e.setPos(attr("lat"), attr("lon")); err != nil {
+						return err
+					}
+				}
+			case "tag":
+				if e != nil {
+					e.tags[attr("k")] = attr("v")
+				}
+			case "nd":
+				if e != nil {
+					ref, err := strconv.ParseInt(attr("ref"), 10, 64)
+					if err != nil {
+						return fmt.Errorf("way %d: %v", e.id, err)
+					}
+					e.refs = append(e.refs, ref)
+				}
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "node", "way":
+				if err := fn(e); err != nil {
+					return err
+				}
+				e = nil
+			case "relation":
+				e = nil
+			}
+		}
+	}
+}
+
+func (e *osmElement) setPos(lat, long string) error {
+	var err error
+	if e.lat, err = strconv.ParseFloat(lat, 64); err != nil {
+		return fmt.Errorf("%s %d: %v", e.kind, e.id, err)
+	}
+	if e.long, err = strconv.ParseFloat(long, 64); err != nil {
+		return fmt.Errorf("%s %d: %v", e.kind, e.id, err)
+	}
+	e.hasPos = true
+	return nil
+}
+
+// Read the JSON output of an Overpass query, preferably run with
+// "out center" so that ways have positions
+func scanOverpassJSON(r io.Reader, fn func(e *osmElement) error) error {
+	var data struct {
+		Elements []struct {
+			Type   string                      `json:"type"`
+			Id     int64                       `json:"id"`
+			Lat    *float64                    `json:"lat"`
+			Lon    *float64                    `json:"lon"`
+			Center *struct{ Lat, Lon float64 } `json:"center"`
+			Nodes  []int64                     `json:"nodes"`
+			Tags   map[string]string           `json:"tags"`
+		} `json:"elements"`
+	}
+	if err := json.NewDecoder(r).Decode(&data); err != nil {
+		return err
+	}
+	for _, el := range data.Elements {
+		if el.Type != "node" && el.Type != "way" {
+			continue
+		}
+		e := &osmElement{kind: el.Type, id: el.Id, tags: el.Tags, refs: el.Nodes}
+		if e.tags == nil {
+			e.tags = make(map[string]string)
+		}
+		switch {
+		case el.Lat != nil && el.Lon != nil:
+			e.lat, e.long, e.hasPos = *el.Lat, *el.Lon, true
+		case el.Center != nil:
+			e.lat, e.long, e.hasPos = el.Center.Lat, el.Center.Lon, true
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
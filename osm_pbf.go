@@ -0,0 +1,359 @@
+package tbeer
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// Largest blob header and blob allowed by the PBF format
+const (
+	maxPBFHeaderSize = 64 * 1024
+	maxPBFBlobSize   = 32 * 1024 * 1024
+)
+
+// Protocol buffer wire types
+const (
+	pbVarint  = 0
+	pbFixed64 = 1
+	pbBytes   = 2
+	pbFixed32 = 5
+)
+
+// Reads the fields of a protocol buffer message
+type pbMessage struct {
+	buf []byte
+	// the current field
+	field    int
+	wiretype int
+	value    uint64
+	data     []byte
+	err      error
+}
+
+func (m *pbMessage) varint() uint64 {
+	v, n := binary.Uvarint(m.buf)
+	if n <= 0 {
+		m.err = errors.New("pbf: bad varint")
+		m.buf = nil
+		return 0
+	}
+	m.buf = m.buf[n:]
+	return v
+}
+
+// Advance to the next field, false at the end or on error
+func (m *pbMessage) next() bool {
+	if len(m.buf) == 0 || m.err != nil {
+		return false
+	}
+	key := m.varint()
+	m.field, m.wiretype, m.data = int(key>>3), int(key&7), nil
+	switch m.wiretype {
+	case pbVarint:
+		m.value = m.varint()
+	case pbBytes:
+		n := m.varint()
+		if n > uint64(len(m.buf)) {
+			m.err = errors.New("pbf: truncated message")
+			return false
+		}
+		m.data, m.buf = m.buf[:n], m.buf[n:]
+	case pbFixed64, pbFixed32:
+		n := 8
+		if m.wiretype == pbFixed32 {
+			n = 4
+		}
+		if len(m.buf) < n {
+			m.err = errors.New("pbf: truncated message")
+			return false
+		}
+		m.buf = m.buf[n:]
+	default:
+		m.err = fmt.Errorf("pbf: unknown wire type %d", m.wiretype)
+		return false
+	}
+	return m.err == nil
+}
+
+// The values of a repeated integer field, packed or not
+func (m *pbMessage) appendVarints(dst []uint64) []uint64 {
+	if m.wiretype == pbVarint {
+		return append(dst, m.value)
+	}
+	packed := &pbMessage{buf: m.data}
+	for len(packed.buf) > 0 && packed.err == nil {
+		dst = append(dst, packed.varint())
+	}
+	if packed.err != nil {
+		m.err = packed.err
+	}
+	return dst
+}
+
+func zigzag(v uint64) int64 {
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+// Read the next blob of a PBF file, returning its type and data
+func readPBFBlob(r io.Reader) (string, []byte, error) {
+	var size uint32
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return "", nil, err
+	}
+	if size > maxPBFHeaderSize {
+		return "", nil, errors.New("pbf: blob header too large")
+	}
+	header := make([]byte, size)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", nil, err
+	}
+	var typ string
+	var datasize uint64
+	m := &pbMessage{buf: header}
+	for m.next() {
+		switch m.field {
+		case 1:
+			typ = string(m.data)
+		case 3:
+			datasize = m.value
+		}
+	}
+	if m.err != nil {
+		return "", nil, m.err
+	}
+	if datasize > maxPBFBlobSize {
+		return "", nil, errors.New("pbf: blob too large")
+	}
+	blob := make([]byte, datasize)
+	if _, err := io.ReadFull(r, blob); err != nil {
+		return "", nil, err
+	}
+
+	m = &pbMessage{buf: blob}
+	for m.next() {
+		switch m.field {
+		case 1:
+			return typ, m.data, nil
+		case 3:
+			z, err := zlib.NewReader(bytes.NewReader(m.data))
+			if err != nil {
+				return "", nil, err
+			}
+			data, err := ioutil.ReadAll(io.LimitReader(z, maxPBFBlobSize))
+			z.Close()
+			return typ, data, err
+		case 4, 5, 6, 7:
+			return "", nil, errors.New("pbf: only raw and zlib compressed blobs are supported")
+		}
+	}
+	if m.err != nil {
+		return "", nil, m.err
+	}
+	return typ, nil, nil
+}
+
+// Read an OpenStreetMap PBF extract, such as those of Geofabrik
+func scanOSMPBF(r io.Reader, fn func(e *osmElement) error) error {
+	for {
+		typ, data, err := readPBFBlob(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if typ == "OSMData" {
+			if err := scanPBFBlock(data, fn); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Positions in a block are offset + granularity * value, in nanodegrees
+type pbfBlock struct {
+	strings     []string
+	granularity int64
+	latOffset   int64
+	lonOffset   int64
+}
+
+func (b *pbfBlock) lat(v int64) float64 {
+	return float64(b.latOffset+b.granularity*v) / 1e9
+}
+
+func (b *pbfBlock) long(v int64) float64 {
+	return float64(b.lonOffset+b.granularity*v) / 1e9
+}
+
+func (b *pbfBlock) string(i uint64) string {
+	if i < uint64(len(b.strings)) {
+		return b.strings[i]
+	}
+	return ""
+}
+
+func (b *pbfBlock) tags(keys, vals []uint64) map[string]string {
+	tags := make(map[string]string, len(keys))
+	for i := 0; i < len(keys) && i < len(vals); i++ {
+		tags[b.string(keys[i])] = b.string(vals[i])
+	}
+	return tags
+}
+
+func scanPBFBlock(data []byte, fn func(e *osmElement) error) error {
+	b := &pbfBlock{granularity: 100}
+	groups := make([][]byte, 0)
+	m := &pbMessage{buf: data}
+	for m.next() {
+		switch m.field {
+		case 1:
+			st := &pbMessage{buf: m.data}
+			for st.next() {
+				if st.field == 1 {
+					b.strings = append(b.strings, string(st.data))
+				}
+			}
+			if st.err != nil {
+				return st.err
+			}
+		case 2:
+			groups = append(groups, m.data)
+		case 17:
+			b.granularity = int64(m.value)
+		case 19:
+			b.latOffset = int64(m.value)
+		case 20:
+			b.lonOffset = int64(m.value)
+		}
+	}
+	if m.err != nil {
+		return m.err
+	}
+
+	for _, group := range groups {
+		g := &pbMessage{buf: group}
+		for g.next() {
+			var err error
+			switch g.field {
+			case 1:
+				err = b.scanNode(g.data, fn)
+			case 2:
+				err = b.scanDenseNodes(g.data, fn)
+			case 3:
+				err = b.scanWay(g.data, fn)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if g.err != nil {
+			return g.err
+		}
+	}
+	return nil
+}
+
+func (b *pbfBlock) scanNode(data []byte, fn func(e *osmElement) error) error {
+	e := &osmElement{kind: "node", hasPos: true}
+	var keys, vals []uint64
+	m := &pbMessage{buf: data}
+	for m.next() {
+		switch m.field {
+		case 1:
+			e.id = zigzag(m.value)
+		case 2:
+			keys = m.appendVarints(keys)
+		case 3:
+			vals = m.appendVarints(vals)
+		case 8:
+			e.lat = b.lat(zigzag(m.value))
+		case 9:
+			e.long = b.long(zigzag(m.value))
+		}
+	}
+	if m.err != nil {
+		return m.err
+	}
+	e.tags = b.tags(keys, vals)
+	return fn(e)
+}
+
+func (b *pbfBlock) scanDenseNodes(data []byte, fn func(e *osmElement) error) error {
+	var ids, lats, lons, keysVals []uint64
+	m := &pbMessage{buf: data}
+	for m.next() {
+		switch m.field {
+		case 1:
+			ids = m.appendVarints(ids)
+		case 8:
+			lats = m.appendVarints(lats)
+		case 9:
+			lons = m.appendVarints(lons)
+		case 10:
+			keysVals = m.appendVarints(keysVals)
+		}
+	}
+	if m.err != nil {
+		return m.err
+	}
+	if len(lats) != len(ids) || len(lons) != len(ids) {
+		return errors.New("pbf: dense nodes of different lengths")
+	}
+
+	// ids and positions are delta coded, and the tags of each node
+	// are key and value indexes ended by 0
+	var id, lat, lon int64
+	kv := 0
+	for i := range ids {
+		id += zigzag(ids[i])
+		lat += zigzag(lats[i])
+		lon += zigzag(lons[i])
+		e := &osmElement{kind: "node", id: id, lat: b.lat(lat), long: b.long(lon), hasPos: true,
+			tags: make(map[string]string)}
+		for kv < len(keysVals) && keysVals[kv] != 0 {
+			if kv+1 < len(keysVals) {
+				e.tags[b.string(keysVals[kv])] = b.string(keysVals[kv+1])
+			}
+			kv += 2
+		}
+		kv++
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *pbfBlock) scanWay(data []byte, fn func(e *osmElement) error) error {
+	e := &osmElement{kind: "way"}
+	var keys, vals, refs []uint64
+	m := &pbMessage{buf: data}
+	for m.next() {
+		switch m.field {
+		case 1:
+			e.id = int64(m.value)
+		case 2:
+			keys = m.appendVarints(keys)
+		case 3:
+			vals = m.appendVarints(vals)
+		case 8:
+			refs = m.appendVarints(refs)
+		}
+	}
+	if m.err != nil {
+		return m.err
+	}
+	e.tags = b.tags(keys, vals)
+	var ref int64
+	for _, r := range refs {
+		ref += zigzag(r)
+		e.refs = append(e.refs, ref)
+	}
+	return fn(e)
+}
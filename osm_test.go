@@ -0,0 +1,267 @@
+package tbeer
+
+import (
+	"bytes"
+	"compress/zlib"
+	"database/sql"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestOSMTags(t *testing.T) {
+	tests := []struct {
+		tags     map[string]string
+		category string
+	}{
+		{map[string]string{"amenity": "pub"}, "pub"},
+		{map[string]string{"amenity": "pub", "microbrewery": "yes"}, "brewpub"},
+		{map[string]string{"amenity": "biergarten"}, "beer_garden"},
+		{map[string]string{"craft": "brewery"}, "brewery"},
+		{map[string]string{"amenity": "cafe"}, ""},
+	}
+	for _, test := range tests {
+		if c := osmCategory(test.tags); c != test.category {
+			t.Errorf("%v: category %q, expected %q", test.tags, c, test.category)
+		}
+	}
+
+	tags := map[string]string{"outdoor_seating": "yes", "internet_access": "wlan", "cuisine": "burger", "dog": "no"}
+	if a := osmAmenities(tags); !reflect.DeepEqual(a, []string{"outdoor_seating", "food", "wifi"}) {
+		t.Errorf("unexpected amenities %v", a)
+	}
+	address := osmAddress(map[string]string{"addr:street": "Storgata", "addr:housenumber": "5", "addr:city": "Oslo"})
+	if len(address) != 2 || *address[0] != (Address{AddressStreet, "Storgata 5"}) || *address[1] != (Address{AddressLocality, "Oslo"}) {
+		t.Errorf("unexpected address %+v", address)
+	}
+}
+
+// Protocol buffer encoding of the few fields the tests need
+func pbKey(field, wiretype int) []byte {
+	return binary.AppendUvarint(nil, uint64(field<<3|wiretype))
+}
+
+func pbUint(field int, v uint64) []byte {
+	return append(pbKey(field, pbVarint), binary.AppendUvarint(nil, v)...)
+}
+
+func pbData(field int, data ...[]byte) []byte {
+	joined := bytes.Join(data, nil)
+	b := append(pbKey(field, pbBytes), binary.AppendUvarint(nil, uint64(len(joined)))...)
+	return append(b, joined...)
+}
+
+func pbPacked(field int, values ...uint64) []byte {
+	var packed []byte
+	for _, v := range values {
+		packed = binary.AppendUvarint(packed, v)
+	}
+	return pbData(field, packed)
+}
+
+func zz(v int64) uint64 {
+	return uint64((v << 1) ^ (v >> 63))
+}
+
+func pbfBlob(typ string, data []byte) []byte {
+	var z bytes.Buffer
+	w := zlib.NewWriter(&z)
+	w.Write(data)
+	w.Close()
+	blob := bytes.Join([][]byte{pbUint(2, uint64(len(data))), pbData(3, z.Bytes())}, nil)
+	header := bytes.Join([][]byte{pbData(1, []byte(typ)), pbUint(3, uint64(len(blob)))}, nil)
+	size := make([]byte, 4)
+	binary.BigEndian.PutUint32(size, uint32(len(header)))
+	return bytes.Join([][]byte{size, header, blob}, nil)
+}
+
+// A PBF extract of a pub node, a plain node, and a bar way around two nodes
+func testPBF() []byte {
+	strs := [][]byte{{}, []byte("amenity"), []byte("pub"), []byte("name"), []byte("Pølsa"), []byte("bar"), []byte("The Way")}
+	stringtable := make([][]byte, len(strs))
+	for i, s := range strs {
+		stringtable[i] = pbData(1, s)
+	}
+	// nodes 10, 11 and 12 at 59.9 10.7, 59.9001 10.7001 and 59.9003 10.7003,
+	// with granularity 100 and no offset
+	dense := pbData(2,
+		pbPacked(1, zz(10), zz(1), zz(1)),
+		pbPacked(8, zz(599000000), zz(1000), zz(2000)),
+		pbPacked(9, zz(107000000), zz(1000), zz(2000)),
+		pbPacked(10, 1, 2, 3, 4, 0, 0, 0))
+	way := pbData(3,
+		pbUint(1, 20),
+		pbPacked(2, 1, 3),
+		pbPacked(3, 5, 6),
+		pbPacked(8, zz(11), zz(1), zz(-1)))
+	block := bytes.Join([][]byte{pbData(1, stringtable...), pbData(2, dense), pbData(2, way)}, nil)
+	header := pbData(4, []byte("OsmSchema-V0.6"))
+	return append(pbfBlob("OSMHeader", header), pbfBlob("OSMData", block)...)
+}
+
+func TestScanOSMPBF(t *testing.T) {
+	var elements []*osmElement
+	err := scanOSMPBF(bytes.NewReader(testPBF()), func(e *osmElement) error {
+		elements = append(elements, e)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(elements) != 4 {
+		t.Fatalf("expected 4 elements, got %d", len(elements))
+	}
+	pub := elements[0]
+	if pub.kind != "node" || pub.id != 10 || pub.lat != 59.9 || pub.long != 10.7 ||
+		!reflect.DeepEqual(pub.tags, map[string]string{"amenity": "pub", "name": "Pølsa"}) {
+		t.Errorf("unexpected pub %+v", pub)
+	}
+	if n := elements[2]; n.id != 12 || len(n.tags) != 0 || n.lat != 59.9003 {
+		t.Errorf("unexpected node %+v", n)
+	}
+	way := elements[3]
+	if way.kind != "way" || way.id != 20 || !reflect.DeepEqual(way.refs, []int64{11, 12, 11}) ||
+		way.tags["name"] != "The Way" || way.hasPos {
+		t.Errorf("unexpected way %+v", way)
+	}
+
+	if err := scanOSMPBF(bytes.NewReader(testPBF()[:40]), func(*osmElement) error { return nil }); err == nil {
+		t.Error("read a truncated extract")
+	}
+}
+
+const testOSMXML = `<?xml version="1.0" encoding="UTF-8"?>
+<osm version="0.6">
+  <node id="1" lat="59.91" lon="10.75">
+    <tag k="amenity" v="pub"/>
+    <tag k="name" v="Test Tavern"/>
+    <tag k="outdoor_seating" v="yes"/>
+    <tag k="opening_hours" v="Mo-Su 15:00-01:00"/>
+    <tag k="addr:street" v="Storgata"/>
+    <tag k="addr:housenumber" v="1"/>
+  </node>
+  <node id="2" lat="59.92" lon="10.76">
+    <tag k="amenity" v="bar"/>
+  </node>
+  <node id="3" lat="59.9300" lon="10.7700"/>
+  <node id="4" lat="59.9302" lon="10.7700"/>
+  <node id="5" lat="59.9301" lon="10.7704"/>
+  <way id="7">
+    <nd ref="3"/>
+    <nd ref="4"/>
+    <nd ref="5"/>
+    <nd ref="3"/>
+    <tag k="amenity" v="biergarten"/>
+    <tag k="name" v="Test Garden"/>
+    <tag k="opening_hours" v="sometimes"/>
+  </way>
+  <relation id="9">
+    <tag k="amenity" v="pub"/>
+    <tag k="name" v="Not Imported"/>
+  </relation>
+</osm>`
+
+const testOverpassJSON = `{"elements": [
+	{"type": "node", "id": 1, "lat": 59.915, "lon": 10.75, "tags": {"amenity": "pub", "name": "Test Tavern Renamed"}},
+	{"type": "way", "id": 8, "center": {"lat": 59.94, "lon": 10.78}, "nodes": [100, 101],
+		"tags": {"craft": "brewery", "name": "Test Brewery"}}
+]}`
+
+func TestImportOSM(t *testing.T) {
+	app := OpenTestEnv()
+	defer CloseTestEnv(app)
+	defer func() {
+		for _, osmid := range []string{"node/1", "way/7", "way/8"} {
+			var id int64
+			if app.DB.QueryRow("SELECT placeid FROM place_osm WHERE osmid = ?", osmid).Scan(&id) != nil {
+				continue
+			}
+			app.DB.Exec("DELETE FROM address WHERE id IN (SELECT addressid FROM place_address WHERE placeid = ?)", id)
+			for _, table := range []string{"place_address", "place_tag", "place_hours", "place_osm"} {
+				app.DB.Exec("DELETE FROM "+table+" WHERE placeid = ?", id)
+			}
+			app.DB.Exec("DELETE FROM place WHERE id = ?", id)
+		}
+	}()
+
+	file := func(name, content string) string {
+		f, err := ioutil.TempFile("", "*"+name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		io.WriteString(f, content)
+		return f.Name()
+	}
+	xmlFile := file(".osm", testOSMXML)
+	defer os.Remove(xmlFile)
+	jsonFile := file(".json", testOverpassJSON)
+	defer os.Remove(jsonFile)
+
+	importFile := func(path string) OSMImportStats {
+		stats, err := ImportOSMFile(app.DB, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return *stats
+	}
+	if stats := importFile(xmlFile); stats != (OSMImportStats{Inserted: 2, Skipped: 1}) {
+		t.Errorf("first import: %+v", stats)
+	}
+	if stats := importFile(xmlFile); stats != (OSMImportStats{Updated: 2, Skipped: 1}) {
+		t.Errorf("import again: %+v", stats)
+	}
+
+	stmts := make([]*sql.Stmt, len(placeDetailQueries))
+	for i, q := range placeDetailQueries {
+		var err error
+		if stmts[i], err = app.DB.Prepare(q); err != nil {
+			t.Fatal(err)
+		}
+		defer stmts[i].Close()
+	}
+	load := func(osmid string) *Place {
+		var id int64
+		if err := app.DB.QueryRow("SELECT placeid FROM place_osm WHERE osmid = ?", osmid).Scan(&id); err != nil {
+			t.Fatalf("%s: %v", osmid, err)
+		}
+		p, err := loadPlace(stmts, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	pub := load("node/1")
+	if pub.Name != "Test Tavern" || pub.Category != "pub" || pub.Radius != osmNodeRadius ||
+		len(pub.Address) != 1 || pub.Address[0].Value != "Storgata 1" ||
+		!reflect.DeepEqual(pub.Amenities, []string{"outdoor_seating"}) ||
+		pub.OpeningHours.String() != "Mo-Su 15:00-01:00" {
+		t.Errorf("unexpected pub %+v", pub)
+	}
+	garden := load("way/7")
+	if garden.Category != "beer_garden" || garden.Lat < 59.93 || garden.Lat > 59.9302 ||
+		garden.Radius < 10 || garden.Radius > 30 || len(garden.OpeningHours) != 0 {
+		t.Errorf("unexpected beer garden %+v", garden)
+	}
+
+	if stats := importFile(jsonFile); stats != (OSMImportStats{Inserted: 1, Updated: 1}) {
+		t.Errorf("overpass import: %+v", stats)
+	}
+	// what the extract does not know is kept
+	if pub := load("node/1"); pub.Name != "Test Tavern Renamed" || pub.Lat != 59.915 ||
+		len(pub.Address) != 1 || len(pub.OpeningHours) == 0 {
+		t.Errorf("unexpected pub after overpass import %+v", pub)
+	}
+	if brewery := load("way/8"); brewery.Category != "brewery" || brewery.Lat != 59.94 {
+		t.Errorf("unexpected brewery %+v", brewery)
+	}
+
+	if _, err := ImportOSMFile(app.DB, "extract.shp"); err == nil || !strings.Contains(err.Error(), "format") {
+		t.Errorf("expected unknown format, got %v", err)
+	}
+}
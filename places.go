@@ -0,0 +1,362 @@
+package tbeer
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of places
+var placeCategories = []string{
+	"pub", "bar", "brewery", "brewpub", "beer_garden", "restaurant", "cafe", "bottle_shop"}
+
+// What a place may have to offer
+var placeAmenities = []string{
+	"outdoor_seating", "food", "wifi", "wheelchair", "live_music", "sports_tv", "dogs", "quiz"}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Extract an optional list of words, as comma separated or
+// repeated form values, each of which must be in the vocabulary
+func getFormWords(ctx *DispatchContext, key string, vocabulary []string) ([]string, error) {
+	words := make([]string, 0)
+	for _, v := range ctx.request.Form[key] {
+		for _, w := range strings.Split(v, ",") {
+			if w = strings.TrimSpace(w); w == "" {
+				continue
+			}
+			if !contains(vocabulary, w) {
+				return nil, fmt.Errorf("unknown %s: %s", key, w)
+			}
+			if !contains(words, w) {
+				words = append(words, w)
+			}
+		}
+	}
+	return words, nil
+}
+
+const placeHoursQuery = "SELECT day, open, close FROM place_hours WHERE placeid = ? ORDER BY rowid"
+
+const placeTimezoneQuery = "SELECT ifnull(timezone, '') FROM place WHERE id = ?"
+
+// Time zones by name, as loading one reads the zone database
+var placeLocations = struct {
+	sync.Mutex
+	m map[string]*time.Location
+}{m: make(map[string]*time.Location)}
+
+// The time zone of a place, UTC if not known
+func placeLocation(tz string) *time.Location {
+	if tz == "" {
+		return time.UTC
+	}
+	placeLocations.Lock()
+	defer placeLocations.Unlock()
+	if loc, ok := placeLocations.m[tz]; ok {
+		return loc
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		loc = time.UTC
+	}
+	placeLocations.m[tz] = loc
+	return loc
+}
+
+// Load the opening hours of a place and its time zone
+// using placeHoursQuery and placeTimezoneQuery
+func loadOpeningHours(hoursStmt, tzStmt *sql.Stmt, placeid int64) (OpeningHours, *time.Location, error) {
+	var tz string
+	if err := tzStmt.QueryRow(placeid).Scan(&tz); err != nil {
+		return nil, nil, err
+	}
+	rows, err := hoursStmt.Query(placeid)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	h := make(OpeningHours, 0)
+	for rows.Next() {
+		span := &OpeningSpan{}
+		if err := rows.Scan(span.BasicFields()...); err != nil {
+			return nil, nil, err
+		}
+		h = append(h, span)
+	}
+	return h, placeLocation(tz), rows.Err()
+}
+
+// Check that a place is open during the occurrences of a meeting period,
+// using placeHoursQuery and placeTimezoneQuery
+func checkOpeningHours(hoursStmt, tzStmt *sql.Stmt, placeid int64, period *Period) error {
+	h, loc, err := loadOpeningHours(hoursStmt, tzStmt, placeid)
+	if err != nil {
+		return err
+	}
+	p := *period
+	p.loc = loc
+	occurrences, err := p.Occurrences(Period{Start: period.Start})
+	if err != nil {
+		return err
+	}
+	for _, o := range occurrences {
+		if !h.Covers(o, loc) {
+			return fmt.Errorf("the place is not open all of %s - %s (opening hours %s)",
+				time.Unix(int64(o.Start), 0).In(loc).Format("Mon Jan 2 15:04"),
+				time.Unix(int64(o.End), 0).In(loc).Format("15:04 MST"), h)
+		}
+	}
+	return nil
+}
+
+// Restrictions on the places to list
+type PlaceFilter struct {
+	// any of these categories
+	Categories []string
+	// all of these amenities
+	Amenities []string
+	// open at this unix time, if not 0
+	OpenAt int
+}
+
+var placeFilterParams = []RouteParam{
+	{Name: "category", In: "query", Type: "string", Description: "comma separated categories, any of which places have"},
+	{Name: "amenity", In: "query", Type: "string", Description: "comma separated amenities, all of which places have"},
+	{Name: "open_at", In: "query", Type: "integer", Description: "unix time places are open at"},
+}
+
+// SQL condition on the place table, with the arguments of PlaceFilter.args
+const placeFilterCondition = "(? = '' OR instr(?, ',' || place.category || ',') > 0) AND " +
+	"(SELECT count(*) FROM place_tag " +
+	"WHERE place_tag.placeid = place.id AND instr(?, ',' || place_tag.tag || ',') > 0) = ?"
+
+// Extract a place filter from dispatched rest request
+func getPlaceFilter(ctx *DispatchContext) (*PlaceFilter, error) {
+	f := &PlaceFilter{}
+	var err error
+	if f.Categories, err = getFormWords(ctx, "category", placeCategories); err != nil {
+		return nil, err
+	}
+	if f.Amenities, err = getFormWords(ctx, "amenity", placeAmenities); err != nil {
+		return nil, err
+	}
+	if _, ok := ctx.request.Form["open_at"]; ok {
+		t, err := getFormInt(ctx.request.Form, "open_at")
+		if err != nil {
+			return nil, err
+		}
+		f.OpenAt = int(t)
+	}
+	return f, nil
+}
+
+func (f *PlaceFilter) args() []interface{} {
+	categories, amenities := "", ""
+	if len(f.Categories) > 0 {
+		categories = "," + strings.Join(f.Categories, ",") + ","
+	}
+	if len(f.Amenities) > 0 {
+		amenities = "," + strings.Join(f.Amenities, ",") + ","
+	}
+	return []interface{}{categories, categories, amenities, len(f.Amenities)}
+}
+
+// A check whether places pass the opening hours restriction of the
+// filter, using placeHoursQuery and placeTimezoneQuery. Remembers
+// the places checked, and is not safe for concurrent use.
+func (f *PlaceFilter) openCheck(hoursStmt, tzStmt *sql.Stmt) func(placeid int64) (bool, error) {
+	checked := make(map[int64]bool)
+	return func(placeid int64) (bool, error) {
+		if f.OpenAt == 0 {
+			return true, nil
+		}
+		if open, ok := checked[placeid]; ok {
+			return open, nil
+		}
+		h, loc, err := loadOpeningHours(hoursStmt, tzStmt, placeid)
+		if err != nil {
+			return false, err
+		}
+		checked[placeid] = h.IsOpen(f.OpenAt, loc)
+		return checked[placeid], nil
+	}
+}
+
+// Queries for loadPlace
+var placeDetailQueries = []string{
+	"SELECT id, name, lat, long, radius, capacity, category FROM place WHERE id = ?",
+	"SELECT address.type, address.value FROM address, place_address " +
+		"WHERE " +
+		"place_address.placeid = ? AND " +
+		"place_address.addressid = address.id ",
+	"SELECT tag FROM place_tag WHERE placeid = ? ORDER BY tag",
+	placeHoursQuery,
+	placeTimezoneQuery}
+
+// Load a place with its addresses, amenities and opening hours
+func loadPlace(stmts []*sql.Stmt, id int64) (*Place, error) {
+	place := &Place{}
+	if err := stmts[0].QueryRow(id).Scan(place.BasicFields()...); err != nil {
+		return nil, err
+	}
+
+	addrrows, err := stmts[1].Query(place.Id)
+	place.Address = make([]*Address, 0, 10)
+	if err != nil {
+		fmt.Println(err)
+	} else {
+		for addrrows.Next() {
+			addr := &Address{}
+			addrrows.Scan(addr.BasicFields()...)
+			place.Address = append(place.Address, addr)
+		}
+		addrrows.Close()
+	}
+
+	tagrows, err := stmts[2].Query(place.Id)
+	if err != nil {
+		return nil, err
+	}
+	defer tagrows.Close()
+	for tagrows.Next() {
+		var tag string
+		if err := tagrows.Scan(&tag); err != nil {
+			return nil, err
+		}
+		place.Amenities = append(place.Amenities, tag)
+	}
+
+	if err := stmts[4].QueryRow(place.Id).Scan(&place.Timezone); err != nil {
+		return nil, err
+	}
+	place.OpeningHours, _, err = loadOpeningHours(stmts[3], stmts[4], place.Id)
+	return place, err
+}
+
+func (app *App) initPlaceHandlers() {
+	app.installStmtRestHandler("place/:id",
+		&RouteDoc{
+			Summary: "a place with addresses, amenities and opening hours",
+			Params: []RouteParam{
+				{Name: "taps", In: "query", Type: "boolean", Description: "include the beers on tap"}},
+			Response: &APIPlace{}},
+		append(placeDetailQueries, placeTapsQuery),
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			place, err := loadPlace(stmts, ctx.IntParam("id"))
+			if err != nil {
+				return err
+			}
+			if taps := ctx.request.Form.Get("taps"); taps == "1" || taps == "true" {
+				if place.Taps, err = loadTaps(stmts[len(placeDetailQueries)], place.Id); err != nil {
+					return err
+				}
+			}
+			return writeJSON(w, place)
+		})
+
+	app.installStmtRestMethodHandler("PUT", "place/:id",
+		&RouteDoc{
+			Summary: "change the description of a place. Places are shared, so any user may improve them",
+			Params: []RouteParam{
+				{Name: "capacity", In: "query", Type: "integer", Description: "number of people the place holds, 0 if unknown"},
+				{Name: "category", In: "query", Type: "string", Description: "one of " + strings.Join(placeCategories, ", ")},
+				{Name: "amenities", In: "query", Type: "string", Description: "comma separated, from " + strings.Join(placeAmenities, ", ")},
+				{Name: "timezone", In: "query", Type: "string", Description: "IANA time zone of the opening hours, e.g. Europe/Oslo"},
+				{Name: "opening_hours", In: "query", Type: "string", Description: "e.g. Mo-Th 16:00-23:00; Fr,Sa 14:00-02:00; 2021-12-24 off"}},
+			Response: &APIPlace{}},
+		append([]string{
+			"UPDATE place SET capacity = ?, category = ?, timezone = ? WHERE id = ?",
+			"DELETE FROM place_tag WHERE placeid = ?",
+			"INSERT INTO place_tag (placeid, tag) VALUES (?, ?)",
+			"DELETE FROM place_hours WHERE placeid = ?",
+			"INSERT INTO place_hours (placeid, day, open, close) VALUES (?, ?, ?, ?)"},
+			placeDetailQueries...),
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			before, err := loadPlace(stmts[5:], ctx.IntParam("id"))
+			if err != nil {
+				return err
+			}
+
+			form := ctx.request.Form
+			capacity := before.Capacity
+			if _, ok := form["capacity"]; ok {
+				n, err := strconv.Atoi(form.Get("capacity"))
+				if err != nil || n < 0 {
+					return errors.New("capacity must be a number of people")
+				}
+				capacity = n
+			}
+			category := before.Category
+			if _, ok := form["category"]; ok {
+				if category = form.Get("category"); category != "" && !contains(placeCategories, category) {
+					return fmt.Errorf("unknown category: %s", category)
+				}
+			}
+			timezone := before.Timezone
+			if _, ok := form["timezone"]; ok {
+				timezone = form.Get("timezone")
+				if _, err := time.LoadLocation(timezone); err != nil || timezone == "Local" {
+					return fmt.Errorf("unknown timezone: %s", timezone)
+				}
+			}
+			amenities, err := getFormWords(ctx, "amenities", placeAmenities)
+			if err != nil {
+				return err
+			}
+			var hours OpeningHours
+			if _, ok := form["opening_hours"]; ok {
+				if hours, err = ParseOpeningHours(form.Get("opening_hours")); err != nil {
+					return err
+				}
+			}
+
+			err = ctx.app.inTransaction(func(tx *sql.Tx) error {
+				if _, err := tx.Stmt(stmts[0]).Exec(capacity, category, timezone, before.Id); err != nil {
+					return err
+				}
+				if _, ok := form["amenities"]; ok {
+					if _, err := tx.Stmt(stmts[1]).Exec(before.Id); err != nil {
+						return err
+					}
+					for _, a := range amenities {
+						if _, err := tx.Stmt(stmts[2]).Exec(before.Id, a); err != nil {
+							return err
+						}
+					}
+				}
+				if _, ok := form["opening_hours"]; ok {
+					if _, err := tx.Stmt(stmts[3]).Exec(before.Id); err != nil {
+						return err
+					}
+					for _, span := range hours {
+						if _, err := tx.Stmt(stmts[4]).Exec(before.Id, span.Day, span.Open, span.Close); err != nil {
+							return err
+						}
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			place, err := loadPlace(stmts[5:], before.Id)
+			if err != nil {
+				return err
+			}
+			return writeJSON(w, place)
+		})
+}
@@ -0,0 +1,126 @@
+package tbeer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestPlaceDescription(t *testing.T) {
+	app := OpenTestEnv()
+	defer CloseTestEnv(app)
+	serv := httptest.NewServer(app)
+	defer serv.Close()
+
+	res, err := app.DB.Exec("INSERT INTO place (name, lat, long, radius) VALUES ('Garden Gate', 10.5, 20.5, 1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	placeid, _ := res.LastInsertId()
+	defer func() {
+		app.DB.Exec("DELETE FROM place_tag WHERE placeid = ?", placeid)
+		app.DB.Exec("DELETE FROM place_hours WHERE placeid = ?", placeid)
+		app.DB.Exec("DELETE FROM place WHERE id = ?", placeid)
+	}()
+
+	put := func(values url.Values) (int, *APIPlace) {
+		req, _ := http.NewRequest("PUT", fmt.Sprintf("%s/api/place/%d?%s", serv.URL, placeid, values.Encode()), nil)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		p := &APIPlace{}
+		if res.StatusCode == 200 {
+			json.NewDecoder(res.Body).Decode(p)
+		}
+		return res.StatusCode, p
+	}
+
+	status, p := put(url.Values{
+		"category":      {"beer_garden"},
+		"amenities":     {"food,outdoor_seating"},
+		"timezone":      {"Europe/Oslo"},
+		"opening_hours": {"Mo-Fr 16:00-23:00; Sa,Su 12:00-23:00"}})
+	if status != 200 {
+		t.Fatalf("change place: status %d", status)
+	}
+	if p.Category != "beer_garden" || len(p.Amenities) != 2 || p.Timezone != "Europe/Oslo" ||
+		p.OpeningHours != "Mo-Fr 16:00-23:00; Sa-Su 12:00-23:00" {
+		t.Errorf("unexpected place %+v", p)
+	}
+	// only the given fields change
+	if status, p = put(url.Values{"capacity": {"80"}}); status != 200 || p.Capacity != 80 || p.Category != "beer_garden" {
+		t.Errorf("unexpected place after changing capacity: %d %+v", status, p)
+	}
+	for _, bad := range []url.Values{
+		{"category": {"igloo"}},
+		{"amenities": {"jacuzzi"}},
+		{"timezone": {"Mars/Olympus"}},
+		{"opening_hours": {"whenever"}},
+		{"capacity": {"-1"}}} {
+		if status, _ := put(bad); status == 200 {
+			t.Errorf("accepted %v", bad)
+		}
+	}
+
+	// Monday 2021-01-04 at 18:00 and 10:00 in Oslo
+	const evening, morning = 1609779600, 1609750800
+	places := func(query string) []APIPlace {
+		res, err := http.Get(serv.URL + "/api/places?minlat=10&maxlat=11&minlong=20&maxlong=21&" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var items []APIPlace
+		if err := json.NewDecoder(res.Body).Decode(&items); err != nil {
+			t.Fatal(err)
+		}
+		return items
+	}
+	filters := []struct {
+		query string
+		found bool
+	}{
+		{"", true},
+		{"category=pub,beer_garden", true},
+		{"category=pub", false},
+		{"amenity=outdoor_seating", true},
+		{"amenity=outdoor_seating,food", true},
+		{"amenity=outdoor_seating&amenity=wifi", false},
+		{fmt.Sprintf("open_at=%d", evening), true},
+		{fmt.Sprintf("open_at=%d", morning), false},
+	}
+	for _, f := range filters {
+		if items := places(f.query); (len(items) == 1) != f.found {
+			t.Errorf("%q: found %+v", f.query, items)
+		}
+	}
+
+	parts, cleanup := testParticipants(t, app, "early bird")
+	defer cleanup()
+	create := func(start int) *http.Response {
+		res, err := http.PostForm(serv.URL+"/api/meetings", url.Values{
+			"partid":  {fmt.Sprint(parts[0])},
+			"placeid": {fmt.Sprint(placeid)},
+			"name":    {"garden party"},
+			"start":   {fmt.Sprint(start)},
+			"end":     {fmt.Sprint(start + 3600)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+	if res := create(morning); res.StatusCode != 400 {
+		t.Errorf("created a meeting while the place is closed")
+	}
+	if res := create(evening); res.StatusCode != 200 {
+		t.Errorf("create meeting within opening hours: status %d", res.StatusCode)
+	}
+	app.DB.Exec("DELETE FROM meeting_participant WHERE participantid = ?", parts[0])
+	app.DB.Exec("DELETE FROM meeting WHERE placeid = ?", placeid)
+}
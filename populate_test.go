@@ -0,0 +1,84 @@
+package tbeer
+
+import (
+	"fmt"
+	"testing"
+)
+
+// Populate a new database and dump some of its tables
+func populateDump(t *testing.T, config *PopulateConfig) string {
+	db, err := OpenMemoryDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	InitSchema(db)
+	if err := Populate(db, config); err != nil {
+		t.Fatal(err)
+	}
+	var strays int
+	db.QueryRow("SELECT count(*) FROM availability JOIN participant ON participant.id = availability.partid " +
+		"WHERE availability.ownerid != participant.ownerid").Scan(&strays)
+	if strays != 0 {
+		t.Errorf("%d availabilities not owned by the owner of their participant", strays)
+	}
+
+	dump := ""
+	for _, q := range []string{
+		"SELECT id, alias FROM user",
+		"SELECT id, name, lat, long, radius, capacity, category FROM place",
+		"SELECT id, start, end FROM period",
+		"SELECT meetingid, participantid FROM meeting_participant",
+		"SELECT count(*), count(DISTINCT placeid) FROM place_address"} {
+		rows, err := db.Query(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cols, _ := rows.Columns()
+		for rows.Next() {
+			values := make([]interface{}, len(cols))
+			for i := range values {
+				values[i] = new(interface{})
+			}
+			rows.Scan(values...)
+			for _, v := range values {
+				dump += fmt.Sprint(*v.(*interface{}), " ")
+			}
+			dump += "\n"
+		}
+		rows.Close()
+	}
+	return dump
+}
+
+func TestPopulate(t *testing.T) {
+	config := populateTestConfig()
+	config.BatchSize = 7
+	first := populateDump(t, config)
+	if second := populateDump(t, config); second != first {
+		t.Error("the same seed generated different data")
+	}
+	config.Seed++
+	if other := populateDump(t, config); other == first {
+		t.Error("another seed generated the same data")
+	}
+
+	// every meeting participant once, with nothing else
+	small := &PopulateConfig{Users: 1, Participants: 2, Places: 1, Periods: 1, Meetings: 3, MeetingParticipants: 6,
+		CenterLat: 10, CenterLong: 20, Span: 1, MaxLength: 1, BatchSize: 2}
+	if dump := populateDump(t, small); dump == "" {
+		t.Error("nothing generated")
+	}
+
+	bad := []*PopulateConfig{
+		{Users: -1, Span: 1, MaxLength: 1, BatchSize: 1},
+		{Meetings: 1, Span: 1, MaxLength: 1, BatchSize: 1},
+		{Users: 1, Participants: 1, Places: 1, Periods: 1, Meetings: 1, MeetingParticipants: 2, Span: 1, MaxLength: 1, BatchSize: 1},
+		{Users: 1, Span: 1, MaxLength: 1},
+	}
+	for _, c := range bad {
+		if err := Populate(nil, c); err == nil {
+			t.Errorf("accepted %+v", *c)
+		}
+	}
+}
@@ -1,40 +1,116 @@
 package tbeer
 
 import (
-	"code.google.com/p/go-sqlite/go1/sqlite3"
-	"crypto/rand"
 	"database/sql"
-	"encoding/binary"
 	"fmt"
-	"log"
+	"math/rand"
 	"strings"
 	"time"
 )
 
-func randPos() int {
-	var r int32
-	binary.Read(rand.Reader, binary.LittleEndian, &r)
-	if r < 0 {
-		r = -r
-	}
-	return int(r)
+// What Populate generates. The same config, seed included, always
+// generates the same data.
+type PopulateConfig struct {
+	Seed int64
+
+	Users        int
+	Participants int
+	Places       int
+	Addresses    int
+	// addresses given to places
+	PlaceAddresses int
+	Periods        int
+	Meetings       int
+	// participants attending meetings
+	MeetingParticipants int
+	Availabilities      int
+
+	// places and homes of users are spread around the center,
+	// up to half the spread in each direction, in degrees
+	CenterLat  float64
+	CenterLong float64
+	SpreadLat  float64
+	SpreadLong float64
+
+	// periods start within Span after Start and last up to MaxLength
+	Start     time.Time
+	Span      time.Duration
+	MaxLength time.Duration
+
+	// rows inserted per transaction
+	BatchSize int
 }
 
-func randFrac() float64 {
-	i := randPos()
-	return float64(i) / float64(0x7fffffff)
+// A small data set around Oslo starting at the beginning of 2021
+func DefaultPopulateConfig() *PopulateConfig {
+	return &PopulateConfig{
+		Seed:                1,
+		Users:               20,
+		Participants:        20,
+		Places:              50,
+		Addresses:           20,
+		PlaceAddresses:      100,
+		Periods:             20,
+		Meetings:            20,
+		MeetingParticipants: 100,
+		Availabilities:      100,
+		CenterLat:           59.95,
+		CenterLong:          10.75,
+		SpreadLat:           0.1,
+		SpreadLong:          0.2,
+		Start:               time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+		Span:                365 * 24 * time.Hour,
+		MaxLength:           30 * 24 * time.Hour,
+		BatchSize:           10000,
+	}
 }
 
-func errCode(e error) int {
-	switch err := e.(type) {
-	case *sqlite3.Error:
-		return err.Code()
-	default:
-		return sqlite3.OK
+func (c *PopulateConfig) validate() error {
+	for _, n := range []int{c.Users, c.Participants, c.Places, c.Addresses, c.PlaceAddresses,
+		c.Periods, c.Meetings, c.MeetingParticipants, c.Availabilities} {
+		if n < 0 {
+			return fmt.Errorf("negative count in %+v", *c)
+		}
+	}
+	needs := []struct {
+		n        int
+		what     string
+		required int
+		of       string
+	}{
+		{c.Participants, "participants", c.Users, "users"},
+		{c.Meetings, "meetings", c.Users * c.Places * c.Periods, "users, places and periods"},
+		{c.Availabilities, "availabilities", c.Participants * c.Places * c.Periods, "participants, places and periods"},
+		{c.PlaceAddresses, "place addresses", c.Places * c.Addresses, "places and addresses"},
+		{c.MeetingParticipants, "meeting participants", c.Meetings * c.Participants, "meetings and participants"},
+	}
+	for _, need := range needs {
+		if need.n > 0 && need.required == 0 {
+			return fmt.Errorf("%s need %s", need.what, need.of)
+		}
 	}
+	if c.PlaceAddresses > c.Places*c.Addresses {
+		return fmt.Errorf("more place addresses than pairs of places and addresses")
+	}
+	if c.MeetingParticipants > c.Meetings*c.Participants {
+		return fmt.Errorf("more meeting participants than pairs of meetings and participants")
+	}
+	if c.Span <= 0 || c.MaxLength <= 0 {
+		return fmt.Errorf("span and max length of periods must be positive")
+	}
+	if c.BatchSize <= 0 {
+		return fmt.Errorf("batch size must be positive")
+	}
+	return nil
+}
+
+type populator struct {
+	db     *sql.DB
+	config *PopulateConfig
+	rand   *rand.Rand
 }
 
-func randName() string {
+func (p *populator) name() string {
 	gr := [][]string{
 		[]string{"b", "c", "d", "g", "j", "k", "p", "q", "t"}, // class 0
 		[]string{"f", "h", "th", "v"},                         // class 1
@@ -50,65 +126,167 @@ func randName() string {
 		[]int{3, 4, 4, 4},
 		[]int{4, 3, 3, 2, 2, 1, 1, 1, 0, 0, 0}}
 	str := ""
-	state := randPos() % 5
+	state := p.rand.Intn(5)
 	for i := 0; ; i++ {
-		chr := gr[state][randPos()%len(gr[state])]
+		chr := gr[state][p.rand.Intn(len(gr[state]))]
 		str = str + chr
-		if 4+(randPos()%10) < i {
+		if 4+p.rand.Intn(10) < i {
 			break
 		}
-		state = st[state][randPos()%len(st[state])]
+		state = st[state][p.rand.Intn(len(st[state]))]
 	}
 	return strings.ToUpper(str[:1]) + str[1:]
 }
 
-type randTable struct {
-	stmt *sql.Stmt
-	ids  []int64
+// A position around the center
+func (p *populator) position() (float64, float64) {
+	c := p.config
+	return c.CenterLat + (p.rand.Float64()-0.5)*c.SpreadLat,
+		c.CenterLong + (p.rand.Float64()-0.5)*c.SpreadLong
 }
 
-// Put data into table and store the id
-func (t *randTable) put(args ...interface{}) {
-	res, err := t.stmt.Exec(args...)
-	if err != nil {
-		log.Fatal(err)
-	} else {
-		id, _ := res.LastInsertId()
-		t.ids = append(t.ids, id)
-	}
+func (p *populator) pick(ids []int64) int64 {
+	return ids[p.rand.Intn(len(ids))]
 }
 
-// Put data into table, tolerate errors. Does not store id
-func (t *randTable) tryPut(args ...interface{}) error {
-	_, err := t.stmt.Exec(args...)
-	return err
+// Insert n rows into table, with the values returned by row, in
+// transactions of BatchSize rows. Returns the ids of the rows.
+func (p *populator) insert(table string, columns []string, n int, row func(i int) []interface{}) ([]int64, error) {
+	ids := make([]int64, 0, n)
+	for start := 0; start < n; start += p.config.BatchSize {
+		err := inTransactionOf(p.db, func(tx *sql.Tx) error {
+			stmt, err := tx.Prepare(iq(table, columns))
+			if err != nil {
+				return err
+			}
+			defer stmt.Close()
+			for i := start; i < n && i < start+p.config.BatchSize; i++ {
+				res, err := stmt.Exec(row(i)...)
+				if err != nil {
+					return fmt.Errorf("%s: %v", table, err)
+				}
+				id, err := res.LastInsertId()
+				if err != nil {
+					return err
+				}
+				ids = append(ids, id)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ids, nil
 }
 
-func (t *randTable) randId() int64 {
-	return t.ids[randPos()%len(t.ids)]
+// Distinct random pairs of ids, n of them
+func (p *populator) pairs(a, b []int64, n int) [][2]int64 {
+	seen := make(map[[2]int64]bool, n)
+	pairs := make([][2]int64, 0, n)
+	for len(pairs) < n {
+		pair := [2]int64{p.pick(a), p.pick(b)}
+		if !seen[pair] {
+			seen[pair] = true
+			pairs = append(pairs, pair)
+		}
+	}
+	return pairs
 }
 
-type randContext struct {
-	db *sql.DB
-	tx *sql.Tx
-}
+// Fill the database with random data as configured
+func Populate(db *sql.DB, config *PopulateConfig) error {
+	if err := config.validate(); err != nil {
+		return err
+	}
+	p := &populator{db: db, config: config, rand: rand.New(rand.NewSource(config.Seed))}
 
-func (rc *randContext) table(q string) *randTable {
-	fmt.Println(q)
-	stmt, err := rc.db.Prepare(q)
+	users, err := p.insert("user", []string{"alias", "login", "email"}, config.Users,
+		func(i int) []interface{} {
+			return []interface{}{p.name(), fmt.Sprintf("user%d", i+1), fmt.Sprintf("user%d@example.com", i+1)}
+		})
 	if err != nil {
-		fmt.Println(err)
-		return nil
-	} else {
-		return &randTable{rc.tx.Stmt(stmt), make([]int64, 0, 1000)}
+		return err
 	}
-}
-
-func newRandContext() *randContext {
-	rc := new(randContext)
-	rc.db = GlobalDB
-	rc.tx, _ = rc.db.Begin()
-	return rc
+	_, err = p.insert("user_preference", []string{"ownerid", "key", "value"}, 2*len(users),
+		func(i int) []interface{} {
+			lat, long := p.position()
+			if i%2 == 0 {
+				return []interface{}{users[i/2], "homelat", lat}
+			}
+			return []interface{}{users[i/2], "homelong", long}
+		})
+	if err != nil {
+		return err
+	}
+	places, err := p.insert("place", []string{"name", "lat", "long", "radius", "capacity", "category"}, config.Places,
+		func(i int) []interface{} {
+			lat, long := p.position()
+			category := placeCategories[p.rand.Intn(len(placeCategories))]
+			return []interface{}{p.name(), lat, long, 10 + p.rand.Intn(50), 10 * p.rand.Intn(30), category}
+		})
+	if err != nil {
+		return err
+	}
+	// owners of participants, which also own their availabilities
+	partOwners := make(map[int64]int64, config.Participants)
+	owners := make([]int64, config.Participants)
+	parts, err := p.insert("participant", []string{"ownerid", "alias", "description"}, config.Participants,
+		func(i int) []interface{} {
+			owners[i] = p.pick(users)
+			return []interface{}{owners[i], p.name(), "my description"}
+		})
+	if err != nil {
+		return err
+	}
+	for i, id := range parts {
+		partOwners[id] = owners[i]
+	}
+	periods, err := p.insert("period", []string{"start", "end"}, config.Periods,
+		func(i int) []interface{} {
+			start := config.Start.Add(time.Hour * time.Duration(p.rand.Int63n(int64(config.Span/time.Hour)+1)))
+			end := start.Add(time.Hour * time.Duration(1+p.rand.Int63n(int64(config.MaxLength/time.Hour)+1)))
+			return []interface{}{start.Unix(), end.Unix()}
+		})
+	if err != nil {
+		return err
+	}
+	meetings, err := p.insert("meeting", []string{"ownerid", "periodid", "placeid", "name"}, config.Meetings,
+		func(i int) []interface{} {
+			return []interface{}{p.pick(users), p.pick(periods), p.pick(places), "my meeting name"}
+		})
+	if err != nil {
+		return err
+	}
+	_, err = p.insert("availability", []string{"ownerid", "partid", "placeid", "periodid", "description"}, config.Availabilities,
+		func(i int) []interface{} {
+			part := p.pick(parts)
+			return []interface{}{partOwners[part], part, p.pick(places), p.pick(periods), "my availability reason"}
+		})
+	if err != nil {
+		return err
+	}
+	addresses, err := p.insert("address", []string{"type", "value"}, config.Addresses,
+		func(i int) []interface{} {
+			return []interface{}{p.rand.Intn(AddressCountry + 1), p.name()}
+		})
+	if err != nil {
+		return err
+	}
+	attending := p.pairs(meetings, parts, config.MeetingParticipants)
+	_, err = p.insert("meeting_participant", []string{"meetingid", "participantid"}, len(attending),
+		func(i int) []interface{} {
+			return []interface{}{attending[i][0], attending[i][1]}
+		})
+	if err != nil {
+		return err
+	}
+	located := p.pairs(places, addresses, config.PlaceAddresses)
+	_, err = p.insert("place_address", []string{"placeid", "addressid"}, len(located),
+		func(i int) []interface{} {
+			return []interface{}{located[i][0], located[i][1]}
+		})
+	return err
 }
 
 // return a slice that contains n copies of str
@@ -127,99 +305,3 @@ func iq(table string, columns []string) string {
 		strings.Join(columns, ",") + ") VALUES (" +
 		strings.Join(repeat("?", len(columns)), ",") + ")"
 }
-
-func randPeriod(base time.Time) (time.Time, time.Time) {
-	t1 := base.Add(time.Hour * time.Duration(randPos()%8760))
-	t2 := t1.Add(time.Hour * time.Duration(randPos()%720))
-	return t1, t2
-}
-
-func PopulateRandom() {
-	rc := newRandContext()
-
-	fmt.Println("populating random data")
-
-	rc.db.Begin()
-
-	user := rc.table(iq("user", []string{"alias", "login", "email"}))
-	userpref := rc.table(iq("user_preference", []string{"ownerid", "key", "value"}))
-	place := rc.table(iq("place", []string{"name", "lat", "long", "radius"}))
-	part := rc.table(iq("participant", []string{"ownerid", "alias", "description"}))
-	period := rc.table(iq("period", []string{"start", "end"}))
-	meeting := rc.table(iq("meeting", []string{"ownerid", "periodid", "placeid", "name"}))
-	avail := rc.table(iq("availability", []string{"ownerid", "partid", "placeid", "periodid", "description"}))
-	addr := rc.table(iq("address", []string{"type", "value"}))
-
-	mpart := rc.table(iq("meeting_participant", []string{"meetingid", "participantid"}))
-	pladdr := rc.table(iq("place_address", []string{"placeid", "addressid"}))
-
-	for i := 0; i < 20; i++ {
-		user.put(randName(), "login", "test@mail.com")
-	}
-
-	for i := 0; i < 20; i++ {
-		/* hack for now */
-		userpref.put(user.ids[i], "homelat", 59.95)
-		userpref.put(user.ids[i], "homelong", 10.75)
-	}
-
-	for i := 0; i < 50; i++ {
-		baseLat := 59.95
-		baseLong := 10.75
-		place.put(randName(), baseLat+(randFrac()-0.5)/10.0, baseLong+((randFrac()-0.5)/5.0), randPos()%10)
-	}
-
-	for i := 0; i < 20; i++ {
-		part.put(user.randId(), randName(), "my description")
-	}
-
-	now := time.Now().Round(time.Hour)
-	for i := 0; i < 20; i++ {
-		t1, t2 := randPeriod(now)
-		period.put(t1.Unix(), t2.Unix())
-	}
-
-	for i := 0; i < 20; i++ {
-		meeting.put(user.randId(), period.randId(), place.randId(), "my meeting name")
-	}
-
-	for i := 0; i < 100; i++ {
-		avail.put(user.randId(), part.randId(), place.randId(), period.randId(), "my availability reason")
-	}
-
-	for i := 0; i < 20; i++ {
-		addr.put(randPos()%5, randName())
-	}
-
-	for i := 0; i < 100; i++ {
-		err := mpart.tryPut(meeting.randId(), part.randId())
-		switch errCode(err) {
-		case 2067:
-			i--
-		case 0:
-			continue
-		default:
-			log.Fatal(err)
-		}
-	}
-
-	for i := 0; i < 100; i++ {
-		err := pladdr.tryPut(place.randId(), addr.randId())
-		switch errCode(err) {
-		case 2067:
-			i--
-		case 0:
-			continue
-		default:
-			log.Fatal(err)
-		}
-	}
-
-	fmt.Println("committing...")
-	err := rc.tx.Commit()
-	if err != nil {
-		fmt.Println(err)
-	} else {
-		fmt.Println("... done")
-	}
-}
@@ -0,0 +1,466 @@
+package tbeer
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Maximum number of occurrences expanded from one period
+const maxOccurrences = 1000
+
+// Open ended windows are cut off this long after their start when
+// expanding recurring periods
+const recurrenceHorizon = 8 * 7 * 24 * time.Hour
+
+// A time that is after every occurrence of unbounded recurrences
+const foreverTime = 1<<31 - 1
+
+// Give up expanding a rule after this many intervals, in case
+// it has no more occurrences, e.g. the 31st of every 12th february
+const maxRecurrenceIntervals = 10000
+
+var weekdayNames = []string{"SU", "MO", "TU", "WE", "TH", "FR", "SA"}
+
+// A BYDAY entry: a weekday, with an ordinal within the month for
+// monthly rules. Ordinal 0 means every such weekday.
+type ByDay struct {
+	Ordinal int
+	Weekday time.Weekday
+}
+
+func (d ByDay) String() string {
+	if d.Ordinal == 0 {
+		return weekdayNames[d.Weekday]
+	}
+	return strconv.Itoa(d.Ordinal) + weekdayNames[d.Weekday]
+}
+
+// The supported subset of an RFC 5545 recurrence rule
+type RRule struct {
+	// DAILY, WEEKLY or MONTHLY
+	Freq     string
+	Interval int
+	ByDay    []ByDay
+	// number of occurrences, 0 if unlimited
+	Count int
+	// unix time of the last possible start, 0 if unlimited
+	Until int64
+}
+
+func parseByDay(s string) (ByDay, error) {
+	if len(s) < 2 {
+		return ByDay{}, fmt.Errorf("bad BYDAY: %s", s)
+	}
+	d := ByDay{Weekday: -1}
+	name := s[len(s)-2:]
+	for i, n := range weekdayNames {
+		if n == name {
+			d.Weekday = time.Weekday(i)
+		}
+	}
+	if d.Weekday < 0 {
+		return ByDay{}, fmt.Errorf("bad BYDAY: %s", s)
+	}
+	if len(s) > 2 {
+		n, err := strconv.Atoi(s[:len(s)-2])
+		if err != nil || n == 0 || n < -5 || n > 5 {
+			return ByDay{}, fmt.Errorf("bad BYDAY: %s", s)
+		}
+		d.Ordinal = n
+	}
+	return d, nil
+}
+
+// Parse a recurrence rule such as FREQ=WEEKLY;BYDAY=FR;COUNT=10
+func ParseRRule(s string) (*RRule, error) {
+	r := &RRule{Interval: 1}
+	for _, part := range strings.Split(strings.TrimPrefix(s, "RRULE:"), ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("bad rule part: %s", part)
+		}
+		val := kv[1]
+		var err error
+		switch strings.ToUpper(kv[0]) {
+		case "FREQ":
+			r.Freq = strings.ToUpper(val)
+			if r.Freq != "DAILY" && r.Freq != "WEEKLY" && r.Freq != "MONTHLY" {
+				return nil, fmt.Errorf("unsupported FREQ: %s", val)
+			}
+		case "INTERVAL":
+			if r.Interval, err = strconv.Atoi(val); err != nil || r.Interval < 1 {
+				return nil, fmt.Errorf("bad INTERVAL: %s", val)
+			}
+		case "COUNT":
+			if r.Count, err = strconv.Atoi(val); err != nil || r.Count < 1 {
+				return nil, fmt.Errorf("bad COUNT: %s", val)
+			}
+		case "UNTIL":
+			t, err := time.Parse("20060102T150405Z", val)
+			if err != nil {
+				if t, err = time.Parse("20060102", val); err != nil {
+					return nil, fmt.Errorf("bad UNTIL: %s", val)
+				}
+				// a date includes the whole day
+				t = t.Add(24*time.Hour - time.Second)
+			}
+			r.Until = t.Unix()
+		case "BYDAY":
+			for _, d := range strings.Split(strings.ToUpper(val), ",") {
+				bd, err := parseByDay(d)
+				if err != nil {
+					return nil, err
+				}
+				r.ByDay = append(r.ByDay, bd)
+			}
+		default:
+			return nil, fmt.Errorf("unsupported rule part: %s", kv[0])
+		}
+	}
+	if r.Freq == "" {
+		return nil, fmt.Errorf("rule has no FREQ: %s", s)
+	}
+	if r.Count != 0 && r.Until != 0 {
+		return nil, fmt.Errorf("rule has both COUNT and UNTIL: %s", s)
+	}
+	for _, d := range r.ByDay {
+		if d.Ordinal != 0 && r.Freq != "MONTHLY" {
+			return nil, fmt.Errorf("BYDAY ordinals are only supported for MONTHLY rules: %s", s)
+		}
+	}
+	return r, nil
+}
+
+// The rule in its canonical form
+func (r *RRule) String() string {
+	parts := []string{"FREQ=" + r.Freq}
+	if r.Interval > 1 {
+		parts = append(parts, "INTERVAL="+strconv.Itoa(r.Interval))
+	}
+	if len(r.ByDay) > 0 {
+		days := make([]string, len(r.ByDay))
+		for i, d := range r.ByDay {
+			days[i] = d.String()
+		}
+		parts = append(parts, "BYDAY="+strings.Join(days, ","))
+	}
+	if r.Count > 0 {
+		parts = append(parts, "COUNT="+strconv.Itoa(r.Count))
+	}
+	if r.Until > 0 {
+		parts = append(parts, "UNTIL="+time.Unix(r.Until, 0).UTC().Format("20060102T150405Z"))
+	}
+	return strings.Join(parts, ";")
+}
+
+// Candidate starts of the rule in the k'th interval after first,
+// in chronological order
+func (r *RRule) candidates(first time.Time, k int) []time.Time {
+	y, mon, d := first.Date()
+	h, min, s := first.Clock()
+	loc := first.Location()
+	at := func(y int, mon time.Month, d int) time.Time {
+		return time.Date(y, mon, d, h, min, s, 0, loc)
+	}
+	// whether a weekday is in BYDAY, or is the weekday of first if none
+	byDay := func(wd time.Weekday) bool {
+		if len(r.ByDay) == 0 {
+			return wd == first.Weekday() || r.Freq == "DAILY"
+		}
+		for _, bd := range r.ByDay {
+			if bd.Weekday == wd {
+				return true
+			}
+		}
+		return false
+	}
+
+	var c []time.Time
+	switch r.Freq {
+	case "DAILY":
+		t := at(y, mon, d+k*r.Interval)
+		if byDay(t.Weekday()) {
+			c = append(c, t)
+		}
+	case "WEEKLY":
+		// weeks start on monday
+		monday := d - (int(first.Weekday())+6)%7 + 7*k*r.Interval
+		for i := 0; i < 7; i++ {
+			t := at(y, mon, monday+i)
+			if byDay(t.Weekday()) {
+				c = append(c, t)
+			}
+		}
+	case "MONTHLY":
+		month := at(y, mon+time.Month(k*r.Interval), 1)
+		my, mm, _ := month.Date()
+		days := time.Date(my, mm+1, 0, 0, 0, 0, 0, loc).Day()
+		if len(r.ByDay) == 0 {
+			if d <= days {
+				c = append(c, at(my, mm, d))
+			}
+			break
+		}
+		for _, bd := range r.ByDay {
+			// days of the month on this weekday
+			var matching []int
+			for day := 1; day <= days; day++ {
+				if at(my, mm, day).Weekday() == bd.Weekday {
+					matching = append(matching, day)
+				}
+			}
+			switch {
+			case bd.Ordinal == 0:
+				for _, day := range matching {
+					c = append(c, at(my, mm, day))
+				}
+			case bd.Ordinal > 0 && bd.Ordinal <= len(matching):
+				c = append(c, at(my, mm, matching[bd.Ordinal-1]))
+			case bd.Ordinal < 0 && -bd.Ordinal <= len(matching):
+				c = append(c, at(my, mm, matching[len(matching)+bd.Ordinal]))
+			}
+		}
+		sort.Slice(c, func(i, j int) bool { return c[i].Before(c[j]) })
+	}
+	return c
+}
+
+// Starts of cancelled occurrences of a period
+func (p *Period) exceptions() map[int]bool {
+	ex := make(map[int]bool)
+	for _, s := range strings.Split(p.ExDate, ",") {
+		if start, err := strconv.Atoi(s); err == nil {
+			ex[start] = true
+		}
+	}
+	return ex
+}
+
+// Cancel the occurrence starting at start
+func (p *Period) addException(start int) {
+	if p.ExDate != "" {
+		p.ExDate += ","
+	}
+	p.ExDate += strconv.Itoa(start)
+}
+
+// Whether the period overlaps the window, where a window End of zero
+// means open ended
+func (p *Period) overlaps(window Period) bool {
+	return p.End >= window.Start && (window.End == 0 || p.Start <= window.End)
+}
+
+// A field to scan the time zone of the place of a period into,
+// selected from place.timezone
+type periodZone struct{ p *Period }
+
+func (z periodZone) Scan(v interface{}) error {
+	var tz string
+	switch v := v.(type) {
+	case string:
+		tz = v
+	case []byte:
+		tz = string(v)
+	}
+	z.p.loc = placeLocation(tz)
+	return nil
+}
+
+func (p *Period) zoneField() interface{} {
+	return periodZone{p}
+}
+
+func (p *Period) location() *time.Location {
+	if p.loc == nil {
+		return time.UTC
+	}
+	return p.loc
+}
+
+// Occurrences of the period overlapping the window, computed in the
+// time zone of its place, so that e.g. a weekly meeting at 19:00 stays
+// at 19:00 across daylight saving time changes.
+// A period without a recurrence rule has only itself as occurrence.
+// For recurring periods an open ended window is cut off at
+// recurrenceHorizon after its start, or after now if that is later.
+func (p *Period) Occurrences(window Period) ([]Period, error) {
+	return p.occurrencesIn(window, p.location())
+}
+
+func (p *Period) occurrencesIn(window Period, loc *time.Location) ([]Period, error) {
+	if p.RRule == "" {
+		if p.overlaps(window) {
+			return []Period{*p}, nil
+		}
+		return nil, nil
+	}
+	r, err := ParseRRule(p.RRule)
+	if err != nil {
+		return nil, err
+	}
+	if window.End == 0 {
+		from := time.Unix(int64(window.Start), 0)
+		if now := time.Now(); now.After(from) {
+			from = now
+		}
+		window.End = int(from.Add(recurrenceHorizon).Unix())
+	}
+
+	ex := p.exceptions()
+	duration := p.End - p.Start
+	first := time.Unix(int64(p.Start), 0).In(loc)
+	occurrences := make([]Period, 0)
+	count := 0
+	for k := 0; k < maxRecurrenceIntervals; k++ {
+		for _, t := range r.candidates(first, k) {
+			start := int(t.Unix())
+			if start < p.Start {
+				continue
+			}
+			if r.Until != 0 && int64(start) > r.Until || start > window.End {
+				return occurrences, nil
+			}
+			count++
+			if r.Count != 0 && count > r.Count {
+				return occurrences, nil
+			}
+			o := Period{Start: start, End: start + duration, RRule: p.RRule, loc: p.loc}
+			if !ex[start] && o.overlaps(window) {
+				occurrences = append(occurrences, o)
+				if len(occurrences) >= maxOccurrences {
+					return occurrences, nil
+				}
+			}
+		}
+	}
+	return occurrences, nil
+}
+
+// The time span from the start of the first occurrence
+// to the end of the last
+func (p *Period) Span() Period {
+	if p.RRule == "" {
+		return Period{Start: p.Start, End: p.End}
+	}
+	r, err := ParseRRule(p.RRule)
+	switch {
+	case err != nil:
+		return Period{Start: p.Start, End: p.End}
+	case r.Until != 0:
+		return Period{Start: p.Start, End: int(r.Until) + p.End - p.Start}
+	case r.Count != 0:
+		all, _ := p.Occurrences(Period{Start: p.Start, End: foreverTime})
+		if len(all) == 0 {
+			return Period{Start: p.Start, End: p.End}
+		}
+		return Period{Start: p.Start, End: all[len(all)-1].End}
+	}
+	return Period{Start: p.Start, End: foreverTime}
+}
+
+// Check whether start is the start of an occurrence of the period
+func (p *Period) hasOccurrence(start int) (bool, error) {
+	occurrences, err := p.Occurrences(Period{Start: start, End: start})
+	if err != nil {
+		return false, err
+	}
+	for _, o := range occurrences {
+		if o.Start == start {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Check whether an occurrence of the period, not cancelled, has
+// ended at now
+func (p *Period) hasEnded(now int) (bool, error) {
+	occurrences, err := p.Occurrences(Period{Start: p.Start, End: now})
+	if err != nil {
+		return false, err
+	}
+	for _, o := range occurrences {
+		if o.End <= now {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Cancel the occurrence of a recurring period starting at start
+func cancelOccurrence(p *Period, start int) error {
+	if p.RRule == "" {
+		return errors.New("not recurring")
+	}
+	if p.exceptions()[start] {
+		return errors.New("occurrence already cancelled")
+	}
+	ok, err := p.hasOccurrence(start)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("no occurrence starts at %d", start)
+	}
+	p.addException(start)
+	return nil
+}
+
+var rruleParam = RouteParam{Name: "rrule", In: "query", Type: "string",
+	Description: "RFC 5545 recurrence rule, FREQ=DAILY, WEEKLY or MONTHLY with INTERVAL, BYDAY, COUNT or UNTIL. " +
+		"Empty for a single occurrence"}
+
+// Read the recurrence rule form value in canonical form, or def if not present
+func getFormRRule(ctx *DispatchContext, def string) (string, error) {
+	if _, ok := ctx.request.Form["rrule"]; !ok {
+		return def, nil
+	}
+	s := ctx.request.Form.Get("rrule")
+	if s == "" {
+		return "", nil
+	}
+	r, err := ParseRRule(s)
+	if err != nil {
+		return "", err
+	}
+	return r.String(), nil
+}
+
+// An item with a possibly recurring period
+type recurringItem interface {
+	recurrence() *Period
+	// copy of the item for one occurrence of its period
+	occurrence(p Period) interface{}
+}
+
+func (a *Availability) recurrence() *Period { return &a.Period }
+
+func (a *Availability) occurrence(p Period) interface{} {
+	o := *a
+	o.Period = p
+	return &o
+}
+
+func (m *Meeting) recurrence() *Period { return &m.Period }
+
+func (m *Meeting) occurrence(p Period) interface{} {
+	o := *m
+	o.Period = p
+	return &o
+}
+
+// Send each occurrence of the item within the window
+func sendOccurrences(out chan<- interface{}, item recurringItem, window Period) {
+	occurrences, err := item.recurrence().Occurrences(window)
+	if err != nil {
+		out <- err
+		return
+	}
+	for _, p := range occurrences {
+		out <- item.occurrence(p)
+	}
+}
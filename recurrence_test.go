@@ -0,0 +1,160 @@
+package tbeer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRRule(t *testing.T) {
+	good := map[string]string{
+		"FREQ=WEEKLY;BYDAY=FR":                   "FREQ=WEEKLY;BYDAY=FR",
+		"RRULE:freq=daily;interval=2;count=3":    "FREQ=DAILY;INTERVAL=2;COUNT=3",
+		"FREQ=MONTHLY;BYDAY=-1FR;UNTIL=20211231": "FREQ=MONTHLY;BYDAY=-1FR;UNTIL=20211231T235959Z",
+		"FREQ=WEEKLY;INTERVAL=1;BYDAY=MO,WE":     "FREQ=WEEKLY;BYDAY=MO,WE",
+	}
+	for in, want := range good {
+		r, err := ParseRRule(in)
+		if err != nil {
+			t.Errorf("%s: %v", in, err)
+		} else if r.String() != want {
+			t.Errorf("%s: got %s, expected %s", in, r.String(), want)
+		}
+	}
+	bad := []string{
+		"",
+		"FREQ=YEARLY",
+		"FREQ=WEEKLY;BYDAY=XX",
+		"FREQ=WEEKLY;BYDAY=1FR",
+		"FREQ=DAILY;COUNT=0",
+		"FREQ=DAILY;COUNT=2;UNTIL=20210101",
+		"FREQ=DAILY;BYMONTH=1",
+		"BYDAY=FR",
+	}
+	for _, in := range bad {
+		if _, err := ParseRRule(in); err == nil {
+			t.Errorf("%s: parsed a bad rule", in)
+		}
+	}
+}
+
+func TestOccurrences(t *testing.T) {
+	at := func(y int, m time.Month, d int) int {
+		return int(time.Date(y, m, d, 17, 0, 0, 0, time.UTC).Unix())
+	}
+	year := Period{Start: at(2021, 1, 1), End: at(2022, 1, 1)}
+
+	// friday 1 january 2021, 17:00
+	first := at(2021, 1, 1)
+
+	tests := []struct {
+		first  int
+		rule   string
+		exdate string
+		window Period
+		starts []int
+	}{
+		{first, "FREQ=DAILY;COUNT=3", "", year,
+			[]int{at(2021, 1, 1), at(2021, 1, 2), at(2021, 1, 3)}},
+		{first, "FREQ=WEEKLY;COUNT=3", "", year,
+			[]int{at(2021, 1, 1), at(2021, 1, 8), at(2021, 1, 15)}},
+		// COUNT includes cancelled occurrences
+		{first, "FREQ=WEEKLY;BYDAY=MO,FR;COUNT=4", "", year,
+			[]int{at(2021, 1, 1), at(2021, 1, 4), at(2021, 1, 8), at(2021, 1, 11)}},
+		{first, "FREQ=WEEKLY;BYDAY=MO,FR;COUNT=4", "1610125200", year,
+			[]int{at(2021, 1, 1), at(2021, 1, 4), at(2021, 1, 11)}},
+		{first, "FREQ=WEEKLY;INTERVAL=2;UNTIL=20210131", "", year,
+			[]int{at(2021, 1, 1), at(2021, 1, 15), at(2021, 1, 29)}},
+		{first, "FREQ=MONTHLY;BYDAY=-1FR;COUNT=3", "", year,
+			[]int{at(2021, 1, 29), at(2021, 2, 26), at(2021, 3, 26)}},
+		// months without a 31st are skipped
+		{at(2021, 1, 31), "FREQ=MONTHLY;COUNT=3", "", Period{Start: at(2021, 1, 31), End: at(2022, 1, 1)},
+			[]int{at(2021, 1, 31), at(2021, 3, 31), at(2021, 5, 31)}},
+		// window in the middle of an unlimited rule
+		{first, "FREQ=WEEKLY", "", Period{Start: at(2021, 6, 1), End: at(2021, 6, 14)},
+			[]int{at(2021, 6, 4), at(2021, 6, 11)}},
+	}
+	for _, test := range tests {
+		p := &Period{
+			Start:  test.first,
+			End:    test.first + 2*3600,
+			RRule:  test.rule,
+			ExDate: test.exdate}
+		occurrences, err := p.Occurrences(test.window)
+		if err != nil {
+			t.Errorf("%s: %v", test.rule, err)
+			continue
+		}
+		starts := make([]int, len(occurrences))
+		for i, o := range occurrences {
+			starts[i] = o.Start
+			if o.End-o.Start != 2*3600 {
+				t.Errorf("%s: occurrence has wrong duration", test.rule)
+			}
+		}
+		if len(starts) != len(test.starts) {
+			t.Errorf("%s: got starts %v, expected %v", test.rule, starts, test.starts)
+			continue
+		}
+		for i := range starts {
+			if starts[i] != test.starts[i] {
+				t.Errorf("%s: got starts %v, expected %v", test.rule, starts, test.starts)
+				break
+			}
+		}
+	}
+}
+
+func TestCancelOccurrence(t *testing.T) {
+	start := int(time.Date(2021, 1, 1, 17, 0, 0, 0, time.UTC).Unix())
+	p := &Period{Start: start, End: start + 3600, RRule: "FREQ=DAILY;COUNT=5"}
+	if err := cancelOccurrence(p, start+86400); err != nil {
+		t.Fatal(err)
+	}
+	if err := cancelOccurrence(p, start+86400); err == nil {
+		t.Errorf("cancelled an occurrence twice")
+	}
+	if err := cancelOccurrence(p, start+3600); err == nil {
+		t.Errorf("cancelled something that is not an occurrence")
+	}
+	if err := cancelOccurrence(p, start+5*86400); err == nil {
+		t.Errorf("cancelled an occurrence after COUNT")
+	}
+	if span := p.Span(); span.End != start+4*86400+3600 {
+		t.Errorf("unexpected span %+v", span)
+	}
+}
+
+// Recurrences keep their local time in the time zone of the place
+func TestOccurrencesAcrossDST(t *testing.T) {
+	oslo, err := time.LoadLocation("Europe/Oslo")
+	if err != nil {
+		t.Skip("no time zone database")
+	}
+	// fridays at 17:00, before and after summer time starts on 28 march
+	start := int(time.Date(2021, 3, 19, 17, 0, 0, 0, oslo).Unix())
+	p := &Period{Start: start, End: start + 7200, RRule: "FREQ=WEEKLY;COUNT=4"}
+	if err := p.zoneField().(periodZone).Scan([]byte("Europe/Oslo")); err != nil || p.location().String() != "Europe/Oslo" {
+		t.Fatalf("zone not scanned: %v %v", p.loc, err)
+	}
+	occurrences, err := p.Occurrences(Period{Start: start, End: foreverTime})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(occurrences) != 4 {
+		t.Fatalf("unexpected occurrences %v", occurrences)
+	}
+	for _, o := range occurrences {
+		if local := time.Unix(int64(o.Start), 0).In(oslo); local.Hour() != 17 || local.Weekday() != time.Friday {
+			t.Errorf("occurrence at %v", local)
+		}
+	}
+
+	// the first friday of summer time, as a calendar client sees it
+	summer := int(time.Date(2021, 4, 2, 17, 0, 0, 0, oslo).Unix())
+	if err := cancelOccurrence(p, summer); err != nil {
+		t.Fatal(err)
+	}
+	if occurrences, _ := p.Occurrences(Period{Start: start, End: foreverTime}); len(occurrences) != 3 {
+		t.Errorf("cancelled occurrence still expanded: %v", occurrences)
+	}
+}
@@ -2,29 +2,51 @@ package tbeer
 
 import (
 	"database/sql"
-	"encoding/json"
 	"fmt"
 	"net/http"
 )
 
 const queueBufferSize = 0
 
-func jsonError(w http.ResponseWriter, err error) {
-	w.WriteHeader(400)
-	json.NewEncoder(w).Encode(err.Error())
+// Meetings a user participates in, with the participant attending
+const userMeetingsQuery = "SELECT meeting.id, meeting.ownerid, meeting.name, meeting.visibility, meeting.max_participants, " +
+	"place.id, place.name, place.lat, place.long, place.radius, place.capacity, place.category, " +
+	"period.start, period.end, period.rrule, period.exdate, " +
+	"participant.id, ifnull(place.timezone, '') " +
+	"FROM meeting, place, period, meeting_participant, participant " +
+	"WHERE " +
+	"participant.ownerid = ? AND " +
+	"meeting_participant.participantid = participant.id AND " +
+	"meeting_participant.meetingid = meeting.id AND " +
+	"meeting.placeid = place.id AND " +
+	"meeting.periodid = period.id"
+
+// An error answered with a status other than 400 Bad Request
+type statusError struct {
+	status int
+	msg    string
 }
 
-func compileStatements(q []string) ([]*sql.Stmt, error) {
-	var err error
-	stmts := make([]*sql.Stmt, len(q))
-	for i, _ := range stmts {
-		stmts[i], err = GlobalDB.Prepare(q[i])
-		if err != nil {
-			fmt.Println(err)
-			return nil, err
+func (e *statusError) Error() string {
+	return e.msg
+}
+
+// Answered with 404 Not Found, also for things the user can't see
+var errNotFound = &statusError{http.StatusNotFound, "not found"}
+
+func jsonError(w http.ResponseWriter, err error) {
+	switch e := err.(type) {
+	case *statusError:
+		w.WriteHeader(e.status)
+	default:
+		if err == sql.ErrNoRows {
+			err = errNotFound
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(400)
 		}
 	}
-	return stmts, nil
+	writeJSON(w, err.Error())
 }
 
 // Type of the function use to handle REST requests based on one sql statement
@@ -35,6 +57,7 @@ type StmtRestHandler struct {
 	LeafDispatcher
 	fn    StmtRestFunc
 	stmts []*sql.Stmt
+	doc   *RouteDoc
 }
 
 func (h *StmtRestHandler) ServeREST(ctx *DispatchContext, w http.ResponseWriter, r *http.Request) {
@@ -44,19 +67,40 @@ func (h *StmtRestHandler) ServeREST(ctx *DispatchContext, w http.ResponseWriter,
 	}
 }
 
-func installStmtRestHandler(pathPattern string, queryStrings []string, fn StmtRestFunc) {
+func (app *App) installStmtRestHandler(pathPattern string, doc *RouteDoc, queryStrings []string, fn StmtRestFunc) {
+	app.installStmtRestMethodHandler("GET", pathPattern, doc, queryStrings, fn)
+}
+
+func (app *App) installRestMethodHandler(method string, pathPattern string, handler RESTHandler) {
+	if err := app.InstallRestMethodHandler(method, pathPattern, handler); err != nil && app.installErr == nil {
+		app.installErr = err
+	}
+}
+
+func (app *App) installStmtRestMethodHandler(method string, pathPattern string, doc *RouteDoc, queryStrings []string, fn StmtRestFunc) {
 	handler := new(StmtRestHandler)
 	var err error
 	handler.fn = fn
-	handler.stmts, err = compileStatements(queryStrings)
+	handler.doc = doc
+	handler.stmts, err = app.compileStatements(queryStrings)
 
-	if err == nil {
-		InstallRestHandler(pathPattern, handler)
+	if err != nil {
+		if app.installErr == nil {
+			app.installErr = fmt.Errorf("%s: %v", pathPattern, err)
+		}
+	} else {
+		app.installRestMethodHandler(method, pathPattern, handler)
 	}
 }
 
-func InitRestTree() {
-	installStmtRestHandler("userpref",
+// Install all REST handlers
+func (app *App) initRestTree() error {
+
+	app.installStmtRestHandler("userpref",
+		&RouteDoc{
+			Summary:  "preferences of the user",
+			Params:   []RouteParam{{Name: "q", In: "query", Type: "string", Repeated: true, Description: "keys to get, all if omitted"}},
+			Response: map[string]interface{}{}},
 		[]string{
 			"SELECT key, value FROM user_preference WHERE ownerid = ?",
 			"SELECT value FROM user_preference WHERE ownerid = ? AND key = ?"},
@@ -95,41 +139,16 @@ func InitRestTree() {
 			return nil
 		})
 
-	installStmtRestHandler("place/:id",
-		[]string{
-			"SELECT id, name, lat, long, radius FROM place WHERE id = ?",
-			"SELECT address.type, address.value FROM address, place_address " +
-				"WHERE " +
-				"place_address.placeid = ? AND " +
-				"place_address.addressid = address.id "},
-		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
-			row := stmts[0].QueryRow(ctx.param[0])
-			place := &Place{Type: "place"}
-			if err := row.Scan(place.BasicFields()...); err != nil {
-				return err
-			} else {
-				addrrows, err := stmts[1].Query(place.Id)
-				place.Address = make([]*Address, 0, 10)
-
-				if err != nil {
-					fmt.Println(err)
-				} else {
-					for addrrows.Next() {
-						addr := &Address{}
-						addrrows.Scan(addr.BasicFields()...)
-						place.Address = append(place.Address, addr)
-					}
-				}
-
-				json.NewEncoder(w).Encode(place)
-				return nil
-			}
-		})
-
-	installStmtRestHandler("places",
+	app.installStmtRestHandler("places",
+		&RouteDoc{
+			Summary:  "places inside a rectangle",
+			Params:   append(rectangleParams, placeFilterParams...),
+			Response: []*APIPlace{}},
 		[]string{
-			"SELECT id, name, lat, long, radius FROM place WHERE " +
-				"lat > ? AND lat < ? AND long > ? AND long < ?"},
+			"SELECT id, name, lat, long, radius, capacity, category FROM place WHERE " +
+				"lat > ? AND lat < ? AND long > ? AND long < ? AND " + placeFilterCondition,
+			placeHoursQuery,
+			placeTimezoneQuery},
 		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
 			items, err := Uniplex(queueBufferSize,
 				func(out chan<- interface{}) error {
@@ -137,17 +156,28 @@ func InitRestTree() {
 					if err != nil {
 						return err
 					}
-					rows, err := stmts[0].Query(rect.MinLat, rect.MaxLat, rect.MinLong, rect.MaxLong)
+					filter, err := getPlaceFilter(ctx)
+					if err != nil {
+						return err
+					}
+					isOpen := filter.openCheck(stmts[1], stmts[2])
+					args := append([]interface{}{rect.MinLat, rect.MaxLat, rect.MinLong, rect.MaxLong}, filter.args()...)
+					rows, err := stmts[0].Query(args...)
 					if err != nil {
 						return err
 					}
+					defer rows.Close()
 					for rows.Next() {
-						place := &Place{Type: "place"}
+						place := &Place{}
 						err := rows.Scan(place.BasicFields()...)
 						if err != nil {
 							return err
 						}
-						out <- place
+						if open, err := isOpen(place.Id); err != nil {
+							return err
+						} else if open {
+							out <- place
+						}
 					}
 					return nil
 				})
@@ -160,53 +190,79 @@ func InitRestTree() {
 			return nil
 		})
 
-	installStmtRestHandler("stuff_at",
+	app.installStmtRestHandler("stuff_at",
+		&RouteDoc{
+			Summary:  "places inside a rectangle, and occurrences of availabilities at them within a time window",
+			Params:   append(append(rectangleParams, windowParams...), placeFilterParams...),
+			Response: []interface{}{&APIPlace{}, &APIAvailability{}}},
 		[]string{
-			"SELECT id, name, lat, long, radius FROM place WHERE " +
-				"lat > ? AND lat < ? AND long > ? AND long < ?",
-			"SELECT availability.id, availability.description, " +
+			"SELECT id, name, lat, long, radius, capacity, category FROM place WHERE " +
+				"lat > ? AND lat < ? AND long > ? AND long < ? AND " + placeFilterCondition,
+			"SELECT availability.id, availability.description, availability.visibility, " +
 				"participant.id, participant.alias, participant.description, " +
-				"place.id, place.name, place.lat, place.long, place.radius, " +
-				"period.start, period.end " +
+				"place.id, place.name, place.lat, place.long, place.radius, place.capacity, place.category, " +
+				"period.start, period.end, period.rrule, period.exdate, ifnull(place.timezone, '') " +
 				"FROM availability, participant, place, period " +
 				"WHERE " +
 				"availability.partid = participant.id AND " +
 				"availability.placeid = place.id AND " +
 				"place.lat > ? AND place.lat < ? AND place.long > ? and place.long < ? AND " +
-				"availability.periodid = period.id"},
+				"availability.periodid = period.id AND " +
+				visibleTo("availability") + " AND " + placeFilterCondition,
+			placeHoursQuery,
+			placeTimezoneQuery},
 		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
 			rect, err := GetRectangle(ctx)
 			if err != nil {
 				return err
 			}
+			window, err := GetWindow(ctx)
+			if err != nil {
+				return err
+			}
+			filter, err := getPlaceFilter(ctx)
+			if err != nil {
+				return err
+			}
 
 			items, err := Multiplex(queueBufferSize,
 				func(out chan<- interface{}) error {
-					rows, err := stmts[0].Query(rect.MinLat, rect.MaxLat, rect.MinLong, rect.MaxLong)
+					isOpen := filter.openCheck(stmts[2], stmts[3])
+					args := append([]interface{}{rect.MinLat, rect.MaxLat, rect.MinLong, rect.MaxLong}, filter.args()...)
+					rows, err := stmts[0].Query(args...)
 					if err != nil {
 						return err
 					}
+					defer rows.Close()
 					for rows.Next() {
-						place := &Place{Type: "place"}
+						place := &Place{}
 						if err := rows.Scan(place.BasicFields()...); err != nil {
 							out <- err
-						} else {
+						} else if open, err := isOpen(place.Id); err != nil {
+							out <- err
+						} else if open {
 							out <- place
 						}
 					}
 					return nil
 				},
 				func(out chan<- interface{}) error {
-					rows, err := stmts[1].Query(rect.MinLat, rect.MaxLat, rect.MinLong, rect.MaxLong)
+					isOpen := filter.openCheck(stmts[2], stmts[3])
+					args := append([]interface{}{rect.MinLat, rect.MaxLat, rect.MinLong, rect.MaxLong},
+						visibilityArgs(ctx.userid)...)
+					rows, err := stmts[1].Query(append(args, filter.args()...)...)
 					if err != nil {
 						return err
 					}
+					defer rows.Close()
 					for rows.Next() {
-						a := &Availability{Type: "availability"}
-						if err := rows.Scan(ConcatBasicFields(a, &a.Participant, &a.Place, &a.Period)...); err != nil {
+						a := &Availability{}
+						if err := rows.Scan(append(ConcatBasicFields(a, &a.Participant, &a.Place, &a.Period), a.Period.zoneField())...); err != nil {
 							out <- err
-						} else {
-							out <- a
+						} else if open, err := isOpen(a.Place.Id); err != nil {
+							out <- err
+						} else if open {
+							sendOccurrences(out, a, *window)
 						}
 					}
 					return nil
@@ -220,26 +276,29 @@ func InitRestTree() {
 			return nil
 		})
 
-	installStmtRestHandler("meeting/:id",
-		[]string{"SELECT id, ownerid, name FROM meeting WHERE id = ?"},
+	app.installStmtRestHandler("meeting/:id",
+		&RouteDoc{
+			Summary:  "a meeting with place and period",
+			Response: &APIMeeting{}},
+		[]string{meetingByIdQuery, visibilityQuery},
 		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
-			row := stmts[0].QueryRow(ctx.param[0])
-			meeting := &Meeting{Type: "meeting"}
-			if err := row.Scan(meeting.BasicFields()...); err != nil {
+			meeting, _, err := loadVisibleMeeting(ctx, stmts[0], stmts[1], ctx.IntParam("id"))
+			if err != nil {
 				return err
-			} else {
-				json.NewEncoder(w).Encode(meeting)
-				return nil
 			}
-			return nil
+			return writeJSON(w, meeting)
 		})
 
-	installStmtRestHandler("availability",
+	app.installStmtRestHandler("availability",
+		&RouteDoc{
+			Summary:  "occurrences of the availabilities of the user within a time window",
+			Params:   windowParams,
+			Response: []*APIAvailability{}},
 		[]string{
-			"SELECT availability.id, availability.description," +
+			"SELECT availability.id, availability.description, availability.visibility, " +
 				"participant.id, participant.alias, participant.description, " +
-				"place.id, place.name, place.lat, place.long, place.radius, " +
-				"period.start, period.end " +
+				"place.id, place.name, place.lat, place.long, place.radius, place.capacity, place.category, " +
+				"period.start, period.end, period.rrule, period.exdate, ifnull(place.timezone, '') " +
 				"FROM availability, participant, place, period " +
 				"WHERE " +
 				"availability.ownerid = ? AND " +
@@ -247,6 +306,10 @@ func InitRestTree() {
 				"availability.placeid = place.id AND " +
 				"availability.periodid = period.id"},
 		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			window, err := GetWindow(ctx)
+			if err != nil {
+				return err
+			}
 			items, err := Uniplex(queueBufferSize,
 				func(out chan<- interface{}) error {
 					rows, err := stmts[0].Query(ctx.userid)
@@ -254,12 +317,12 @@ func InitRestTree() {
 						return err
 					}
 					for rows.Next() {
-						a := &Availability{Type: "availability"}
-						err := rows.Scan(ConcatBasicFields(a, &a.Participant, &a.Place, &a.Period)...)
+						a := &Availability{}
+						err := rows.Scan(append(ConcatBasicFields(a, &a.Participant, &a.Place, &a.Period), a.Period.zoneField())...)
 						if err != nil {
 							out <- err
 						} else {
-							out <- a
+							sendOccurrences(out, a, *window)
 						}
 					}
 					return nil
@@ -273,20 +336,18 @@ func InitRestTree() {
 			return nil
 		})
 
-	installStmtRestHandler("meetings",
+	app.installStmtRestHandler("meetings",
+		&RouteDoc{
+			Summary:  "occurrences of the meetings the user participates in within a time window",
+			Params:   windowParams,
+			Response: []*APIMeeting{}},
 		[]string{
-			"SELECT meeting.id, meeting.ownerid, meeting.name, " +
-				"place.id, place.name, place.lat, place.long, place.radius, " +
-				"period.start, period.end, " +
-				"participant.id " +
-				"FROM meeting, place, period, meeting_participant, participant " +
-				"WHERE " +
-				"participant.ownerid = ? AND " +
-				"meeting_participant.participantid = participant.id AND " +
-				"meeting_participant.meetingid = meeting.id AND " +
-				"meeting.placeid = place.id AND " +
-				"meeting.periodid = period.id"},
+			userMeetingsQuery},
 		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			window, err := GetWindow(ctx)
+			if err != nil {
+				return err
+			}
 			items, err := Uniplex(queueBufferSize,
 				func(out chan<- interface{}) error {
 					rows, err := stmts[0].Query(ctx.userid)
@@ -294,13 +355,13 @@ func InitRestTree() {
 						return err
 					}
 					for rows.Next() {
-						m := &Meeting{Type: "meeting"}
+						m := &Meeting{}
 						var partid int
-						err := rows.Scan(append(ConcatBasicFields(m, &m.Place, &m.Period), &partid)...)
+						err := rows.Scan(append(ConcatBasicFields(m, &m.Place, &m.Period), &partid, m.Period.zoneField())...)
 						if err != nil {
 							out <- err
 						} else {
-							out <- m
+							sendOccurrences(out, m, *window)
 						}
 					}
 					return nil
@@ -313,14 +374,18 @@ func InitRestTree() {
 			return nil
 		})
 
-	installStmtRestHandler("placesearch",
-		[]string{"SELECT name, id FROM place WHERE name LIKE ?"},
+	app.installStmtRestHandler("placesearch",
+		&RouteDoc{
+			Summary: "autocomplete place names. Given a time window, " +
+				"places overbooked within it are suggested with a warning",
+			Params: append(append([]RouteParam{{Name: "query", In: "query", Type: "string", Required: true, Description: "part of the name"}},
+				windowParams...), placeFilterParams...),
+			Response: &APISuggestions{}},
+		[]string{
+			"SELECT name, id FROM place WHERE name LIKE ? AND " + placeFilterCondition,
+			placeHoursQuery,
+			placeTimezoneQuery},
 		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
-			type Suggestion struct {
-				Value string `json:"value"`
-				Data  int64  `json:"data"`
-			}
-
 			items, err := Uniplex(queueBufferSize,
 				func(out chan<- interface{}) error {
 					q, ok := ctx.request.Form["query"]
@@ -328,18 +393,36 @@ func InitRestTree() {
 						return fmt.Errorf("no query")
 					}
 
-					rows, err := stmts[0].Query("%" + q[0] + "%")
+					window, err := GetWindow(ctx)
+					if err != nil {
+						return err
+					}
+					filter, err := getPlaceFilter(ctx)
+					if err != nil {
+						return err
+					}
+					isOpen := filter.openCheck(stmts[1], stmts[2])
+
+					rows, err := stmts[0].Query(append([]interface{}{"%" + q[0] + "%"}, filter.args()...)...)
 
 					if err != nil {
 						return err
 					}
+					defer rows.Close()
 
 					for rows.Next() {
-						s := &Suggestion{}
+						s := &APISuggestion{}
 						err := rows.Scan(&s.Value, &s.Data)
+						open := false
+						if err == nil {
+							open, err = isOpen(s.Data)
+						}
+						if err == nil && open && window.Start != 0 && window.End != 0 {
+							s.Warning, err = placeCapacityWarning(ctx.app.DB, s.Data, *window)
+						}
 						if err != nil {
 							out <- err
-						} else {
+						} else if open {
 							out <- s
 						}
 					}
@@ -355,4 +438,38 @@ func InitRestTree() {
 			w.Write([]byte("}"))
 			return nil
 		})
+
+	app.initPlaceHandlers()
+	app.initWriteHandlers()
+	app.initDynamicURLHandlers()
+	app.initReviewHandlers()
+	app.initUserHandlers()
+	app.initFriendHandlers()
+	app.initMessageHandlers()
+	app.initNotificationHandlers()
+	app.initCalendarHandlers()
+	app.initFreeBusyHandlers()
+	app.initCapacityHandlers()
+	app.initBeerHandlers()
+	app.initCheckinHandlers()
+	app.initGeocodeHandlers()
+	app.installStmtRestHandler("live",
+		&RouteDoc{
+			Summary:     "server-sent events of changes inside a rectangle and time window",
+			Params:      append(rectangleParams, windowParams...),
+			Response:    &APIEvent{},
+			ContentType: "text/event-stream"},
+		[]string{visibilityQuery},
+		serveLiveEvents)
+	app.installRestMethodHandler("GET", "schema.json", Documented(RESTHandlerFunc(serveAPISchema),
+		&RouteDoc{
+			Summary:     "JSON Schema of the API types",
+			Response:    map[string]interface{}{},
+			ContentType: "application/schema+json"}))
+	app.installRestMethodHandler("GET", "openapi.json", Documented(RESTHandlerFunc(serveOpenAPI),
+		&RouteDoc{
+			Summary:  "OpenAPI description of the API",
+			Response: map[string]interface{}{}}))
+
+	return app.installErr
 }
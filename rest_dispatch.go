@@ -4,26 +4,57 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"regexp"
 	"strconv"
 	"strings"
+	"unicode"
 )
 
 type DispatchContext struct {
 	// userid of the dispatched request
-	userid  int64
-	param   []interface{}
+	userid int64
+	// path parameters by name
+	params  map[string]interface{}
 	request *http.Request
+	app     *App
+}
+
+// Get a path parameter, nil if not present
+func (ctx *DispatchContext) Param(name string) interface{} {
+	return ctx.params[name]
+}
+
+// Get a path parameter of type int
+func (ctx *DispatchContext) IntParam(name string) int64 {
+	i, _ := ctx.params[name].(int64)
+	return i
+}
+
+// Get a path parameter of type string, slug or uuid
+func (ctx *DispatchContext) StringParam(name string) string {
+	s, _ := ctx.params[name].(string)
+	return s
 }
 
 type dispatcher interface {
 	dispatch(item string, context *DispatchContext) (dispatcher, error)
 	install(key string, dp dispatcher) error
+	// the dispatcher previously installed under key, or nil
+	installed(key string) dispatcher
 }
 
 type RESTHandler interface {
 	ServeREST(ctx *DispatchContext, w http.ResponseWriter, r *http.Request)
 }
 
+// The RESTHandlerFunc type is an adapter to allow the use of
+// ordinary functions as REST handlers.
+type RESTHandlerFunc func(ctx *DispatchContext, w http.ResponseWriter, r *http.Request)
+
+func (f RESTHandlerFunc) ServeREST(ctx *DispatchContext, w http.ResponseWriter, r *http.Request) {
+	f(ctx, w, r)
+}
+
 // leaf dispatcher should also implement RESTHandler
 type LeafDispatcher struct {
 }
@@ -38,14 +69,29 @@ type acceptDP struct {
 	child dispatcher
 }
 
-// dispatcher that reads an integer
-type intDP struct {
-	acceptDP
+// A type of path parameter, e.g. int in the pattern element :id:int
+type paramType struct {
+	name string
+	// json schema type and format of the parameter
+	schemaType   string
+	schemaFormat string
+	parse        func(item string) (interface{}, error)
 }
 
-// dispatcher that reads a string
-type stringDP struct {
+// dispatcher that reads a typed path parameter
+type paramDP struct {
 	acceptDP
+	name  string
+	ptype *paramType
+}
+
+// A node in the rest tree that serves requests for its own path,
+// selecting a handler by HTTP method, and optionally dispatches
+// deeper paths to next.
+type restNode struct {
+	// handlers by method. The empty method accepts any method.
+	methods map[string]RESTHandler
+	next    dispatcher
 }
 
 func newSelectDP() *selectDP {
@@ -66,18 +112,27 @@ func (s *selectDP) install(key string, dp dispatcher) error {
 	return nil
 }
 
+func (s *selectDP) installed(key string) dispatcher {
+	return s.children[key]
+}
+
 // Accept the item and go to child
 func (s *acceptDP) dispatch(item string, ctx *DispatchContext) (dispatcher, error) {
 	return s.child, nil
 }
 
+// Install child. An existing child may only be replaced by a restNode
+// wrapping it, as done by graftHandler; use graft to merge.
 func (s *acceptDP) install(key string, dp dispatcher) error {
-	if s.child != nil {
+	if node, ok := dp.(*restNode); s.child != nil && !(ok && node.next == s.child) {
 		return errors.New("accept dispatcher child already exists")
-	} else {
-		s.child = dp
-		return nil
 	}
+	s.child = dp
+	return nil
+}
+
+func (s *acceptDP) installed(key string) dispatcher {
+	return s.child
 }
 
 func (s *LeafDispatcher) dispatch(item string, ctx *DispatchContext) (dispatcher, error) {
@@ -88,26 +143,149 @@ func (s *LeafDispatcher) install(key string, dp dispatcher) error {
 	return errors.New("can't install in a leaf")
 }
 
-func (s *intDP) dispatch(item string, ctx *DispatchContext) (dispatcher, error) {
-	i, err := strconv.ParseInt(item, 10, 64)
+func (s *LeafDispatcher) installed(key string) dispatcher {
+	return nil
+}
+
+func newRestNode() *restNode {
+	return &restNode{methods: make(map[string]RESTHandler)}
+}
+
+func (n *restNode) dispatch(item string, ctx *DispatchContext) (dispatcher, error) {
+	if n.next == nil {
+		return nil, fmt.Errorf("not found: %s", item)
+	}
+	return n.next.dispatch(item, ctx)
+}
+
+func (n *restNode) install(key string, dp dispatcher) error {
+	if n.next == nil {
+		return errors.New("rest node has no child dispatcher")
+	}
+	return n.next.install(key, dp)
+}
+
+func (n *restNode) installed(key string) dispatcher {
+	if n.next == nil {
+		return nil
+	}
+	return n.next.installed(key)
+}
+
+func (n *restNode) ServeREST(ctx *DispatchContext, w http.ResponseWriter, r *http.Request) {
+	handler, ok := n.methods[r.Method]
+	if !ok {
+		handler, ok = n.methods[""]
+	}
+	if !ok && r.Method == "HEAD" {
+		handler, ok = n.methods["GET"]
+	}
+	if !ok {
+		allow := make([]string, 0, len(n.methods))
+		for method := range n.methods {
+			allow = append(allow, method)
+		}
+		w.Header().Set("Allow", strings.Join(allow, ", "))
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	handler.ServeREST(ctx, w, r)
+}
+
+// Install a method handler in the node
+func (n *restNode) addMethod(method string, h RESTHandler) error {
+	if _, exists := n.methods[method]; exists {
+		return fmt.Errorf("handler for method '%s' already installed", method)
+	}
+	n.methods[method] = h
+	return nil
+}
+
+var uuidPattern = regexp.MustCompile("^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$")
+
+// Path parameter types by the name used in patterns
+var paramTypes = map[string]*paramType{
+	"int": {"int", "integer", "int64", func(item string) (interface{}, error) {
+		return strconv.ParseInt(item, 10, 64)
+	}},
+	"string": {"string", "string", "", func(item string) (interface{}, error) {
+		if item == "" {
+			return nil, errors.New("empty string parameter")
+		}
+		return item, nil
+	}},
+	"slug": {"slug", "string", "slug", func(item string) (interface{}, error) {
+		if !IsSlug(item) {
+			return nil, fmt.Errorf("not a slug: %s", item)
+		}
+		return item, nil
+	}},
+	"uuid": {"uuid", "string", "uuid", func(item string) (interface{}, error) {
+		if !uuidPattern.MatchString(item) {
+			return nil, fmt.Errorf("not a uuid: %s", item)
+		}
+		return strings.ToLower(item), nil
+	}},
+}
+
+// A slug is 1 to 64 lower case letters, digits and inner hyphens
+func IsSlug(s string) bool {
+	if len(s) == 0 || len(s) > 64 || s[0] == '-' || s[len(s)-1] == '-' {
+		return false
+	}
+	for _, r := range s {
+		if r != '-' && !unicode.IsDigit(r) && !(unicode.IsLetter(r) && !unicode.IsUpper(r)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Parse a pattern element of the form :name or :name:type. The type
+// defaults to int, except that a bare :uuid or :slug is shorthand for
+// a parameter of that type with the same name.
+func newParamDP(element string) (*paramDP, error) {
+	parts := strings.Split(element[1:], ":")
+	name := parts[0]
+	typeName := "int"
+	switch len(parts) {
+	case 1:
+		if name == "uuid" || name == "slug" {
+			typeName = name
+		}
+	case 2:
+		typeName = parts[1]
+	default:
+		return nil, fmt.Errorf("malformed path parameter '%s'", element)
+	}
+	if name == "" {
+		return nil, fmt.Errorf("unnamed path parameter '%s'", element)
+	}
+	ptype, ok := paramTypes[typeName]
+	if !ok {
+		return nil, fmt.Errorf("unknown path parameter type '%s'", typeName)
+	}
+	return &paramDP{name: name, ptype: ptype}, nil
+}
+
+func (s *paramDP) dispatch(item string, ctx *DispatchContext) (dispatcher, error) {
+	v, err := s.ptype.parse(item)
 	if err != nil {
 		return nil, err
 	}
-	ctx.param = append(ctx.param, i)
+	ctx.params[s.name] = v
 	return s.acceptDP.dispatch(item, ctx)
 }
 
-func (s *stringDP) dispatch(item string, ctx *DispatchContext) (dispatcher, error) {
-	ctx.param = append(ctx.param, item)
-	return s.acceptDP.dispatch(item, ctx)
+// The pattern element that installed the dispatcher
+func (s *paramDP) String() string {
+	return ":" + s.name + ":" + s.ptype.name
 }
 
-var restTree = newSelectDP()
-
 // dispatch path. Path must start with a slash
-func dispatchRESTPath(path string) (RESTHandler, *DispatchContext, error) {
-	ctx := new(DispatchContext)
-	var dis dispatcher = restTree
+func (app *App) dispatchRESTPath(path string) (RESTHandler, *DispatchContext, error) {
+	ctx := &DispatchContext{params: make(map[string]interface{}), app: app}
+	var dis dispatcher = app.tree
 	remain := path
 	for dis != nil {
 		if len(remain) == 0 {
@@ -141,24 +319,33 @@ func dispatchRESTPath(path string) (RESTHandler, *DispatchContext, error) {
 	return nil, nil, errors.New("no handler found")
 }
 
-func HandleRestRequest(w http.ResponseWriter, r *http.Request) {
-	restPath := r.URL.Path[len("/api"):]
-	if restPath[0] != '/' {
+// The user making a request.
+// BUG: faking the user id, which would be supplied using a token in the
+// future
+func requestUser(r *http.Request) int64 {
+	return 1
+}
+
+// Serve the REST api under /api
+func (app *App) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	restPath := strings.TrimPrefix(r.URL.Path, "/api")
+	if len(restPath) == 0 || restPath[0] != '/' {
 		http.NotFound(w, r)
 	} else {
-		handler, ctx, err := dispatchRESTPath(restPath)
+		handler, ctx, err := app.dispatchRESTPath(restPath)
 		if err != nil {
 			http.NotFound(w, r)
 		} else {
 			w.Header().Set("Content-Type", "application/json")
 
-			// BUG: faking the user id of the context, which would be supplied
-			// using a token in the future
-			ctx.userid = 1
+			ctx.userid = requestUser(r)
 
 			err := r.ParseForm()
 
-			if err != nil {
+			if app.checkUser(ctx.userid) {
+				w.WriteHeader(http.StatusForbidden)
+				writeJSON(w, errUserDisabled.Error())
+			} else if err != nil {
 				http.Error(w, "error in form", http.StatusBadRequest)
 			} else {
 				ctx.request = r
@@ -168,52 +355,103 @@ func HandleRestRequest(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func InstallRestHandler(pathPattern string, restHandler dispatcher) {
+// Check that dp can be merged with old, which was installed under
+// the same key by an earlier pattern
+func checkSibling(old dispatcher, dp dispatcher, key string) error {
+	switch o := old.(type) {
+	case *selectDP:
+		if _, ok := dp.(*selectDP); ok {
+			return nil
+		}
+		return fmt.Errorf("ambiguous path: '%s' is followed by both literals and %v", key, dp)
+	case *paramDP:
+		if p, ok := dp.(*paramDP); ok && p.name == o.name && p.ptype == o.ptype {
+			return nil
+		}
+		return fmt.Errorf("ambiguous path: '%s' is followed by both %v and %v", key, o, dp)
+	}
+	return fmt.Errorf("conflicting path element '%s'", key)
+}
+
+// Install dp as the intermediate dispatcher under key in parent, merging
+// with whatever was installed there by an earlier pattern. Returns the
+// dispatcher that handles the next level.
+func graft(parent dispatcher, key string, dp dispatcher) (dispatcher, error) {
+	old := parent.installed(key)
+	if node, ok := old.(*restNode); ok {
+		if node.next == nil {
+			node.next = dp
+			return dp, nil
+		}
+		old = node.next
+	}
+	if old == nil {
+		return dp, parent.install(key, dp)
+	}
+	if err := checkSibling(old, dp, key); err != nil {
+		return nil, err
+	}
+	return old, nil
+}
+
+// Install the handler for the given method under key in parent.
+func graftHandler(parent dispatcher, key string, method string, h RESTHandler) error {
+	old := parent.installed(key)
+	node, ok := old.(*restNode)
+	if !ok {
+		node = newRestNode()
+		node.next = old
+		if err := parent.install(key, node); err != nil {
+			return err
+		}
+	}
+	return node.addMethod(method, h)
+}
+
+func (app *App) InstallRestHandler(pathPattern string, restHandler RESTHandler) error {
+	return app.InstallRestMethodHandler("", pathPattern, restHandler)
+}
+
+// Install a handler that only serves requests with the given HTTP method.
+// The empty method serves any method not otherwise handled.
+//
+// Path elements are either literals or typed parameters, see newParamDP.
+// Installation fails if the pattern is ambiguous with an installed one,
+// e.g. place/:id and place/:name:string.
+func (app *App) InstallRestMethodHandler(method string, pathPattern string, restHandler RESTHandler) error {
 	elements := strings.Split(strings.TrimRight(pathPattern, "/"), "/")
-	var parent dispatcher = restTree
+	if strings.HasPrefix(elements[0], ":") {
+		return fmt.Errorf("pattern must start with a literal: %s", pathPattern)
+	}
+	var parent dispatcher = app.tree
+	names := make(map[string]bool)
 
 	for i := 1; i < len(elements); i++ {
 		var dp dispatcher
 		element := elements[i]
 		if strings.HasPrefix(element, ":") {
-			dp = new(intDP)
+			pdp, err := newParamDP(element)
+			if err != nil {
+				return fmt.Errorf("%s: %v", pathPattern, err)
+			}
+			if names[pdp.name] {
+				return fmt.Errorf("%s: duplicate path parameter '%s'", pathPattern, pdp.name)
+			}
+			names[pdp.name] = true
+			dp = pdp
 		} else {
 			dp = newSelectDP()
 		}
-		err := parent.install(elements[i-1], dp)
+		var err error
+		parent, err = graft(parent, elements[i-1], dp)
 		if err != nil {
-			panic(err)
+			return fmt.Errorf("%s: %v", pathPattern, err)
 		}
-		parent = dp
 	}
 
-	fmt.Println("installing ", pathPattern)
-	err := parent.install(elements[len(elements)-1], restHandler)
+	err := graftHandler(parent, elements[len(elements)-1], method, restHandler)
 	if err != nil {
-		panic(err)
-	}
-}
-
-func debugRestTree(dp interface{}, level int) {
-	ind := func() string {
-		return strings.Repeat(" ", level)
-	}
-	if dp == nil {
-		return
-	}
-	switch dyn := dp.(type) {
-	case *selectDP:
-		fmt.Println(ind() + "selectDP")
-		for key, d := range dyn.children {
-			fmt.Println(ind() + key + ":")
-			debugRestTree(d, level+1)
-		}
-	case *intDP:
-		fmt.Println(ind() + "int")
-		debugRestTree(dyn.child, level+1)
-	case RESTHandler:
-		fmt.Println(ind() + "http")
-	default:
-		fmt.Println(ind() + "unknown")
+		return fmt.Errorf("%s: %v", pathPattern, err)
 	}
+	return nil
 }
@@ -0,0 +1,65 @@
+package tbeer
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestTypedPathParams(t *testing.T) {
+	app := &App{tree: newSelectDP()}
+
+	h := RESTHandlerFunc(func(ctx *DispatchContext, w http.ResponseWriter, r *http.Request) {})
+
+	for _, pattern := range []string{"t/:id:int", "t/:id:int/s/:slug", "u/:uuid", "v/:name:string"} {
+		if err := app.InstallRestMethodHandler("GET", pattern, h); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, pattern := range []string{"t/:name:string", "t/lit", "u/:key:uuid", "w/:id/:id", "x/:id:float"} {
+		if err := app.InstallRestMethodHandler("GET", pattern, h); err == nil {
+			t.Errorf("expected installation of %s to fail", pattern)
+		}
+	}
+
+	_, ctx, err := app.dispatchRESTPath("/t/12/s/friday-beers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ctx.IntParam("id") != 12 || ctx.StringParam("slug") != "friday-beers" {
+		t.Errorf("unexpected params %v", ctx.params)
+	}
+
+	_, ctx, err = app.dispatchRESTPath("/u/0F8FAD5B-D9CB-469F-A165-70867728950E")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ctx.StringParam("uuid") != "0f8fad5b-d9cb-469f-a165-70867728950e" {
+		t.Errorf("unexpected params %v", ctx.params)
+	}
+
+	for _, path := range []string{"/t/abc", "/t/1/s/Not-A-Slug", "/u/1234"} {
+		if _, _, err := app.dispatchRESTPath(path); err == nil {
+			t.Errorf("expected dispatch of %s to fail", path)
+		}
+	}
+}
+
+func TestAcceptInstall(t *testing.T) {
+	accept := &acceptDP{}
+	leaf := &LeafDispatcher{}
+	if err := accept.install("", leaf); err != nil {
+		t.Fatal(err)
+	}
+	if err := accept.install("", &LeafDispatcher{}); err == nil {
+		t.Error("replaced an existing child")
+	}
+
+	h := RESTHandlerFunc(func(ctx *DispatchContext, w http.ResponseWriter, r *http.Request) {})
+	if err := graftHandler(accept, "", "GET", h); err != nil {
+		t.Fatal(err)
+	}
+	if node, ok := accept.child.(*restNode); !ok || node.next != leaf {
+		t.Errorf("child not merged: %v", accept.child)
+	}
+}
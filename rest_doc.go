@@ -0,0 +1,228 @@
+package tbeer
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// A request parameter of a REST route
+type RouteParam struct {
+	Name string
+	// "query" or "path"
+	In string
+	// json schema type: "integer", "number" or "string"
+	Type string
+	// json schema format, e.g. "uuid"
+	Format      string
+	Required    bool
+	Repeated    bool
+	Description string
+}
+
+// Documentation of a REST handler
+type RouteDoc struct {
+	Summary string
+	Params  []RouteParam
+	// A value of the type of the response, e.g. []*APIPlace{}.
+	// A []interface{} of values documents a list of mixed types.
+	Response interface{}
+	// Content type of the response if not json
+	ContentType string
+}
+
+// A RESTHandler that is documented
+type RouteDocumenter interface {
+	RouteDoc() *RouteDoc
+}
+
+type documentedHandler struct {
+	RESTHandler
+	doc *RouteDoc
+}
+
+func (h *documentedHandler) RouteDoc() *RouteDoc {
+	return h.doc
+}
+
+// Attach documentation to a REST handler
+func Documented(h RESTHandler, doc *RouteDoc) RESTHandler {
+	return &documentedHandler{h, doc}
+}
+
+func (h *StmtRestHandler) RouteDoc() *RouteDoc {
+	return h.doc
+}
+
+// An installed REST route
+type Route struct {
+	// HTTP method. Empty for any method
+	Method string
+	// The path in OpenAPI syntax, e.g. /place/{id}
+	Path string
+	// the path parameters in order
+	PathParams []RouteParam
+	Handler    RESTHandler
+}
+
+// The documentation of the route, or nil if undocumented
+func (r *Route) Doc() *RouteDoc {
+	if d, ok := r.Handler.(RouteDocumenter); ok {
+		return d.RouteDoc()
+	}
+	return nil
+}
+
+// Walk the dispatcher tree and collect all routes, sorted by path
+func (app *App) RestRoutes() []*Route {
+	routes := make([]*Route, 0)
+	walkRestTree(app.tree, "", nil, &routes)
+	sort.Sort(routesByPath(routes))
+	return routes
+}
+
+type routesByPath []*Route
+
+func (r routesByPath) Len() int      { return len(r) }
+func (r routesByPath) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r routesByPath) Less(i, j int) bool {
+	if r[i].Path == r[j].Path {
+		return r[i].Method < r[j].Method
+	}
+	return r[i].Path < r[j].Path
+}
+
+func walkRestTree(dp dispatcher, path string, params []RouteParam, routes *[]*Route) {
+	switch dyn := dp.(type) {
+	case *selectDP:
+		for key, d := range dyn.children {
+			walkRestTree(d, path+"/"+key, params, routes)
+		}
+	case *paramDP:
+		param := RouteParam{
+			Name:     dyn.name,
+			In:       "path",
+			Type:     dyn.ptype.schemaType,
+			Format:   dyn.ptype.schemaFormat,
+			Required: true}
+		walkRestTree(dyn.child, path+"/{"+dyn.name+"}",
+			append(params[:len(params):len(params)], param), routes)
+	case *restNode:
+		for method, h := range dyn.methods {
+			*routes = append(*routes, &Route{method, path, params, h})
+		}
+		if dyn.next != nil {
+			walkRestTree(dyn.next, path, params, routes)
+		}
+	}
+}
+
+// Print all routes, one per line
+func (app *App) PrintRestRoutes(w io.Writer) {
+	for _, r := range app.RestRoutes() {
+		method := r.Method
+		if method == "" {
+			method = "*"
+		}
+		summary := ""
+		if doc := r.Doc(); doc != nil {
+			summary = doc.Summary
+		}
+		fmt.Fprintf(w, "%-7s /api%-30s %s\n", method, r.Path, summary)
+	}
+}
+
+// Generate the schema of a documented response value
+func responseSchema(o interface{}, refPrefix string) map[string]interface{} {
+	if mixed, ok := o.([]interface{}); ok {
+		alternatives := make([]interface{}, len(mixed))
+		for i, item := range mixed {
+			alternatives[i] = jsonSchemaOf(reflect.TypeOf(item), refPrefix)
+		}
+		return map[string]interface{}{
+			"type":  "array",
+			"items": map[string]interface{}{"oneOf": alternatives}}
+	}
+	return jsonSchemaOf(reflect.TypeOf(o), refPrefix)
+}
+
+func openAPIOperation(r *Route) map[string]interface{} {
+	const refPrefix = "#/components/schemas/"
+	doc := r.Doc()
+	if doc == nil {
+		doc = &RouteDoc{}
+	}
+
+	params := make([]interface{}, 0)
+	for _, p := range append(r.PathParams[:len(r.PathParams):len(r.PathParams)], doc.Params...) {
+		var schema interface{} = map[string]interface{}{"type": p.Type}
+		if p.Format != "" {
+			schema.(map[string]interface{})["format"] = p.Format
+		}
+		if p.Repeated {
+			schema = map[string]interface{}{"type": "array", "items": schema}
+		}
+		params = append(params, map[string]interface{}{
+			"name":        p.Name,
+			"in":          p.In,
+			"required":    p.Required,
+			"description": p.Description,
+			"schema":      schema})
+	}
+
+	ok := map[string]interface{}{"description": "success"}
+	if doc.Response != nil {
+		contentType := doc.ContentType
+		if contentType == "" {
+			contentType = "application/json"
+		}
+		ok["content"] = map[string]interface{}{
+			contentType: map[string]interface{}{
+				"schema": responseSchema(doc.Response, refPrefix)}}
+	}
+
+	return map[string]interface{}{
+		"summary":    doc.Summary,
+		"parameters": params,
+		"responses": map[string]interface{}{
+			"200": ok,
+			"400": map[string]interface{}{
+				"description": "error message",
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{
+						"schema": map[string]interface{}{"type": "string"}}}}}}
+}
+
+// Generate the OpenAPI 3 document of all installed routes
+func (app *App) OpenAPIDocument() map[string]interface{} {
+	paths := make(map[string]interface{})
+	for _, r := range app.RestRoutes() {
+		item, ok := paths[r.Path].(map[string]interface{})
+		if !ok {
+			item = make(map[string]interface{})
+			paths[r.Path] = item
+		}
+		method := strings.ToLower(r.Method)
+		if method == "" {
+			method = "get"
+		}
+		item[method] = openAPIOperation(r)
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "beer-socialist",
+			"version": "1"},
+		"servers": []interface{}{map[string]interface{}{"url": "/api"}},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas": apiSchemaDefinitions("#/components/schemas/")}}
+}
+
+func serveOpenAPI(ctx *DispatchContext, w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, ctx.app.OpenAPIDocument())
+}
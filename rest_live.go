@@ -0,0 +1,83 @@
+package tbeer
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Number of events queued for a live subscriber before it is dropped
+const liveBufferSize = 64
+
+// Interval between keepalive writes on idle streams, a variable for
+// the tests
+var liveKeepalive = 30 * time.Second
+
+// Start a response streamed until the client leaves or the server
+// stops, outliving the write timeout of the server. The returned ticker
+// tells when to write something to keep an idle stream open, and is to
+// be stopped by the caller.
+func startStream(w http.ResponseWriter, contentType string) (http.Flusher, *time.Ticker, error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, nil, errors.New("streaming not supported")
+	}
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		return nil, nil, err
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	return flusher, time.NewTicker(liveKeepalive), nil
+}
+
+// Stream changes to availabilities and meetings inside a rectangle and
+// an optional time window as server-sent events. The event name is the
+// kind of change and the data is the json encoded Event. Events of items
+// the user can't see are not sent. stmts[0] is visibilityQuery.
+func serveLiveEvents(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+	rect, err := GetRectangle(ctx)
+	if err != nil {
+		return err
+	}
+	window, err := GetWindow(ctx)
+	if err != nil {
+		return err
+	}
+	sub := ctx.app.Events.Subscribe(*rect, *window, liveBufferSize)
+	defer ctx.app.Events.Unsubscribe(sub)
+
+	flusher, keepalive, err := startStream(w, "text/event-stream")
+	if err != nil {
+		return err
+	}
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case e, ok := <-sub.C:
+			if !ok {
+				// dropped by the bus, the client should reload
+				return nil
+			}
+			if visible, err := canSee(stmts[0], ctx.userid, e.owner, e.visibility); err != nil || !visible {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: ", e.Kind)
+			if err := encodeItem(w, e); err != nil {
+				return nil
+			}
+			w.Write([]byte("\n\n"))
+		case <-keepalive.C:
+			w.Write([]byte(": keepalive\n\n"))
+		case <-ctx.request.Context().Done():
+			return nil
+		case <-serverStopping(ctx.request.Context()):
+			return nil
+		}
+		flusher.Flush()
+	}
+}
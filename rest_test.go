@@ -1,18 +1,18 @@
 package tbeer
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
+	"time"
 )
 
-type RestTestHttpHandler struct{}
-
-func (s RestTestHttpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	HandleRestRequest(w, r)
-}
-
 // traverse rest tree and test that none of the calls produce errors
 func TestRestGetError(t *testing.T) {
 	type Expect struct {
@@ -27,17 +27,30 @@ func TestRestGetError(t *testing.T) {
 		{"places", "error"}, /* missing bounding box */
 		{"places?minlat=abcde", "error"},
 		{"places?minlat=-90&minlong=-180&maxlat=90&maxlong=180", "list"},
+		{"places?minlat=-90&minlong=-180&maxlat=90&maxlong=180&category=pub,bar&amenity=food&open_at=1609786800", "list"},
+		{"places?minlat=-90&minlong=-180&maxlat=90&maxlong=180&category=igloo", "error"},
 		{"stuff_at?minlat=abcde", "error"},
 		{"stuff_at?minlat=-90&minlong=-180&maxlat=90&maxlong=180", "list"},
 		{"meeting/1", "dict"},
 		{"availability", "list"},
 		{"meetings", "list"},
 		{"placesearch", "error"}, /* missing query */
-		{"placesearch?query=a", "dict"}}
+		{"placesearch?query=a", "dict"},
+		{"placesearch?query=a&amenity=outdoor_seating", "dict"},
+		{"schema.json", "dict"},
+		{"openapi.json", "dict"},
+		{"reviews/received", "list"},
+		{"reviews/given", "list"},
+		{"users/1/reputation", "dict"},
+		{"me", "dict"},
+		{"users/2", "dict"},
+		{"participants", "list"},
+		{"friends", "list"},
+		{"meeting/1/messages?limit=0", "error"}}
 
-	OpenTestEnv()
-	defer CloseTestEnv()
-	serv := httptest.NewServer(RestTestHttpHandler{})
+	app := OpenTestEnv()
+	defer CloseTestEnv(app)
+	serv := httptest.NewServer(app)
 	defer serv.Close()
 
 	for _, item := range l {
@@ -57,7 +70,694 @@ func TestRestGetError(t *testing.T) {
 	}
 }
 
+// subscribe to a rectangle and check that creating an availability
+// inside it is pushed to the subscriber
+func TestLiveEvents(t *testing.T) {
+	app := OpenTestEnv()
+	defer CloseTestEnv(app)
+	serv := httptest.NewServer(app)
+	defer serv.Close()
+
+	res, err := app.DB.Exec("INSERT INTO participant (ownerid, alias, description) VALUES (1, 'live', 'test')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	partid, _ := res.LastInsertId()
+	defer app.DB.Exec("DELETE FROM participant WHERE id = ?", partid)
+
+	var lat, long float64
+	if err := app.DB.QueryRow("SELECT lat, long FROM place WHERE id = 1").Scan(&lat, &long); err != nil {
+		t.Fatal(err)
+	}
+
+	live, err := http.Get(fmt.Sprintf("%s/api/live?minlat=%f&minlong=%f&maxlat=%f&maxlong=%f",
+		serv.URL, lat-0.01, long-0.01, lat+0.01, long+0.01))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer live.Body.Close()
+	if ct := live.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("unexpected content type %s", ct)
+	}
+
+	res2, err := http.PostForm(serv.URL+"/api/availability", url.Values{
+		"partid":      {fmt.Sprint(partid)},
+		"placeid":     {"1"},
+		"start":       {"1000"},
+		"end":         {"2000"},
+		"description": {"live test"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res2.Body.Close()
+	if res2.StatusCode != 200 {
+		t.Fatalf("create availability: status %d", res2.StatusCode)
+	}
+
+	reader := bufio.NewReader(live.Body)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "event: created\n" {
+		t.Errorf("unexpected event line %q", line)
+	}
+	line, _ = reader.ReadString('\n')
+	if !strings.Contains(line, "live test") {
+		t.Errorf("unexpected data line %q", line)
+	}
+
+	var id int64
+	app.DB.QueryRow("SELECT id FROM availability WHERE partid = ?", partid).Scan(&id)
+	req, _ := http.NewRequest("DELETE", fmt.Sprintf("%s/api/availability/%d", serv.URL, id), nil)
+	res3, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res3.Body.Close()
+	line, _ = reader.ReadString('\n')
+	line, _ = reader.ReadString('\n')
+	if line != "event: deleted\n" {
+		t.Errorf("unexpected event line %q", line)
+	}
+}
+
+// create, change and delete a meeting through the api
+func TestWriteMeeting(t *testing.T) {
+	app := OpenTestEnv()
+	defer CloseTestEnv(app)
+	serv := httptest.NewServer(app)
+	defer serv.Close()
+
+	res, err := app.DB.Exec("INSERT INTO participant (ownerid, alias, description) VALUES (1, 'writer', 'test')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	partid, _ := res.LastInsertId()
+	defer app.DB.Exec("DELETE FROM participant WHERE id = ?", partid)
+
+	decode := func(res *http.Response, err error) *APIMeeting {
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != 200 {
+			t.Fatalf("unexpected status %d", res.StatusCode)
+		}
+		m := &APIMeeting{}
+		if err := json.NewDecoder(res.Body).Decode(m); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	do := func(method string, path string, form url.Values) (*http.Response, error) {
+		req, _ := http.NewRequest(method, serv.URL+path, bytes.NewBufferString(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return http.DefaultClient.Do(req)
+	}
+
+	m := decode(http.PostForm(serv.URL+"/api/meetings", url.Values{
+		"partid":  {fmt.Sprint(partid)},
+		"placeid": {"1"},
+		"name":    {"written"},
+		"start":   {"1000"},
+		"end":     {"2000"}}))
+	if m.Name != "written" || m.Place.Id != 1 || m.Period.Start != 1000 || m.Owner != 1 {
+		t.Errorf("unexpected meeting %+v", m)
+	}
+
+	changed := decode(do("PUT", fmt.Sprintf("/api/meeting/%d", m.Id), url.Values{"name": {"rewritten"}}))
+	if changed.Name != "rewritten" || changed.Period.Start != m.Period.Start || changed.Period.End != m.Period.End {
+		t.Errorf("unexpected change %+v", changed)
+	}
+	if res, err := do("PUT", fmt.Sprintf("/api/meeting/%d", m.Id), url.Values{"start": {"3000"}, "end": {"2000"}}); err != nil || res.StatusCode == 200 {
+		t.Error("accepted a period ending before it starts")
+	}
+
+	res2, err := do("DELETE", fmt.Sprintf("/api/meeting/%d", m.Id), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res2.Body.Close()
+	var count int
+	app.DB.QueryRow("SELECT count(*) FROM meeting WHERE id = ?", m.Id).Scan(&count)
+	if res2.StatusCode != 200 || count != 0 {
+		t.Errorf("meeting not deleted: status %d", res2.StatusCode)
+	}
+}
+
+// check that items are encoded with their API representation and
+// a type discriminator
+func TestTypedJSON(t *testing.T) {
+	app := OpenTestEnv()
+	defer CloseTestEnv(app)
+	serv := httptest.NewServer(app)
+	defer serv.Close()
+
+	res, err := http.Get(serv.URL + "/api/place/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var place map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&place); err != nil {
+		t.Fatal(err)
+	}
+	if place["type"] != "place" {
+		t.Errorf("expected type place, got %v", place["type"])
+	}
+	for _, key := range []string{"id", "name", "lat", "long", "radius"} {
+		if _, ok := place[key]; !ok {
+			t.Errorf("missing key %s in %v", key, place)
+		}
+	}
+
+	schema := APISchema()["definitions"].(map[string]interface{})
+	for _, name := range []string{"place", "meeting", "availability"} {
+		props := schema[name].(map[string]interface{})["properties"].(map[string]interface{})
+		if _, ok := props["type"]; !ok {
+			t.Errorf("schema of %s has no type discriminator", name)
+		}
+	}
+}
+
+// every installed route must be documented in the OpenAPI document
+func TestRoutesDocumented(t *testing.T) {
+	app := OpenTestEnv()
+	defer CloseTestEnv(app)
+
+	paths := app.OpenAPIDocument()["paths"].(map[string]interface{})
+	routes := app.RestRoutes()
+	if len(routes) == 0 {
+		t.Fatal("no routes installed")
+	}
+	for _, r := range routes {
+		if doc := r.Doc(); doc == nil || doc.Summary == "" {
+			t.Errorf("route %s %s is not documented", r.Method, r.Path)
+		}
+		item, ok := paths[r.Path].(map[string]interface{})
+		if !ok {
+			t.Errorf("path %s missing in OpenAPI document", r.Path)
+			continue
+		}
+		if _, ok := item[strings.ToLower(r.Method)]; !ok {
+			t.Errorf("operation %s %s missing in OpenAPI document", r.Method, r.Path)
+		}
+	}
+	if _, ok := paths["/place/{id}"]; !ok {
+		t.Errorf("expected path parameter syntax in %v", paths)
+	}
+}
+
+func TestDynamicURL(t *testing.T) {
+	app := OpenTestEnv()
+	defer CloseTestEnv(app)
+	serv := httptest.NewServer(app)
+	defer serv.Close()
+
+	res, err := app.DB.Exec("INSERT INTO period (start, end) VALUES (1000, 2000)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	periodid, _ := res.LastInsertId()
+	defer app.DB.Exec("DELETE FROM period WHERE id = ?", periodid)
+	res, err = app.DB.Exec("INSERT INTO meeting (ownerid, periodid, placeid, name) VALUES (1, ?, 1, 'vanity')", periodid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meetingid, _ := res.LastInsertId()
+	defer app.DB.Exec("DELETE FROM meeting WHERE id = ?", meetingid)
+	defer app.DB.Exec("DELETE FROM dynamic_url WHERE foreignid = ?", meetingid)
+
+	claim := func(slug string, typ string) int {
+		res, err := http.PostForm(serv.URL+"/api/slugs", url.Values{
+			"slug": {slug}, "type": {typ}, "id": {fmt.Sprint(meetingid)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	if status := claim("Friday-Beers", "meeting"); status != 200 {
+		t.Fatalf("claim failed with status %d", status)
+	}
+	if status := claim("friday-beers", "meeting"); status != 200 {
+		t.Errorf("reclaiming own slug failed with status %d", status)
+	}
+	if status := claim("friday-beers", "user"); status == 200 {
+		t.Errorf("claiming a taken slug succeeded")
+	}
+	if status := claim("api", "meeting"); status == 200 {
+		t.Errorf("claiming a reserved slug succeeded")
+	}
+
+	rec := httptest.NewRecorder()
+	vanityHandler(app.DB, DynamicURLMeeting)(rec, httptest.NewRequest("GET", "/m/friday-beers", nil))
+	if loc := rec.Header().Get("Location"); loc != fmt.Sprintf("/?meeting=%d", meetingid) {
+		t.Errorf("unexpected redirect to %q", loc)
+	}
+	rec = httptest.NewRecorder()
+	vanityHandler(app.DB, DynamicURLPlace)(rec, httptest.NewRequest("GET", "/p/friday-beers", nil))
+	if rec.Code != 404 {
+		t.Errorf("expected slug of other type not to resolve, got %d", rec.Code)
+	}
+
+	release := func(slug string) int {
+		req, _ := http.NewRequest("DELETE", serv.URL+"/api/slug/"+slug, nil)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	// slugs of places are released by whoever claimed them
+	app.DB.Exec("DELETE FROM dynamic_url WHERE value IN ('tavern', 'squatted')")
+	defer app.DB.Exec("DELETE FROM dynamic_url WHERE value IN ('tavern', 'squatted')")
+	app.DB.Exec("INSERT INTO dynamic_url (value, type, foreignid, ownerid) VALUES ('squatted', ?, 1, 2)", DynamicURLPlace)
+	if status := release("squatted"); status == 200 {
+		t.Errorf("released a place slug claimed by another user")
+	}
+	placeRes, err := http.PostForm(serv.URL+"/api/slugs", url.Values{"slug": {"tavern"}, "type": {"place"}, "id": {"2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	placeRes.Body.Close()
+	if placeRes.StatusCode != 200 {
+		t.Fatalf("claiming a place slug failed with status %d", placeRes.StatusCode)
+	}
+	if status := release("tavern"); status != 200 {
+		t.Errorf("releasing a claimed place slug failed with status %d", status)
+	}
+
+	// deleting a meeting releases its slugs and deletes its messages
+	if _, err := app.DB.Exec("INSERT INTO meeting_message (meetingid, partid, ownerid, body, created, edited) "+
+		"VALUES (?, 1, 1, 'bye', 0, 0)", meetingid); err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("DELETE", fmt.Sprintf("%s/api/meeting/%d", serv.URL, meetingid), nil)
+	if res, err := http.DefaultClient.Do(req); err != nil || res.StatusCode != 200 {
+		t.Fatalf("deleting the meeting failed: %v", err)
+	}
+	var left int
+	app.DB.QueryRow("SELECT count(*) FROM dynamic_url WHERE value = 'friday-beers'").Scan(&left)
+	if left != 0 {
+		t.Errorf("slug of a deleted meeting kept")
+	}
+	app.DB.QueryRow("SELECT count(*) FROM meeting_message WHERE meetingid = ?", meetingid).Scan(&left)
+	if left != 0 {
+		t.Errorf("messages of a deleted meeting kept")
+	}
+}
+
+func TestReviews(t *testing.T) {
+	app := OpenTestEnv()
+	defer CloseTestEnv(app)
+	serv := httptest.NewServer(app)
+	defer serv.Close()
+
+	exec := func(q string, args ...interface{}) int64 {
+		res, err := app.DB.Exec(q, args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, _ := res.LastInsertId()
+		return id
+	}
+	periodid := exec("INSERT INTO period (start, end) VALUES (1000, 2000)")
+	meetingid := exec("INSERT INTO meeting (ownerid, periodid, placeid, name) VALUES (1, ?, 1, 'review')", periodid)
+	part1 := exec("INSERT INTO participant (ownerid, alias) VALUES (1, 'one')")
+	part2 := exec("INSERT INTO participant (ownerid, alias) VALUES (2, 'two')")
+	exec("INSERT INTO meeting_participant (meetingid, participantid) VALUES (?, ?), (?, ?)",
+		meetingid, part1, meetingid, part2)
+	defer func() {
+		exec("DELETE FROM user_review WHERE meeting_id = ?", meetingid)
+		exec("DELETE FROM meeting_participant WHERE meetingid = ?", meetingid)
+		exec("DELETE FROM participant WHERE id IN (?, ?)", part1, part2)
+		exec("DELETE FROM meeting WHERE id = ?", meetingid)
+		exec("DELETE FROM period WHERE id = ?", periodid)
+	}()
+
+	review := func(reviewee int, score int) int {
+		res, err := http.PostForm(serv.URL+"/api/reviews", url.Values{
+			"meetingid": {fmt.Sprint(meetingid)},
+			"reviewee":  {fmt.Sprint(reviewee)},
+			"score":     {fmt.Sprint(score)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	if status := review(2, 4); status != 200 {
+		t.Fatalf("review failed with status %d", status)
+	}
+	if status := review(2, 5); status == 200 {
+		t.Errorf("second review of the same meeting succeeded")
+	}
+	if status := review(1, 5); status == 200 {
+		t.Errorf("self review succeeded")
+	}
+	if status := review(3, 0); status == 200 {
+		t.Errorf("review with invalid score succeeded")
+	}
+
+	// a weekly meeting whose first occurrence was cancelled, and
+	// whose next one is in the future
+	week := 7 * 24 * 3600
+	start := int(time.Now().Unix()) - week + 3600
+	exec("UPDATE period SET start = ?, end = ?, rrule = 'FREQ=WEEKLY', exdate = ? WHERE id = ?",
+		start, start+3600, fmt.Sprint(start), periodid)
+	exec("DELETE FROM user_review WHERE meeting_id = ?", meetingid)
+	if status := review(2, 4); status == 200 {
+		t.Errorf("reviewed a meeting whose only ended occurrence was cancelled")
+	}
+	res, err := http.PostForm(serv.URL+"/api/reviews", url.Values{
+		"meetingid": {fmt.Sprint(meetingid)},
+		"reviewee":  {"2"},
+		"start":     {fmt.Sprint(start + week)},
+		"score":     {"4"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode == 200 {
+		t.Errorf("reviewed an occurrence that has not ended")
+	}
+	exec("UPDATE period SET exdate = '' WHERE id = ?", periodid)
+	if status := review(2, 4); status != 200 {
+		t.Errorf("review after an ended occurrence failed with status %d", status)
+	}
+}
+
+func TestVisibility(t *testing.T) {
+	app := OpenTestEnv()
+	defer CloseTestEnv(app)
+	serv := httptest.NewServer(app)
+	defer serv.Close()
+
+	exec := func(q string, args ...interface{}) int64 {
+		res, err := app.DB.Exec(q, args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, _ := res.LastInsertId()
+		return id
+	}
+	exec("DELETE FROM friendship WHERE userid IN (1, 2) OR otherid IN (1, 2)")
+	partid := exec("INSERT INTO participant (ownerid, alias, description) VALUES (2, 'hidden', '')")
+	periodid := exec("INSERT INTO period (start, end) VALUES (1000, 2000)")
+	availid := exec("INSERT INTO availability (ownerid, partid, placeid, periodid, description, visibility) "+
+		"VALUES (2, ?, 1, ?, 'friends only', ?)", partid, periodid, VisibilityFriends)
+	defer func() {
+		exec("DELETE FROM friendship WHERE userid IN (1, 2) OR otherid IN (1, 2)")
+		exec("DELETE FROM availability WHERE id = ?", availid)
+		exec("DELETE FROM period WHERE id = ?", periodid)
+		exec("DELETE FROM participant WHERE id = ?", partid)
+	}()
+
+	visible := func() bool {
+		res, err := http.Get(serv.URL + "/api/stuff_at?minlat=-90&minlong=-180&maxlat=90&maxlong=180")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var items []map[string]interface{}
+		if err := json.NewDecoder(res.Body).Decode(&items); err != nil {
+			t.Fatal(err)
+		}
+		for _, item := range items {
+			if item["type"] == "availability" && item["id"] == float64(availid) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if visible() {
+		t.Errorf("friends only availability visible to stranger")
+	}
+
+	// user 2 requests, user 1 accepts
+	exec("INSERT INTO friendship (userid, otherid, state) VALUES (2, 1, 'requested')")
+	res, err := http.PostForm(serv.URL+"/api/friends/2", url.Values{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if !visible() {
+		t.Errorf("friends only availability not visible to friend")
+	}
+
+	exec("UPDATE friendship SET state = 'blocked' WHERE userid = 2")
+	if visible() {
+		t.Errorf("availability visible to blocked user")
+	}
+}
+
+// Meetings the user can't see can't be joined, and are not found
+func TestHiddenMeeting(t *testing.T) {
+	app := OpenTestEnv()
+	defer CloseTestEnv(app)
+	serv := httptest.NewServer(app)
+	defer serv.Close()
+
+	exec := func(q string, args ...interface{}) int64 {
+		res, err := app.DB.Exec(q, args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, _ := res.LastInsertId()
+		return id
+	}
+	periodid := exec("INSERT INTO period (start, end) VALUES (1000, 2000)")
+	meetingid := exec("INSERT INTO meeting (ownerid, periodid, placeid, name, visibility) VALUES (2, ?, 1, 'secret', ?)",
+		periodid, VisibilityPrivate)
+	partid := exec("INSERT INTO participant (ownerid, alias, description) VALUES (1, 'curious', '')")
+	exec("INSERT INTO dynamic_url (value, type, foreignid) VALUES ('secret-meeting', ?, ?)", DynamicURLMeeting, meetingid)
+	defer func() {
+		exec("DELETE FROM dynamic_url WHERE value = 'secret-meeting'")
+		exec("DELETE FROM meeting_participant WHERE meetingid = ?", meetingid)
+		exec("DELETE FROM meeting_waitlist WHERE meetingid = ?", meetingid)
+		exec("DELETE FROM participant WHERE id = ?", partid)
+		exec("DELETE FROM meeting WHERE id = ?", meetingid)
+		exec("DELETE FROM period WHERE id = ?", periodid)
+	}()
+
+	requests := []struct {
+		method string
+		path   string
+		form   url.Values
+	}{
+		{"GET", fmt.Sprintf("/api/meeting/%d", meetingid), nil},
+		{"POST", fmt.Sprintf("/api/meeting/%d/participants", meetingid), url.Values{"partid": {fmt.Sprint(partid)}}},
+		{"POST", fmt.Sprintf("/api/meeting/%d/invitations", meetingid), url.Values{"userid": {"3"}}},
+		{"GET", "/api/slug/secret-meeting", nil},
+	}
+	for _, r := range requests {
+		req, _ := http.NewRequest(r.method, serv.URL+r.path, strings.NewReader(r.form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusNotFound {
+			t.Errorf("%s %s: status %d", r.method, r.path, res.StatusCode)
+		}
+	}
+	rec := httptest.NewRecorder()
+	vanityHandler(app.DB, DynamicURLMeeting)(rec, httptest.NewRequest("GET", "/m/secret-meeting", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("vanity url of a private meeting: status %d", rec.Code)
+	}
+	var count int
+	app.DB.QueryRow("SELECT count(*) FROM meeting_participant WHERE meetingid = ?", meetingid).Scan(&count)
+	if count != 0 {
+		t.Errorf("joined a private meeting")
+	}
+}
+
 func TestSomethingElse(t *testing.T) {
-	OpenTestEnv()
-	defer CloseTestEnv()
+	app := OpenTestEnv()
+	defer CloseTestEnv(app)
+}
+
+func TestMeetingMessages(t *testing.T) {
+	app := OpenTestEnv()
+	defer CloseTestEnv(app)
+	serv := httptest.NewServer(app)
+	defer serv.Close()
+
+	exec := func(q string, args ...interface{}) int64 {
+		res, err := app.DB.Exec(q, args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, _ := res.LastInsertId()
+		return id
+	}
+	periodid := exec("INSERT INTO period (start, end) VALUES (1000, 2000)")
+	meetingid := exec("INSERT INTO meeting (ownerid, periodid, placeid, name) VALUES (2, ?, 1, 'chat')", periodid)
+	otherid := exec("INSERT INTO meeting (ownerid, periodid, placeid, name) VALUES (2, ?, 1, 'closed')", periodid)
+	partid := exec("INSERT INTO participant (ownerid, alias, description) VALUES (1, 'chatty', '')")
+	exec("INSERT INTO meeting_participant (meetingid, participantid) VALUES (?, ?)", meetingid, partid)
+	defer func() {
+		exec("DELETE FROM meeting_message WHERE meetingid IN (?, ?)", meetingid, otherid)
+		exec("DELETE FROM meeting_participant WHERE meetingid = ?", meetingid)
+		exec("DELETE FROM participant WHERE id = ?", partid)
+		exec("DELETE FROM meeting WHERE id IN (?, ?)", meetingid, otherid)
+		exec("DELETE FROM period WHERE id = ?", periodid)
+	}()
+
+	stream, err := http.Get(fmt.Sprintf("%s/api/meeting/%d/stream", serv.URL, meetingid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Body.Close()
+	dec := json.NewDecoder(stream.Body)
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+		t.Fatalf("unexpected start of stream %v %v", tok, err)
+	}
+
+	post := func(id int64, body string) *http.Response {
+		res, err := http.PostForm(fmt.Sprintf("%s/api/meeting/%d/messages", serv.URL, id),
+			url.Values{"body": {body}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+	if res := post(meetingid, "cheers"); res.StatusCode != 200 {
+		t.Fatalf("post message: status %d", res.StatusCode)
+	}
+	if res := post(otherid, "let me in"); res.StatusCode == 200 {
+		t.Errorf("posted to a meeting without attending it")
+	}
+
+	var m APIMessage
+	if err := dec.Decode(&m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Body != "cheers" || m.Participant == nil || m.Participant.Id != partid {
+		t.Errorf("unexpected streamed message %+v", m)
+	}
+
+	req, _ := http.NewRequest("DELETE", fmt.Sprintf("%s/api/meeting/%d/messages/%d", serv.URL, meetingid, m.Id), nil)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	var deleted APIMessage
+	if err := dec.Decode(&deleted); err != nil {
+		t.Fatal(err)
+	}
+	if !deleted.Deleted || deleted.Id != m.Id {
+		t.Errorf("unexpected deletion %+v", deleted)
+	}
+
+	history, err := http.Get(fmt.Sprintf("%s/api/meeting/%d/messages?limit=10", serv.URL, meetingid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer history.Body.Close()
+	var items []APIMessage
+	if err := json.NewDecoder(history.Body).Decode(&items); err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 0 {
+		t.Errorf("deleted message still in history: %+v", items)
+	}
+
+	// the stream of a participant who left ends at the next message
+	exec("DELETE FROM meeting_participant WHERE meetingid = ?", meetingid)
+	app.Messages.Publish(&Message{Meeting: meetingid, Body: "psst"})
+	if tok, err := dec.Token(); err != nil || tok != json.Delim(']') {
+		t.Errorf("stream went on after leaving: %v %v", tok, err)
+	}
+}
+
+// create a weekly meeting, list its occurrences and cancel one
+func TestRecurringMeeting(t *testing.T) {
+	app := OpenTestEnv()
+	defer CloseTestEnv(app)
+	serv := httptest.NewServer(app)
+	defer serv.Close()
+
+	res, err := app.DB.Exec("INSERT INTO participant (ownerid, alias, description) VALUES (1, 'weekly', '')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	partid, _ := res.LastInsertId()
+	defer app.DB.Exec("DELETE FROM participant WHERE id = ?", partid)
+
+	const start, week = 1609520400, 7 * 24 * 3600
+	created, err := http.PostForm(serv.URL+"/api/meetings", url.Values{
+		"partid":  {fmt.Sprint(partid)},
+		"placeid": {"1"},
+		"name":    {"after work"},
+		"start":   {fmt.Sprint(start)},
+		"end":     {fmt.Sprint(start + 7200)},
+		"rrule":   {"FREQ=WEEKLY;COUNT=3"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &APIMeeting{}
+	json.NewDecoder(created.Body).Decode(m)
+	created.Body.Close()
+	if created.StatusCode != 200 || m.Period == nil || m.Period.RRule != "FREQ=WEEKLY;COUNT=3" {
+		t.Fatalf("create meeting: status %d, %+v", created.StatusCode, m)
+	}
+	defer func() {
+		req, _ := http.NewRequest("DELETE", fmt.Sprintf("%s/api/meeting/%d", serv.URL, m.Id), nil)
+		if res, err := http.DefaultClient.Do(req); err == nil {
+			res.Body.Close()
+		}
+	}()
+
+	occurrences := func() []int {
+		res, err := http.Get(fmt.Sprintf("%s/api/meetings?start=%d&end=%d", serv.URL, start, start+10*week))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var items []APIMeeting
+		if err := json.NewDecoder(res.Body).Decode(&items); err != nil {
+			t.Fatal(err)
+		}
+		starts := make([]int, 0)
+		for _, item := range items {
+			if item.Id == m.Id {
+				starts = append(starts, item.Period.Start)
+			}
+		}
+		return starts
+	}
+
+	if starts := occurrences(); len(starts) != 3 || starts[2] != start+2*week {
+		t.Fatalf("unexpected occurrences %v", starts)
+	}
+
+	cancel := func(at int) int {
+		req, _ := http.NewRequest("DELETE", fmt.Sprintf("%s/api/meeting/%d/occurrences/%d", serv.URL, m.Id, at), nil)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	if status := cancel(start + week); status != 200 {
+		t.Fatalf("cancel occurrence: status %d", status)
+	}
+	if status := cancel(start + week + 60); status == 200 {
+		t.Errorf("cancelled a time that is not an occurrence")
+	}
+	if starts := occurrences(); len(starts) != 2 || starts[1] != start+2*week {
+		t.Errorf("unexpected occurrences after cancelling %v", starts)
+	}
 }
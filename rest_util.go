@@ -1,6 +1,7 @@
 package tbeer
 
 import (
+	"crypto/rand"
 	"fmt"
 	"net/url"
 	"strconv"
@@ -26,6 +27,37 @@ func getFormFloat(m url.Values, key string) (float64, error) {
 	}
 }
 
+// Check that a position is a latitude and longitude on earth
+func checkPosition(lat, long float64) error {
+	if !(lat >= -90 && lat <= 90) {
+		return fmt.Errorf("latitude out of range: %v", lat)
+	}
+	if !(long >= -180 && long <= 180) {
+		return fmt.Errorf("longitude out of range: %v", long)
+	}
+	return nil
+}
+
+// Parameters read by GetRectangle
+var rectangleParams = []RouteParam{
+	{Name: "minlat", In: "query", Type: "number", Required: true},
+	{Name: "minlong", In: "query", Type: "number", Required: true},
+	{Name: "maxlat", In: "query", Type: "number", Required: true},
+	{Name: "maxlong", In: "query", Type: "number", Required: true},
+}
+
+// Parameters read by GetPeriod
+var periodParams = []RouteParam{
+	{Name: "start", In: "query", Type: "integer", Required: true, Description: "unix time"},
+	{Name: "end", In: "query", Type: "integer", Required: true, Description: "unix time"},
+}
+
+// Parameters read by GetWindow
+var windowParams = []RouteParam{
+	{Name: "start", In: "query", Type: "integer", Description: "unix time"},
+	{Name: "end", In: "query", Type: "integer", Description: "unix time, open ended if omitted"},
+}
+
 // Extract a rectangle from dispatched rest request
 func GetRectangle(ctx *DispatchContext) (*Rectangle, error) {
 	r := &Rectangle{}
@@ -40,3 +72,100 @@ func GetRectangle(ctx *DispatchContext) (*Rectangle, error) {
 	}
 	return r, nil
 }
+
+func getFormInt(m url.Values, key string) (int64, error) {
+	val, ok := m[key]
+	if !ok {
+		return 0, fmt.Errorf("missing key %s", key)
+	}
+	i, err := strconv.ParseInt(val[0], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("could not parse integer: %s", val[0])
+	} else {
+		return i, nil
+	}
+}
+
+func getFormString(m url.Values, key string) (string, error) {
+	val, ok := m[key]
+	if !ok {
+		return "", fmt.Errorf("missing key %s", key)
+	}
+	return val[0], nil
+}
+
+// Extract a period (start and end as unix time) from dispatched rest request
+func GetPeriod(ctx *DispatchContext) (*Period, error) {
+	start, err := getFormInt(ctx.request.Form, "start")
+	if err != nil {
+		return nil, err
+	}
+	end, err := getFormInt(ctx.request.Form, "end")
+	if err != nil {
+		return nil, err
+	}
+	if end < start {
+		return nil, fmt.Errorf("period ends before it starts")
+	}
+	return &Period{Start: int(start), End: int(end)}, nil
+}
+
+// Extract an optional time window from dispatched rest request.
+// Missing bounds are zero, meaning open ended.
+func GetWindow(ctx *DispatchContext) (*Period, error) {
+	w := &Period{}
+	keys := []string{"start", "end"}
+	targets := []*int{&w.Start, &w.End}
+	for i, t := range targets {
+		if _, ok := ctx.request.Form[keys[i]]; !ok {
+			continue
+		}
+		v, err := getFormInt(ctx.request.Form, keys[i])
+		if err != nil {
+			return nil, err
+		}
+		*t = int(v)
+	}
+	return w, nil
+}
+
+// Default and maximum number of items in one page of a paginated list
+const (
+	pageSize    = 50
+	maxPageSize = 200
+)
+
+var pageParams = []RouteParam{
+	{Name: "before", In: "query", Type: "integer", Description: "only items with lower id"},
+	{Name: "limit", In: "query", Type: "integer", Description: "page size, default 50"},
+}
+
+// Extract the optional before id and page size of a paginated list
+func getFormPage(m url.Values) (before int64, limit int64, err error) {
+	before, limit = 1<<63-1, pageSize
+	if _, ok := m["before"]; ok {
+		if before, err = getFormInt(m, "before"); err != nil {
+			return
+		}
+	}
+	if _, ok := m["limit"]; ok {
+		if limit, err = getFormInt(m, "limit"); err != nil {
+			return
+		}
+		if limit < 1 || limit > maxPageSize {
+			err = fmt.Errorf("limit out of range: %d", limit)
+		}
+	}
+	return
+}
+
+// Generate a random version 4 UUID
+func newUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
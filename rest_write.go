@@ -0,0 +1,705 @@
+package tbeer
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+const availabilityByIdQuery = "SELECT availability.id, availability.description, availability.visibility, " +
+	"participant.id, participant.alias, participant.description, " +
+	"place.id, place.name, place.lat, place.long, place.radius, place.capacity, place.category, " +
+	"period.start, period.end, period.rrule, period.exdate, " +
+	"availability.ownerid, availability.periodid, ifnull(place.timezone, '') " +
+	"FROM availability, participant, place, period " +
+	"WHERE " +
+	"availability.id = ? AND " +
+	"availability.partid = participant.id AND " +
+	"availability.placeid = place.id AND " +
+	"availability.periodid = period.id"
+
+const meetingByIdQuery = "SELECT meeting.id, meeting.ownerid, meeting.name, meeting.visibility, meeting.max_participants, " +
+	"place.id, place.name, place.lat, place.long, place.radius, place.capacity, place.category, " +
+	"period.start, period.end, period.rrule, period.exdate, " +
+	"meeting.periodid, ifnull(place.timezone, '') " +
+	"FROM meeting, place, period " +
+	"WHERE " +
+	"meeting.id = ? AND " +
+	"meeting.placeid = place.id AND " +
+	"meeting.periodid = period.id"
+
+var errNotOwner = errors.New("not owned by user")
+
+var (
+	partidParam      = RouteParam{Name: "partid", In: "query", Type: "integer", Required: true, Description: "participant owned by the user"}
+	placeidParam     = RouteParam{Name: "placeid", In: "query", Type: "integer", Required: true}
+	nameParam        = RouteParam{Name: "name", In: "query", Type: "string", Required: true}
+	descriptionParam = RouteParam{Name: "description", In: "query", Type: "string"}
+)
+
+// Copy of params where none are required
+func optionalParams(params []RouteParam) []RouteParam {
+	opt := make([]RouteParam, len(params))
+	for i, p := range params {
+		p.Required = false
+		opt[i] = p
+	}
+	return opt
+}
+
+func inTransactionOf(db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Load an availability along with its owner and period id
+func loadAvailability(stmt *sql.Stmt, id int64) (a *Availability, periodid int64, err error) {
+	a = &Availability{}
+	fields := append(ConcatBasicFields(a, &a.Participant, &a.Place, &a.Period), &a.Owner, &periodid, a.Period.zoneField())
+	err = stmt.QueryRow(id).Scan(fields...)
+	return
+}
+
+// Load a meeting along with its period id
+func loadMeeting(stmt *sql.Stmt, id int64) (m *Meeting, periodid int64, err error) {
+	m = &Meeting{}
+	fields := append(ConcatBasicFields(m, &m.Place, &m.Period), &periodid, m.Period.zoneField())
+	err = stmt.QueryRow(id).Scan(fields...)
+	return
+}
+
+// Load a meeting the user can see. Meetings hidden from the user are
+// not found, like meetings that don't exist.
+func loadVisibleMeeting(ctx *DispatchContext, meetingStmt, visibilityStmt *sql.Stmt, id int64) (*Meeting, int64, error) {
+	m, periodid, err := loadMeeting(meetingStmt, id)
+	if err != nil {
+		return nil, 0, err
+	}
+	if ok, err := canSee(visibilityStmt, ctx.userid, m.Owner, m.Visibility); err != nil {
+		return nil, 0, err
+	} else if !ok {
+		return nil, 0, errNotFound
+	}
+	return m, periodid, nil
+}
+
+// Check that the participant given by the form key exists and is owned by the user
+func formParticipant(ctx *DispatchContext, stmt *sql.Stmt, key string) (int64, error) {
+	partid, err := getFormInt(ctx.request.Form, key)
+	if err != nil {
+		return 0, err
+	}
+	var owner int64
+	if err := stmt.QueryRow(partid).Scan(&owner); err != nil {
+		return 0, err
+	}
+	if owner != ctx.userid {
+		return 0, errNotOwner
+	}
+	return partid, nil
+}
+
+// Statements of createAvailabilities
+var createAvailabilityQueries = []string{
+	"SELECT count(*) FROM place WHERE id = ?",
+	"INSERT INTO period (start, end, rrule) VALUES (?, ?, ?)",
+	"INSERT INTO availability (ownerid, partid, placeid, periodid, description, visibility) " +
+		"VALUES (?, ?, ?, ?, ?, ?)",
+	availabilityByIdQuery}
+
+// Create availabilities of a participant at a place, one for each
+// period, then publish them and notify the owners of matching ones.
+// stmts are createAvailabilityQueries.
+func createAvailabilities(ctx *DispatchContext, stmts []*sql.Stmt, partid, placeid int64,
+	description string, visibility int, periods []Period) ([]*Availability, error) {
+	ids := make([]int64, len(periods))
+	err := ctx.app.inTransaction(func(tx *sql.Tx) error {
+		var count int
+		if err := tx.Stmt(stmts[0]).QueryRow(placeid).Scan(&count); err != nil {
+			return err
+		}
+		if count == 0 {
+			return fmt.Errorf("no such place: %d", placeid)
+		}
+		for i, p := range periods {
+			res, err := tx.Stmt(stmts[1]).Exec(p.Start, p.End, p.RRule)
+			if err != nil {
+				return err
+			}
+			periodid, _ := res.LastInsertId()
+			res, err = tx.Stmt(stmts[2]).Exec(ctx.userid, partid, placeid, periodid, description, visibility)
+			if err != nil {
+				return err
+			}
+			if ids[i], err = res.LastInsertId(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]*Availability, len(ids))
+	for i, id := range ids {
+		if items[i], _, err = loadAvailability(stmts[3], id); err != nil {
+			return nil, err
+		}
+		ctx.app.publishAvailability(EventCreated, items[i], nil)
+		notifyAvailabilityMatches(ctx.app.DB, items[i])
+	}
+	return items, nil
+}
+
+func (app *App) publishAvailability(kind EventKind, a *Availability, before *Availability) {
+	e := &Event{Kind: kind, Type: "availability", Id: a.Id, owner: a.Owner, visibility: a.Visibility}
+	if kind != EventDeleted {
+		e.Item = a
+	}
+	e.touch(&a.Place, a.Period.Span())
+	if before != nil {
+		e.touch(&before.Place, before.Period.Span())
+	}
+	app.Events.Publish(e)
+}
+
+func (app *App) publishMeeting(kind EventKind, m *Meeting, before *Meeting) {
+	e := &Event{Kind: kind, Type: "meeting", Id: m.Id, owner: m.Owner, visibility: m.Visibility}
+	if kind != EventDeleted {
+		e.Item = m
+	}
+	e.touch(&m.Place, m.Period.Span())
+	if before != nil {
+		e.touch(&before.Place, before.Period.Span())
+	}
+	app.Events.Publish(e)
+}
+
+func (app *App) initWriteHandlers() {
+	app.installStmtRestMethodHandler("POST", "availability",
+		&RouteDoc{
+			Summary:  "create an availability",
+			Params:   append([]RouteParam{partidParam, placeidParam, descriptionParam, visibilityParam, rruleParam}, periodParams...),
+			Response: &APIAvailability{}},
+		append([]string{"SELECT ownerid FROM participant WHERE id = ?"}, createAvailabilityQueries...),
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			partid, err := formParticipant(ctx, stmts[0], "partid")
+			if err != nil {
+				return err
+			}
+			placeid, err := getFormInt(ctx.request.Form, "placeid")
+			if err != nil {
+				return err
+			}
+			period, err := GetPeriod(ctx)
+			if err != nil {
+				return err
+			}
+			description := ctx.request.Form.Get("description")
+			visibility, err := getFormVisibility(ctx, VisibilityPublic)
+			if err != nil {
+				return err
+			}
+			rrule, err := getFormRRule(ctx, "")
+			if err != nil {
+				return err
+			}
+
+			p := *period
+			p.RRule = rrule
+			items, err := createAvailabilities(ctx, stmts[1:], partid, placeid, description, visibility, []Period{p})
+			if err != nil {
+				return err
+			}
+			return writeJSON(w, items[0])
+		})
+
+	app.installStmtRestMethodHandler("PUT", "availability/:id",
+		&RouteDoc{
+			Summary:  "change an availability owned by the user",
+			Params:   optionalParams(append([]RouteParam{partidParam, placeidParam, descriptionParam, visibilityParam, rruleParam}, periodParams...)),
+			Response: &APIAvailability{}},
+		[]string{
+			availabilityByIdQuery,
+			"SELECT ownerid FROM participant WHERE id = ?",
+			"UPDATE period SET start = ?, end = ?, rrule = ? WHERE id = ?",
+			"UPDATE availability SET partid = ?, placeid = ?, description = ?, visibility = ? WHERE id = ?"},
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			before, periodid, err := loadAvailability(stmts[0], ctx.IntParam("id"))
+			if err != nil {
+				return err
+			}
+			if before.Owner != ctx.userid {
+				return errNotOwner
+			}
+
+			form := ctx.request.Form
+			partid := before.Participant.Id
+			if _, ok := form["partid"]; ok {
+				if partid, err = formParticipant(ctx, stmts[1], "partid"); err != nil {
+					return err
+				}
+			}
+			placeid := before.Place.Id
+			if _, ok := form["placeid"]; ok {
+				if placeid, err = getFormInt(form, "placeid"); err != nil {
+					return err
+				}
+			}
+			period := &before.Period
+			if _, ok := form["start"]; ok {
+				if period, err = GetPeriod(ctx); err != nil {
+					return err
+				}
+			}
+			description := before.Description
+			if _, ok := form["description"]; ok {
+				description = form.Get("description")
+			}
+			visibility, err := getFormVisibility(ctx, before.Visibility)
+			if err != nil {
+				return err
+			}
+			rrule, err := getFormRRule(ctx, before.Period.RRule)
+			if err != nil {
+				return err
+			}
+
+			err = ctx.app.inTransaction(func(tx *sql.Tx) error {
+				if _, err := tx.Stmt(stmts[2]).Exec(period.Start, period.End, rrule, periodid); err != nil {
+					return err
+				}
+				_, err := tx.Stmt(stmts[3]).Exec(partid, placeid, description, visibility, before.Id)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+
+			a, _, err := loadAvailability(stmts[0], before.Id)
+			if err != nil {
+				return err
+			}
+			ctx.app.publishAvailability(EventChanged, a, before)
+			return writeJSON(w, a)
+		})
+
+	app.installStmtRestMethodHandler("DELETE", "availability/:id",
+		&RouteDoc{
+			Summary:  "delete an availability owned by the user",
+			Response: int64(0)},
+		[]string{
+			availabilityByIdQuery,
+			"DELETE FROM availability WHERE id = ?",
+			"DELETE FROM period WHERE id = ?"},
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			a, periodid, err := loadAvailability(stmts[0], ctx.IntParam("id"))
+			if err != nil {
+				return err
+			}
+			if a.Owner != ctx.userid {
+				return errNotOwner
+			}
+			err = ctx.app.inTransaction(func(tx *sql.Tx) error {
+				if _, err := tx.Stmt(stmts[1]).Exec(a.Id); err != nil {
+					return err
+				}
+				_, err := tx.Stmt(stmts[2]).Exec(periodid)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			ctx.app.publishAvailability(EventDeleted, a, nil)
+			return writeJSON(w, a.Id)
+		})
+
+	app.installStmtRestMethodHandler("POST", "meetings",
+		&RouteDoc{
+			Summary: "create a meeting, attended by the given participant. The place must be open " +
+				"during the meeting. Warns if the place is overbooked during the first occurrence",
+			Params: append([]RouteParam{partidParam, placeidParam, nameParam, visibilityParam, maxParticipantsParam, rruleParam},
+				periodParams...),
+			Response: &APIMeeting{}},
+		[]string{
+			"SELECT ownerid FROM participant WHERE id = ?",
+			"INSERT INTO period (start, end, rrule) VALUES (?, ?, ?)",
+			"INSERT INTO meeting (ownerid, periodid, placeid, name, visibility, max_participants) VALUES (?, ?, ?, ?, ?, ?)",
+			"INSERT INTO meeting_participant (meetingid, participantid) VALUES (?, ?)",
+			meetingByIdQuery,
+			placeHoursQuery,
+			placeTimezoneQuery},
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			partid, err := formParticipant(ctx, stmts[0], "partid")
+			if err != nil {
+				return err
+			}
+			placeid, err := getFormInt(ctx.request.Form, "placeid")
+			if err != nil {
+				return err
+			}
+			name, err := getFormString(ctx.request.Form, "name")
+			if err != nil {
+				return err
+			}
+			period, err := GetPeriod(ctx)
+			if err != nil {
+				return err
+			}
+			visibility, err := getFormVisibility(ctx, VisibilityPublic)
+			if err != nil {
+				return err
+			}
+			maxParticipants, err := getFormMaxParticipants(ctx, 0)
+			if err != nil {
+				return err
+			}
+			rrule, err := getFormRRule(ctx, "")
+			if err != nil {
+				return err
+			}
+			period.RRule = rrule
+			if err := checkOpeningHours(stmts[5], stmts[6], placeid, period); err != nil {
+				return err
+			}
+
+			var id int64
+			err = ctx.app.inTransaction(func(tx *sql.Tx) error {
+				res, err := tx.Stmt(stmts[1]).Exec(period.Start, period.End, rrule)
+				if err != nil {
+					return err
+				}
+				periodid, _ := res.LastInsertId()
+				res, err = tx.Stmt(stmts[2]).Exec(ctx.userid, periodid, placeid, name, visibility, maxParticipants)
+				if err != nil {
+					return err
+				}
+				if id, err = res.LastInsertId(); err != nil {
+					return err
+				}
+				_, err = tx.Stmt(stmts[3]).Exec(id, partid)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+
+			m, _, err := loadMeeting(stmts[4], id)
+			if err != nil {
+				return err
+			}
+			ctx.app.publishMeeting(EventCreated, m, nil)
+			v, err := meetingWithWarnings(ctx.app.DB, m)
+			if err != nil {
+				return err
+			}
+			return writeJSON(w, v)
+		})
+
+	app.installStmtRestMethodHandler("PUT", "meeting/:id",
+		&RouteDoc{
+			Summary: "change a meeting owned by the user. A new place or period must be within the " +
+				"opening hours of the place. Raising the participant limit gives waitlisted participants a seat. " +
+				"The limit can't be lowered below the number attending",
+			Params: optionalParams(append([]RouteParam{placeidParam, nameParam, visibilityParam, maxParticipantsParam, rruleParam},
+				periodParams...)),
+			Response: &APIMeeting{}},
+		[]string{
+			meetingByIdQuery,
+			"UPDATE period SET start = ?, end = ?, rrule = ? WHERE id = ?",
+			"UPDATE meeting SET placeid = ?, name = ?, visibility = ?, max_participants = ? WHERE id = ?",
+			placeHoursQuery,
+			placeTimezoneQuery},
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			before, periodid, err := loadMeeting(stmts[0], ctx.IntParam("id"))
+			if err != nil {
+				return err
+			}
+			if before.Owner != ctx.userid {
+				return errNotOwner
+			}
+
+			form := ctx.request.Form
+			placeid := before.Place.Id
+			if _, ok := form["placeid"]; ok {
+				if placeid, err = getFormInt(form, "placeid"); err != nil {
+					return err
+				}
+			}
+			period := &before.Period
+			if _, ok := form["start"]; ok {
+				if period, err = GetPeriod(ctx); err != nil {
+					return err
+				}
+			}
+			name := before.Name
+			if _, ok := form["name"]; ok {
+				name = form.Get("name")
+			}
+			visibility, err := getFormVisibility(ctx, before.Visibility)
+			if err != nil {
+				return err
+			}
+			maxParticipants, err := getFormMaxParticipants(ctx, before.MaxParticipants)
+			if err != nil {
+				return err
+			}
+			rrule, err := getFormRRule(ctx, before.Period.RRule)
+			if err != nil {
+				return err
+			}
+			if placeid != before.Place.Id || period.Start != before.Period.Start ||
+				period.End != before.Period.End || rrule != before.Period.RRule {
+				p := *period
+				p.RRule = rrule
+				if err := checkOpeningHours(stmts[3], stmts[4], placeid, &p); err != nil {
+					return err
+				}
+			}
+
+			var promoted []int64
+			err = ctx.app.inTransaction(func(tx *sql.Tx) error {
+				if err := checkAttendeesFit(tx, before.Id, maxParticipants); err != nil {
+					return err
+				}
+				if _, err := tx.Stmt(stmts[1]).Exec(period.Start, period.End, rrule, periodid); err != nil {
+					return err
+				}
+				if _, err := tx.Stmt(stmts[2]).Exec(placeid, name, visibility, maxParticipants, before.Id); err != nil {
+					return err
+				}
+				promoted, err = promoteWaitlist(tx, before.Id, maxParticipants)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+
+			m, _, err := loadMeeting(stmts[0], before.Id)
+			if err != nil {
+				return err
+			}
+			ctx.app.publishMeeting(EventChanged, m, before)
+			notifyUsers(ctx.app.DB, meetingAttendees(ctx.app.DB, m.Id), ctx.userid, NotifyMeetingChanged, m.Id,
+				fmt.Sprintf("%s was changed", m.Name), meetingSummary(ctx.app.DB, m))
+			notifyPromoted(ctx.app.DB, m, promoted)
+			v, err := meetingWithWarnings(ctx.app.DB, m)
+			if err != nil {
+				return err
+			}
+			return writeJSON(w, v)
+		})
+
+	app.installStmtRestMethodHandler("DELETE", "meeting/:id",
+		&RouteDoc{
+			Summary:  "delete a meeting owned by the user",
+			Response: int64(0)},
+		[]string{
+			meetingByIdQuery,
+			"DELETE FROM meeting_participant WHERE meetingid = ?",
+			"DELETE FROM meeting WHERE id = ?",
+			"DELETE FROM period WHERE id = ?",
+			"DELETE FROM meeting_waitlist WHERE meetingid = ?",
+			"DELETE FROM drink WHERE checkinid IN (SELECT id FROM checkin WHERE meetingid = ?)",
+			"DELETE FROM checkin WHERE meetingid = ?",
+			"DELETE FROM meeting_message WHERE meetingid = ?",
+			fmt.Sprintf("DELETE FROM dynamic_url WHERE type = %d AND foreignid = ?", DynamicURLMeeting)},
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			m, periodid, err := loadMeeting(stmts[0], ctx.IntParam("id"))
+			if err != nil {
+				return err
+			}
+			if m.Owner != ctx.userid {
+				return errNotOwner
+			}
+			attendees := meetingAttendees(ctx.app.DB, m.Id)
+			err = ctx.app.inTransaction(func(tx *sql.Tx) error {
+				if _, err := tx.Stmt(stmts[1]).Exec(m.Id); err != nil {
+					return err
+				}
+				if _, err := tx.Stmt(stmts[2]).Exec(m.Id); err != nil {
+					return err
+				}
+				for _, stmt := range stmts[4:] {
+					if _, err := tx.Stmt(stmt).Exec(m.Id); err != nil {
+						return err
+					}
+				}
+				_, err := tx.Stmt(stmts[3]).Exec(periodid)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			ctx.app.publishMeeting(EventDeleted, m, nil)
+			notifyUsers(ctx.app.DB, attendees, ctx.userid, NotifyMeetingCancelled, m.Id,
+				fmt.Sprintf("%s was cancelled", m.Name), meetingSummary(ctx.app.DB, m))
+			return writeJSON(w, m.Id)
+		})
+
+	app.installStmtRestMethodHandler("POST", "meeting/:id/participants",
+		&RouteDoc{
+			Summary: "attend a meeting as a participant owned by the user. " +
+				"If the meeting is full, the participant is put on its waitlist",
+			Params:   []RouteParam{partidParam},
+			Response: &APIMeeting{}},
+		[]string{
+			"SELECT ownerid FROM participant WHERE id = ?",
+			meetingByIdQuery,
+			"INSERT INTO meeting_participant (meetingid, participantid) VALUES (?, ?)",
+			"SELECT alias FROM participant WHERE id = ?",
+			visibilityQuery},
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			m, _, err := loadVisibleMeeting(ctx, stmts[1], stmts[4], ctx.IntParam("id"))
+			if err != nil {
+				return err
+			}
+			partid, err := formParticipant(ctx, stmts[0], "partid")
+			if err != nil {
+				return err
+			}
+			var position int
+			err = ctx.app.inTransaction(func(tx *sql.Tx) error {
+				full, err := meetingFull(tx, m.Id, m.MaxParticipants)
+				if err != nil {
+					return err
+				}
+				if full {
+					position, err = joinWaitlist(tx, m.Id, partid)
+					return err
+				}
+				_, err = tx.Stmt(stmts[2]).Exec(m.Id, partid)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			v := m.APIValue().(*APIMeeting)
+			if position != 0 {
+				v.WaitlistPosition = position
+				return writeJSON(w, v)
+			}
+			ctx.app.publishMeeting(EventChanged, m, nil)
+			var alias string
+			stmts[3].QueryRow(partid).Scan(&alias)
+			notifyUsers(ctx.app.DB, []int64{m.Owner}, ctx.userid, NotifyAttending, m.Id,
+				fmt.Sprintf("%s attends %s", alias, m.Name), meetingSummary(ctx.app.DB, m))
+			return writeJSON(w, v)
+		})
+
+	app.installStmtRestMethodHandler("DELETE", "meeting/:id/participants/:partid",
+		&RouteDoc{
+			Summary: "leave a meeting or its waitlist with a participant owned by the user. " +
+				"The seat goes to the first participant on the waitlist",
+			Response: &APIMeeting{}},
+		[]string{
+			"SELECT ownerid, alias FROM participant WHERE id = ?",
+			meetingByIdQuery,
+			"DELETE FROM meeting_participant WHERE meetingid = ? AND participantid = ?",
+			"DELETE FROM meeting_waitlist WHERE meetingid = ? AND participantid = ?"},
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			var owner int64
+			var alias string
+			if err := stmts[0].QueryRow(ctx.IntParam("partid")).Scan(&owner, &alias); err != nil {
+				return err
+			}
+			if owner != ctx.userid {
+				return errNotOwner
+			}
+			m, _, err := loadMeeting(stmts[1], ctx.IntParam("id"))
+			if err != nil {
+				return err
+			}
+			var left int64
+			var promoted []int64
+			err = ctx.app.inTransaction(func(tx *sql.Tx) error {
+				res, err := tx.Stmt(stmts[2]).Exec(m.Id, ctx.IntParam("partid"))
+				if err != nil {
+					return err
+				}
+				if left, err = res.RowsAffected(); err != nil {
+					return err
+				}
+				if left == 0 {
+					_, err = tx.Stmt(stmts[3]).Exec(m.Id, ctx.IntParam("partid"))
+					return err
+				}
+				promoted, err = promoteWaitlist(tx, m.Id, m.MaxParticipants)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			if left == 0 {
+				return writeJSON(w, m)
+			}
+			ctx.app.publishMeeting(EventChanged, m, nil)
+			notifyUsers(ctx.app.DB, []int64{m.Owner}, ctx.userid, NotifyLeft, m.Id,
+				fmt.Sprintf("%s left %s", alias, m.Name), meetingSummary(ctx.app.DB, m))
+			notifyPromoted(ctx.app.DB, m, promoted)
+			return writeJSON(w, m)
+		})
+
+	app.installStmtRestMethodHandler("DELETE", "availability/:id/occurrences/:start",
+		&RouteDoc{
+			Summary:  "cancel one occurrence of a recurring availability owned by the user",
+			Response: &APIAvailability{}},
+		[]string{
+			availabilityByIdQuery,
+			"UPDATE period SET exdate = ? WHERE id = ?"},
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			a, periodid, err := loadAvailability(stmts[0], ctx.IntParam("id"))
+			if err != nil {
+				return err
+			}
+			if a.Owner != ctx.userid {
+				return errNotOwner
+			}
+			if err := cancelOccurrence(&a.Period, int(ctx.IntParam("start"))); err != nil {
+				return err
+			}
+			if _, err := stmts[1].Exec(a.Period.ExDate, periodid); err != nil {
+				return err
+			}
+			ctx.app.publishAvailability(EventChanged, a, nil)
+			return writeJSON(w, a)
+		})
+
+	app.installStmtRestMethodHandler("DELETE", "meeting/:id/occurrences/:start",
+		&RouteDoc{
+			Summary:  "cancel one occurrence of a recurring meeting owned by the user",
+			Response: &APIMeeting{}},
+		[]string{
+			meetingByIdQuery,
+			"UPDATE period SET exdate = ? WHERE id = ?"},
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			m, periodid, err := loadMeeting(stmts[0], ctx.IntParam("id"))
+			if err != nil {
+				return err
+			}
+			if m.Owner != ctx.userid {
+				return errNotOwner
+			}
+			start := int(ctx.IntParam("start"))
+			if err := cancelOccurrence(&m.Period, start); err != nil {
+				return err
+			}
+			if _, err := stmts[1].Exec(m.Period.ExDate, periodid); err != nil {
+				return err
+			}
+			ctx.app.publishMeeting(EventChanged, m, nil)
+			occurrence := m.occurrence(Period{Start: start, End: start + m.Period.End - m.Period.Start}).(*Meeting)
+			notifyUsers(ctx.app.DB, meetingAttendees(ctx.app.DB, m.Id), ctx.userid, NotifyMeetingCancelled, m.Id,
+				fmt.Sprintf("%s was cancelled", m.Name), meetingSummary(ctx.app.DB, occurrence))
+			return writeJSON(w, m)
+		})
+}
@@ -0,0 +1,202 @@
+package tbeer
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Scores are from 1 to maxReviewScore
+const maxReviewScore = 5
+
+// In memory representation: Review
+type Review struct {
+	Id       int64
+	Reviewer int64
+	Reviewee int64
+	Meeting  int64
+	Score    int
+}
+
+func (r *Review) BasicFields() []interface{} {
+	return []interface{}{&r.Id, &r.Reviewer, &r.Reviewee, &r.Meeting, &r.Score}
+}
+
+func (r *Review) APIValue() interface{} {
+	return &APIReview{r.Id, r.Reviewer, r.Reviewee, r.Meeting, r.Score}
+}
+
+// Count of meeting participants owned by a user
+const attendanceQuery = "SELECT count(*) FROM meeting_participant, participant " +
+	"WHERE " +
+	"meeting_participant.meetingid = ? AND " +
+	"meeting_participant.participantid = participant.id AND " +
+	"participant.ownerid = ?"
+
+const reputationQuery = "SELECT count(*), avg(score) FROM user_review WHERE reviewee_id = ?"
+
+// Load the aggregate review score of a user
+func loadReputation(stmt *sql.Stmt, userid int64) (*APIReputation, error) {
+	rep := &APIReputation{User: userid}
+	var avg sql.NullFloat64
+	if err := stmt.QueryRow(userid).Scan(&rep.Reviews, &avg); err != nil {
+		return nil, err
+	}
+	if avg.Valid {
+		rep.Score = &avg.Float64
+	}
+	return rep, nil
+}
+
+// Write the reviews returned by a query as a json list
+func writeReviews(w http.ResponseWriter, stmt *sql.Stmt, args ...interface{}) error {
+	items, err := Uniplex(queueBufferSize,
+		func(out chan<- interface{}) error {
+			rows, err := stmt.Query(args...)
+			if err != nil {
+				return err
+			}
+			for rows.Next() {
+				r := &Review{}
+				if err := rows.Scan(r.BasicFields()...); err != nil {
+					out <- err
+				} else {
+					out <- r
+				}
+			}
+			return nil
+		})
+	if err != nil {
+		return err
+	}
+	WriteChannelAsJSONList(w, items)
+	return nil
+}
+
+func (app *App) initReviewHandlers() {
+	app.installStmtRestMethodHandler("POST", "reviews",
+		&RouteDoc{
+			Summary: "review a user after a meeting both attended. The occurrence reviewed, " +
+				"or some occurrence if none is given, must have ended",
+			Params: []RouteParam{
+				{Name: "meetingid", In: "query", Type: "integer", Required: true},
+				{Name: "start", In: "query", Type: "integer", Description: "unix time of the occurrence reviewed"},
+				{Name: "reviewee", In: "query", Type: "integer", Required: true, Description: "user id"},
+				{Name: "score", In: "query", Type: "integer", Required: true, Description: "1 to 5"}},
+			Response: &APIReview{}},
+		[]string{
+			"SELECT period.start, period.end, period.rrule, period.exdate, ifnull(place.timezone, '') " +
+				"FROM meeting, period, place " +
+				"WHERE meeting.id = ? AND meeting.periodid = period.id AND meeting.placeid = place.id",
+			attendanceQuery,
+			"SELECT count(*) FROM user_review WHERE reviewer_id = ? AND reviewee_id = ? AND meeting_id = ?",
+			"INSERT INTO user_review (reviewer_id, reviewee_id, meeting_id, score) VALUES (?, ?, ?, ?)"},
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			form := ctx.request.Form
+			r := &Review{Reviewer: ctx.userid}
+			var err error
+			if r.Meeting, err = getFormInt(form, "meetingid"); err != nil {
+				return err
+			}
+			if r.Reviewee, err = getFormInt(form, "reviewee"); err != nil {
+				return err
+			}
+			score, err := getFormInt(form, "score")
+			if err != nil {
+				return err
+			}
+			if score < 1 || score > maxReviewScore {
+				return fmt.Errorf("score must be from 1 to %d", maxReviewScore)
+			}
+			r.Score = int(score)
+			if r.Reviewee == r.Reviewer {
+				return errors.New("can't review yourself")
+			}
+
+			var period Period
+			if err := stmts[0].QueryRow(r.Meeting).Scan(append(period.BasicFields(), period.zoneField())...); err != nil {
+				return err
+			}
+			now := int(time.Now().Unix())
+			if _, ok := form["start"]; ok {
+				start, err := getFormInt(form, "start")
+				if err != nil {
+					return err
+				}
+				if ok, err := period.hasOccurrence(int(start)); err != nil {
+					return err
+				} else if !ok {
+					return fmt.Errorf("no occurrence starts at %d", start)
+				}
+				if int(start)+period.End-period.Start > now {
+					return errors.New("occurrence has not ended")
+				}
+			} else if ended, err := period.hasEnded(now); err != nil {
+				return err
+			} else if !ended {
+				return errors.New("meeting has not ended")
+			}
+			for _, user := range []int64{r.Reviewer, r.Reviewee} {
+				var count int
+				if err := stmts[1].QueryRow(r.Meeting, user).Scan(&count); err != nil {
+					return err
+				}
+				if count == 0 {
+					return fmt.Errorf("user %d did not attend meeting %d", user, r.Meeting)
+				}
+			}
+
+			err = ctx.app.inTransaction(func(tx *sql.Tx) error {
+				var count int
+				if err := tx.Stmt(stmts[2]).QueryRow(r.Reviewer, r.Reviewee, r.Meeting).Scan(&count); err != nil {
+					return err
+				}
+				if count > 0 {
+					return errors.New("already reviewed")
+				}
+				res, err := tx.Stmt(stmts[3]).Exec(r.Reviewer, r.Reviewee, r.Meeting, r.Score)
+				if err != nil {
+					return err
+				}
+				r.Id, err = res.LastInsertId()
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			return writeJSON(w, r)
+		})
+
+	app.installStmtRestHandler("reviews/received",
+		&RouteDoc{
+			Summary:  "reviews of the user",
+			Response: []*APIReview{}},
+		[]string{"SELECT id, reviewer_id, reviewee_id, meeting_id, score FROM user_review WHERE reviewee_id = ?"},
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			return writeReviews(w, stmts[0], ctx.userid)
+		})
+
+	app.installStmtRestHandler("reviews/given",
+		&RouteDoc{
+			Summary:  "reviews written by the user",
+			Response: []*APIReview{}},
+		[]string{"SELECT id, reviewer_id, reviewee_id, meeting_id, score FROM user_review WHERE reviewer_id = ?"},
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			return writeReviews(w, stmts[0], ctx.userid)
+		})
+
+	app.installStmtRestHandler("users/:id/reputation",
+		&RouteDoc{
+			Summary:  "aggregate review score of a user",
+			Response: &APIReputation{}},
+		[]string{reputationQuery},
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			rep, err := loadReputation(stmts[0], ctx.IntParam("id"))
+			if err != nil {
+				return err
+			}
+			return writeJSON(w, rep)
+		})
+}
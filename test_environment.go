@@ -1,12 +1,30 @@
 package tbeer
 
-func OpenTestEnv() {
-	InitDB()
-	InitRestTree()
+// The fixtures of the test database, the same on every run
+func populateTestConfig() *PopulateConfig {
+	return DefaultPopulateConfig()
 }
 
-func CloseTestEnv() {
-	GlobalDB.Close()
-	GlobalDB = nil
-	restTree = newSelectDP()
+// An app of the default configuration serving a test database of its
+// own, in memory and populated with the fixtures
+func OpenTestEnv() *App {
+	db, err := OpenMemoryDB()
+	if err != nil {
+		panic(err)
+	}
+	if err := InitSchema(db); err != nil {
+		panic(err)
+	}
+	if err := Populate(db, populateTestConfig()); err != nil {
+		panic(err)
+	}
+	app, err := NewApp(DefaultEnv(), db)
+	if err != nil {
+		panic(err)
+	}
+	return app
+}
+
+func CloseTestEnv(app *App) {
+	app.Close()
 }
@@ -0,0 +1,335 @@
+package tbeer
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// In memory representation: User
+type User struct {
+	Id    int64
+	Alias string
+	Email string
+}
+
+const userByIdQuery = "SELECT id, alias, email FROM user WHERE id = ?"
+
+// Load a user with userByIdQuery. Users may have no email.
+func loadUser(stmt *sql.Stmt, id int64) (*User, error) {
+	u := &User{}
+	var email sql.NullString
+	if err := stmt.QueryRow(id).Scan(&u.Id, &u.Alias, &email); err != nil {
+		return nil, err
+	}
+	u.Email = email.String
+	return u, nil
+}
+
+const participantsByOwnerQuery = "SELECT id, alias, description FROM participant WHERE ownerid = ?"
+
+var participantParams = []RouteParam{
+	{Name: "alias", In: "query", Type: "string", Required: true},
+	{Name: "description", In: "query", Type: "string"},
+}
+
+// Load the profile of a user: the user, its participants and reputation.
+// stmts are userByIdQuery, participantsByOwnerQuery and reputationQuery.
+func loadProfile(stmts []*sql.Stmt, userid int64) (*APIUser, error) {
+	u, err := loadUser(stmts[0], userid)
+	if err != nil {
+		return nil, err
+	}
+	profile := &APIUser{Id: u.Id, Alias: u.Alias, Email: u.Email}
+
+	rows, err := stmts[1].Query(userid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	profile.Participants = make([]*APIParticipant, 0)
+	for rows.Next() {
+		p := &Participant{}
+		if err := rows.Scan(p.BasicFields()...); err != nil {
+			return nil, err
+		}
+		profile.Participants = append(profile.Participants, p.apiParticipant())
+	}
+
+	if profile.Reputation, err = loadReputation(stmts[2], userid); err != nil {
+		return nil, err
+	}
+	return profile, nil
+}
+
+// Load a participant and check that it's owned by the user
+func loadOwnParticipant(ctx *DispatchContext, stmt *sql.Stmt, id int64) (*Participant, error) {
+	p := &Participant{}
+	var owner int64
+	if err := stmt.QueryRow(id).Scan(append(p.BasicFields(), &owner)...); err != nil {
+		return nil, err
+	}
+	if owner != ctx.userid {
+		return nil, errNotOwner
+	}
+	return p, nil
+}
+
+var errUserDisabled = errors.New("user is disabled")
+
+// Add a user with a login not used by any other user, returning its id
+func CreateUser(db *sql.DB, alias, login, email string) (int64, error) {
+	if alias == "" || login == "" {
+		return 0, errors.New("a user needs an alias and a login")
+	}
+	var id int64
+	err := inTransactionOf(db, func(tx *sql.Tx) error {
+		var n int
+		if err := tx.QueryRow("SELECT count(*) FROM user WHERE login = ?", login).Scan(&n); err != nil {
+			return err
+		}
+		if n > 0 {
+			return fmt.Errorf("login %s is taken", login)
+		}
+		res, err := tx.Exec("INSERT INTO user (alias, login, email) VALUES (?, ?, ?)", alias, login, email)
+		if err != nil {
+			return err
+		}
+		id, err = res.LastInsertId()
+		return err
+	})
+	return id, err
+}
+
+// The id of the user with a login
+func UserByLogin(db *sql.DB, login string) (int64, error) {
+	var id int64
+	err := db.QueryRow("SELECT id FROM user WHERE login = ?", login).Scan(&id)
+	return id, err
+}
+
+// Disable a user, who may then no longer use the api, or enable it again
+func SetUserDisabled(db *sql.DB, id int64, disabled bool) error {
+	res, err := db.Exec("UPDATE user SET disabled = ? WHERE id = ?", disabled, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func userDisabled(db *sql.DB, id int64) (bool, error) {
+	var disabled bool
+	err := db.QueryRow("SELECT disabled FROM user WHERE id = ?", id).Scan(&disabled)
+	return disabled, err
+}
+
+// How long the app trusts a check of a user before checking again, so
+// disabling a user takes effect within this time
+var userCheckInterval = time.Minute
+
+type userCheck struct {
+	disabled bool
+	at       time.Time
+}
+
+// Whether the user is disabled, looked up at most once per
+// userCheckInterval instead of on every request
+func (app *App) checkUser(id int64) bool {
+	app.usersMutex.Lock()
+	defer app.usersMutex.Unlock()
+	c, ok := app.users[id]
+	if !ok || time.Since(c.at) >= userCheckInterval {
+		disabled, _ := userDisabled(app.DB, id)
+		c = userCheck{disabled, time.Now()}
+		if app.users == nil {
+			app.users = make(map[int64]userCheck)
+		}
+		app.users[id] = c
+	}
+	return c.disabled
+}
+
+func (app *App) initUserHandlers() {
+	app.installStmtRestHandler("me",
+		&RouteDoc{
+			Summary:  "profile of the user, including email",
+			Response: &APIUser{}},
+		[]string{userByIdQuery, participantsByOwnerQuery, reputationQuery},
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			profile, err := loadProfile(stmts, ctx.userid)
+			if err != nil {
+				return err
+			}
+			return writeJSON(w, profile)
+		})
+
+	app.installStmtRestMethodHandler("PUT", "me",
+		&RouteDoc{
+			Summary: "change alias or email of the user",
+			Params: []RouteParam{
+				{Name: "alias", In: "query", Type: "string"},
+				{Name: "email", In: "query", Type: "string"}},
+			Response: &APIUser{}},
+		[]string{
+			userByIdQuery, participantsByOwnerQuery, reputationQuery,
+			"UPDATE user SET alias = ?, email = ? WHERE id = ?"},
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			u, err := loadUser(stmts[0], ctx.userid)
+			if err != nil {
+				return err
+			}
+			form := ctx.request.Form
+			if _, ok := form["alias"]; ok {
+				u.Alias = form.Get("alias")
+			}
+			if _, ok := form["email"]; ok {
+				u.Email = form.Get("email")
+			}
+			if _, err := stmts[3].Exec(u.Alias, u.Email, u.Id); err != nil {
+				return err
+			}
+			profile, err := loadProfile(stmts, ctx.userid)
+			if err != nil {
+				return err
+			}
+			return writeJSON(w, profile)
+		})
+
+	app.installStmtRestHandler("users/:id",
+		&RouteDoc{
+			Summary:  "public profile of a user",
+			Response: &APIUser{}},
+		[]string{userByIdQuery, participantsByOwnerQuery, reputationQuery},
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			profile, err := loadProfile(stmts, ctx.IntParam("id"))
+			if err != nil {
+				return err
+			}
+			if profile.Id != ctx.userid {
+				profile.Email = ""
+			}
+			return writeJSON(w, profile)
+		})
+
+	app.installStmtRestHandler("participants",
+		&RouteDoc{
+			Summary:  "participants owned by the user",
+			Response: []*APIParticipant{}},
+		[]string{participantsByOwnerQuery},
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			items, err := Uniplex(queueBufferSize,
+				func(out chan<- interface{}) error {
+					rows, err := stmts[0].Query(ctx.userid)
+					if err != nil {
+						return err
+					}
+					for rows.Next() {
+						p := &Participant{}
+						if err := rows.Scan(p.BasicFields()...); err != nil {
+							out <- err
+						} else {
+							out <- p
+						}
+					}
+					return nil
+				})
+			if err != nil {
+				return err
+			}
+			WriteChannelAsJSONList(w, items)
+			return nil
+		})
+
+	app.installStmtRestMethodHandler("POST", "participants",
+		&RouteDoc{
+			Summary:  "create a participant owned by the user",
+			Params:   participantParams,
+			Response: &APIParticipant{}},
+		[]string{"INSERT INTO participant (ownerid, alias, description) VALUES (?, ?, ?)"},
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			p := &Participant{Description: ctx.request.Form.Get("description")}
+			var err error
+			if p.Alias, err = getFormString(ctx.request.Form, "alias"); err != nil {
+				return err
+			}
+			res, err := stmts[0].Exec(ctx.userid, p.Alias, p.Description)
+			if err != nil {
+				return err
+			}
+			if p.Id, err = res.LastInsertId(); err != nil {
+				return err
+			}
+			return writeJSON(w, p)
+		})
+
+	app.installStmtRestHandler("participants/:id",
+		&RouteDoc{
+			Summary:  "a participant",
+			Response: &APIParticipant{}},
+		[]string{"SELECT id, alias, description FROM participant WHERE id = ?"},
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			p := &Participant{}
+			if err := stmts[0].QueryRow(ctx.IntParam("id")).Scan(p.BasicFields()...); err != nil {
+				return err
+			}
+			return writeJSON(w, p)
+		})
+
+	app.installStmtRestMethodHandler("PUT", "participants/:id",
+		&RouteDoc{
+			Summary:  "change a participant owned by the user",
+			Params:   optionalParams(participantParams),
+			Response: &APIParticipant{}},
+		[]string{
+			"SELECT id, alias, description, ownerid FROM participant WHERE id = ?",
+			"UPDATE participant SET alias = ?, description = ? WHERE id = ?"},
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			p, err := loadOwnParticipant(ctx, stmts[0], ctx.IntParam("id"))
+			if err != nil {
+				return err
+			}
+			form := ctx.request.Form
+			if _, ok := form["alias"]; ok {
+				p.Alias = form.Get("alias")
+			}
+			if _, ok := form["description"]; ok {
+				p.Description = form.Get("description")
+			}
+			if _, err := stmts[1].Exec(p.Alias, p.Description, p.Id); err != nil {
+				return err
+			}
+			return writeJSON(w, p)
+		})
+
+	app.installStmtRestMethodHandler("DELETE", "participants/:id",
+		&RouteDoc{
+			Summary:  "delete a participant owned by the user that has no availabilities or meetings",
+			Response: int64(0)},
+		[]string{
+			"SELECT id, alias, description, ownerid FROM participant WHERE id = ?",
+			"SELECT (SELECT count(*) FROM availability WHERE partid = ?) + " +
+				"(SELECT count(*) FROM meeting_participant WHERE participantid = ?)",
+			"DELETE FROM participant WHERE id = ?"},
+		func(ctx *DispatchContext, stmts []*sql.Stmt, w http.ResponseWriter) error {
+			p, err := loadOwnParticipant(ctx, stmts[0], ctx.IntParam("id"))
+			if err != nil {
+				return err
+			}
+			var uses int
+			if err := stmts[1].QueryRow(p.Id, p.Id).Scan(&uses); err != nil {
+				return err
+			}
+			if uses > 0 {
+				return errors.New("participant has availabilities or meetings")
+			}
+			if _, err := stmts[2].Exec(p.Id); err != nil {
+				return err
+			}
+			return writeJSON(w, p.Id)
+		})
+}
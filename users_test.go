@@ -0,0 +1,110 @@
+package tbeer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCreateAndDisableUser(t *testing.T) {
+	app := OpenTestEnv()
+	defer CloseTestEnv(app)
+
+	id, err := CreateUser(app.DB, "Tester", "create-test", "create-test@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.DB.Exec("DELETE FROM user WHERE id = ?", id)
+	if _, err := CreateUser(app.DB, "Other", "create-test", ""); err == nil {
+		t.Error("created two users with the same login")
+	}
+	if found, err := UserByLogin(app.DB, "create-test"); err != nil || found != id {
+		t.Errorf("user by login: %d %v", found, err)
+	}
+	if err := SetUserDisabled(app.DB, -1, true); err == nil {
+		t.Error("disabled a missing user")
+	}
+
+	// the rest api answers a disabled user with 403
+	serv := httptest.NewServer(app)
+	defer serv.Close()
+	status := func() int {
+		resp, err := http.Get(serv.URL + "/api/me")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if s := status(); s != http.StatusOK {
+		t.Errorf("enabled user got %d", s)
+	}
+	if err := SetUserDisabled(app.DB, 1, true); err != nil {
+		t.Fatal(err)
+	}
+	defer SetUserDisabled(app.DB, 1, false)
+	// the user was checked by the first request
+	if s := status(); s != http.StatusOK {
+		t.Errorf("user checked again within the interval, got %d", s)
+	}
+	defer func(interval time.Duration) { userCheckInterval = interval }(userCheckInterval)
+	userCheckInterval = 0
+	if s := status(); s != http.StatusForbidden {
+		t.Errorf("disabled user got %d", s)
+	}
+	SetUserDisabled(app.DB, 1, false)
+	if s := status(); s != http.StatusOK {
+		t.Errorf("enabled user got %d", s)
+	}
+}
+
+func TestExportJSON(t *testing.T) {
+	app := OpenTestEnv()
+	defer CloseTestEnv(app)
+
+	var buf bytes.Buffer
+	if err := ExportJSON(app.DB, &buf, []string{"user", "place"}); err != nil {
+		t.Fatal(err)
+	}
+	var export map[string][]map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &export); err != nil {
+		t.Fatal(err)
+	}
+	if len(export) != 2 || len(export["user"]) == 0 || export["user"][0]["alias"] == nil {
+		t.Errorf("unexpected export %v", export)
+	}
+	if err := ExportJSON(app.DB, &buf, []string{"no_such_table"}); err == nil {
+		t.Error("exported a missing table")
+	}
+}
+
+// Users without an email have a profile
+func TestProfileWithoutEmail(t *testing.T) {
+	app := OpenTestEnv()
+	defer CloseTestEnv(app)
+	res, err := app.DB.Exec("INSERT INTO user (alias, login, email) VALUES ('anonymous', 'no-email-test', NULL)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := res.LastInsertId()
+	defer app.DB.Exec("DELETE FROM user WHERE id = ?", id)
+
+	serv := httptest.NewServer(app)
+	defer serv.Close()
+	resp, err := http.Get(fmt.Sprintf("%s/api/users/%d", serv.URL, id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var u APIUser
+	if err := json.NewDecoder(resp.Body).Decode(&u); err != nil || resp.StatusCode != 200 {
+		t.Fatalf("status %d: %v", resp.StatusCode, err)
+	}
+	if u.Alias != "anonymous" || u.Email != "" {
+		t.Errorf("unexpected profile %+v", u)
+	}
+}